@@ -0,0 +1,395 @@
+package kvdb_go
+
+import (
+    "context"
+    "encoding/json"
+    "io"
+    "kvdb-go/data"
+    "kvdb-go/fio"
+    "kvdb-go/index"
+    "os"
+    "path/filepath"
+    "strconv"
+    "time"
+)
+
+const BackupManifestFileName = "backup-manifest.json"
+
+type BackupFile struct {
+    Name string `json:"name"`
+    Size int64 `json:"size"`
+    ModTime int64 `json:"mod_time"`
+    Location string `json:"location"` // The backup directory holding the content
+}
+
+// Lists every file of the checkpoint. Files unchanged since the base backup stay in the base's directory,
+// so an incremental backup is only complete together with its chain.
+type BackupManifest struct {
+    Dir string `json:"dir"`
+    Base string `json:"base,omitempty"`
+    CreatedAt int64 `json:"created_at"`
+    Files []BackupFile `json:"files"`
+}
+
+type backupMode = byte
+
+const (
+    // Sealed files never change, they are hard linked
+    backupLink backupMode = iota
+    // Bytes of the active files below the write offset never change, they are copied after the lock is released
+    backupTail
+    // Files rewritten in place are copied under the lock
+    backupCopy
+)
+
+type backupSource struct {
+    name string
+    size int64
+    mode backupMode
+    file *data.DataFile // Set when the database is not on the OS filesystem, the content is copied from the file itself
+}
+
+// Takes a full checkpoint that can be opened as a database
+func (db *DB) Backup(dir string) error {
+    return db.BackupCtx(context.Background(), dir)
+}
+
+func (db *DB) BackupCtx(ctx context.Context, dir string) error {
+    _, err := db.CreateBackupCtx(ctx, dir, nil)
+    return err
+}
+
+// Takes a checkpoint into an empty directory. With a base manifest only the files
+// added or grown since the base are stored, the rest is referenced.
+// Writers are only blocked while the sealed files are linked.
+func (db *DB) CreateBackup(dir string, base *BackupManifest) (*BackupManifest, error) {
+    return db.CreateBackupCtx(context.Background(), dir, base)
+}
+
+// Stops with ctx.Err() between files, the directory is emptied again on any error
+func (db *DB) CreateBackupCtx(ctx context.Context, dir string, base *BackupManifest) (_ *BackupManifest, err error) {
+    start := time.Now()
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    dir, err = filepath.Abs(dir)
+    if err != nil {
+        return nil, err
+    }
+    if err := prepareEmptyDir(fio.OSFS{}, dir); err != nil {
+        return nil, err
+    }
+    defer func() {
+        if err != nil {
+            clearDir(fio.OSFS{}, dir)
+        }
+    }()
+
+    baseFiles := make(map[string]BackupFile)
+    manifest := &BackupManifest{Dir: dir, CreatedAt: time.Now().UnixNano()}
+    if base != nil {
+        manifest.Base = base.Dir
+        for _, file := range base.Files {
+            baseFiles[file.Name] = file
+        }
+    }
+
+    var tails []BackupFile
+    err = func() error {
+        db.mutex.RLock()
+        defer db.mutex.RUnlock()
+
+        sources, err := db.backupSources()
+        if err != nil {
+            return err
+        }
+
+        for _, source := range sources {
+            if err := ctx.Err(); err != nil {
+                return err
+            }
+            srcName := filepath.Join(db.options.DirPath, source.name)
+            modTime, err := db.backupModTime(source, srcName)
+            if err != nil {
+                return err
+            }
+
+            // Copies under the lock are not paced, writers wait for them
+            file := BackupFile{Name: source.name, Size: source.size, ModTime: modTime.UnixNano(), Location: dir}
+            if baseFile, ok := baseFiles[file.Name]; ok && baseFile.Size == file.Size && baseFile.ModTime == file.ModTime {
+                file.Location = baseFile.Location
+            } else if source.file != nil {
+                if err := copyIOManagerPrefix(ctx, nil, fio.OSFS{}, source.file.IOManager, filepath.Join(dir, source.name), source.size); err != nil {
+                    return err
+                }
+            } else {
+                switch source.mode {
+                case backupLink:
+                    err = linkOrCopyFile(ctx, nil, fio.OSFS{}, srcName, filepath.Join(dir, source.name), source.size)
+                case backupCopy:
+                    err = copyFilePrefix(ctx, nil, fio.OSFS{}, srcName, filepath.Join(dir, source.name), source.size)
+                case backupTail:
+                    tails = append(tails, file)
+                }
+                if err != nil {
+                    return err
+                }
+            }
+            manifest.Files = append(manifest.Files, file)
+        }
+
+        // A database with the B+ tree index needs the sequence number to accept batches
+        if db.options.IndexType == BPTreeIndex {
+            file, err := writeSeqNumFile(dir, db.seqNum)
+            if err != nil {
+                return err
+            }
+            manifest.Files = append(manifest.Files, *file)
+        }
+
+        return nil
+    }()
+    if err != nil {
+        return nil, err
+    }
+
+    for _, file := range tails {
+        if err := ctx.Err(); err != nil {
+            return nil, err
+        }
+        if err := copyFilePrefix(ctx, db.options.RateLimiter, fio.OSFS{}, filepath.Join(db.options.DirPath, file.Name), filepath.Join(dir, file.Name), file.Size); err != nil {
+            return nil, err
+        }
+    }
+
+    if err := writeBackupManifest(manifest); err != nil {
+        return nil, err
+    }
+    db.options.EventListener.OnBackupCompleted(BackupInfo {
+        Dir: dir,
+        Base: manifest.Base,
+        FileNum: len(manifest.Files),
+        Duration: time.Since(start),
+    })
+    return manifest, nil
+}
+
+// The caller holds db.mutex
+func (db *DB) backupSources() ([]*backupSource, error) {
+    var sources []*backupSource
+    for fileId, dataFile := range db.olderFiles {
+        size, err := dataFile.IOManager.Size()
+        if err != nil {
+            return nil, err
+        }
+        sources = append(sources, db.newBackupSource(filepath.Base(data.GetDataFileName("", fileId)), size, backupLink, dataFile))
+    }
+    if db.activeFile != nil {
+        sources = append(sources, db.newBackupSource(filepath.Base(data.GetDataFileName("", db.activeFile.FileId)), db.activeFile.WriteOffset, backupTail, db.activeFile))
+    }
+
+    for fileId, valueLogFile := range db.olderValueLogs {
+        size, err := valueLogFile.IOManager.Size()
+        if err != nil {
+            return nil, err
+        }
+        sources = append(sources, db.newBackupSource(filepath.Base(data.GetValueLogFileName("", fileId)), size, backupLink, valueLogFile))
+    }
+    if db.activeValueLog != nil {
+        sources = append(sources, db.newBackupSource(filepath.Base(data.GetValueLogFileName("", db.activeValueLog.FileId)), db.activeValueLog.WriteOffset, backupTail, db.activeValueLog))
+    }
+
+    // Elsewhere the data files are enough, a database opened from them reads every record instead of the merge hints
+    if !db.onOSFS() {
+        return sources, nil
+    }
+
+    // Merge results are only moved in on open, so these do not change while the database is open
+    for _, name := range []string{data.HintFileName, data.MergeFinishedFileName} {
+        if info, err := os.Stat(filepath.Join(db.options.DirPath, name)); err == nil {
+            sources = append(sources, &backupSource{name, info.Size(), backupLink, nil})
+        }
+    }
+
+    if db.options.IndexType == BPTreeIndex {
+        info, err := os.Stat(filepath.Join(db.options.DirPath, index.BPTreeIndexFileName))
+        if err != nil {
+            return nil, err
+        }
+        sources = append(sources, &backupSource{index.BPTreeIndexFileName, info.Size(), backupCopy, nil})
+    }
+
+    return sources, nil
+}
+
+// Files that are not on the OS filesystem are copied under the lock, an in-memory merge may close them once it is released
+func (db *DB) newBackupSource(name string, size int64, mode backupMode, file *data.DataFile) *backupSource {
+    source := &backupSource{name: name, size: size, mode: mode}
+    if !db.onOSFS() {
+        source.file = file
+    }
+    return source
+}
+
+func (db *DB) backupModTime(source *backupSource, fileName string) (time.Time, error) {
+    if source.file != nil {
+        if memoryIO, ok := source.file.IOManager.(*fio.InMemoryIO); ok {
+            return memoryIO.ModTime(), nil
+        }
+    }
+    info, err := db.options.VFS.Stat(fileName)
+    if err != nil {
+        return time.Time{}, err
+    }
+    return info.ModTime(), nil
+}
+
+func LoadBackupManifest(dir string) (*BackupManifest, error) {
+    buf, err := os.ReadFile(filepath.Join(dir, BackupManifestFileName))
+    if err != nil {
+        return nil, err
+    }
+
+    manifest := new(BackupManifest)
+    if err := json.Unmarshal(buf, manifest); err != nil {
+        return nil, err
+    }
+    return manifest, nil
+}
+
+func writeBackupManifest(manifest *BackupManifest) error {
+    buf, err := json.MarshalIndent(manifest, "", "  ")
+    if err != nil {
+        return err
+    }
+
+    // Written last, a backup without a manifest is incomplete
+    tmpName := filepath.Join(manifest.Dir, BackupManifestFileName + ".tmp")
+    if err := os.WriteFile(tmpName, buf, fio.DataFilePerm); err != nil {
+        return err
+    }
+    if err := os.Rename(tmpName, filepath.Join(manifest.Dir, BackupManifestFileName)); err != nil {
+        return err
+    }
+    return fio.OSFS{}.SyncDir(manifest.Dir)
+}
+
+// Rebuilds a database directory from the backups the manifest refers to
+func Restore(manifest *BackupManifest, dir string) error {
+    if err := prepareEmptyDir(fio.OSFS{}, dir); err != nil {
+        return err
+    }
+
+    for _, file := range manifest.Files {
+        if err := copyFilePrefix(context.Background(), nil, fio.OSFS{}, filepath.Join(file.Location, file.Name), filepath.Join(dir, file.Name), file.Size); err != nil {
+            return err
+        }
+    }
+    return fio.OSFS{}.SyncDir(dir)
+}
+
+func prepareEmptyDir(fs fio.VFS, dir string) error {
+    if err := fio.MkdirAllDurable(fs, dir); err != nil {
+        return err
+    }
+
+    entries, err := fs.ReadDir(dir)
+    if err != nil {
+        return err
+    }
+    if len(entries) > 0 {
+        return ErrBackupDirNotEmpty
+    }
+    return nil
+}
+
+// Removes what a failed backup wrote, the directory was empty before
+func clearDir(fs fio.VFS, dir string) {
+    entries, err := fs.ReadDir(dir)
+    if err != nil {
+        return
+    }
+    for _, entry := range entries {
+        _ = fs.RemoveAll(filepath.Join(dir, entry.Name()))
+    }
+    _ = fs.SyncDir(dir)
+}
+
+func writeSeqNumFile(dir string, seqNum uint64) (*BackupFile, error) {
+    seqNumFile, err := data.OpenSeqNumFile(nil, dir)
+    if err != nil {
+        return nil, err
+    }
+    defer seqNumFile.Close()
+
+    encodedRecord, size := data.EncodeLogRecord(&data.LogRecord {
+        Key: []byte(seqNumKey),
+        Value: []byte(strconv.FormatUint(seqNum, 10)),
+    })
+    if err := seqNumFile.Write(encodedRecord); err != nil {
+        return nil, err
+    }
+    if err := seqNumFile.Sync(); err != nil {
+        return nil, err
+    }
+
+    return &BackupFile {
+        Name: data.SeqNumFileName,
+        Size: size,
+        ModTime: time.Now().UnixNano(),
+        Location: dir,
+    }, nil
+}
+
+// Falls back to a copy when the destination is on another file system
+func linkOrCopyFile(ctx context.Context, limiter *RateLimiter, fs fio.VFS, src string, dst string, size int64) error {
+    if err := fs.Link(src, dst); err == nil {
+        return nil
+    }
+    return copyFilePrefix(ctx, limiter, fs, src, dst, size)
+}
+
+func copyFilePrefix(ctx context.Context, limiter *RateLimiter, fs fio.VFS, src string, dst string, size int64) error {
+    // Opening creates missing files
+    if _, err := fs.Stat(src); err != nil {
+        return err
+    }
+    srcFile, err := fs.OpenFile(src, fio.StandardFileIO)
+    if err != nil {
+        return err
+    }
+    defer srcFile.Close()
+
+    return copyIOManagerPrefix(ctx, limiter, fs, srcFile, dst, size)
+}
+
+// The copy is paced by limiter and stops when ctx is done
+func copyIOManagerPrefix(ctx context.Context, limiter *RateLimiter, fs fio.VFS, src fio.IOManager, dst string, size int64) error {
+    // Files are opened for appending, a copy left behind by a crash starts over
+    if err := fs.Remove(dst); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    dstFile, err := fs.OpenFile(dst, fio.StandardFileIO)
+    if err != nil {
+        return err
+    }
+    defer dstFile.Close()
+
+    reader := &rateLimitedReader {
+        ctx: ctx,
+        limiter: limiter,
+        reader: io.NewSectionReader(ioManagerReaderAt{src}, 0, size),
+    }
+    if _, err := io.CopyN(dstFile, reader, size); err != nil {
+        return err
+    }
+    return dstFile.Sync()
+}
+
+type ioManagerReaderAt struct {
+    ioManager fio.IOManager
+}
+
+func (r ioManagerReaderAt) ReadAt(p []byte, off int64) (int, error) {
+    return r.ioManager.Read(p, off)
+}
@@ -0,0 +1,87 @@
+package kvdb_go
+
+import (
+    "kvdb-go/data"
+    "kvdb-go/utils"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestDBCreateBackup(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-checkpoint-")
+    options.DirPath = dir
+    options.DataFileSize = 64 * 1024
+    options.ValueLogThreshold = 256
+
+    db, err := Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+
+    for i := 0; i < 500; i++ {
+        value := utils.GetTestValue(128)
+        if i % 10 == 0 {
+            value = utils.GetTestValue(1024)
+        }
+        err := db.Put(utils.GetTestKey(i), value)
+        assert.Nil(t, err)
+    }
+
+    // 1. Full checkpoint, sealed files are hard linked
+    backupRoot, _ := os.MkdirTemp("", "kvdb-go-checkpoint-dst-")
+    defer os.RemoveAll(backupRoot)
+    fullDir := filepath.Join(backupRoot, "full")
+    full, err := db.CreateBackup(fullDir, nil)
+    assert.Nil(t, err)
+    assert.True(t, len(db.olderFiles) > 0)
+
+    sealedName := filepath.Base(data.GetDataFileName("", 0))
+    srcInfo, _ := os.Stat(filepath.Join(dir, sealedName))
+    dstInfo, _ := os.Stat(filepath.Join(fullDir, sealedName))
+    assert.True(t, os.SameFile(srcInfo, dstInfo))
+
+    err = db.Backup(fullDir)
+    assert.Equal(t, ErrBackupDirNotEmpty, err)
+
+    // 2. Incremental backup only stores what changed
+    for i := 500; i < 1000; i++ {
+        err := db.Put(utils.GetTestKey(i), utils.GetTestValue(128))
+        assert.Nil(t, err)
+    }
+    err = db.Delete(utils.GetTestKey(0))
+    assert.Nil(t, err)
+
+    incrementalDir := filepath.Join(backupRoot, "incremental")
+    base, err := LoadBackupManifest(fullDir)
+    assert.Nil(t, err)
+    assert.Equal(t, full.Files, base.Files)
+    incremental, err := db.CreateBackup(incrementalDir, base)
+    assert.Nil(t, err)
+    assert.Equal(t, fullDir, incremental.Base)
+
+    stored, _ := os.ReadDir(incrementalDir)
+    assert.True(t, len(stored) - 1 < len(incremental.Files))
+    _, err = os.Stat(filepath.Join(incrementalDir, sealedName))
+    assert.True(t, os.IsNotExist(err))
+
+    // 3. Restore the chain and open it
+    restoreDir := filepath.Join(backupRoot, "restore")
+    err = Restore(incremental, restoreDir)
+    assert.Nil(t, err)
+
+    restoreOptions := options
+    restoreOptions.DirPath = restoreDir
+    restored, err := Open(restoreOptions)
+    defer destroyDB(restored)
+    assert.Nil(t, err)
+    assert.Equal(t, 999, len(restored.ListKeys()))
+    for _, i := range []int{10, 499, 999} {
+        expected, _ := db.Get(utils.GetTestKey(i))
+        val, err := restored.Get(utils.GetTestKey(i))
+        assert.Nil(t, err)
+        assert.Equal(t, expected, val)
+    }
+}
@@ -1,8 +1,10 @@
 package kvdb_go
 
 import (
+    "context"
     "encoding/binary"
     "kvdb-go/data"
+    "sort"
     "sync"
     "sync/atomic"
 )
@@ -18,7 +20,7 @@ type WriteBatch struct {
 }
 
 func (db *DB) NewWriteBatch(options WriteBatchOptions) *WriteBatch {
-    if db.options.IndexType == BPTreeIndex && !db.seqNumFileExists && !db.isFirstLaunch {
+    if !db.canUseWriteBatch() {
         panic("cannot use WriteBatch with BPTreeIndex without sequence number")
     }
 
@@ -30,9 +32,14 @@ func (db *DB) NewWriteBatch(options WriteBatchOptions) *WriteBatch {
     }
 }
 
+// A B+ tree index reopened without its sequence number file does not know which numbers were used
+func (db *DB) canUseWriteBatch() bool {
+    return db.options.IndexType != BPTreeIndex || db.seqNumFileExists || db.isFirstLaunch
+}
+
 func (wb *WriteBatch) Put(key []byte, value []byte) error {
-    if len(key) == 0 {
-        return ErrKeyIsEmpty
+    if err := wb.db.ValidateKeyValue(key, value); err != nil {
+        return err
     }
 
     wb.mutex.Lock()
@@ -47,11 +54,17 @@ func (wb *WriteBatch) Delete(key []byte) error {
     if len(key) == 0 {
         return ErrKeyIsEmpty
     }
+    if wb.db.isReadOnly() {
+        return ErrReadOnly
+    }
 
     wb.mutex.Lock()
     defer wb.mutex.Unlock()
 
-    logRecordPos := wb.db.index.Get(key)
+    var logRecordPos *data.LogRecordPos
+    if wb.db.bloomMayContain(key) {
+        logRecordPos = wb.db.index.Get(key)
+    }
     if logRecordPos == nil {
         if wb.pendingWrites[string(key)] != nil {
             delete(wb.pendingWrites, string(key))
@@ -78,6 +91,24 @@ func (wb *WriteBatch) Commit() error {
     wb.db.mutex.Lock()
     defer wb.db.mutex.Unlock()
 
+    if wb.db.options.ReadOnly {
+        return ErrReadOnly
+    }
+    if err := wb.db.waitWriteStall(context.Background()); err != nil {
+        return err
+    }
+
+    // A batch is checked as a whole, so that it is not cut off halfway
+    var putSize int64
+    for _, record := range wb.pendingWrites {
+        if record.Type != data.LogRecordDeleted {
+            putSize += data.MaxLogRecordSize(len(record.Key) + binary.MaxVarintLen64, len(record.Value))
+        }
+    }
+    if err := wb.db.checkDiskSpace(putSize); err != nil {
+        return err
+    }
+
     // Here wb.db.seqNum is updated atomically
     seqNum := atomic.AddUint64(&wb.db.seqNum, 1)
 
@@ -106,7 +137,7 @@ func (wb *WriteBatch) Commit() error {
     }
 
     if wb.options.SyncWrites && wb.db.activeFile != nil {
-        if err := wb.db.activeFile.Sync(); err != nil {
+        if err := wb.db.syncFiles(); err != nil {
             return err
         }
     }
@@ -118,13 +149,32 @@ func (wb *WriteBatch) Commit() error {
         if record.Type == data.LogRecordDeleted {
             oldPos, _ = wb.db.index.Delete(record.Key)
         } else if record.Type == data.LogRecordNormal {
+            wb.db.bloomAdd(record.Key)
             oldPos = wb.db.index.Put(record.Key, pos)
         }
 
         if oldPos != nil {
             wb.db.reclaimableSpace += int64(oldPos.Size)
+            wb.db.invalidateCache(oldPos)
+        }
+    }
+
+    // Only now the transaction is finished and visible, its events go out in key order
+    keys := make([]string, 0, len(wb.pendingWrites))
+    for key := range wb.pendingWrites {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    events := make([]*Event, 0, len(keys))
+    for _, key := range keys {
+        record := wb.pendingWrites[key]
+        if record.Type == data.LogRecordDeleted {
+            events = append(events, &Event{Key: record.Key, Op: EventDelete})
+        } else {
+            events = append(events, &Event{Key: record.Key, Value: record.Value, Op: EventPut})
         }
     }
+    wb.db.watchHub.publishAll(events)
 
     wb.pendingWrites = make(map[string]*data.LogRecord)
     
@@ -2,6 +2,7 @@ package benchmark
 
 import (
     kvdb "kvdb-go"
+    "kvdb-go/data"
     "kvdb-go/utils"
     "math/rand"
     "os"
@@ -70,3 +71,50 @@ func BenchmarkDelete(b *testing.B) {
         }
     }
 }
+
+var checksumTypes = []struct {
+    name string
+    checksumType kvdb.ChecksumType
+}{
+    {"CRC32IEEE", kvdb.ChecksumCRC32IEEE},
+    {"CRC32C", kvdb.ChecksumCRC32C},
+    {"XXHash64", kvdb.ChecksumXXHash64},
+}
+
+func BenchmarkChecksum(b *testing.B) {
+    buf := utils.GetTestValue(4096)
+    for _, c := range checksumTypes {
+        b.Run(c.name, func(b *testing.B) {
+            b.SetBytes(int64(len(buf)))
+            b.ReportAllocs()
+            for i := 0; i < b.N; i++ {
+                data.Checksum(c.checksumType, buf)
+            }
+        })
+    }
+}
+
+func BenchmarkPutChecksum(b *testing.B) {
+    for _, c := range checksumTypes {
+        b.Run(c.name, func(b *testing.B) {
+            options := kvdb.DefaultOptions
+            options.DirPath, _ = os.MkdirTemp("", "kvdb-go-benchmark-checksum-")
+            options.Checksum = c.checksumType
+            checksumDB, err := kvdb.Open(options)
+            if err != nil {
+                b.Fatal(err)
+            }
+            defer os.RemoveAll(options.DirPath)
+            defer checksumDB.Close()
+
+            value := utils.GetTestValue(4096)
+            b.SetBytes(int64(len(value)))
+            b.ResetTimer()
+            b.ReportAllocs()
+            for i := 0; i < b.N; i++ {
+                err := checksumDB.Put(utils.GetTestKey(i), value)
+                assert.Nil(b, err)
+            }
+        })
+    }
+}
@@ -0,0 +1,105 @@
+package kvdb_go
+
+import (
+    "kvdb-go/bloom"
+    "kvdb-go/data"
+    "kvdb-go/fio"
+    "path/filepath"
+)
+
+const bloomFilterKey = "bloom-filter"
+
+// The persisted filter is removed once loaded, so a crash never leaves a stale one behind
+func (db *DB) loadBloomFilter() error {
+    if db.options.InMemory {
+        db.bloomFilter = db.buildBloomFilter()
+        return nil
+    }
+
+    fileName := filepath.Join(db.options.DirPath, data.BloomFilterFileName)
+    if _, err := db.options.VFS.Stat(fileName); err == nil {
+        bloomFilterFile, err := db.openMetaFile(db.options.DirPath, data.BloomFilterFileName, data.OpenBloomFilterFile)
+        if err != nil {
+            return err
+        }
+
+        record, _, err := bloomFilterFile.ReadLogRecord(data.FileHeaderSize)
+        if err != nil {
+            return err
+        }
+        if err := bloomFilterFile.Close(); err != nil {
+            return err
+        }
+        if !db.options.ReadOnly {
+            if err := fio.RemoveDurable(db.options.VFS, fileName); err != nil {
+                return err
+            }
+        }
+
+        if filter, err := bloom.Decode(record.Value); err == nil {
+            db.bloomFilter = filter
+            return nil
+        }
+    }
+
+    db.bloomFilter = db.buildBloomFilter()
+    return nil
+}
+
+// A filter left by an open with BloomFilter set would miss the keys written without it
+func (db *DB) removeBloomFilterFile() error {
+    fileName := filepath.Join(db.options.DirPath, data.BloomFilterFileName)
+    if _, err := db.options.VFS.Stat(fileName); err != nil {
+        return nil
+    }
+    return fio.RemoveDurable(db.options.VFS, fileName)
+}
+
+func (db *DB) buildBloomFilter() *bloom.Filter {
+    filter := bloom.New(uint64(db.index.Size()) * 2, db.options.BloomFalsePositiveRate)
+
+    iterator := db.index.Iterator(false)
+    defer iterator.Close()
+    for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+        filter.Add(iterator.Key())
+    }
+
+    return filter
+}
+
+func (db *DB) saveBloomFilter() error {
+    bloomFilterFile, err := data.OpenBloomFilterFile(db.options.VFS, db.options.DirPath)
+    if err != nil {
+        return err
+    }
+
+    record := &data.LogRecord {
+        Key: []byte(bloomFilterKey),
+        Value: db.bloomFilter.Encode(),
+    }
+    encodedRecord, _ := data.EncodeLogRecord(record)
+    if err := bloomFilterFile.Write(encodedRecord); err != nil {
+        return err
+    }
+    if err := bloomFilterFile.Sync(); err != nil {
+        return err
+    }
+    return bloomFilterFile.Close()
+}
+
+func (db *DB) bloomAdd(key []byte) {
+    if db.bloomFilter == nil {
+        return
+    }
+
+    // The key is not in the index yet, AddOrGrow adds it to the rebuilt filter
+    db.bloomFilter.AddOrGrow(key, db.buildBloomFilter)
+}
+
+// False means the key is definitely not in the database
+func (db *DB) bloomMayContain(key []byte) bool {
+    if db.bloomFilter == nil {
+        return true
+    }
+    return db.bloomFilter.MayContain(key)
+}
@@ -0,0 +1,170 @@
+package bloom
+
+import (
+    "encoding/binary"
+    "errors"
+    "hash/fnv"
+    "math"
+    "sync"
+)
+
+const (
+    minCapacity = 1024
+    // num_hashes | capacity | count | num_bits
+    encodedHeaderSize = 4 + 8 + 8 + 8
+)
+
+var ErrFilterCorrupted = errors.New("bloom filter is corrupted")
+
+type Filter struct {
+    bits []uint64
+    numBits uint64
+    numHashes uint32
+    capacity uint64
+    count uint64
+    lock *sync.RWMutex
+}
+
+// Sized so that the false positive rate holds until capacity keys have been added
+func New(capacity uint64, falsePositiveRate float64) *Filter {
+    if capacity < minCapacity {
+        capacity = minCapacity
+    }
+
+    numBits := uint64(math.Ceil(-float64(capacity) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+    numHashes := uint32(math.Round(float64(numBits) / float64(capacity) * math.Ln2))
+    if numHashes == 0 {
+        numHashes = 1
+    }
+
+    return &Filter {
+        bits: make([]uint64, (numBits + 63) / 64),
+        numBits: numBits,
+        numHashes: numHashes,
+        capacity: capacity,
+        lock: new(sync.RWMutex),
+    }
+}
+
+func (f *Filter) Add(key []byte) {
+    h1, h2 := hashKey(key)
+
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    f.add(h1, h2)
+}
+
+// Adds the key, and once the filter is full takes over the state of the filter rebuild returns.
+// Both happen under the lock, so no Add running meanwhile is lost. rebuild must not use f.
+func (f *Filter) AddOrGrow(key []byte, rebuild func() *Filter) {
+    h1, h2 := hashKey(key)
+
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    f.add(h1, h2)
+    if f.count <= f.capacity {
+        return
+    }
+
+    other := rebuild()
+    other.Add(key)
+    other.lock.RLock()
+    defer other.lock.RUnlock()
+    f.bits = other.bits
+    f.numBits = other.numBits
+    f.numHashes = other.numHashes
+    f.capacity = other.capacity
+    f.count = other.count
+}
+
+// The caller holds f.lock
+func (f *Filter) add(h1 uint64, h2 uint64) {
+    for i := uint32(0); i < f.numHashes; i++ {
+        bit := (h1 + uint64(i) * h2) % f.numBits
+        f.bits[bit / 64] |= 1 << (bit % 64)
+    }
+    f.count++
+}
+
+// False means the key was never added, true means it might have been
+func (f *Filter) MayContain(key []byte) bool {
+    h1, h2 := hashKey(key)
+
+    f.lock.RLock()
+    defer f.lock.RUnlock()
+
+    for i := uint32(0); i < f.numHashes; i++ {
+        bit := (h1 + uint64(i) * h2) % f.numBits
+        if f.bits[bit / 64] & (1 << (bit % 64)) == 0 {
+            return false
+        }
+    }
+    return true
+}
+
+// Once more keys than the capacity are added, the false positive rate is no longer guaranteed
+func (f *Filter) IsFull() bool {
+    f.lock.RLock()
+    defer f.lock.RUnlock()
+    return f.count > f.capacity
+}
+
+func (f *Filter) Capacity() uint64 {
+    f.lock.RLock()
+    defer f.lock.RUnlock()
+    return f.capacity
+}
+
+func (f *Filter) Encode() []byte {
+    f.lock.RLock()
+    defer f.lock.RUnlock()
+
+    buf := make([]byte, encodedHeaderSize + len(f.bits) * 8)
+    binary.LittleEndian.PutUint32(buf[0:], f.numHashes)
+    binary.LittleEndian.PutUint64(buf[4:], f.capacity)
+    binary.LittleEndian.PutUint64(buf[12:], f.count)
+    binary.LittleEndian.PutUint64(buf[20:], f.numBits)
+    for i, word := range f.bits {
+        binary.LittleEndian.PutUint64(buf[encodedHeaderSize + i * 8:], word)
+    }
+    return buf
+}
+
+func Decode(buf []byte) (*Filter, error) {
+    if len(buf) < encodedHeaderSize {
+        return nil, ErrFilterCorrupted
+    }
+
+    f := &Filter {
+        numHashes: binary.LittleEndian.Uint32(buf[0:]),
+        capacity: binary.LittleEndian.Uint64(buf[4:]),
+        count: binary.LittleEndian.Uint64(buf[12:]),
+        numBits: binary.LittleEndian.Uint64(buf[20:]),
+        lock: new(sync.RWMutex),
+    }
+
+    words := (f.numBits + 63) / 64
+    if f.numBits == 0 || f.numHashes == 0 || uint64(len(buf) - encodedHeaderSize) != words * 8 {
+        return nil, ErrFilterCorrupted
+    }
+
+    f.bits = make([]uint64, words)
+    for i := range f.bits {
+        f.bits[i] = binary.LittleEndian.Uint64(buf[encodedHeaderSize + i * 8:])
+    }
+    return f, nil
+}
+
+// Two independent hashes are derived from one 64 bit hash (Kirsch-Mitzenmacher)
+func hashKey(key []byte) (uint64, uint64) {
+    hasher := fnv.New64a()
+    _, _ = hasher.Write(key)
+    sum := hasher.Sum64()
+
+    h1 := sum & 0xffffffff
+    h2 := sum >> 32
+    if h2 == 0 {
+        h2 = 1
+    }
+    return h1, h2
+}
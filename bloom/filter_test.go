@@ -0,0 +1,94 @@
+package bloom
+
+import (
+    "kvdb-go/utils"
+    "sync"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestFilterAddAndMayContain(t *testing.T) {
+    f := New(10000, 0.01)
+
+    for i := 0; i < 10000; i++ {
+        f.Add(utils.GetTestKey(i))
+    }
+    for i := 0; i < 10000; i++ {
+        assert.True(t, f.MayContain(utils.GetTestKey(i)))
+    }
+    assert.False(t, f.IsFull())
+
+    var falsePositives int
+    for i := 10000; i < 20000; i++ {
+        if f.MayContain(utils.GetTestKey(i)) {
+            falsePositives++
+        }
+    }
+    assert.Less(t, falsePositives, 300)
+}
+
+func TestFilterIsFull(t *testing.T) {
+    f := New(0, 0.01)
+    assert.Equal(t, uint64(minCapacity), f.Capacity())
+
+    for i := 0; i <= minCapacity; i++ {
+        f.Add(utils.GetTestKey(i))
+    }
+    assert.True(t, f.IsFull())
+}
+
+func TestFilterEncodeDecode(t *testing.T) {
+    f := New(2000, 0.05)
+    for i := 0; i < 1000; i++ {
+        f.Add(utils.GetTestKey(i))
+    }
+
+    decoded, err := Decode(f.Encode())
+    assert.Nil(t, err)
+    assert.Equal(t, f.Capacity(), decoded.Capacity())
+    for i := 0; i < 1000; i++ {
+        assert.True(t, decoded.MayContain(utils.GetTestKey(i)))
+    }
+
+    _, err = Decode([]byte("short"))
+    assert.Equal(t, ErrFilterCorrupted, err)
+}
+
+func TestFilterAddOrGrow(t *testing.T) {
+    f := New(0, 0.01)
+
+    // Keys are recorded before they are added, like the index is updated before the filter
+    var mutex sync.Mutex
+    var keys [][]byte
+    rebuild := func() *Filter {
+        mutex.Lock()
+        defer mutex.Unlock()
+        other := New(uint64(len(keys)) * 2, 0.01)
+        for _, key := range keys {
+            other.Add(key)
+        }
+        return other
+    }
+
+    var wg sync.WaitGroup
+    for g := 0; g < 8; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            for i := 0; i < 2000; i++ {
+                key := utils.GetTestKey(g * 2000 + i)
+                mutex.Lock()
+                keys = append(keys, key)
+                mutex.Unlock()
+                f.AddOrGrow(key, rebuild)
+            }
+        }(g)
+    }
+    wg.Wait()
+
+    assert.True(t, f.Capacity() > minCapacity)
+    for i := 0; i < 8 * 2000; i++ {
+        assert.True(t, f.MayContain(utils.GetTestKey(i)))
+    }
+}
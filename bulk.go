@@ -0,0 +1,466 @@
+package kvdb_go
+
+import (
+    "context"
+    "io"
+    "kvdb-go/data"
+    "kvdb-go/fio"
+    "kvdb-go/index"
+    "os"
+    "path"
+    "path/filepath"
+)
+
+const (
+    bulkFinishedFileName = "bulk-finished"
+    ingestDirName = "-ingest"
+    ingestBatchSize = 10000
+)
+
+// Writes data files and a hint file into a staging directory without going through a DB,
+// DB.Ingest then adds them in one step. Keys may come in any order, a later Add of a key wins.
+type BulkLoader struct {
+    dir string
+    options Options
+    activeFile *data.DataFile
+    hintFile *data.DataFile
+    count int
+    finished bool
+}
+
+// The options should be the ones of the DB the files are ingested into
+func NewBulkLoader(dir string, options Options) (*BulkLoader, error) {
+    options.VFS = fio.OrOSFS(options.VFS)
+    if err := prepareEmptyDir(options.VFS, dir); err != nil {
+        if err == ErrBackupDirNotEmpty {
+            return nil, ErrStagingDirNotEmpty
+        }
+        return nil, err
+    }
+
+    activeFile, err := data.OpenDataFileWithHeader(options.VFS, dir, 0, fio.StandardFileIO, newFileHeader(options))
+    if err != nil {
+        return nil, err
+    }
+    hintFile, err := data.OpenHintFile(options.VFS, dir)
+    if err != nil {
+        _ = activeFile.Close()
+        return nil, err
+    }
+
+    // Values are always written inline
+    options.ValueLogThreshold = 0
+    return &BulkLoader {
+        dir: dir,
+        options: options,
+        activeFile: activeFile,
+        hintFile: hintFile,
+    }, nil
+}
+
+func (bl *BulkLoader) Add(key []byte, value []byte) error {
+    if bl.finished {
+        return ErrBulkLoaderFinished
+    }
+    if err := validateKeyValue(bl.options, key, value); err != nil {
+        return err
+    }
+
+    logRecord := &data.LogRecord {
+        Key: logRecordKeyWithSeq(key, nonTransactionSeqNum),
+        Value: value,
+        Type: data.LogRecordNormal,
+    }
+    encodedRecord, size := bl.activeFile.EncodeLogRecord(logRecord)
+    if size > bl.options.DataFileSize - data.FileHeaderSize {
+        return ErrLogRecordTooLarge
+    }
+
+    if bl.activeFile.WriteOffset + size > bl.options.DataFileSize {
+        if err := bl.activeFile.Sync(); err != nil {
+            return err
+        }
+        if err := bl.activeFile.Close(); err != nil {
+            return err
+        }
+
+        dataFile, err := data.OpenDataFileWithHeader(bl.options.VFS, bl.dir, bl.activeFile.FileId + 1, fio.StandardFileIO, newFileHeader(bl.options))
+        if err != nil {
+            return err
+        }
+        bl.activeFile = dataFile
+    }
+
+    pos := &data.LogRecordPos {
+        FileId: bl.activeFile.FileId,
+        Offset: bl.activeFile.WriteOffset,
+        Size: uint32(size),
+    }
+    if err := bl.activeFile.Write(encodedRecord); err != nil {
+        return err
+    }
+    if err := bl.hintFile.WriteHintRecord(key, pos); err != nil {
+        return err
+    }
+
+    bl.count++
+    return nil
+}
+
+// Adds the pairs of an export whose key has one of the prefixes, or every pair without prefixes
+func (bl *BulkLoader) Import(r io.Reader, format ExportFormat, prefixes ...[]byte) (int, error) {
+    next, err := newImportReader(r, format, bl.options)
+    if err != nil {
+        return 0, err
+    }
+
+    var count int
+    for {
+        key, value, err := next()
+        if err == io.EOF {
+            return count, nil
+        }
+        if err != nil {
+            return count, err
+        }
+        if !hasAnyPrefix(key, prefixes) {
+            continue
+        }
+
+        if err := bl.Add(key, value); err != nil {
+            return count, err
+        }
+        count++
+    }
+}
+
+func (bl *BulkLoader) Count() int {
+    return bl.count
+}
+
+// Syncs the staged files and marks them ready for DB.Ingest
+func (bl *BulkLoader) Finish() error {
+    if bl.finished {
+        return ErrBulkLoaderFinished
+    }
+    bl.finished = true
+
+    for _, file := range []*data.DataFile{bl.activeFile, bl.hintFile} {
+        if err := file.Sync(); err != nil {
+            return err
+        }
+        if err := file.Close(); err != nil {
+            return err
+        }
+    }
+    // Nothing is staged, Ingest leaves the active file of the database alone
+    if bl.count == 0 {
+        if err := bl.options.VFS.Remove(data.GetDataFileName(bl.dir, bl.activeFile.FileId)); err != nil {
+            return err
+        }
+    }
+
+    return writeBulkFinishedFile(bl.options.VFS, bl.dir)
+}
+
+// The empty file marks the directory complete
+func writeBulkFinishedFile(fs fio.VFS, dir string) error {
+    finishedFile, err := fs.OpenFile(filepath.Join(dir, bulkFinishedFileName), fio.StandardFileIO)
+    if err != nil {
+        return err
+    }
+    if err := finishedFile.Sync(); err != nil {
+        _ = finishedFile.Close()
+        return err
+    }
+    if err := finishedFile.Close(); err != nil {
+        return err
+    }
+    return fs.SyncDir(dir)
+}
+
+// Drops everything staged so far
+func (bl *BulkLoader) Abort() error {
+    if !bl.finished {
+        bl.finished = true
+        _ = bl.activeFile.Close()
+        _ = bl.hintFile.Close()
+    }
+    return fio.RemoveAllDurable(bl.options.VFS, bl.dir)
+}
+
+// Moves the data files staged by a finished BulkLoader behind the active file and applies its hint entries to the index.
+// The ingested pairs replace older values of their keys, watchers get an EventMissed event instead of them.
+// A crash in the middle leaves a prefix of the staged files ingested. The data files are replayed on open,
+// a B+ tree index, which is not rebuilt on open, gets their entries from a copy of the hint file kept until it has them.
+// Returns the number of distinct keys ingested.
+func (db *DB) Ingest(dir string) (int, error) {
+    if db.options.InMemory {
+        return 0, ErrInMemoryUnsupported
+    }
+    if _, err := db.options.VFS.Stat(filepath.Join(dir, bulkFinishedFileName)); err != nil {
+        return 0, ErrBulkLoadNotFinished
+    }
+
+    stagedFileIds, err := listFileIds(db.options.VFS, dir, data.DataFileNameSuffix)
+    if err != nil {
+        return 0, err
+    }
+
+    db.mutex.Lock()
+    defer db.mutex.Unlock()
+
+    if db.options.ReadOnly {
+        return 0, ErrReadOnly
+    }
+    // An earlier ingest that failed half way goes first
+    if db.options.IndexType == BPTreeIndex {
+        if err := db.finishIngest(); err != nil {
+            return 0, err
+        }
+    }
+    if len(stagedFileIds) == 0 {
+        return 0, fio.RemoveAllDurable(db.options.VFS, dir)
+    }
+
+    // The staged files get the ids after the active file, so they replay after everything written before
+    var baseFileId uint32
+    if db.activeFile != nil {
+        if err := db.syncFile(db.activeFile); err != nil {
+            return 0, err
+        }
+        baseFileId = db.activeFile.FileId + 1
+    }
+    hintDir, fileIdOffset := dir, baseFileId
+    if db.options.IndexType == BPTreeIndex {
+        if err := db.keepIngestHint(dir, baseFileId); err != nil {
+            return 0, err
+        }
+        hintDir, fileIdOffset = db.getIngestPath(), 0
+    }
+    if db.activeFile != nil {
+        db.olderFiles[db.activeFile.FileId] = db.activeFile
+    }
+
+    var movedFiles uint32
+    var moveErr error
+    for _, stagedFileId := range stagedFileIds {
+        if moveErr = db.ingestDataFile(dir, stagedFileId, baseFileId + stagedFileId); moveErr != nil {
+            break
+        }
+        movedFiles = stagedFileId + 1
+    }
+
+    // The active file takes the id of the file that failed to move. Files are opened for appending,
+    // so a partial copy left there would put the new records behind the staged ones.
+    if moveErr != nil {
+        fileName := data.GetDataFileName(db.options.DirPath, baseFileId + movedFiles)
+        if err := fio.RemoveDurable(db.options.VFS, fileName); err != nil && !os.IsNotExist(err) {
+            return 0, err
+        }
+    }
+
+    activeFile, err := data.OpenDataFileWithHeader(db.options.VFS, db.options.DirPath, baseFileId + movedFiles, fio.StandardFileIO, newFileHeader(db.options))
+    if err != nil {
+        return 0, err
+    }
+    db.activeFile = activeFile
+
+    // Only the entries of moved files are applied, so the index matches what a reopen would load
+    count, err := db.applyHintFile(hintDir, baseFileId, func(pos *data.LogRecordPos) (bool, error) {
+        pos.FileId += fileIdOffset
+        return pos.FileId < baseFileId + movedFiles, nil
+    })
+    if count > 0 {
+        db.watchHub.publishMissed()
+    }
+    if err != nil {
+        return count, err
+    }
+    if db.options.IndexType == BPTreeIndex {
+        if err := fio.RemoveAllDurable(db.options.VFS, db.getIngestPath()); err != nil {
+            return count, err
+        }
+    }
+    if moveErr != nil {
+        return count, moveErr
+    }
+
+    return count, fio.RemoveAllDurable(db.options.VFS, dir)
+}
+
+func (db *DB) ingestDataFile(dir string, stagedFileId uint32, fileId uint32) error {
+    src := data.GetDataFileName(dir, stagedFileId)
+    dst := data.GetDataFileName(db.options.DirPath, fileId)
+    if err := db.options.VFS.Rename(src, dst); err != nil {
+        // The staging directory may live on another file system
+        info, err := db.options.VFS.Stat(src)
+        if err != nil {
+            return err
+        }
+        if err := linkOrCopyFile(context.Background(), nil, db.options.VFS, src, dst, info.Size()); err != nil {
+            return err
+        }
+        if err := db.options.VFS.Remove(src); err != nil {
+            return err
+        }
+    }
+    // Files move in order, a crash leaves a prefix of them ingested
+    if err := db.options.VFS.SyncDir(db.options.DirPath); err != nil {
+        return err
+    }
+
+    dataFile, err := db.withLogger(data.OpenDataFile(db.options.VFS, db.options.DirPath, fileId, fio.StandardFileIO))
+    if err != nil {
+        return err
+    }
+    size, err := dataFile.IOManager.Size()
+    if err != nil {
+        return err
+    }
+    dataFile.WriteOffset = size
+    db.olderFiles[fileId] = dataFile
+
+    return nil
+}
+
+func (db *DB) getIngestPath() string {
+    return path.Join(path.Dir(db.options.DirPath), path.Base(db.options.DirPath) + ingestDirName)
+}
+
+// Copies the staged hint entries with their final file ids next to the database directory before any file moves.
+// The copy counts once its finished file is written.
+func (db *DB) keepIngestHint(dir string, baseFileId uint32) error {
+    ingestPath := db.getIngestPath()
+    if err := fio.RemoveAllDurable(db.options.VFS, ingestPath); err != nil {
+        return err
+    }
+    if err := fio.MkdirAllDurable(db.options.VFS, ingestPath); err != nil {
+        return err
+    }
+
+    hintFile, err := data.OpenHintFile(db.options.VFS, ingestPath)
+    if err != nil {
+        return err
+    }
+    if err := readHintFile(db.options.VFS, dir, func(key []byte, pos *data.LogRecordPos) error {
+        pos.FileId += baseFileId
+        return hintFile.WriteHintRecord(key, pos)
+    }); err != nil {
+        _ = hintFile.Close()
+        return err
+    }
+    if err := hintFile.Sync(); err != nil {
+        _ = hintFile.Close()
+        return err
+    }
+    if err := hintFile.Close(); err != nil {
+        return err
+    }
+
+    return writeBulkFinishedFile(db.options.VFS, ingestPath)
+}
+
+// Applies the hint entries an ingest into a B+ tree index kept when a crash or an error cut it short.
+// Files that did not move in whole get none of their entries applied. The caller holds db.mutex.
+func (db *DB) finishIngest() error {
+    ingestPath := db.getIngestPath()
+    if _, err := db.options.VFS.Stat(ingestPath); os.IsNotExist(err) {
+        return nil
+    }
+
+    if _, err := db.options.VFS.Stat(filepath.Join(ingestPath, bulkFinishedFileName)); err == nil {
+        fileSizes := make(map[uint32]int64)
+        count, err := db.applyHintFile(ingestPath, 0, func(pos *data.LogRecordPos) (bool, error) {
+            size, ok := fileSizes[pos.FileId]
+            if !ok {
+                if dataFile := db.getDataFile(pos.FileId); dataFile != nil {
+                    fileSize, err := dataFile.IOManager.Size()
+                    if err != nil {
+                        return false, err
+                    }
+                    size = fileSize
+                }
+                fileSizes[pos.FileId] = size
+            }
+            return pos.Offset + int64(pos.Size) <= size, nil
+        })
+        if count > 0 {
+            db.watchHub.publishMissed()
+        }
+        if err != nil {
+            return err
+        }
+    }
+
+    return fio.RemoveAllDurable(db.options.VFS, ingestPath)
+}
+
+func readHintFile(fs fio.VFS, dir string, fn func(key []byte, pos *data.LogRecordPos) error) error {
+    hintFile, err := data.OpenHintFile(fs, dir)
+    if err != nil {
+        return err
+    }
+    defer hintFile.Close()
+
+    var offset int64 = data.FileHeaderSize
+    for {
+        logRecord, size, err := hintFile.ReadLogRecord(offset)
+        if err == io.EOF || (err == nil && logRecord == nil) {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        offset += size
+
+        if err := fn(logRecord.Key, data.DecodeLogRecordPos(logRecord.Value)); err != nil {
+            return err
+        }
+    }
+}
+
+// Applies the entries whose position apply accepts, it may change the position first.
+// Returns the number of distinct keys, a key is counted once however many files from baseFileId on hold it.
+func (db *DB) applyHintFile(dir string, baseFileId uint32, apply func(pos *data.LogRecordPos) (bool, error)) (int, error) {
+    var count int
+    var keys [][]byte
+    var positions []*data.LogRecordPos
+    err := readHintFile(db.options.VFS, dir, func(key []byte, pos *data.LogRecordPos) error {
+        ok, err := apply(pos)
+        if err != nil || !ok {
+            return err
+        }
+        keys = append(keys, key)
+        positions = append(positions, pos)
+
+        if len(keys) == ingestBatchSize {
+            count += db.applyIndexBatch(keys, positions, baseFileId)
+            keys, positions = keys[:0], positions[:0]
+        }
+        return nil
+    })
+    if err != nil {
+        return count, err
+    }
+
+    return count + db.applyIndexBatch(keys, positions, baseFileId), nil
+}
+
+// Returns how many of the keys were not in files from baseFileId on before, the caller holds db.mutex
+func (db *DB) applyIndexBatch(keys [][]byte, positions []*data.LogRecordPos, baseFileId uint32) int {
+    var count int
+    oldPositions := index.PutBatch(db.index, keys, positions)
+    for i, key := range keys {
+        db.bloomAdd(key)
+        oldPos := oldPositions[i]
+        if oldPos == nil || oldPos.FileId < baseFileId {
+            count++
+        }
+        if oldPos != nil {
+            db.reclaimableSpace += int64(oldPos.Size)
+            db.invalidateCache(oldPos)
+        }
+    }
+    return count
+}
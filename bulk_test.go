@@ -0,0 +1,285 @@
+package kvdb_go
+
+import (
+    "bytes"
+    "errors"
+    "kvdb-go/data"
+    "kvdb-go/fio"
+    "kvdb-go/index"
+    "kvdb-go/utils"
+    "math/rand"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestDBIngest(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-ingest-")
+    options.DirPath = dir
+    options.DataFileSize = 64 * 1024
+    db, err := Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+
+    for i := 0; i < 100; i++ {
+        err := db.Put(utils.GetTestKey(i), []byte("old"))
+        assert.Nil(t, err)
+    }
+
+    stagingDir, _ := os.MkdirTemp("", "kvdb-go-staging-")
+    defer os.RemoveAll(stagingDir)
+    loader, err := NewBulkLoader(stagingDir, options)
+    assert.Nil(t, err)
+
+    // Unsorted input spanning several data files, the last value of a key wins
+    for i := 2999; i >= 50; i-- {
+        err := loader.Add(utils.GetTestKey(i), utils.GetTestValue(64))
+        assert.Nil(t, err)
+    }
+    err = loader.Add(utils.GetTestKey(60), []byte("latest"))
+    assert.Nil(t, err)
+    assert.Equal(t, 2951, loader.Count())
+
+    _, err = db.Ingest(stagingDir)
+    assert.Equal(t, ErrBulkLoadNotFinished, err)
+    err = loader.Finish()
+    assert.Nil(t, err)
+    err = loader.Add([]byte("late"), []byte("late"))
+    assert.Equal(t, ErrBulkLoaderFinished, err)
+
+    watcher, err := db.Watch(nil, 0)
+    assert.Nil(t, err)
+    // The key added twice counts once
+    count, err := db.Ingest(stagingDir)
+    assert.Nil(t, err)
+    assert.Equal(t, 2950, count)
+    _, err = os.Stat(stagingDir)
+    assert.True(t, os.IsNotExist(err))
+    event := <-watcher.Events()
+    assert.Equal(t, EventMissed, event.Op)
+    watcher.Close()
+
+    check := func(db *DB) {
+        val, err := db.Get(utils.GetTestKey(10))
+        assert.Nil(t, err)
+        assert.Equal(t, []byte("old"), val)
+        val, err = db.Get(utils.GetTestKey(60))
+        assert.Nil(t, err)
+        assert.Equal(t, []byte("latest"), val)
+        val, err = db.Get(utils.GetTestKey(70))
+        assert.Nil(t, err)
+        assert.NotEqual(t, []byte("old"), val)
+        val, err = db.Get([]byte("after"))
+        assert.Nil(t, err)
+        assert.Equal(t, []byte("after"), val)
+        assert.Equal(t, 3001, len(db.ListKeys()))
+    }
+
+    // Writes after the ingest go to a file after the ingested ones
+    err = db.Put([]byte("after"), []byte("after"))
+    assert.Nil(t, err)
+    err = db.Put(utils.GetTestKey(2999), []byte("after"))
+    assert.Nil(t, err)
+    check(db)
+
+    err = db.Close()
+    assert.Nil(t, err)
+    db, err = Open(options)
+    assert.Nil(t, err)
+    check(db)
+    val, err := db.Get(utils.GetTestKey(2999))
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("after"), val)
+
+    // Staging from an export
+    buf := new(bytes.Buffer)
+    _, err = db.Export(buf, ExportBinary, []byte("after"))
+    assert.Nil(t, err)
+    stagingDir2 := filepath.Join(stagingDir + "-2")
+    defer os.RemoveAll(stagingDir2)
+    loader, err = NewBulkLoader(stagingDir2, options)
+    assert.Nil(t, err)
+    count, err = loader.Import(buf, ExportBinary)
+    assert.Nil(t, err)
+    assert.Equal(t, 1, count)
+    err = loader.Abort()
+    assert.Nil(t, err)
+    _, err = os.Stat(stagingDir2)
+    assert.True(t, os.IsNotExist(err))
+
+    // Nothing staged, the active file stays
+    loader, err = NewBulkLoader(stagingDir2, options)
+    assert.Nil(t, err)
+    err = loader.Finish()
+    assert.Nil(t, err)
+    activeFileId := db.activeFile.FileId
+    count, err = db.Ingest(stagingDir2)
+    assert.Nil(t, err)
+    assert.Equal(t, 0, count)
+    assert.Equal(t, activeFileId, db.activeFile.FileId)
+    _, err = os.Stat(stagingDir2)
+    assert.True(t, os.IsNotExist(err))
+}
+
+// Moves staged files like onto another, full file system: renames and links out of the staging directory fail
+type crossDeviceVFS struct {
+    *fio.FaultInjector
+    stagingDir string
+}
+
+var errCrossDevice = errors.New("invalid cross-device link")
+
+func (fs crossDeviceVFS) Rename(oldName string, newName string) error {
+    if filepath.Dir(oldName) == fs.stagingDir {
+        return errCrossDevice
+    }
+    return fs.FaultInjector.Rename(oldName, newName)
+}
+
+func (fs crossDeviceVFS) Link(oldName string, newName string) error {
+    if filepath.Dir(oldName) == fs.stagingDir {
+        return errCrossDevice
+    }
+    return fs.FaultInjector.Link(oldName, newName)
+}
+
+func TestDBIngestPartialCopy(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-ingest-copy-")
+    options.DirPath = dir
+    options.DataFileSize = 64 * 1024
+
+    stagingDir, _ := os.MkdirTemp("", "kvdb-go-staging-")
+    defer os.RemoveAll(stagingDir)
+    loader, err := NewBulkLoader(stagingDir, options)
+    assert.Nil(t, err)
+    for i := 0; i < 1000; i++ {
+        err := loader.Add(utils.GetTestKey(i), utils.GetTestValue(64))
+        assert.Nil(t, err)
+    }
+    err = loader.Finish()
+    assert.Nil(t, err)
+
+    // The copy of the first staged file runs out of space after its first chunk
+    copied := data.GetDataFileName(dir, 1)
+    var copiedWrites int
+    injector := fio.NewFaultInjector(func(fileName string, op fio.FaultOp, rand *rand.Rand) fio.Fault {
+        if fileName == copied && op == fio.FaultOpWrite {
+            copiedWrites++
+            if copiedWrites == 2 {
+                return fio.FaultWriteError
+            }
+        }
+        return fio.NoFault
+    }, 1)
+    options.VFS = crossDeviceVFS{FaultInjector: injector, stagingDir: stagingDir}
+    db, err := Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+    err = db.Put([]byte("before"), []byte("before"))
+    assert.Nil(t, err)
+
+    count, err := db.Ingest(stagingDir)
+    assert.Equal(t, fio.ErrInjectedFault, err)
+    assert.Equal(t, 0, count)
+
+    check := func(db *DB) {
+        for _, key := range []string{"before", "after"} {
+            val, err := db.Get([]byte(key))
+            assert.Nil(t, err)
+            assert.Equal(t, []byte(key), val)
+        }
+        _, err := db.Get(utils.GetTestKey(0))
+        assert.Equal(t, ErrKeyNotFound, err)
+        assert.Equal(t, 2, len(db.ListKeys()))
+    }
+
+    // Writes go to a fresh file, not behind the partial copy
+    err = db.Put([]byte("after"), []byte("after"))
+    assert.Nil(t, err)
+    check(db)
+
+    err = db.Close()
+    assert.Nil(t, err)
+    db, err = Open(options)
+    assert.Nil(t, err)
+    check(db)
+}
+
+// Opens the ingest's copy of the hint file once to write it, the power goes out when it is opened to be applied
+type crashOnIngestHintVFS struct {
+    *fio.FaultInjector
+    hintFileName string
+    opens int
+}
+
+func (fs *crashOnIngestHintVFS) OpenFile(name string, ioType fio.IOType) (fio.IOManager, error) {
+    if name == fs.hintFileName {
+        fs.opens++
+        if fs.opens == 2 {
+            if err := fs.Crash(); err != nil {
+                return nil, err
+            }
+        }
+    }
+    return fs.FaultInjector.OpenFile(name, ioType)
+}
+
+func TestCrashIngestBPTree(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-ingest-crash-")
+    defer os.RemoveAll(dir)
+    options.DirPath = dir
+    options.DataFileSize = 64 * 1024
+    options.IndexType = index.BPTreeIndex
+
+    stagingDir, _ := os.MkdirTemp("", "kvdb-go-staging-")
+    defer os.RemoveAll(stagingDir)
+    loader, err := NewBulkLoader(stagingDir, options)
+    assert.Nil(t, err)
+    for i := 0; i < 2000; i++ {
+        err := loader.Add(utils.GetTestKey(i), utils.GetTestValue(64))
+        assert.Nil(t, err)
+    }
+    err = loader.Finish()
+    assert.Nil(t, err)
+
+    injector := fio.NewFaultInjector(nil, 1)
+    fs := &crashOnIngestHintVFS{FaultInjector: injector}
+    options.VFS = fs
+    db, err := Open(options)
+    assert.Nil(t, err)
+    fs.hintFileName = filepath.Join(db.getIngestPath(), data.HintFileName)
+    for i := 0; i < 100; i++ {
+        err := db.Put(utils.GetTestKey(i), []byte("old"))
+        assert.Nil(t, err)
+    }
+
+    // Every staged file moved in, the index has none of their entries
+    _, err = db.Ingest(stagingDir)
+    assert.Equal(t, fio.ErrCrashed, err)
+    crash(t, db, injector, newCrashModel())
+    err = db.index.Close()
+    assert.Nil(t, err)
+
+    options.VFS = fio.OSFS{}
+    db, err = Open(options)
+    assert.Nil(t, err)
+    defer db.Close()
+    for i := 0; i < 2000; i++ {
+        val, err := db.Get(utils.GetTestKey(i))
+        assert.Nil(t, err)
+        assert.Equal(t, len(utils.GetTestValue(64)), len(val))
+    }
+    _, err = os.Stat(db.getIngestPath())
+    assert.True(t, os.IsNotExist(err))
+
+    err = db.Put([]byte("after"), []byte("after"))
+    assert.Nil(t, err)
+    val, err := db.Get([]byte("after"))
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("after"), val)
+}
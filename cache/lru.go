@@ -0,0 +1,131 @@
+package cache
+
+import (
+    "container/list"
+    "sync"
+    "sync/atomic"
+)
+
+// Rough per entry bookkeeping cost (list element, map slot and key)
+const entryOverhead = 64
+
+type Key struct {
+    FileId uint32
+    Offset int64
+}
+
+type entry struct {
+    key Key
+    value []byte
+}
+
+type LRUCache struct {
+    capacity int64
+    size int64
+    items map[Key]*list.Element
+    evictList *list.List
+    lock *sync.Mutex
+    hits uint64
+    misses uint64
+}
+
+func NewLRUCache(capacity int64) *LRUCache {
+    return &LRUCache {
+        capacity: capacity,
+        items: make(map[Key]*list.Element),
+        evictList: list.New(),
+        lock: new(sync.Mutex),
+    }
+}
+
+// The returned value is a copy, the caller is free to modify it
+func (c *LRUCache) Get(key Key) ([]byte, bool) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    element, ok := c.items[key]
+    if !ok {
+        atomic.AddUint64(&c.misses, 1)
+        return nil, false
+    }
+    atomic.AddUint64(&c.hits, 1)
+    c.evictList.MoveToFront(element)
+
+    value := element.Value.(*entry).value
+    copied := make([]byte, len(value))
+    copy(copied, value)
+    return copied, true
+}
+
+func (c *LRUCache) Put(key Key, value []byte) {
+    cost := entryCost(value)
+    if cost > c.capacity {
+        return
+    }
+
+    copied := make([]byte, len(value))
+    copy(copied, value)
+
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    if element, ok := c.items[key]; ok {
+        c.removeElement(element)
+    }
+
+    element := c.evictList.PushFront(&entry{key: key, value: copied})
+    c.items[key] = element
+    c.size += cost
+
+    for c.size > c.capacity {
+        c.removeElement(c.evictList.Back())
+    }
+}
+
+func (c *LRUCache) Remove(key Key) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    if element, ok := c.items[key]; ok {
+        c.removeElement(element)
+    }
+}
+
+func (c *LRUCache) Purge() {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    c.items = make(map[Key]*list.Element)
+    c.evictList.Init()
+    c.size = 0
+}
+
+func (c *LRUCache) Len() int {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.evictList.Len()
+}
+
+func (c *LRUCache) Size() int64 {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.size
+}
+
+func (c *LRUCache) Hits() uint64 {
+    return atomic.LoadUint64(&c.hits)
+}
+
+func (c *LRUCache) Misses() uint64 {
+    return atomic.LoadUint64(&c.misses)
+}
+
+func (c *LRUCache) removeElement(element *list.Element) {
+    e := c.evictList.Remove(element).(*entry)
+    delete(c.items, e.key)
+    c.size -= entryCost(e.value)
+}
+
+func entryCost(value []byte) int64 {
+    return int64(len(value)) + entryOverhead
+}
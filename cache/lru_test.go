@@ -0,0 +1,76 @@
+package cache
+
+import (
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestLRUCacheGetPut(t *testing.T) {
+    c := NewLRUCache(1024)
+
+    value, ok := c.Get(Key{FileId: 1, Offset: 0})
+    assert.False(t, ok)
+    assert.Nil(t, value)
+
+    c.Put(Key{FileId: 1, Offset: 0}, []byte("value-a"))
+    value, ok = c.Get(Key{FileId: 1, Offset: 0})
+    assert.True(t, ok)
+    assert.Equal(t, []byte("value-a"), value)
+
+    // Modifying the returned value must not change the cached one
+    value[0] = 'x'
+    value, ok = c.Get(Key{FileId: 1, Offset: 0})
+    assert.True(t, ok)
+    assert.Equal(t, []byte("value-a"), value)
+
+    c.Put(Key{FileId: 1, Offset: 0}, []byte("value-b"))
+    value, ok = c.Get(Key{FileId: 1, Offset: 0})
+    assert.True(t, ok)
+    assert.Equal(t, []byte("value-b"), value)
+    assert.Equal(t, 1, c.Len())
+
+    assert.Equal(t, uint64(3), c.Hits())
+    assert.Equal(t, uint64(1), c.Misses())
+}
+
+func TestLRUCacheEviction(t *testing.T) {
+    c := NewLRUCache(3 * (entryOverhead + 10))
+
+    c.Put(Key{FileId: 0, Offset: 0}, make([]byte, 10))
+    c.Put(Key{FileId: 0, Offset: 10}, make([]byte, 10))
+    c.Put(Key{FileId: 0, Offset: 20}, make([]byte, 10))
+
+    // Touch the first one so the second one becomes the least recently used
+    _, ok := c.Get(Key{FileId: 0, Offset: 0})
+    assert.True(t, ok)
+
+    c.Put(Key{FileId: 0, Offset: 30}, make([]byte, 10))
+    assert.Equal(t, 3, c.Len())
+
+    _, ok = c.Get(Key{FileId: 0, Offset: 10})
+    assert.False(t, ok)
+    _, ok = c.Get(Key{FileId: 0, Offset: 0})
+    assert.True(t, ok)
+
+    // Values larger than the whole cache are never stored
+    c.Put(Key{FileId: 0, Offset: 40}, make([]byte, 1024))
+    _, ok = c.Get(Key{FileId: 0, Offset: 40})
+    assert.False(t, ok)
+}
+
+func TestLRUCacheRemoveAndPurge(t *testing.T) {
+    c := NewLRUCache(1024)
+
+    c.Put(Key{FileId: 1, Offset: 0}, []byte("value-a"))
+    c.Put(Key{FileId: 1, Offset: 20}, []byte("value-b"))
+
+    c.Remove(Key{FileId: 1, Offset: 0})
+    _, ok := c.Get(Key{FileId: 1, Offset: 0})
+    assert.False(t, ok)
+    assert.Equal(t, 1, c.Len())
+
+    c.Purge()
+    assert.Equal(t, 0, c.Len())
+    assert.Equal(t, int64(0), c.Size())
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "io"
+    kvdb "kvdb-go"
+    "os"
+    "strings"
+)
+
+const usage = `usage: kvdb <command> [flags]
+
+commands:
+  export    write every live key-value pair of a database
+  import    put the pairs of an export into a database
+  upgrade   rewrite a database written before files had a format header
+`
+
+type prefixFlags [][]byte
+
+func (p *prefixFlags) String() string {
+    var prefixes []string
+    for _, prefix := range *p {
+        prefixes = append(prefixes, string(prefix))
+    }
+    return strings.Join(prefixes, ",")
+}
+
+func (p *prefixFlags) Set(value string) error {
+    *p = append(*p, []byte(value))
+    return nil
+}
+
+func main() {
+    if len(os.Args) < 2 {
+        fmt.Fprint(os.Stderr, usage)
+        os.Exit(2)
+    }
+
+    var err error
+    switch os.Args[1] {
+    case "export":
+        err = runExport(os.Args[2:])
+    case "import":
+        err = runImport(os.Args[2:])
+    case "upgrade":
+        err = runUpgrade(os.Args[2:])
+    default:
+        fmt.Fprint(os.Stderr, usage)
+        os.Exit(2)
+    }
+
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "kvdb %s: %v\n", os.Args[1], err)
+        os.Exit(1)
+    }
+}
+
+func runExport(args []string) error {
+    flags := flag.NewFlagSet("export", flag.ExitOnError)
+    dir := flags.String("dir", "", "database directory")
+    format := flags.String("format", "jsonl", "jsonl, csv or binary")
+    output := flags.String("out", "", "output file, stdout when empty")
+    var prefixes prefixFlags
+    flags.Var(&prefixes, "prefix", "only export keys with this prefix, may be repeated")
+    _ = flags.Parse(args)
+
+    exportFormat, err := kvdb.ParseExportFormat(*format)
+    if err != nil {
+        return err
+    }
+
+    // Read-only takes no lock, so a running writer can keep the database open
+    options := kvdb.DefaultOptions
+    options.DirPath = *dir
+    options.ReadOnly = true
+    db, err := kvdb.Open(options)
+    if err != nil {
+        return err
+    }
+    defer db.Close()
+
+    var writer io.Writer = os.Stdout
+    if *output != "" {
+        file, err := os.Create(*output)
+        if err != nil {
+            return err
+        }
+        defer file.Close()
+        writer = file
+    }
+
+    count, err := db.Export(writer, exportFormat, prefixes...)
+    if err != nil {
+        return err
+    }
+    fmt.Fprintf(os.Stderr, "exported %d pairs\n", count)
+    return nil
+}
+
+func runImport(args []string) error {
+    flags := flag.NewFlagSet("import", flag.ExitOnError)
+    dir := flags.String("dir", "", "database directory")
+    format := flags.String("format", "jsonl", "jsonl, csv or binary")
+    input := flags.String("in", "", "input file, stdin when empty")
+    var prefixes prefixFlags
+    flags.Var(&prefixes, "prefix", "only import keys with this prefix, may be repeated")
+    _ = flags.Parse(args)
+
+    exportFormat, err := kvdb.ParseExportFormat(*format)
+    if err != nil {
+        return err
+    }
+
+    options := kvdb.DefaultOptions
+    options.DirPath = *dir
+    db, err := kvdb.Open(options)
+    if err != nil {
+        return err
+    }
+    defer db.Close()
+
+    var reader io.Reader = os.Stdin
+    if *input != "" {
+        file, err := os.Open(*input)
+        if err != nil {
+            return err
+        }
+        defer file.Close()
+        reader = file
+    }
+
+    count, err := db.Import(reader, exportFormat, prefixes...)
+    if err != nil {
+        return err
+    }
+    fmt.Fprintf(os.Stderr, "imported %d pairs\n", count)
+    return nil
+}
+
+func runUpgrade(args []string) error {
+    flags := flag.NewFlagSet("upgrade", flag.ExitOnError)
+    dir := flags.String("dir", "", "database directory")
+    indexType := flags.String("index", "btree", "btree, art or bptree, the index the database is opened with")
+    _ = flags.Parse(args)
+
+    options := kvdb.DefaultOptions
+    options.DirPath = *dir
+    switch *indexType {
+    case "btree":
+        options.IndexType = kvdb.BTreeIndex
+    case "art":
+        options.IndexType = kvdb.ARTIndex
+    case "bptree":
+        options.IndexType = kvdb.BPTreeIndex
+    default:
+        return fmt.Errorf("unknown index type %q", *indexType)
+    }
+
+    if err := kvdb.Upgrade(options); err != nil {
+        return err
+    }
+    fmt.Fprintf(os.Stderr, "upgraded %s\n", *dir)
+    return nil
+}
@@ -0,0 +1,305 @@
+package kvdb_go
+
+import (
+    "bytes"
+    "fmt"
+    "kvdb-go/data"
+    "kvdb-go/fio"
+    "math/rand"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+// Every value a key may have after a crash, nil stands for a missing key.
+// Writes are pending until a sync makes the acknowledged ones durable, a failed write may or may not
+// have reached the disk.
+type crashModel struct {
+    values map[string][][]byte
+    pending []crashWrite
+}
+
+type crashWrite struct {
+    key string
+    value []byte
+    acknowledged bool
+}
+
+func newCrashModel() *crashModel {
+    return &crashModel{values: make(map[string][][]byte)}
+}
+
+func (m *crashModel) write(key string, value []byte, acknowledged bool) {
+    m.pending = append(m.pending, crashWrite{key: key, value: value, acknowledged: acknowledged})
+}
+
+func (m *crashModel) add(key string, value []byte) {
+    if _, ok := m.values[key]; !ok {
+        m.values[key] = [][]byte{nil}
+    }
+    m.values[key] = append(m.values[key], value)
+}
+
+func (m *crashModel) sync() {
+    for _, w := range m.pending {
+        if w.acknowledged {
+            m.values[w.key] = [][]byte{w.value}
+        } else {
+            m.add(w.key, w.value)
+        }
+    }
+    m.pending = nil
+}
+
+// Unsynced writes may have been lost, or kept up to any point
+func (m *crashModel) crash() {
+    for _, w := range m.pending {
+        m.add(w.key, w.value)
+    }
+    m.pending = nil
+}
+
+func (m *crashModel) allows(key string, value []byte) bool {
+    possibilities, ok := m.values[key]
+    if !ok {
+        possibilities = [][]byte{nil}
+    }
+    for _, w := range m.pending {
+        if w.key == key {
+            possibilities = append(possibilities, w.value)
+        }
+    }
+    for _, possibility := range possibilities {
+        if (possibility == nil) == (value == nil) && bytes.Equal(possibility, value) {
+            return true
+        }
+    }
+    return false
+}
+
+func crashTestGet(db *DB, key string) ([]byte, error) {
+    value, err := db.Get([]byte(key))
+    if err == ErrKeyNotFound {
+        return nil, nil
+    }
+    return value, err
+}
+
+func runCrashWorkload(t *testing.T, db *DB, rng *rand.Rand, model *crashModel, round int) {
+    for i := 0; i < 200; i++ {
+        key := fmt.Sprintf("key-%03d", rng.Intn(64))
+        value := []byte(fmt.Sprintf("value-%d-%d-%s", round, i, bytes.Repeat([]byte("x"), rng.Intn(200))))
+
+        switch op := rng.Intn(20); {
+        case op < 8:
+            err := db.Put([]byte(key), value)
+            model.write(key, value, err == nil)
+            if err == nil {
+                model.sync()
+            }
+        case op < 11:
+            // Deleting a key the index does not have writes nothing, a failed write of it may still come back
+            current, err := crashTestGet(db, key)
+            assert.Nil(t, err)
+            err = db.Delete([]byte(key))
+            if current != nil || err != nil {
+                model.write(key, nil, err == nil)
+            }
+            if current != nil && err == nil {
+                model.sync()
+            }
+        case op < 16:
+            batchOptions := DefaultWriteBatchOptions
+            batchOptions.SyncWrites = rng.Intn(2) == 0
+            batch := db.NewWriteBatch(batchOptions)
+            batchValues := make(map[string][]byte)
+            for j := rng.Intn(5); j >= 0; j-- {
+                batchKey := fmt.Sprintf("key-%03d", rng.Intn(64))
+                if rng.Intn(4) == 0 {
+                    current, err := crashTestGet(db, batchKey)
+                    assert.Nil(t, err)
+                    _ = batch.Delete([]byte(batchKey))
+                    // Like Delete, it drops the key from the batch when the index does not have it
+                    if current != nil {
+                        batchValues[batchKey] = nil
+                    } else {
+                        delete(batchValues, batchKey)
+                    }
+                } else {
+                    batchValue := []byte(fmt.Sprintf("batch-%d-%d-%d", round, i, j))
+                    _ = batch.Put([]byte(batchKey), batchValue)
+                    batchValues[batchKey] = batchValue
+                }
+            }
+            err := batch.Commit()
+            for batchKey, batchValue := range batchValues {
+                model.write(batchKey, batchValue, err == nil)
+            }
+            if err == nil && batchOptions.SyncWrites && len(batchValues) > 0 {
+                model.sync()
+            }
+        case op < 17:
+            if err := db.Sync(); err == nil {
+                model.sync()
+            }
+        case op < 18:
+            // Merging never changes what the keys hold, whether it fails or not
+            _ = db.Merge()
+        default:
+            value, err := crashTestGet(db, key)
+            assert.Nil(t, err)
+            assert.True(t, model.allows(key, value), "round %d op %d: %s has %q", round, i, key, value)
+        }
+    }
+}
+
+// Loses the unsynced data like a power loss would and drops the database without closing it
+func crash(t *testing.T, db *DB, injector *fio.FaultInjector, model *crashModel) {
+    model.crash()
+    err := injector.Crash()
+    assert.Nil(t, err)
+    db.watchHub.close()
+    err = db.fileLock.Unlock()
+    assert.Nil(t, err)
+}
+
+// Checks the reopened database against the model and settles the model on what it holds
+func checkCrashModel(t *testing.T, db *DB, model *crashModel, round int) {
+    for key := range model.values {
+        value, err := crashTestGet(db, key)
+        assert.Nil(t, err)
+        assert.True(t, model.allows(key, value), "round %d: %s has %q", round, key, value)
+        model.values[key] = [][]byte{value}
+    }
+    assert.Nil(t, db.Fold(func(key []byte, value []byte) bool {
+        _, ok := model.values[string(key)]
+        assert.True(t, ok, "round %d: unknown key %s", round, key)
+        return true
+    }))
+}
+
+func TestCrashRecovery(t *testing.T) {
+    randomFaults := fio.RandomFaults(0.03, fio.FaultWriteError, fio.FaultShortWrite, fio.FaultSyncError)
+    // Open records the watch epoch, the faults are meant for the workload. Headers go to a temporary file first.
+    faults := func(fileName string, op fio.FaultOp, rand *rand.Rand) fio.Fault {
+        if strings.HasPrefix(filepath.Base(fileName), data.WatchEpochFileName) {
+            return fio.NoFault
+        }
+        return randomFaults(fileName, op, rand)
+    }
+
+    for seed := int64(1); seed <= 4; seed++ {
+        t.Run(fmt.Sprintf("seed-%d", seed), func(t *testing.T) {
+            dir, _ := os.MkdirTemp("", "kvdb-go-crash-")
+            defer os.RemoveAll(dir)
+            defer os.RemoveAll(dir + mergeDirName)
+
+            options := DefaultOptions
+            options.DirPath = dir
+            options.DataFileSize = 8 * 1024
+            options.SyncWrites = true
+            options.MergeTriggerRatio = 0
+
+            rng := rand.New(rand.NewSource(seed))
+            model := newCrashModel()
+            for round := 0; round < 5; round++ {
+                injector := fio.NewFaultInjector(faults, seed * 100 + int64(round))
+                options.VFS = injector
+                db, err := Open(options)
+                if !assert.Nil(t, err) {
+                    return
+                }
+                runCrashWorkload(t, db, rng, model, round)
+                crash(t, db, injector, model)
+
+                options.VFS = fio.OSFS{}
+                db, err = Open(options)
+                if !assert.Nil(t, err, "round %d", round) {
+                    return
+                }
+                checkCrashModel(t, db, model, round)
+                err = db.Close()
+                assert.Nil(t, err)
+            }
+        })
+    }
+}
+
+func TestCrashCorruptedWrite(t *testing.T) {
+    dir, _ := os.MkdirTemp("", "kvdb-go-crash-")
+    defer os.RemoveAll(dir)
+
+    options := DefaultOptions
+    options.DirPath = dir
+    // The header is written to a temporary file, the first write to the data file is a record
+    var dataFileWrites int
+    injector := fio.NewFaultInjector(func(fileName string, op fio.FaultOp, rand *rand.Rand) fio.Fault {
+        if filepath.Ext(fileName) == data.DataFileNameSuffix && op == fio.FaultOpWrite {
+            dataFileWrites++
+            if dataFileWrites == 1 {
+                return fio.FaultCorruptWrite
+            }
+        }
+        return fio.NoFault
+    }, 1)
+    options.VFS = injector
+    db, err := Open(options)
+    assert.Nil(t, err)
+    for i := 0; i < 3; i++ {
+        err = db.Put([]byte(fmt.Sprintf("key-%d", i)), bytes.Repeat([]byte("v"), 1024))
+        assert.Nil(t, err)
+    }
+    err = db.Close()
+    assert.Nil(t, err)
+
+    // A bit flipped in an acknowledged record is reported, not skipped
+    options.VFS = fio.OSFS{}
+    _, err = Open(options)
+    assert.Equal(t, data.ErrInvalidCRC, err)
+}
+
+func TestCrashPowerLossAfterMerge(t *testing.T) {
+    for seed := int64(1); seed <= 16; seed++ {
+        t.Run(fmt.Sprintf("seed-%d", seed), func(t *testing.T) {
+            dir, _ := os.MkdirTemp("", "kvdb-go-crash-")
+            defer os.RemoveAll(dir)
+            defer os.RemoveAll(dir + mergeDirName)
+
+            options := DefaultOptions
+            options.DirPath = dir
+            options.DataFileSize = 8 * 1024
+            options.MergeTriggerRatio = 0
+            injector := fio.NewFaultInjector(nil, seed)
+            options.VFS = injector
+
+            db, err := Open(options)
+            assert.Nil(t, err)
+            for i := 0; i < 400; i++ {
+                err = db.Put([]byte(fmt.Sprintf("key-%03d", i % 100)), []byte(fmt.Sprintf("value-%d", i)))
+                assert.Nil(t, err)
+            }
+            err = db.Merge()
+            assert.Nil(t, err)
+            err = db.Close()
+            assert.Nil(t, err)
+
+            // The merged files are moved in on open, then the power goes out
+            db, err = Open(options)
+            assert.Nil(t, err)
+            crash(t, db, injector, newCrashModel())
+
+            options.VFS = fio.OSFS{}
+            db, err = Open(options)
+            assert.Nil(t, err)
+            defer db.Close()
+            for i := 300; i < 400; i++ {
+                value, err := db.Get([]byte(fmt.Sprintf("key-%03d", i % 100)))
+                assert.Nil(t, err)
+                assert.Equal(t, []byte(fmt.Sprintf("value-%d", i)), value)
+            }
+        })
+    }
+}
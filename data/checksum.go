@@ -0,0 +1,81 @@
+package data
+
+import (
+    "hash"
+    "hash/crc32"
+
+    "github.com/cespare/xxhash/v2"
+)
+
+type ChecksumType = byte
+
+// Recorded in the file header, records keep their 4 byte checksum field whatever the type
+const (
+    ChecksumCRC32IEEE ChecksumType = iota
+    // Castagnoli, computed with SSE4.2 or ARM64 CRC instructions where available
+    ChecksumCRC32C
+    // The lower 32 bits of xxhash64
+    ChecksumXXHash64
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+func ValidChecksumType(checksumType ChecksumType) bool {
+    return checksumType <= ChecksumXXHash64
+}
+
+// Computes the checksum of parts as if they were one slice
+func Checksum(checksumType ChecksumType, parts ...[]byte) uint32 {
+    switch checksumType {
+    case ChecksumCRC32C:
+        var crc uint32
+        for _, part := range parts {
+            crc = crc32.Update(crc, castagnoliTable, part)
+        }
+        return crc
+    case ChecksumXXHash64:
+        if len(parts) == 1 {
+            return uint32(xxhash.Sum64(parts[0]))
+        }
+        digest := xxhash.New()
+        for _, part := range parts {
+            _, _ = digest.Write(part)
+        }
+        return uint32(digest.Sum64())
+    default:
+        var crc uint32
+        for _, part := range parts {
+            crc = crc32.Update(crc, crc32.IEEETable, part)
+        }
+        return crc
+    }
+}
+
+// Incremental checksum for values that are streamed
+func NewChecksum(checksumType ChecksumType) hash.Hash32 {
+    switch checksumType {
+    case ChecksumCRC32C:
+        return crc32.New(castagnoliTable)
+    case ChecksumXXHash64:
+        return &xxhash32{xxhash.New()}
+    default:
+        return crc32.NewIEEE()
+    }
+}
+
+type xxhash32 struct {
+    *xxhash.Digest
+}
+
+func (h *xxhash32) Size() int {
+    return 4
+}
+
+func (h *xxhash32) Sum32() uint32 {
+    return uint32(h.Sum64())
+}
+
+func (h *xxhash32) Sum(b []byte) []byte {
+    sum := h.Sum32()
+    return append(b, byte(sum >> 24), byte(sum >> 16), byte(sum >> 8), byte(sum))
+}
@@ -1,13 +1,15 @@
 package data
 
 import (
+    "encoding/binary"
     "errors"
     "fmt"
+    "hash"
     "hash/crc32"
     "io"
     "kvdb-go/fio"
+    "kvdb-go/logger"
     "path/filepath"
-    log "github.com/sirupsen/logrus"
 )
 
 var (
@@ -15,57 +17,155 @@ var (
     ErrDataFileCorrupted = errors.New("data file is corrupted")
 )
 
-const (
-    LogRecordEntryFormatString = "offset: %d, crc: %d, header.crc: %d, header.recordType: %d, header.keySize: %d, header.valueSize: %d, key: %s, value: %s"
-)
-
 const (
     DataFileNameSuffix = ".data"
+    ValueLogFileNameSuffix = ".vlog"
     HintFileName = "hint-index"
     MergeFinishedFileName = "merge-finished"
     SeqNumFileName = "seq-num"
+    BloomFilterFileName = "bloom-filter"
+    WatchEpochFileName = "watch-epoch"
 )
 
 type DataFile struct {
     FileId uint32
     WriteOffset int64
     IOManager fio.IOManager
+    Header FileHeader
+    Logger logger.Logger // Warned about damaged records, nil drops the messages
 }
 
-func OpenDataFile(dirPath string, fileId uint32, ioType fio.IOType) (*DataFile, error) {
+func OpenDataFile(fs fio.VFS, dirPath string, fileId uint32, ioType fio.IOType) (*DataFile, error) {
+    return OpenDataFileWithHeader(fs, dirPath, fileId, ioType, DefaultFileHeader)
+}
+
+// A missing file is created with the given header, an existing one keeps its own
+func OpenDataFileWithHeader(fs fio.VFS, dirPath string, fileId uint32, ioType fio.IOType, header FileHeader) (*DataFile, error) {
     fileName := GetDataFileName(dirPath, fileId)
-    
-    return newDataFile(fileName, fileId, ioType)
+
+    return newDataFile(fs, fileName, fileId, ioType, header)
+}
+
+func OpenValueLogFile(fs fio.VFS, dirPath string, fileId uint32) (*DataFile, error) {
+    return OpenValueLogFileWithHeader(fs, dirPath, fileId, DefaultFileHeader)
+}
+
+func OpenValueLogFileWithHeader(fs fio.VFS, dirPath string, fileId uint32, header FileHeader) (*DataFile, error) {
+    fileName := GetValueLogFileName(dirPath, fileId)
+
+    return newDataFile(fs, fileName, fileId, fio.StandardFileIO, header)
 }
 
-func OpenHintFile(dirPath string) (*DataFile, error) {
+func OpenHintFile(fs fio.VFS, dirPath string) (*DataFile, error) {
     fileName := filepath.Join(dirPath, HintFileName)
     
-    return newDataFile(fileName, 0, fio.StandardFileIO)
+    return newDataFile(fs, fileName, 0, fio.StandardFileIO, DefaultFileHeader)
 }
 
-func OpenMergeFinishedFile(dirPath string) (*DataFile, error) {
+func OpenMergeFinishedFile(fs fio.VFS, dirPath string) (*DataFile, error) {
     fileName := filepath.Join(dirPath, MergeFinishedFileName)
     
-    return newDataFile(fileName, 0, fio.StandardFileIO)
+    return newDataFile(fs, fileName, 0, fio.StandardFileIO, DefaultFileHeader)
 }
 
-func OpenSeqNumFile(dirPath string) (*DataFile, error) {
+func OpenSeqNumFile(fs fio.VFS, dirPath string) (*DataFile, error) {
     fileName := filepath.Join(dirPath, SeqNumFileName)
     
-    return newDataFile(fileName, 0, fio.StandardFileIO)
+    return newDataFile(fs, fileName, 0, fio.StandardFileIO, DefaultFileHeader)
+}
+
+func OpenBloomFilterFile(fs fio.VFS, dirPath string) (*DataFile, error) {
+    fileName := filepath.Join(dirPath, BloomFilterFileName)
+    
+    return newDataFile(fs, fileName, 0, fio.StandardFileIO, DefaultFileHeader)
+}
+
+func OpenWatchEpochFile(fs fio.VFS, dirPath string) (*DataFile, error) {
+    fileName := filepath.Join(dirPath, WatchEpochFileName)
+    
+    return newDataFile(fs, fileName, 0, fio.StandardFileIO, DefaultFileHeader)
 }
 
 func GetDataFileName(dirPath string, fileId uint32) string {
     return filepath.Join(dirPath, fmt.Sprintf("%09d%s", fileId, DataFileNameSuffix))
 }
 
-func newDataFile(fileName string, fileId uint32, ioType fio.IOType) (*DataFile, error) {
-    ioManager, err := fio.NewIOManager(fileName, ioType)
+func GetValueLogFileName(dirPath string, fileId uint32) string {
+    return filepath.Join(dirPath, fmt.Sprintf("%09d%s", fileId, ValueLogFileNameSuffix))
+}
+
+// Opens an existing file for reading only, nothing is created or written
+func OpenFileReadOnly(fs fio.VFS, fileName string, fileId uint32) (*DataFile, error) {
+    return newDataFile(fs, fileName, fileId, fio.ReadOnlyFileIO, DefaultFileHeader)
+}
+
+// Opens a file of the format before headers, its records start at offset 0
+func OpenLegacyFile(fileName string, fileId uint32) (*DataFile, error) {
+    ioManager, err := fio.NewIOManager(fileName, fio.StandardFileIO)
     if err != nil {
         return nil, err
     }
-    return &DataFile{fileId, 0, ioManager}, nil
+    return &DataFile{FileId: fileId, IOManager: ioManager}, nil
+}
+
+// A file without a name that lives in memory until it is closed
+func NewInMemoryFile(fileId uint32, header FileHeader) (*DataFile, error) {
+    ioManager := fio.NewInMemoryIO()
+    if _, err := ioManager.Write(EncodeFileHeader(header)); err != nil {
+        return nil, err
+    }
+
+    return &DataFile {
+        FileId: fileId,
+        WriteOffset: FileHeaderSize,
+        IOManager: ioManager,
+        Header: header,
+    }, nil
+}
+
+// Records start after the header, WriteOffset points behind it until the file is loaded
+func newDataFile(fs fio.VFS, fileName string, fileId uint32, ioType fio.IOType, header FileHeader) (*DataFile, error) {
+    fs = fio.OrOSFS(fs)
+    readOnly := ioType == fio.ReadOnlyFileIO
+    if !readOnly {
+        if err := createFileWithHeader(fs, fileName, header); err != nil {
+            return nil, err
+        }
+    }
+
+    ioManager, err := fs.OpenFile(fileName, ioType)
+    if err != nil {
+        return nil, err
+    }
+
+    // A crash right after the writer created the file left it empty, it has no records yet
+    if readOnly {
+        size, err := ioManager.Size()
+        if err != nil {
+            _ = ioManager.Close()
+            return nil, err
+        }
+        if size == 0 {
+            return &DataFile{FileId: fileId, WriteOffset: FileHeaderSize, IOManager: ioManager, Header: header}, nil
+        }
+    }
+
+    header, err = ReadFileHeader(ioManager)
+    if err != nil {
+        _ = ioManager.Close()
+        return nil, err
+    }
+
+    return &DataFile {
+        FileId: fileId,
+        WriteOffset: FileHeaderSize,
+        IOManager: ioManager,
+        Header: header,
+    }, nil
+}
+
+func (df *DataFile) logger() logger.Logger {
+    return logger.OrNop(df.Logger)
 }
 
 func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
@@ -76,7 +176,7 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
     if offset == fileSize {
         return nil, 0, io.EOF
     } else if offset > fileSize {
-        log.Warn("Data file might be corrupted, offset is larger than file size")
+        df.logger().Warn("Data file might be corrupted, offset is larger than file size", "fileId", df.FileId, "offset", offset)
         return nil, 0, io.EOF
     }
 
@@ -92,54 +192,138 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 
     header, headerSize := DecodeLogRecordHeader(headerBuffer)
     if header == nil {
+        df.logger().Warn("Data file might be corrupted, the record header runs past the end of file", "fileId", df.FileId, "offset", offset)
         return nil, 0, nil
     }
     if header.crc == 0 && header.keySize == 0 && header.valueSize == 0 {
-        log.Warn("Data file might be corrupted, there are some extra zero value bytes in the end of file")
+        df.logger().Warn("Data file might be corrupted, there are some extra zero value bytes in the end of file", "fileId", df.FileId, "offset", offset)
         return nil, 0, io.EOF
     }
 
     keySize, valueSize := int64(header.keySize), int64(header.valueSize)
     if (keySize <= 0) {
-        log.Error("Data file is corrupted, key size is less than or equal to zero")
+        df.logger().Error("Data file is corrupted, key size is less than or equal to zero", "fileId", df.FileId, "offset", offset)
         return nil, 0, ErrDataFileCorrupted
     }
     var recordSize = headerSize + keySize + valueSize
 
+    var trailerSize int64 = 0
+    if header.recordType == LogRecordStreamed {
+        trailerSize = crc32.Size
+        recordSize += trailerSize
+    }
+
+    // A torn write at the end, or garbage claiming a huge record
+    if offset + recordSize > fileSize {
+        df.logger().Warn("Data file might be corrupted, the record runs past the end of file", "fileId", df.FileId, "offset", offset)
+        return nil, 0, io.EOF
+    }
+
     logRecord := &LogRecord{Type: header.recordType}
-    kvBuffer, err := df.readNBytes(keySize + valueSize, offset + headerSize)
+    kvBuffer, err := df.readNBytes(keySize + valueSize + trailerSize, offset + headerSize)
     if err != nil {
         return nil, 0, err
     }
 
     logRecord.Key = kvBuffer[:keySize]
-    logRecord.Value = kvBuffer[keySize:]
+    logRecord.Value = kvBuffer[keySize : keySize + valueSize]
 
-    crc := GetLogRecordCRC(logRecord, headerBuffer[crc32.Size : headerSize])
+    var crc uint32
+    checksumType := df.Header.ChecksumType
+    if header.recordType == LogRecordStreamed {
+        crc = Checksum(checksumType, headerBuffer[crc32.Size : headerSize], logRecord.Key)
+        valueCRC := binary.LittleEndian.Uint32(kvBuffer[keySize + valueSize:])
+        if crc == header.crc && Checksum(checksumType, logRecord.Value) != valueCRC {
+            df.logger().Error("Data file is corrupted, value crc value is not matched", "fileId", df.FileId, "offset", offset,
+                "key", logger.NewPayload(logRecord.Key), "value", logger.NewPayload(logRecord.Value))
+            return nil, 0, ErrInvalidCRC
+        }
+    } else {
+        crc = getLogRecordChecksum(checksumType, logRecord, headerBuffer[crc32.Size : headerSize])
+    }
     
     if crc != header.crc {
-        log.Error("Data file is corrupted, crc value is not matched")
-        log.Error(fmt.Sprintf(
-            LogRecordEntryFormatString, 
-            offset, crc, header.crc, header.recordType, header.keySize, header.valueSize, logRecord.Key, logRecord.Value,
-        ))
+        df.logger().Error("Data file is corrupted, crc value is not matched", "fileId", df.FileId, "offset", offset,
+            "crc", crc, "headerCRC", header.crc, "recordType", header.recordType,
+            "key", logger.NewPayload(logRecord.Key), "value", logger.NewPayload(logRecord.Value))
         return nil, 0, ErrInvalidCRC
     }
-
-    log.Debug(fmt.Sprintf(
-        LogRecordEntryFormatString, 
-        offset, crc, header.crc, header.recordType, header.keySize, header.valueSize, logRecord.Key, logRecord.Value,
-    ))
     
     return logRecord, recordSize, nil
 }
 
+// Streams the value of the record at offset, the crc is checked once the reader reaches the end.
+// The caller has to keep the data file open while reading.
+func (df *DataFile) ReadLogRecordValue(offset int64) (LogRecordType, io.Reader, int64, error) {
+    fileSize, err := df.IOManager.Size()
+    if err != nil {
+        return 0, nil, 0, err
+    }
+    if offset >= fileSize {
+        return 0, nil, 0, io.EOF
+    }
+
+    var readHeaderSize int64 = maxLogRecordHeaderSize
+    if offset + readHeaderSize > fileSize {
+        readHeaderSize = fileSize - offset
+    }
+
+    headerBuffer, err := df.readNBytes(readHeaderSize, offset)
+    if err != nil {
+        return 0, nil, 0, err
+    }
+
+    header, headerSize := DecodeLogRecordHeader(headerBuffer)
+    if header == nil || header.keySize == 0 {
+        return 0, nil, 0, ErrDataFileCorrupted
+    }
+
+    keySize, valueSize := int64(header.keySize), int64(header.valueSize)
+    key, err := df.readNBytes(keySize, offset + headerSize)
+    if err != nil {
+        return 0, nil, 0, err
+    }
+
+    // A normal record's checksum goes on over the value, a streamed one has a checksum of its own after the value
+    checksum := NewChecksum(df.Header.ChecksumType)
+    _, _ = checksum.Write(headerBuffer[crc32.Size : headerSize])
+    _, _ = checksum.Write(key)
+    valueOffset := offset + headerSize + keySize
+    reader := &valueReader {
+        section: io.NewSectionReader(&ioManagerReaderAt{df.IOManager}, valueOffset, valueSize),
+        checksum: checksum,
+        expectedCRC: header.crc,
+    }
+
+    if header.recordType == LogRecordStreamed {
+        if checksum.Sum32() != header.crc {
+            return 0, nil, 0, ErrInvalidCRC
+        }
+
+        trailer, err := df.readNBytes(crc32.Size, valueOffset + valueSize)
+        if err != nil {
+            return 0, nil, 0, err
+        }
+        checksum.Reset()
+        reader.expectedCRC = binary.LittleEndian.Uint32(trailer)
+    }
+
+    return header.recordType, reader, valueSize, nil
+}
+
 func (df *DataFile) Write(buf []byte) error {
+    // A failed write may still have written a part of buf
     n, err := df.IOManager.Write(buf)
-    if err != nil {
+    df.WriteOffset += int64(n)
+    return err
+}
+
+// Drops what a failed write left behind size
+func (df *DataFile) Truncate(size int64) error {
+    if err := df.IOManager.Truncate(size); err != nil {
         return err
     }
-    df.WriteOffset += int64(n)
+    df.WriteOffset = size
     return nil
 }
 
@@ -149,10 +333,15 @@ func (df *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos) error {
         Value: EncodeLogRecordPos(pos),
     }
 
-    encodedRecord, _ := EncodeLogRecord(record)
+    encodedRecord, _ := df.EncodeLogRecord(record)
     return df.Write(encodedRecord)
 }
 
+// Encodes the record with the checksum type of this file
+func (df *DataFile) EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
+    return EncodeLogRecordWithChecksum(logRecord, df.Header.ChecksumType)
+}
+
 func (df *DataFile) Sync() error {
     return df.IOManager.Sync()
 }
@@ -161,12 +350,12 @@ func (df *DataFile) Close() error {
     return df.IOManager.Close()
 }
 
-func (df *DataFile) SetIOManager(dirPath string, ioType fio.IOType) error {
+func (df *DataFile) SetIOManager(fs fio.VFS, dirPath string, ioType fio.IOType) error {
     if err := df.IOManager.Close(); err != nil {
         return err
     }
 
-    ioManager, err := fio.NewIOManager(GetDataFileName(dirPath, df.FileId), ioType)
+    ioManager, err := fio.OrOSFS(fs).OpenFile(GetDataFileName(dirPath, df.FileId), ioType)
     if err != nil {
         return err
     }
@@ -179,3 +368,26 @@ func (df *DataFile) readNBytes(n int64, offset int64) (buffer []byte, err error)
     _, err = df.IOManager.Read(buffer, offset)
     return
 }
+
+type ioManagerReaderAt struct {
+    ioManager fio.IOManager
+}
+
+func (r *ioManagerReaderAt) ReadAt(p []byte, off int64) (int, error) {
+    return r.ioManager.Read(p, off)
+}
+
+type valueReader struct {
+    section *io.SectionReader
+    checksum hash.Hash32
+    expectedCRC uint32
+}
+
+func (r *valueReader) Read(p []byte) (int, error) {
+    n, err := r.section.Read(p)
+    _, _ = r.checksum.Write(p[:n])
+    if err == io.EOF && r.checksum.Sum32() != r.expectedCRC {
+        return n, ErrInvalidCRC
+    }
+    return n, err
+}
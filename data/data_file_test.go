@@ -1,11 +1,15 @@
 package data
 
 import (
+    "encoding/binary"
     "fmt"
+    "hash/crc32"
+    "io"
     "os"
     "path/filepath"
     "testing"
     "kvdb-go/fio"
+    "kvdb-go/logger"
     "github.com/sirupsen/logrus"
     "github.com/stretchr/testify/assert"
 )
@@ -16,21 +20,27 @@ func init() {
 }
 
 func TestOpenDataFile(t *testing.T) {
-    dataFile1, err := OpenDataFile(os.TempDir(), 0, fio.StandardFileIO)
+    dir, _ := os.MkdirTemp("", "kvdb-go-data-file-")
+    defer os.RemoveAll(dir)
+
+    dataFile1, err := OpenDataFile(nil, dir, 0, fio.StandardFileIO)
     assert.Nil(t, err)
     assert.NotNil(t, dataFile1)
 
-    dataFile2, err := OpenDataFile(os.TempDir(), 42, fio.StandardFileIO)
+    dataFile2, err := OpenDataFile(nil, dir, 42, fio.StandardFileIO)
     assert.Nil(t, err)
     assert.NotNil(t, dataFile2)
 
-    dataFile3, err := OpenDataFile(os.TempDir(), 0, fio.StandardFileIO)
+    dataFile3, err := OpenDataFile(nil, dir, 0, fio.StandardFileIO)
     assert.Nil(t, err)
     assert.NotNil(t, dataFile3)
 }
 
 func TestDataFileWrite(t *testing.T) {
-    dataFile, err := OpenDataFile(os.TempDir(), 0, fio.StandardFileIO)
+    dir, _ := os.MkdirTemp("", "kvdb-go-data-file-")
+    defer os.RemoveAll(dir)
+
+    dataFile, err := OpenDataFile(nil, dir, 0, fio.StandardFileIO)
     assert.Nil(t, err)
     assert.NotNil(t, dataFile)
 
@@ -42,7 +52,10 @@ func TestDataFileWrite(t *testing.T) {
 }
 
 func TestDataFileClose(t *testing.T) {
-    dataFile, err := OpenDataFile(os.TempDir(), 42, fio.StandardFileIO)
+    dir, _ := os.MkdirTemp("", "kvdb-go-data-file-")
+    defer os.RemoveAll(dir)
+
+    dataFile, err := OpenDataFile(nil, dir, 42, fio.StandardFileIO)
     assert.Nil(t, err)
     assert.NotNil(t, dataFile)
 
@@ -51,7 +64,10 @@ func TestDataFileClose(t *testing.T) {
 }
 
 func TestDataFileSync(t *testing.T) {
-    dataFile, err := OpenDataFile(os.TempDir(), 42, fio.StandardFileIO)
+    dir, _ := os.MkdirTemp("", "kvdb-go-data-file-")
+    defer os.RemoveAll(dir)
+
+    dataFile, err := OpenDataFile(nil, dir, 42, fio.StandardFileIO)
     assert.Nil(t, err)
     assert.NotNil(t, dataFile)
 
@@ -63,11 +79,10 @@ func TestDataFileSync(t *testing.T) {
 }
 
 func TestDataFileRead(t *testing.T) {
-    dirPath := os.TempDir()
-    fileId := uint32(42)
-    deleteFile(dirPath, fileId)
+    dir, _ := os.MkdirTemp("", "kvdb-go-data-file-")
+    defer os.RemoveAll(dir)
 
-    dataFile, err := OpenDataFile(os.TempDir(), 42, fio.StandardFileIO)
+    dataFile, err := OpenDataFile(nil, dir, 42, fio.StandardFileIO)
     assert.Nil(t, err)
     assert.NotNil(t, dataFile)
 
@@ -78,7 +93,7 @@ func TestDataFileRead(t *testing.T) {
     encodedRecordAlpha, encodedRecordAlphaSize := EncodeLogRecord(recordAlpha)
     err = dataFile.Write(encodedRecordAlpha)
     assert.Nil(t, err)
-    readRecordAlpha, readRecordAlphaSize, err := dataFile.ReadLogRecord(0)
+    readRecordAlpha, readRecordAlphaSize, err := dataFile.ReadLogRecord(FileHeaderSize)
     assert.Nil(t, err)
     assert.Equal(t, recordAlpha, readRecordAlpha)
     assert.Equal(t, encodedRecordAlphaSize, readRecordAlphaSize)
@@ -90,7 +105,7 @@ func TestDataFileRead(t *testing.T) {
     encodedRecordBeta, encodedRecordBetaSize := EncodeLogRecord(recordBeta)
     err = dataFile.Write(encodedRecordBeta)
     assert.Nil(t, err)
-    readRecordBeta, readRecordBetaSize, err := dataFile.ReadLogRecord(encodedRecordAlphaSize)
+    readRecordBeta, readRecordBetaSize, err := dataFile.ReadLogRecord(FileHeaderSize + encodedRecordAlphaSize)
     assert.Nil(t, err)
     assert.Equal(t, recordBeta, readRecordBeta)
     assert.Equal(t, encodedRecordBetaSize, readRecordBetaSize)
@@ -103,13 +118,98 @@ func TestDataFileRead(t *testing.T) {
     encodedRecordDeleted, encodedRecordDeletedSize := EncodeLogRecord(recordDeleted)
     err = dataFile.Write(encodedRecordDeleted)
     assert.Nil(t, err)
-    readRecordDeleted, readRecordDeletedSize, err := dataFile.ReadLogRecord(encodedRecordAlphaSize + encodedRecordBetaSize)
+    readRecordDeleted, readRecordDeletedSize, err := dataFile.ReadLogRecord(FileHeaderSize + encodedRecordAlphaSize + encodedRecordBetaSize)
     assert.Nil(t, err)
     assert.Equal(t, recordDeleted, readRecordDeleted)
     assert.Equal(t, encodedRecordDeletedSize, readRecordDeletedSize)
 }
 
-func deleteFile(dirPath string, fileId uint32) {
-    fileName := filepath.Join(dirPath, fmt.Sprintf("%09d%s", fileId, DataFileNameSuffix))
-    os.Remove(fileName)
+func TestOpenValueLogFile(t *testing.T) {
+    dir, _ := os.MkdirTemp("", "kvdb-go-value-log-file-")
+    defer os.RemoveAll(dir)
+
+    valueLogFile, err := OpenValueLogFile(nil, dir, 7)
+    assert.Nil(t, err)
+    assert.NotNil(t, valueLogFile)
+    assert.Equal(t, uint32(7), valueLogFile.FileId)
+
+    _, err = os.Stat(GetValueLogFileName(dir, 7))
+    assert.Nil(t, err)
+    assert.Equal(t, filepath.Join(dir, "000000007.vlog"), GetValueLogFileName(dir, 7))
+}
+
+func TestDataFileReadLogRecordValue(t *testing.T) {
+    dir, _ := os.MkdirTemp("", "kvdb-go-read-value-")
+    defer os.RemoveAll(dir)
+
+    dataFile, err := OpenDataFile(nil, dir, 0, fio.StandardFileIO)
+    assert.Nil(t, err)
+
+    // 1. Normal record
+    record := &LogRecord{Key: []byte("key"), Value: []byte("value")}
+    encodedRecord, size := EncodeLogRecord(record)
+    err = dataFile.Write(encodedRecord)
+    assert.Nil(t, err)
+
+    recordType, reader, valueSize, err := dataFile.ReadLogRecordValue(FileHeaderSize)
+    assert.Nil(t, err)
+    assert.Equal(t, LogRecordNormal, recordType)
+    assert.Equal(t, int64(5), valueSize)
+    value, err := io.ReadAll(reader)
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("value"), value)
+
+    // 2. Streamed record
+    streamedValue := []byte("streamed-value")
+    err = dataFile.Write(EncodeStreamedLogRecordHeader([]byte("key-streamed"), int64(len(streamedValue)), ChecksumCRC32IEEE))
+    assert.Nil(t, err)
+    err = dataFile.Write(streamedValue)
+    assert.Nil(t, err)
+    trailer := make([]byte, crc32.Size)
+    binary.LittleEndian.PutUint32(trailer, crc32.ChecksumIEEE(streamedValue))
+    err = dataFile.Write(trailer)
+    assert.Nil(t, err)
+
+    recordType, reader, _, err = dataFile.ReadLogRecordValue(FileHeaderSize + size)
+    assert.Nil(t, err)
+    assert.Equal(t, LogRecordStreamed, recordType)
+    value, err = io.ReadAll(reader)
+    assert.Nil(t, err)
+    assert.Equal(t, streamedValue, value)
+
+    readRecord, readSize, err := dataFile.ReadLogRecord(FileHeaderSize + size)
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("key-streamed"), readRecord.Key)
+    assert.Equal(t, streamedValue, readRecord.Value)
+    assert.Equal(t, dataFile.WriteOffset - FileHeaderSize - size, readSize)
+}
+
+type recordingLogger struct {
+    logger.Nop
+    errors [][]interface{}
+}
+
+func (l *recordingLogger) Error(msg string, keyvals ...interface{}) {
+    l.errors = append(l.errors, append([]interface{}{msg}, keyvals...))
+}
+
+func TestDataFileLogsCorruption(t *testing.T) {
+    dir, _ := os.MkdirTemp("", "kvdb-go-data-file-")
+    defer os.RemoveAll(dir)
+
+    dataFile, err := OpenDataFile(nil, dir, 42, fio.StandardFileIO)
+    assert.Nil(t, err)
+    recording := &recordingLogger{}
+    dataFile.Logger = recording
+
+    encodedRecord, _ := EncodeLogRecord(&LogRecord{Key: []byte("secret-key"), Value: []byte("secret-value")})
+    encodedRecord[len(encodedRecord) - 1] ^= 0xff
+    err = dataFile.Write(encodedRecord)
+    assert.Nil(t, err)
+
+    _, _, err = dataFile.ReadLogRecord(FileHeaderSize)
+    assert.Equal(t, ErrInvalidCRC, err)
+    assert.Equal(t, 1, len(recording.errors))
+    assert.Contains(t, recording.errors[0], logger.NewPayload([]byte("secret-key")))
+    assert.NotContains(t, fmt.Sprint(recording.errors[0]...), "secret")
 }
@@ -0,0 +1,144 @@
+package data
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "kvdb-go/fio"
+    "os"
+    "path/filepath"
+    "sync/atomic"
+)
+
+var (
+    ErrFileHeaderMissing = errors.New("file has no format header, it may have been written by an older version")
+    ErrFileHeaderCorrupted = errors.New("file format header is corrupted")
+    ErrFileVersionUnsupported = errors.New("file format version is not supported")
+    ErrFileFeatureUnsupported = errors.New("file uses a feature this version does not support")
+)
+
+// magic | version | checksum type | flags | reserved | crc
+//     4 |       1 |             1 |     2 |        4 |   4
+const FileHeaderSize = 16
+
+const FileFormatVersion byte = 1
+
+var fileMagic = []byte("KVDB")
+
+// Features a reader has to understand to read the records of a file
+const (
+    FileFlagCompression uint16 = 1 << iota
+    FileFlagTTL
+)
+
+const supportedFileFlags uint16 = 0
+
+type FileHeader struct {
+    Version byte
+    ChecksumType ChecksumType
+    Flags uint16
+}
+
+var DefaultFileHeader = FileHeader {
+    Version: FileFormatVersion,
+    ChecksumType: ChecksumCRC32IEEE,
+}
+
+func EncodeFileHeader(header FileHeader) []byte {
+    buf := make([]byte, FileHeaderSize)
+    copy(buf, fileMagic)
+    buf[4] = header.Version
+    buf[5] = header.ChecksumType
+    binary.LittleEndian.PutUint16(buf[6:8], header.Flags)
+    binary.LittleEndian.PutUint32(buf[12:], crc32.ChecksumIEEE(buf[:12]))
+    return buf
+}
+
+// Refuses headers of newer versions and with features this version can not read
+func DecodeFileHeader(buf []byte) (FileHeader, error) {
+    if len(buf) < len(fileMagic) || !bytes.Equal(buf[:len(fileMagic)], fileMagic) {
+        return FileHeader{}, ErrFileHeaderMissing
+    }
+    if len(buf) < FileHeaderSize || binary.LittleEndian.Uint32(buf[12:]) != crc32.ChecksumIEEE(buf[:12]) {
+        return FileHeader{}, ErrFileHeaderCorrupted
+    }
+
+    header := FileHeader {
+        Version: buf[4],
+        ChecksumType: buf[5],
+        Flags: binary.LittleEndian.Uint16(buf[6:8]),
+    }
+    if header.Version == 0 || header.Version > FileFormatVersion {
+        return header, ErrFileVersionUnsupported
+    }
+    if !ValidChecksumType(header.ChecksumType) || header.Flags & ^supportedFileFlags != 0 {
+        return header, ErrFileFeatureUnsupported
+    }
+    return header, nil
+}
+
+func ReadFileHeader(ioManager fio.IOManager) (FileHeader, error) {
+    size, err := ioManager.Size()
+    if err != nil {
+        return FileHeader{}, err
+    }
+    if size < FileHeaderSize {
+        return DecodeFileHeader(nil)
+    }
+
+    buf := make([]byte, FileHeaderSize)
+    if _, err := ioManager.Read(buf, 0); err != nil {
+        return FileHeader{}, err
+    }
+    return DecodeFileHeader(buf)
+}
+
+// A missing file is written under a temporary name and linked into place,
+// so a reader listing the directory never sees it without its header
+func createFileWithHeader(fs fio.VFS, fileName string, header FileHeader) error {
+    info, err := fs.Stat(fileName)
+    if err == nil {
+        if info.Size() > 0 {
+            return nil
+        }
+        // Left empty by a crash right after it was created
+        return writeFileHeader(fs, fileName, header)
+    }
+    if !os.IsNotExist(err) {
+        return err
+    }
+
+    tmpFileName := fmt.Sprintf("%s.%d.%d.tmp", fileName, os.Getpid(), atomic.AddUint64(&tmpFileSeq, 1))
+    defer fs.Remove(tmpFileName)
+    if err := writeFileHeader(fs, tmpFileName, header); err != nil {
+        return err
+    }
+    if err := fs.Link(tmpFileName, fileName); err != nil && !os.IsExist(err) {
+        return err
+    }
+    // Removed before the directory is synced, a power loss leaves no temporary file behind
+    if err := fs.Remove(tmpFileName); err != nil {
+        return err
+    }
+    return fs.SyncDir(filepath.Dir(fileName))
+}
+
+var tmpFileSeq uint64
+
+func writeFileHeader(fs fio.VFS, fileName string, header FileHeader) error {
+    ioManager, err := fs.OpenFile(fileName, fio.StandardFileIO)
+    if err != nil {
+        return err
+    }
+    if _, err := ioManager.Write(EncodeFileHeader(header)); err != nil {
+        _ = ioManager.Close()
+        return err
+    }
+    if err := ioManager.Sync(); err != nil {
+        _ = ioManager.Close()
+        return err
+    }
+    return ioManager.Close()
+}
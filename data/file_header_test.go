@@ -0,0 +1,50 @@
+package data
+
+import (
+    "kvdb-go/fio"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestFileHeader(t *testing.T) {
+    header, err := DecodeFileHeader(EncodeFileHeader(DefaultFileHeader))
+    assert.Nil(t, err)
+    assert.Equal(t, DefaultFileHeader, header)
+
+    _, err = DecodeFileHeader([]byte("random bytes of a .data file"))
+    assert.Equal(t, ErrFileHeaderMissing, err)
+
+    buf := EncodeFileHeader(DefaultFileHeader)
+    buf[5]++
+    _, err = DecodeFileHeader(buf)
+    assert.Equal(t, ErrFileHeaderCorrupted, err)
+
+    _, err = DecodeFileHeader(EncodeFileHeader(FileHeader{Version: FileFormatVersion + 1}))
+    assert.Equal(t, ErrFileVersionUnsupported, err)
+    _, err = DecodeFileHeader(EncodeFileHeader(FileHeader{Version: FileFormatVersion, Flags: FileFlagTTL}))
+    assert.Equal(t, ErrFileFeatureUnsupported, err)
+}
+
+func TestOpenDataFileHeader(t *testing.T) {
+    dir, _ := os.MkdirTemp("", "kvdb-go-file-header-")
+    defer os.RemoveAll(dir)
+
+    dataFile, err := OpenDataFile(nil, dir, 0, fio.StandardFileIO)
+    assert.Nil(t, err)
+    assert.Equal(t, int64(FileHeaderSize), dataFile.WriteOffset)
+    assert.Equal(t, DefaultFileHeader, dataFile.Header)
+    err = dataFile.Close()
+    assert.Nil(t, err)
+
+    // No temporary files are left behind
+    entries, _ := os.ReadDir(dir)
+    assert.Equal(t, 1, len(entries))
+
+    err = os.WriteFile(filepath.Join(dir, "000000001.data"), []byte("not a data file"), 0644)
+    assert.Nil(t, err)
+    _, err = OpenDataFile(nil, dir, 1, fio.StandardFileIO)
+    assert.Equal(t, ErrFileHeaderMissing, err)
+}
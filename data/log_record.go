@@ -1,10 +1,6 @@
 package data
 
-import (
-    "encoding/binary"
-    "hash/crc32"
-    log "github.com/sirupsen/logrus"
-)
+import "encoding/binary"
 
 type LogRecordType = byte
 
@@ -12,6 +8,10 @@ const (
     LogRecordNormal LogRecordType = iota
     LogRecordDeleted LogRecordType = iota
     LogRecordTxFinished LogRecordType = iota
+    // The value holds an encoded LogRecordPos into a value log file
+    LogRecordValuePointer LogRecordType = iota
+    // Written by streaming, the crc only covers the header and the key, the value crc follows the value
+    LogRecordStreamed LogRecordType = iota
 )
 
 // crc type key_size value_size key value
@@ -44,6 +44,10 @@ type TransactionRecord struct {
 // crc | type | key_size | value_size | key | value
 //   4 |    1 |    max 5 |      max 5 | var |   var
 func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
+    return EncodeLogRecordWithChecksum(logRecord, ChecksumCRC32IEEE)
+}
+
+func EncodeLogRecordWithChecksum(logRecord *LogRecord, checksumType ChecksumType) ([]byte, int64) {
     header := make([]byte, maxLogRecordHeaderSize)
 
     header[4] = logRecord.Type
@@ -57,12 +61,33 @@ func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
     copy(encodedBytes[index:], logRecord.Key)
     copy(encodedBytes[index + len(logRecord.Key):], logRecord.Value)
 
-    crc := crc32.ChecksumIEEE(encodedBytes[4:])
+    crc := Checksum(checksumType, encodedBytes[4:])
     binary.LittleEndian.PutUint32(encodedBytes, crc)
 
     return encodedBytes, int64(size)
 }
 
+// Upper bound of the encoded size of a record, the header is counted at its largest
+func MaxLogRecordSize(keySize int, valueSize int) int64 {
+    return int64(maxLogRecordHeaderSize + keySize + valueSize)
+}
+
+// crc | type | key_size | value_size | key, the value and its crc are written by the caller
+func EncodeStreamedLogRecordHeader(key []byte, valueSize int64, checksumType ChecksumType) []byte {
+    header := make([]byte, maxLogRecordHeaderSize + len(key))
+
+    header[4] = LogRecordStreamed
+    var index = 5
+    index += binary.PutVarint(header[index:], int64(len(key)))
+    index += binary.PutVarint(header[index:], valueSize)
+    index += copy(header[index:], key)
+
+    crc := Checksum(checksumType, header[4:index])
+    binary.LittleEndian.PutUint32(header, crc)
+
+    return header[:index]
+}
+
 func EncodeLogRecordPos(pos *LogRecordPos) []byte {
     buf := make([]byte, binary.MaxVarintLen32 + binary.MaxVarintLen64)
     var index = 0
@@ -88,7 +113,6 @@ func DecodeLogRecordPos(buf []byte) *LogRecordPos {
 
 func DecodeLogRecordHeader(buf []byte) (*LogRecordHeader, int64) {
     if len(buf) <= 4 {
-        log.Warn("Data file might be corrupted, header size is less than 4")
         return nil, 0
     }
 
@@ -97,12 +121,19 @@ func DecodeLogRecordHeader(buf []byte) (*LogRecordHeader, int64) {
         recordType: buf[4],
     }
 
+    // A size cut short is a header torn at the end of the file
     var index = 5
     keySize, n := binary.Varint(buf[index:])
+    if n <= 0 {
+        return nil, 0
+    }
     header.keySize = uint32(keySize)
     index += n
 
     valueSize, n := binary.Varint(buf[index:])
+    if n <= 0 {
+        return nil, 0
+    }
     header.valueSize = uint32(valueSize)
     index += n
 
@@ -110,13 +141,13 @@ func DecodeLogRecordHeader(buf []byte) (*LogRecordHeader, int64) {
 }
 
 func GetLogRecordCRC(logRecord *LogRecord, header []byte) uint32 {
+    return getLogRecordChecksum(ChecksumCRC32IEEE, logRecord, header)
+}
+
+func getLogRecordChecksum(checksumType ChecksumType, logRecord *LogRecord, header []byte) uint32 {
     if logRecord == nil {
         return 0
     }
 
-    crc := crc32.ChecksumIEEE(header[:])
-    crc = crc32.Update(crc, crc32.IEEETable, logRecord.Key)
-    crc = crc32.Update(crc, crc32.IEEETable, logRecord.Value)
-
-    return crc
+    return Checksum(checksumType, header, logRecord.Key, logRecord.Value)
 }
@@ -118,3 +118,14 @@ func TestGetLogRecordCRC(t *testing.T) {
     crc = GetLogRecordCRC(logRecordDeleted, encodedBytes[crc32.Size : crc32.Size + 1 + 1 + 1])
     assert.Equal(t, crc, header.crc)
 }
+
+func TestMaxLogRecordSize(t *testing.T) {
+    logRecord := &LogRecord{
+        []byte("key"),
+        []byte("value"),
+        LogRecordNormal,
+    }
+    _, size := EncodeLogRecord(logRecord)
+    assert.True(t, size <= MaxLogRecordSize(3, 5))
+    assert.Equal(t, int64(maxLogRecordHeaderSize + 3 + 5), MaxLogRecordSize(3, 5))
+}
@@ -1,20 +1,27 @@
 package kvdb_go
 
 import (
+    "context"
+    "encoding/binary"
+    "errors"
     "fmt"
     "io"
+    "math"
+    "kvdb-go/bloom"
+    "kvdb-go/cache"
     "kvdb-go/data"
     "kvdb-go/fio"
     "kvdb-go/index"
-    "kvdb-go/utils"
+    "kvdb-go/logger"
+    "kvdb-go/metrics"
     "os"
     "path/filepath"
     "sort"
     "strconv"
     "strings"
     "sync"
-
-    "github.com/gofrs/flock"
+    "syscall"
+    "time"
 )
 
 type DB struct {
@@ -28,135 +35,284 @@ type DB struct {
     isMerging bool
     seqNumFileExists bool
     isFirstLaunch bool
-    fileLock *flock.Flock
+    fileLock fio.FileLock
     bytesWrite uint
     reclaimableSpace int64
+    valueCache *cache.LRUCache
+    bloomFilter *bloom.Filter
+    activeValueLog *data.DataFile
+    olderValueLogs map[uint32]*data.DataFile
+    nextValueLogFileId uint32
+    watchHub *watchHub
+    loader *recordLoader
+    unsyncedFiles []*data.DataFile // Sealed after a failed write before they could be synced
+    activeFileTorn bool // A failed write tore the active file and it could not be sealed yet
+    diskUsage int64 // Estimated by estimatedDiskSize
+    diskFree int64 // Free bytes of the file system, sampled with diskUsage when MinFreeDiskBytes is set
+    diskUsageAt time.Time
+    closed bool // Set by Close, a write that released the lock checks it when it takes the lock again
 }
 
 const (
     seqNumKey = "seq-no"
+    watchEpochKey = "watch-epoch"
     fileLockName = "flock"
+    diskUsageRefreshInterval = time.Second
 )
 
 type Stat struct {
     KeyNum uint
     DataFileNum uint
+    ValueLogFileNum uint
     ReclaimableSpace int64
     DiskSize int64
+    CacheHits uint64
+    CacheMisses uint64
+}
+
+// A read-only B+ tree index can only be opened while no writer holds the index file
+func newIndexer(options Options) (index.Indexer, error) {
+    if options.ReadOnly && options.IndexType == BPTreeIndex {
+        tree, err := index.NewReadOnlyBPlusTree(options.DirPath)
+        if err == index.ErrIndexFileInUse {
+            return nil, ErrDatabaseIsInUse
+        }
+        return tree, err
+    }
+    return index.NewIndexer(options.IndexType, options.DirPath, options.SyncWrites), nil
 }
 
 func Open(options Options) (*DB, error) {
+    return open(options, nil)
+}
+
+// A replica is read-only but writes the files it pulls, it passes the lock it holds on the directory
+func open(options Options, replicaLock fio.FileLock) (_ *DB, err error) {
     if err := checkOptions(options); err != nil {
         return nil, err
     }
+    options.VFS = fio.OrOSFS(options.VFS)
+    options.Metrics = metrics.OrNop(options.Metrics)
+    options.Logger = logger.OrNop(options.Logger)
+    if options.WatchBufferSize == 0 {
+        options.WatchBufferSize = DefaultOptions.WatchBufferSize
+    }
+    if options.EventListener == nil {
+        options.EventListener = NopEventListener{}
+    }
 
-    isFirstLaunch := false
-    if _, err := os.Stat(options.DirPath); os.IsNotExist(err) {
-        if err := os.MkdirAll(options.DirPath, 0755); err != nil {
+    var fileLock fio.FileLock
+    isFirstLaunch := options.InMemory
+    if !options.InMemory {
+        isFirstLaunch, fileLock, err = prepareDataDirectory(options)
+        if err != nil {
             return nil, err
         }
-        isFirstLaunch = true
-    }
-
-    fileLock := flock.New(filepath.Join(options.DirPath, fileLockName))
-    hold, err := fileLock.TryLock()
-    if err != nil {
-        return nil, err
-    }
-    if !hold {
-        return nil, ErrDatabaseIsInUse
     }
+    // A failed open leaves the directory unlocked
+    defer func() {
+        if err != nil && fileLock != nil {
+            _ = fileLock.Unlock()
+        }
+    }()
 
-    entries, err := os.ReadDir(options.DirPath)
+    indexer, err := newIndexer(options)
     if err != nil {
         return nil, err
     }
-    if len(entries) == 0 {
-        isFirstLaunch = true
-    }
+    defer func() {
+        if err != nil {
+            _ = indexer.Close()
+        }
+    }()
 
     db := &DB {
         options: options,
         mutex: new(sync.RWMutex),
         olderFiles: make(map[uint32]*data.DataFile),
-        index: index.NewIndexer(options.IndexType, options.DirPath, options.SyncWrites),
+        olderValueLogs: make(map[uint32]*data.DataFile),
+        index: indexer,
         isFirstLaunch: isFirstLaunch,
         fileLock: fileLock,
     }
+    if replicaLock != nil {
+        db.fileLock = replicaLock
+    }
 
-    if err := db.loadMergeFiles(); err != nil {
-        return nil, err
+    if options.ValueCacheBytes > 0 {
+        db.valueCache = cache.NewLRUCache(options.ValueCacheBytes)
+    }
+
+    // Watch sequence numbers start from the epoch of the open, so an earlier open's are smaller
+    var watchEpoch uint32
+    if !options.InMemory {
+        if watchEpoch, err = db.nextWatchEpoch(); err != nil {
+            return nil, err
+        }
+    }
+    db.watchHub = newWatchHub(options.WatchBufferSize, options.WatchHistorySize, watchEpoch)
+
+    // Nothing was persisted for an in-memory database
+    if !options.InMemory {
+        if err := db.loadFiles(); err != nil {
+            return nil, err
+        }
+    }
+
+    if options.BloomFilter {
+        if err := db.loadBloomFilter(); err != nil {
+            return nil, err
+        }
+    } else if !options.InMemory && !options.ReadOnly {
+        if err := db.removeBloomFilterFile(); err != nil {
+            return nil, err
+        }
+    }
+
+    return db, nil
+}
+
+// Locks the directory, creating it first if it is missing. Readers take no lock,
+// any number of them can follow one writer.
+func prepareDataDirectory(options Options) (isFirstLaunch bool, fileLock fio.FileLock, err error) {
+    fs := options.VFS
+    if _, err := fs.Stat(options.DirPath); os.IsNotExist(err) {
+        if options.ReadOnly {
+            return false, nil, ErrDataDirectoryNotFound
+        }
+        if err := fio.MkdirAllDurable(fs, options.DirPath); err != nil {
+            return false, nil, err
+        }
+        isFirstLaunch = true
+    }
+
+    if !options.ReadOnly {
+        lock, held, err := fs.TryLock(filepath.Join(options.DirPath, fileLockName))
+        if err != nil {
+            return false, nil, err
+        }
+        if !held {
+            return false, nil, ErrDatabaseIsInUse
+        }
+        fileLock = lock
+    }
+
+    entries, err := fs.ReadDir(options.DirPath)
+    if err != nil {
+        if fileLock != nil {
+            _ = fileLock.Unlock()
+        }
+        return false, nil, err
+    }
+    if len(entries) == 0 {
+        isFirstLaunch = true
+    }
+    return isFirstLaunch, fileLock, nil
+}
+
+// Loads the files of the directory and builds the index from them
+func (db *DB) loadFiles() error {
+    if !db.options.ReadOnly {
+        if err := db.loadMergeFiles(); err != nil {
+            return err
+        }
     }
 
     if err := db.loadDataFiles(); err != nil {
-        return nil, err
+        return err
+    }
+
+    if err := db.loadValueLogFiles(); err != nil {
+        return err
     }
 
-    if options.IndexType != BPTreeIndex {
+    if db.options.IndexType != BPTreeIndex {
         if err := db.loadIndexFromHintFile(); err != nil {
-            return nil, err
+            return err
         }
     
         if err := db.loadIndexFromDataFiles(); err != nil {
-            return nil, err
+            return err
         }
 
-        if db.options.MMapAtStart {
+        if db.options.MMapAtStart && !db.readOnlyFiles() {
             if err := db.resetIOType(); err != nil {
-                return nil, err
+                return err
+            }
+        }
+
+        // Appends go to the end of the file, behind a record a crash left torn
+        if !db.options.ReadOnly && db.activeFile != nil {
+            size, err := db.activeFile.IOManager.Size()
+            if err != nil {
+                return err
+            }
+            if db.activeFile.WriteOffset < size {
+                if err := db.rotateActiveFile(); err != nil {
+                    return err
+                }
             }
         }
     }
 
-    if options.IndexType == BPTreeIndex {
+    if db.options.IndexType == BPTreeIndex {
         if err := db.loadSeqNum(); err != nil {
-            return nil, err
+            return err
         }
 
         if db.activeFile != nil {
             size, err := db.activeFile.IOManager.Size()
             if err != nil {
-                return nil, err
+                return err
             }
             db.activeFile.WriteOffset = size
         }
+
+        if !db.options.ReadOnly {
+            if err := db.finishIngest(); err != nil {
+                return err
+            }
+        }
     }
 
-    return db, nil
+    return nil
 }
 
 func (db *DB) Close() error {
     defer func() {
+        if db.fileLock == nil {
+            return
+        }
         if err := db.fileLock.Unlock(); err != nil {
             panic(fmt.Sprintf("failed to unlock file lock: %v", err))
         }
     }()
 
-    if db.activeFile == nil {
-        return nil
-    }
+    db.watchHub.close()
 
     db.mutex.Lock()
     defer db.mutex.Unlock()
 
-    if err := db.index.Close(); err != nil {
-        return err
+    db.closed = true
+    if db.activeFile == nil {
+        return nil
     }
 
-    seqNoFile, err := data.OpenSeqNumFile(db.options.DirPath)
-    if err != nil {
-        return err
-    }
-    seqNumRecord := &data.LogRecord {
-        Key: []byte(seqNumKey),
-        Value: []byte(strconv.FormatUint(db.seqNum, 10)),
+    persisted := !db.options.ReadOnly && !db.options.InMemory
+    if db.bloomFilter != nil && persisted {
+        if err := db.saveBloomFilter(); err != nil {
+            return err
+        }
     }
-    encodedSeqNoRecord, _ := data.EncodeLogRecord(seqNumRecord)
-    if err := seqNoFile.Write(encodedSeqNoRecord); err != nil {
+
+    if err := db.index.Close(); err != nil {
         return err
     }
-    if err := seqNoFile.Sync(); err != nil {
-        return err
+
+    if persisted {
+        if err := db.saveSeqNum(); err != nil {
+            return err
+        }
     }
 
     if err := db.activeFile.Close(); err != nil {
@@ -169,6 +325,18 @@ func (db *DB) Close() error {
         }
     }
 
+    if db.activeValueLog != nil {
+        if err := db.activeValueLog.Close(); err != nil {
+            return err
+        }
+    }
+
+    for _, file := range db.olderValueLogs {
+        if err := file.Close(); err != nil {
+            return err
+        }
+    }
+
     return nil
 }
 
@@ -180,10 +348,111 @@ func (db *DB) Sync() error {
     db.mutex.Lock()
     defer db.mutex.Unlock()
 
-    return db.activeFile.Sync()
+    return db.syncFiles()
 }
 
-func (db *DB) Stat() *Stat {
+// Syncs every file an acknowledged record may still be unsynced in, the caller holds db.mutex
+func (db *DB) syncFiles() error {
+    for len(db.unsyncedFiles) > 0 {
+        if err := db.syncFile(db.unsyncedFiles[0]); err != nil {
+            return err
+        }
+        db.unsyncedFiles = db.unsyncedFiles[1:]
+    }
+    if err := db.syncValueLog(); err != nil {
+        return err
+    }
+    return db.syncFile(db.activeFile)
+}
+
+// Picks up the records a writer appended since a read-only database was opened or last refreshed.
+// Once the writer reopens after a merge the files are rewritten and the database has to be reopened.
+func (db *DB) Refresh() error {
+    if db.options.IndexType == BPTreeIndex {
+        return ErrRefreshUnsupported
+    }
+
+    db.mutex.Lock()
+    defer db.mutex.Unlock()
+
+    if !db.options.ReadOnly {
+        return nil
+    }
+
+    // Value logs first, the new records may point into them
+    valueLogFileIds, err := listFileIds(db.options.VFS, db.options.DirPath, data.ValueLogFileNameSuffix)
+    if err != nil {
+        return err
+    }
+    for _, fileId := range valueLogFileIds {
+        if db.getValueLogFile(fileId) != nil {
+            continue
+        }
+        valueLogFile, err := db.openValueLogFile(fileId)
+        if err != nil {
+            return err
+        }
+        db.olderValueLogs[fileId] = valueLogFile
+    }
+
+    fileIds, err := listFileIds(db.options.VFS, db.options.DirPath, data.DataFileNameSuffix)
+    if err != nil {
+        return err
+    }
+    existing := make(map[uint32]bool)
+    for _, fileId := range fileIds {
+        existing[fileId] = true
+    }
+    for fileId := range db.olderFiles {
+        if !existing[fileId] {
+            return ErrDataFilesRewritten
+        }
+    }
+    if db.activeFile != nil && !existing[db.activeFile.FileId] {
+        return ErrDataFilesRewritten
+    }
+
+    if db.loader == nil {
+        db.loader = db.newRecordLoader()
+    }
+
+    if db.activeFile != nil {
+        offset, err := db.loader.loadFile(db.activeFile, db.activeFile.WriteOffset)
+        if err != nil {
+            return err
+        }
+        db.activeFile.WriteOffset = offset
+    }
+
+    for _, fileId := range fileIds {
+        if db.activeFile != nil && fileId <= db.activeFile.FileId {
+            continue
+        }
+
+        dataFile, err := db.withLogger(data.OpenDataFile(db.options.VFS, db.options.DirPath, fileId, db.fileIOType()))
+        if err != nil {
+            return err
+        }
+        if db.activeFile != nil {
+            db.olderFiles[db.activeFile.FileId] = db.activeFile
+        }
+        db.activeFile = dataFile
+
+        offset, err := db.loader.loadFile(dataFile, data.FileHeaderSize)
+        if err != nil {
+            return err
+        }
+        dataFile.WriteOffset = offset
+    }
+
+    if db.loader.seqNum > db.seqNum {
+        db.seqNum = db.loader.seqNum
+    }
+
+    return nil
+}
+
+func (db *DB) Stat() (*Stat, error) {
     db.mutex.RLock()
     defer db.mutex.RUnlock()
 
@@ -192,29 +461,70 @@ func (db *DB) Stat() *Stat {
         dataFileNum++
     }
 
-    dirSize, err := utils.DirSize(db.options.DirPath)
+    var valueLogFileNum = uint(len(db.olderValueLogs))
+    if db.activeValueLog != nil {
+        valueLogFileNum++
+    }
+
+    dirSize, err := db.diskSize()
     if err != nil {
-        panic(fmt.Sprintf("failed to get directory size: %v", err))
+        return nil, err
     }
 
-    return &Stat {
+    stat := &Stat {
         KeyNum: uint(db.index.Size()),
         DataFileNum: dataFileNum,
+        ValueLogFileNum: valueLogFileNum,
         ReclaimableSpace: db.reclaimableSpace,
         DiskSize: dirSize,
     }
+    if db.valueCache != nil {
+        stat.CacheHits = db.valueCache.Hits()
+        stat.CacheMisses = db.valueCache.Misses()
+    }
+
+    return stat, nil
 }
 
-func (db *DB) Backup(dir string) error {
-    db.mutex.RLock()
-    defer db.mutex.RUnlock()
+// Sets the gauges of the database, a metrics.Registry collector usually calls it
+func (db *DB) CollectMetrics(m metrics.Metrics) error {
+    stat, err := db.Stat()
+    if err != nil {
+        return err
+    }
+    m.SetGauge(metrics.Keys, float64(stat.KeyNum))
+    m.SetGauge(metrics.DataFiles, float64(stat.DataFileNum))
+    m.SetGauge(metrics.ValueLogFiles, float64(stat.ValueLogFileNum))
+    m.SetGauge(metrics.DiskBytes, float64(stat.DiskSize))
+    m.SetGauge(metrics.ReclaimableBytes, float64(stat.ReclaimableSpace))
+    return nil
+}
 
-    return utils.CopyDir(db.options.DirPath, dir, []string{fileLockName})
+func (db *DB) observeSince(name string, start time.Time) {
+    db.options.Metrics.ObserveHistogram(name, time.Since(start).Seconds())
+}
+
+// Syncs a data or value log file and measures it
+func (db *DB) syncFile(file *data.DataFile) error {
+    start := time.Now()
+    err := file.Sync()
+    db.options.Metrics.AddCounter(metrics.Fsyncs, 1)
+    db.observeSince(metrics.FsyncDuration, start)
+    return err
 }
 
 func (db *DB) Put(key []byte, value []byte) error {
-    if len(key) == 0 {
-        return ErrKeyIsEmpty
+    return db.PutCtx(context.Background(), key, value)
+}
+
+// Gives up with ctx.Err() while waiting for the lock, a write that has started is not interrupted
+func (db *DB) PutCtx(ctx context.Context, key []byte, value []byte) error {
+    defer db.observeSince(metrics.PutDuration, time.Now())
+    if err := db.ValidateKeyValue(key, value); err != nil {
+        return err
+    }
+    if err := ctx.Err(); err != nil {
+        return err
     }
 
     logRecord := &data.LogRecord {
@@ -223,17 +533,141 @@ func (db *DB) Put(key []byte, value []byte) error {
         Type: data.LogRecordNormal,
     }
 
-    if pos, err := db.appendLogRecordWithLock(logRecord); err != nil {
+    // The index is updated under the lock as well, so that it and the watchers follow the log order
+    db.mutex.Lock()
+    defer db.mutex.Unlock()
+
+    if db.options.ReadOnly {
+        return ErrReadOnly
+    }
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    if err := db.waitWriteStall(ctx); err != nil {
+        return err
+    }
+    if err := db.checkDiskSpace(data.MaxLogRecordSize(len(logRecord.Key), len(value))); err != nil {
+        return err
+    }
+
+    if pos, err := db.appendLogRecord(logRecord); err != nil {
         return err
     } else {
+        db.bloomAdd(key)
         if oldPos := db.index.Put(key, pos); oldPos != nil {
             db.reclaimableSpace += int64(oldPos.Size)
+            db.invalidateCache(oldPos)
         }
+        db.watchHub.publish(EventPut, key, value)
         return nil
     }
 }
 
+// Slows down or rejects a write while reclaimable space or disk usage is over its threshold.
+// A slowed down write waits WriteStallDelay at a time until the threshold is cleared, it fails with ErrWriteStalled
+// once the stop threshold is reached meanwhile. The caller holds db.mutex, it is released while the write waits.
+func (db *DB) waitWriteStall(ctx context.Context) error {
+    var slowedDown bool
+    for {
+        reason, stop, err := db.writeStallReason()
+        if err != nil || reason == "" {
+            return err
+        }
+
+        info := WriteStallInfo{Reason: reason, Rejected: stop}
+        if !stop {
+            info.Delay = db.options.WriteStallDelay
+        }
+        // A slowdown is reported once however often the write waits
+        if stop || !slowedDown {
+            db.options.Metrics.AddCounter(metrics.WriteStalls, 1)
+            db.options.EventListener.OnWriteStall(info)
+        }
+        if stop {
+            return ErrWriteStalled
+        }
+        slowedDown = true
+
+        db.mutex.Unlock()
+        err = sleepCtx(ctx, info.Delay)
+        db.mutex.Lock()
+        if db.closed {
+            return ErrDatabaseClosed
+        }
+        if err != nil {
+            return err
+        }
+    }
+}
+
+// The caller holds db.mutex
+func (db *DB) writeStallReason() (reason string, stop bool, err error) {
+    var diskSize int64
+    if db.options.SlowdownDiskBytes > 0 || db.options.StopDiskBytes > 0 {
+        if diskSize, err = db.estimatedDiskSize(); err != nil {
+            return "", false, err
+        }
+    }
+
+    reclaimable := db.reclaimableSpace
+    switch {
+    case db.options.StopReclaimableBytes > 0 && reclaimable >= db.options.StopReclaimableBytes:
+        return WriteStallReclaimableSpace, true, nil
+    case db.options.StopDiskBytes > 0 && diskSize >= db.options.StopDiskBytes:
+        return WriteStallDiskUsage, true, nil
+    case db.options.SlowdownReclaimableBytes > 0 && reclaimable >= db.options.SlowdownReclaimableBytes:
+        return WriteStallReclaimableSpace, false, nil
+    case db.options.SlowdownDiskBytes > 0 && diskSize >= db.options.SlowdownDiskBytes:
+        return WriteStallDiskUsage, false, nil
+    }
+    return "", false, nil
+}
+
+// Checks the key and value against the configured limits and the data file size
+func (db *DB) ValidateKeyValue(key []byte, value []byte) error {
+    return validateKeyValue(db.options, key, value)
+}
+
+func validateKeyValue(options Options, key []byte, value []byte) error {
+    if len(key) == 0 {
+        return ErrKeyIsEmpty
+    }
+
+    if uint64(len(key)) > math.MaxUint32 || (options.MaxKeySize > 0 && len(key) > options.MaxKeySize) {
+        return ErrKeyTooLarge
+    }
+    if uint64(len(value)) > math.MaxUint32 || (options.MaxValueSize > 0 && len(value) > options.MaxValueSize) {
+        return ErrValueTooLarge
+    }
+
+    // The key is stored with its sequence number prefix, records share the data file with its header
+    keySize := binary.MaxVarintLen64 + len(key)
+    maxRecordSize := options.DataFileSize - data.FileHeaderSize
+    if data.MaxLogRecordSize(keySize, 0) > maxRecordSize {
+        return ErrKeyTooLarge
+    }
+
+    // A separated value leaves only a pointer in the data file, the value log takes any size
+    valueSize := len(value)
+    if options.ValueLogThreshold > 0 && valueSize > options.ValueLogThreshold {
+        valueSize = binary.MaxVarintLen32 + 2 * binary.MaxVarintLen64
+    }
+    if data.MaxLogRecordSize(keySize, valueSize) > maxRecordSize {
+        return ErrValueTooLarge
+    }
+
+    return nil
+}
+
 func (db *DB) Get(key []byte) ([]byte, error) {
+    return db.GetCtx(context.Background(), key)
+}
+
+func (db *DB) GetCtx(ctx context.Context, key []byte) ([]byte, error) {
+    defer db.observeSince(metrics.GetDuration, time.Now())
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
     db.mutex.RLock()
     defer db.mutex.RUnlock()
 
@@ -241,6 +675,10 @@ func (db *DB) Get(key []byte) ([]byte, error) {
         return nil, ErrKeyIsEmpty
     }
 
+    if !db.bloomMayContain(key) {
+        return nil, ErrKeyNotFound
+    }
+
     logRecordPos := db.index.Get(key)
     if logRecordPos == nil {
         return nil, ErrKeyNotFound
@@ -250,17 +688,20 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 }
 
 func (db *DB) GetValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error) {
-    var dataFile *data.DataFile
-    if db.activeFile.FileId == logRecordPos.FileId {
-        dataFile = db.activeFile
-    } else {
-        dataFile = db.olderFiles[logRecordPos.FileId]
-    }
-
+    dataFile := db.getDataFile(logRecordPos.FileId)
     if dataFile == nil {
         return nil, ErrDataFileNotFound
     }
 
+    cacheKey := cache.Key{FileId: logRecordPos.FileId, Offset: logRecordPos.Offset}
+    if db.valueCache != nil {
+        if value, ok := db.valueCache.Get(cacheKey); ok {
+            db.options.Metrics.AddCounter(metrics.CacheHits, 1)
+            return value, nil
+        }
+        db.options.Metrics.AddCounter(metrics.CacheMisses, 1)
+    }
+
     logRecord, _, err := dataFile.ReadLogRecord(logRecordPos.Offset)
     if err != nil {
         return nil, nil
@@ -270,24 +711,60 @@ func (db *DB) GetValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error
         return nil, ErrKeyNotFound
     }
 
+    if logRecord.Type == data.LogRecordValuePointer {
+        value, err := db.readValueLog(logRecord.Value)
+        if err != nil {
+            return nil, err
+        }
+        logRecord.Value = value
+    }
+
+    if db.valueCache != nil {
+        db.valueCache.Put(cacheKey, logRecord.Value)
+    }
+
     return logRecord.Value, nil
 }
 
+func (db *DB) getDataFile(fileId uint32) *data.DataFile {
+    if db.activeFile != nil && db.activeFile.FileId == fileId {
+        return db.activeFile
+    }
+    return db.olderFiles[fileId]
+}
+
 func (db *DB) ListKeys() [][]byte {
-    iterator := db.NewIterator(DefaultIteratorOptions)
+    keys, _ := db.ListKeysCtx(context.Background())
+    return keys
+}
+
+func (db *DB) ListKeysCtx(ctx context.Context) ([][]byte, error) {
+    iterator := db.NewIteratorCtx(ctx, DefaultIteratorOptions)
+    defer iterator.Close()
     keys := make([][]byte, db.index.Size())
     var idx int
     for iterator.Rewind(); iterator.Valid(); iterator.Next() {
         keys[idx] = iterator.Key()
         idx++
     }
-    return keys
+    if err := iterator.Err(); err != nil {
+        return nil, err
+    }
+    return keys, nil
 }
 
 func (db *DB) Delete(key []byte) error {
+    defer db.observeSince(metrics.DeleteDuration, time.Now())
     if len(key) == 0 {
         return ErrKeyIsEmpty
     }
+    if db.isReadOnly() {
+        return ErrReadOnly
+    }
+
+    if !db.bloomMayContain(key) {
+        return nil
+    }
 
     if pos := db.index.Get(key); pos == nil {
         return nil
@@ -298,7 +775,14 @@ func (db *DB) Delete(key []byte) error {
         Type: data.LogRecordDeleted,
     }
 
-    pos, err := db.appendLogRecordWithLock(logRecord)
+    db.mutex.Lock()
+    defer db.mutex.Unlock()
+
+    if db.options.ReadOnly {
+        return ErrReadOnly
+    }
+
+    pos, err := db.appendLogRecord(logRecord)
     if err != nil {
         return err
     }
@@ -310,17 +794,28 @@ func (db *DB) Delete(key []byte) error {
     }
     if oldPos != nil {
         db.reclaimableSpace += int64(oldPos.Size)
+        db.invalidateCache(oldPos)
     }
+    db.watchHub.publish(EventDelete, key, nil)
 
     return nil
 }
 
 func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
+    return db.FoldCtx(context.Background(), fn)
+}
+
+// Stops with ctx.Err() between records
+func (db *DB) FoldCtx(ctx context.Context, fn func(key []byte, value []byte) bool) error {
     db.mutex.RLock()
     defer db.mutex.RUnlock()
 
     iterator := db.index.Iterator(false)
+    defer iterator.Close()
     for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
         value, err := db.GetValueByPosition(iterator.Value())
         if err != nil {
             return err
@@ -334,47 +829,66 @@ func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
     return nil
 }
 
-// This one can be used for single processing
-func (db *DB) appendLogRecordWithLock(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
-    db.mutex.Lock()
-    defer db.mutex.Unlock()
-
-    return db.appendLogRecord(logRecord)
+func (db *DB) invalidateCache(pos *data.LogRecordPos) {
+    if db.valueCache != nil {
+        db.valueCache.Remove(cache.Key{FileId: pos.FileId, Offset: pos.Offset})
+    }
 }
 
-// This one can be used for batch processing
+// The caller holds db.mutex
 func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
     if db.activeFile == nil {
         if err := db.setActiveDataFile(); err != nil {
             return nil, err
         }
     }
+    if db.activeFileTorn {
+        if err := db.sealTornActiveFile(); err != nil {
+            return nil, err
+        }
+    }
 
-    encodedRecord, size := data.EncodeLogRecord(logRecord)
-    if db.activeFile.WriteOffset + size > db.options.DataFileSize {
-        if err := db.activeFile.Sync(); err != nil {
+    if db.shouldSeparateValue(logRecord) {
+        pointerRecord, err := db.separateValue(logRecord)
+        if err != nil {
             return nil, err
         }
+        logRecord = pointerRecord
+    }
 
-        db.olderFiles[db.activeFile.FileId] = db.activeFile
+    encodedRecord, size := db.activeFile.EncodeLogRecord(logRecord)
+    if size > db.options.DataFileSize - data.FileHeaderSize {
+        return nil, ErrLogRecordTooLarge
+    }
 
-        if err := db.setActiveDataFile(); err != nil {
+    if db.activeFile.WriteOffset + size > db.options.DataFileSize {
+        if err := db.rotateActiveFile(); err != nil {
             return nil, err
         }
+        // The file it was encoded for may have been written with another checksum type
+        encodedRecord, _ = db.activeFile.EncodeLogRecord(logRecord)
     }
 
     writeOffset := db.activeFile.WriteOffset
     if err := db.activeFile.Write(encodedRecord); err != nil {
-        return nil, err
+        // The part written is dropped, a file that can not be truncated is sealed instead
+        if db.activeFile.WriteOffset > writeOffset && db.activeFile.Truncate(writeOffset) != nil {
+            if sealErr := db.sealTornActiveFile(); sealErr != nil {
+                db.options.Logger.Error("Failed to seal the active file after a failed write", "err", sealErr)
+            }
+        }
+        return nil, diskFullOr(err)
     }
 
     db.bytesWrite += uint(size)
+    db.addDiskUsage(size)
+    db.options.Metrics.AddCounter(metrics.BytesWritten, float64(size))
     var needSync = db.options.SyncWrites
     if !needSync && db.options.BytesPerSync > 0 && db.bytesWrite >= db.options.BytesPerSync {
         needSync = true
     }
     if needSync {
-        if err := db.activeFile.Sync(); err != nil {
+        if err := db.syncFiles(); err != nil {
             return nil, err
         }
         if db.bytesWrite > 0 {
@@ -391,6 +905,42 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
     return pos, nil
 }
 
+// Syncs and seals the active file and opens the next one
+func (db *DB) rotateActiveFile() error {
+    if err := db.syncFile(db.activeFile); err != nil {
+        return err
+    }
+    return db.sealActiveFile()
+}
+
+func (db *DB) sealActiveFile() error {
+    sealedFile := db.activeFile
+    if err := db.setActiveDataFile(); err != nil {
+        return err
+    }
+    db.olderFiles[sealedFile.FileId] = sealedFile
+    db.options.Metrics.AddCounter(metrics.FileRotations, 1)
+    db.options.EventListener.OnFileRotated(FileRotatedInfo{SealedFileId: sealedFile.FileId, ActiveFileId: db.activeFile.FileId})
+    return nil
+}
+
+// Records behind a torn one are never loaded, so nothing may be appended after a failed write.
+// The file is sealed even if it can not be synced, the next sync tries again.
+// Until it is sealed every append tries to seal it first.
+func (db *DB) sealTornActiveFile() error {
+    tornFile := db.activeFile
+    syncErr := db.syncFile(tornFile)
+    if err := db.sealActiveFile(); err != nil {
+        db.activeFileTorn = true
+        return err
+    }
+    db.activeFileTorn = false
+    if syncErr != nil {
+        db.unsyncedFiles = append(db.unsyncedFiles, tornFile)
+    }
+    return nil
+}
+
 // Set up new data file for active file
 func (db *DB) setActiveDataFile() error {
     var initialFileId uint32 = 0
@@ -399,7 +949,7 @@ func (db *DB) setActiveDataFile() error {
         initialFileId = db.activeFile.FileId + 1
     }
 
-    dataFile, err := data.OpenDataFile(db.options.DirPath, initialFileId, fio.StandardFileIO)
+    dataFile, err := db.createDataFile(initialFileId)
     if err != nil {
         return err
     }
@@ -408,19 +958,139 @@ func (db *DB) setActiveDataFile() error {
     return nil
 }
 
-func (db *DB) loadDataFiles() error {
-    dirEntries, err := os.ReadDir(db.options.DirPath)
+func (db *DB) createDataFile(fileId uint32) (*data.DataFile, error) {
+    if db.options.InMemory {
+        return db.withLogger(data.NewInMemoryFile(fileId, newFileHeader(db.options)))
+    }
+    return db.withLogger(data.OpenDataFileWithHeader(db.options.VFS, db.options.DirPath, fileId, fio.StandardFileIO, newFileHeader(db.options)))
+}
+
+func (db *DB) createValueLogFile(fileId uint32) (*data.DataFile, error) {
+    if db.options.InMemory {
+        return db.withLogger(data.NewInMemoryFile(fileId, newFileHeader(db.options)))
+    }
+    return db.withLogger(data.OpenValueLogFileWithHeader(db.options.VFS, db.options.DirPath, fileId, newFileHeader(db.options)))
+}
+
+// Hands the logger of the database to a file it opened
+func (db *DB) withLogger(file *data.DataFile, err error) (*data.DataFile, error) {
+    if err != nil {
+        return nil, err
+    }
+    file.Logger = db.options.Logger
+    return file, nil
+}
+
+// A closed in-memory file is already gone
+func (db *DB) removeValueLogFile(fileId uint32) error {
+    if db.options.InMemory {
+        return nil
+    }
+    return fio.RemoveDurable(db.options.VFS, data.GetValueLogFileName(db.options.DirPath, fileId))
+}
+
+// Backups link and copy files by name only on the OS filesystem
+func (db *DB) onOSFS() bool {
+    _, ok := db.options.VFS.(fio.OSFS)
+    return ok && !db.options.InMemory
+}
+
+// Walks the directory at most once a second, the bytes written in between are added up. The caller holds db.mutex.
+func (db *DB) estimatedDiskSize() (int64, error) {
+    if db.diskUsageAt.IsZero() || time.Since(db.diskUsageAt) >= diskUsageRefreshInterval {
+        size, err := db.diskSize()
+        if err != nil {
+            return 0, err
+        }
+        if db.options.MinFreeDiskBytes > 0 && !db.options.InMemory {
+            free, err := db.options.VFS.AvailableSpace(db.options.DirPath)
+            if err != nil {
+                return 0, err
+            }
+            db.diskFree = int64(free)
+        }
+        db.diskUsage, db.diskUsageAt = size, time.Now()
+    }
+    return db.diskUsage, nil
+}
+
+// The caller holds db.mutex
+func (db *DB) addDiskUsage(size int64) {
+    db.diskUsage += size
+    db.diskFree -= size
+}
+
+// Fails with ErrDiskFull when size more bytes would go over MaxDiskBytes or below MinFreeDiskBytes.
+// Only new keys and values are checked, deletes and the rewrites of merges still get through. The caller holds db.mutex.
+func (db *DB) checkDiskSpace(size int64) error {
+    if db.options.MaxDiskBytes == 0 && db.options.MinFreeDiskBytes == 0 {
+        return nil
+    }
+    diskSize, err := db.estimatedDiskSize()
     if err != nil {
         return err
     }
+    if db.options.MaxDiskBytes > 0 && diskSize + size > db.options.MaxDiskBytes {
+        return ErrDiskFull
+    }
+    if db.options.MinFreeDiskBytes > 0 && !db.options.InMemory && db.diskFree - size < db.options.MinFreeDiskBytes {
+        return ErrDiskFull
+    }
+    return nil
+}
+
+// A write that ran out of space fails with ErrDiskFull
+func diskFullOr(err error) error {
+    if errors.Is(err, syscall.ENOSPC) {
+        return ErrDiskFull
+    }
+    return err
+}
+
+// In memory there is no directory, the files are counted instead. The caller holds db.mutex.
+func (db *DB) diskSize() (int64, error) {
+    if !db.options.InMemory {
+        return db.options.VFS.DirSize(db.options.DirPath)
+    }
+
+    var files []*data.DataFile
+    for _, file := range db.olderFiles {
+        files = append(files, file)
+    }
+    for _, file := range db.olderValueLogs {
+        files = append(files, file)
+    }
+    for _, file := range []*data.DataFile{db.activeFile, db.activeValueLog} {
+        if file != nil {
+            files = append(files, file)
+        }
+    }
+
+    var size int64
+    for _, file := range files {
+        fileSize, err := file.IOManager.Size()
+        if err != nil {
+            return 0, err
+        }
+        size += fileSize
+    }
+    return size, nil
+}
+
+// Returns the sorted ids of the files with the given suffix
+func listFileIds(fs fio.VFS, dirPath string, suffix string) ([]uint32, error) {
+    dirEntries, err := fs.ReadDir(dirPath)
+    if err != nil {
+        return nil, err
+    }
 
     var fileIds []uint32
     for _, entry := range dirEntries {
-        if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+        if strings.HasSuffix(entry.Name(), suffix) {
             splitNames := strings.Split(entry.Name(), ".")
             fileId, err := strconv.Atoi(splitNames[0])
             if err != nil {
-                return ErrDataDirectoryCorrupted
+                return nil, ErrDataDirectoryCorrupted
             }
             fileIds = append(fileIds, uint32(fileId))
         }
@@ -429,15 +1099,24 @@ func (db *DB) loadDataFiles() error {
     sort.Slice(fileIds, func(i int, j int) bool {
         return fileIds[i] < fileIds[j]
     })
+    return fileIds, nil
+}
+
+func (db *DB) loadDataFiles() error {
+    fileIds, err := listFileIds(db.options.VFS, db.options.DirPath, data.DataFileNameSuffix)
+    if err != nil {
+        return err
+    }
     db.fileIds = fileIds
 
-    ioType := fio.StandardFileIO
-    if db.options.MMapAtStart {
+    // Mapping a file creates it when it is missing, and a B+ tree index replays no file it would speed up
+    ioType := db.fileIOType()
+    if db.options.MMapAtStart && !db.readOnlyFiles() && db.options.IndexType != BPTreeIndex {
         ioType = fio.MemoryMapIO
     }
 
     for i, fileId := range fileIds {
-        dataFile, err := data.OpenDataFile(db.options.DirPath, fileId, ioType)
+        dataFile, err := db.withLogger(data.OpenDataFile(db.options.VFS, db.options.DirPath, fileId, ioType))
         if err != nil {
             return err
         }
@@ -459,7 +1138,7 @@ func (db *DB) loadIndexFromDataFiles() error {
 
     isMerged, nonMergeFileId := false, uint32(0)
     mergeFinishedFile := filepath.Join(db.options.DirPath, data.MergeFinishedFileName)
-    if _, err := os.Stat(mergeFinishedFile); err == nil {
+    if _, err := db.options.VFS.Stat(mergeFinishedFile); err == nil {
         id, err := db.getNonMergeFileId(db.options.DirPath)
         if err != nil {
             return err
@@ -469,94 +1148,133 @@ func (db *DB) loadIndexFromDataFiles() error {
         nonMergeFileId = id
     }
 
-    updateIndex := func(key []byte, typ data.LogRecordType, logRecordPos *data.LogRecordPos) {
-        var oldPos *data.LogRecordPos
-        if typ == data.LogRecordDeleted {
-            oldPos, _ = db.index.Delete(key)
-            db.reclaimableSpace += int64(logRecordPos.Size)
-        } else {
-            oldPos = db.index.Put(key, logRecordPos)
-        }
-
-        if oldPos != nil {
-            db.reclaimableSpace += int64(oldPos.Size)
-        }
-    }
-
-    transactionRecords := make(map[uint64][]*data.TransactionRecord)
-    var currentSeqNum = nonTransactionSeqNum
-    
+    loader := db.newRecordLoader()
     for _, fileId := range db.fileIds {
         var fileId = uint32(fileId)
         if isMerged && fileId < nonMergeFileId {
             continue
         }
 
-        var dataFile *data.DataFile
-        if fileId == db.activeFile.FileId {
-            dataFile = db.activeFile
-        } else {
-            dataFile = db.olderFiles[fileId]
+        dataFile := db.getDataFile(fileId)
+        offset, err := loader.loadFile(dataFile, data.FileHeaderSize)
+        if err != nil {
+            if err == data.ErrInvalidCRC {
+                db.options.EventListener.OnCorruptionDetected(CorruptionInfo{FileId: fileId, Offset: offset, Err: err})
+            }
+            return err
+        }
+        // A reader may see the last record of a writer cut short
+        size, err := dataFile.IOManager.Size()
+        if err != nil {
+            return err
+        }
+        if offset < size && !db.options.ReadOnly {
+            db.options.EventListener.OnRecoveryTruncated(RecoveryTruncatedInfo{FileId: fileId, Offset: offset, DroppedBytes: size - offset})
         }
 
-        var offset int64 = 0
-        for {
-            logRecord, readLength, err := dataFile.ReadLogRecord(offset)
-            if err != nil {
-                if err == io.EOF {
-                    break
-                } else {
-                    return err
-                }
-            }
+        // Tells a replica where to continue applying records
+        dataFile.WriteOffset = offset
+    }
 
-            logRecordPos := &data.LogRecordPos {
-                FileId: fileId,
-                Offset: offset,
-                Size: uint32(readLength),
-            }
+    db.seqNum = loader.seqNum
+    db.loader = loader
+
+    return nil
+}
+
+// Applies log records to the index. Transactions are kept pending until their finished record
+// shows up, so a loader can be fed one file section after another.
+type recordLoader struct {
+    db *DB
+    transactionRecords map[uint64][]*data.TransactionRecord
+    seqNum uint64
+}
+
+func (db *DB) newRecordLoader() *recordLoader {
+    return &recordLoader {
+        db: db,
+        transactionRecords: make(map[uint64][]*data.TransactionRecord),
+        seqNum: nonTransactionSeqNum,
+    }
+}
 
-            realKey, seqNum := parseLogRecordKeyWithSeq(logRecord.Key)
-            if seqNum == nonTransactionSeqNum {
-                updateIndex(realKey, logRecord.Type, logRecordPos)
+// Returns the offset after the last complete record, or of the record that failed
+func (loader *recordLoader) loadFile(dataFile *data.DataFile, offset int64) (int64, error) {
+    for {
+        logRecord, readLength, err := dataFile.ReadLogRecord(offset)
+        if err != nil {
+            if err == io.EOF {
+                break
             } else {
-                if logRecord.Type == data.LogRecordTxFinished {
-                    for _, transactionRecord := range transactionRecords[seqNum] {
-                        updateIndex(transactionRecord.Record.Key, transactionRecord.Record.Type, transactionRecord.Pos)
-                    }
-                    delete(transactionRecords, seqNum)
-                } else {
-                    logRecord.Key = realKey
-                    transactionRecords[seqNum] = append(transactionRecords[seqNum], &data.TransactionRecord {
-                        Record: logRecord,
-                        Pos: logRecordPos,
-                    })
-                }
+                return offset, err
             }
+        }
+        // A header cut short by a concurrent writer
+        if logRecord == nil {
+            break
+        }
 
-            if seqNum > currentSeqNum {
-                currentSeqNum = seqNum
-            }
+        logRecordPos := &data.LogRecordPos {
+            FileId: dataFile.FileId,
+            Offset: offset,
+            Size: uint32(readLength),
+        }
 
-            offset += readLength
+        realKey, seqNum := parseLogRecordKeyWithSeq(logRecord.Key)
+        if seqNum == nonTransactionSeqNum {
+            loader.db.applyLogRecord(realKey, logRecord.Type, logRecordPos)
+        } else {
+            if logRecord.Type == data.LogRecordTxFinished {
+                for _, transactionRecord := range loader.transactionRecords[seqNum] {
+                    loader.db.applyLogRecord(transactionRecord.Record.Key, transactionRecord.Record.Type, transactionRecord.Pos)
+                }
+                delete(loader.transactionRecords, seqNum)
+            } else {
+                logRecord.Key = realKey
+                loader.transactionRecords[seqNum] = append(loader.transactionRecords[seqNum], &data.TransactionRecord {
+                    Record: logRecord,
+                    Pos: logRecordPos,
+                })
+            }
         }
 
-        if fileId == db.activeFile.FileId {
-            db.activeFile.WriteOffset = offset
+        if seqNum > loader.seqNum {
+            loader.seqNum = seqNum
         }
+
+        offset += readLength
     }
 
-    db.seqNum = currentSeqNum
+    return offset, nil
+}
 
-    return nil
+func (db *DB) applyLogRecord(key []byte, typ data.LogRecordType, logRecordPos *data.LogRecordPos) {
+    var oldPos *data.LogRecordPos
+    if typ == data.LogRecordDeleted {
+        oldPos, _ = db.index.Delete(key)
+        db.reclaimableSpace += int64(logRecordPos.Size)
+    } else {
+        db.bloomAdd(key)
+        oldPos = db.index.Put(key, logRecordPos)
+    }
+
+    if oldPos != nil {
+        db.reclaimableSpace += int64(oldPos.Size)
+        db.invalidateCache(oldPos)
+    }
 }
 
 func checkOptions(options Options) error {
-    if options.DirPath == "" {
+    if options.DirPath == "" && !options.InMemory {
         return ErrDataDirectoryEmpty
     }
 
-    if options.DataFileSize <= 0 {
+    // The B+ tree index lives in a file of its own, and a read-only database reads files another process writes
+    if options.InMemory && (options.IndexType == BPTreeIndex || options.ReadOnly) {
+        return ErrInMemoryUnsupported
+    }
+
+    if options.DataFileSize <= data.FileHeaderSize {
         return ErrDataFileSizeInvalid
     }
 
@@ -564,21 +1282,112 @@ func checkOptions(options Options) error {
         return ErrMergeTriggerRatioInvalid
     }
 
+    if options.WatchBufferSize < 0 || options.WatchHistorySize < 0 {
+        return ErrWatchOptionsInvalid
+    }
+
+    if options.MaxKeySize < 0 || options.MaxValueSize < 0 {
+        return ErrMaxKeyValueSizeInvalid
+    }
+
+    if options.ValueLogThreshold < 0 {
+        return ErrValueLogThresholdInvalid
+    }
+
+    if options.ValueCacheBytes < 0 {
+        return ErrValueCacheBytesInvalid
+    }
+
+    if options.WriteStallDelay < 0 || options.SlowdownReclaimableBytes < 0 || options.StopReclaimableBytes < 0 ||
+        options.SlowdownDiskBytes < 0 || options.StopDiskBytes < 0 {
+        return ErrWriteStallOptionsInvalid
+    }
+
+    if options.MaxDiskBytes < 0 || options.MinFreeDiskBytes < 0 {
+        return ErrDiskQuotaInvalid
+    }
+
+    if options.BloomFilter && (options.BloomFalsePositiveRate <= 0 || options.BloomFalsePositiveRate >= 1) {
+        return ErrBloomFalsePositiveRateInvalid
+    }
+
+    if !data.ValidChecksumType(options.Checksum) {
+        return ErrChecksumTypeInvalid
+    }
+
     return nil
 }
 
+// The header new data and value log files are created with
+func newFileHeader(options Options) data.FileHeader {
+    header := data.DefaultFileHeader
+    header.ChecksumType = options.Checksum
+    return header
+}
+
+func (db *DB) saveSeqNum() error {
+    seqNoFile, err := data.OpenSeqNumFile(db.options.VFS, db.options.DirPath)
+    if err != nil {
+        return err
+    }
+    seqNumRecord := &data.LogRecord {
+        Key: []byte(seqNumKey),
+        Value: []byte(strconv.FormatUint(db.seqNum, 10)),
+    }
+    encodedSeqNoRecord, _ := data.EncodeLogRecord(seqNumRecord)
+    if err := seqNoFile.Write(encodedSeqNoRecord); err != nil {
+        return err
+    }
+    return seqNoFile.Sync()
+}
+
+// Promote can turn a replica writable, so the flag is read under the lock
+func (db *DB) isReadOnly() bool {
+    db.mutex.RLock()
+    defer db.mutex.RUnlock()
+
+    return db.options.ReadOnly
+}
+
+// A read-only database without a lock never creates or writes a file, a replica writes the ones it pulls
+func (db *DB) readOnlyFiles() bool {
+    return db.options.ReadOnly && db.fileLock == nil
+}
+
+func (db *DB) fileIOType() fio.IOType {
+    if db.readOnlyFiles() {
+        return fio.ReadOnlyFileIO
+    }
+    return fio.StandardFileIO
+}
+
+func (db *DB) openValueLogFile(fileId uint32) (*data.DataFile, error) {
+    if db.readOnlyFiles() {
+        return db.withLogger(data.OpenFileReadOnly(db.options.VFS, data.GetValueLogFileName(db.options.DirPath, fileId), fileId))
+    }
+    return db.withLogger(data.OpenValueLogFile(db.options.VFS, db.options.DirPath, fileId))
+}
+
+// Opens one of the files kept next to the data files, like the hint or the sequence number file
+func (db *DB) openMetaFile(dirPath string, fileName string, open func(fio.VFS, string) (*data.DataFile, error)) (*data.DataFile, error) {
+    if db.readOnlyFiles() {
+        return data.OpenFileReadOnly(db.options.VFS, filepath.Join(dirPath, fileName), 0)
+    }
+    return open(db.options.VFS, dirPath)
+}
+
 func (db *DB) loadSeqNum() error {
     fileName := filepath.Join(db.options.DirPath, data.SeqNumFileName)
-    if _, err := os.Stat(fileName); os.IsNotExist(err) {
+    if _, err := db.options.VFS.Stat(fileName); os.IsNotExist(err) {
         return nil
     }
 
-    seqNumFile, err := data.OpenSeqNumFile(db.options.DirPath)
+    seqNumFile, err := db.openMetaFile(db.options.DirPath, data.SeqNumFileName, data.OpenSeqNumFile)
     if err != nil {
         return err
     }
 
-    record, _, err := seqNumFile.ReadLogRecord(0)
+    record, _, err := seqNumFile.ReadLogRecord(data.FileHeaderSize)
     if err != nil {
         return err
     }
@@ -589,7 +1398,67 @@ func (db *DB) loadSeqNum() error {
     db.seqNum = seqNum
     db.seqNumFileExists = true
 
-    return os.Remove(fileName)
+    if db.options.ReadOnly {
+        return seqNumFile.Close()
+    }
+    return fio.RemoveDurable(db.options.VFS, fileName)
+}
+
+// Every writable open appends the next epoch to the file, a read-only one takes the last
+func (db *DB) nextWatchEpoch() (uint32, error) {
+    fileName := filepath.Join(db.options.DirPath, data.WatchEpochFileName)
+    if _, err := db.options.VFS.Stat(fileName); os.IsNotExist(err) && db.options.ReadOnly {
+        return 0, nil
+    }
+
+    epochFile, err := db.openMetaFile(db.options.DirPath, data.WatchEpochFileName, data.OpenWatchEpochFile)
+    if err != nil {
+        return 0, err
+    }
+    defer epochFile.Close()
+
+    var epoch uint64
+    var offset int64 = data.FileHeaderSize
+    for {
+        record, size, err := epochFile.ReadLogRecord(offset)
+        if err == io.EOF || (err == nil && record == nil) {
+            break
+        }
+        if err != nil {
+            return 0, err
+        }
+        if epoch, err = strconv.ParseUint(string(record.Value), 10, 32); err != nil {
+            return 0, err
+        }
+        offset += size
+    }
+    if db.options.ReadOnly {
+        return uint32(epoch), nil
+    }
+
+    // A record torn by a crash is cut off, the next one has to be readable
+    fileSize, err := epochFile.IOManager.Size()
+    if err != nil {
+        return 0, err
+    }
+    if fileSize > offset {
+        if err := epochFile.IOManager.Truncate(offset); err != nil {
+            return 0, err
+        }
+    }
+
+    epoch++
+    encodedRecord, _ := data.EncodeLogRecord(&data.LogRecord {
+        Key: []byte(watchEpochKey),
+        Value: []byte(strconv.FormatUint(epoch, 10)),
+    })
+    if err := epochFile.Write(encodedRecord); err != nil {
+        return 0, err
+    }
+    if err := epochFile.Sync(); err != nil {
+        return 0, err
+    }
+    return uint32(epoch), nil
 }
 
 func (db *DB) resetIOType() error {
@@ -597,12 +1466,12 @@ func (db *DB) resetIOType() error {
         return nil
     }
 
-    if err := db.activeFile.SetIOManager(db.options.DirPath, fio.StandardFileIO); err != nil {
+    if err := db.activeFile.SetIOManager(db.options.VFS, db.options.DirPath, db.fileIOType()); err != nil {
         return err
     }
 
     for _, olderFile := range db.olderFiles {
-        if err := olderFile.SetIOManager(db.options.DirPath, fio.StandardFileIO); err != nil {
+        if err := olderFile.SetIOManager(db.options.VFS, db.options.DirPath, db.fileIOType()); err != nil {
             return err
         }
     }
@@ -1,9 +1,22 @@
 package kvdb_go
 
 import (
+    "bytes"
+    "context"
+    "errors"
+    "io"
+    "kvdb-go/data"
+    "kvdb-go/fio"
+    "kvdb-go/metrics"
     "kvdb-go/utils"
     "os"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "sync"
+    "syscall"
     "testing"
+    "time"
 
     "github.com/sirupsen/logrus"
     "github.com/stretchr/testify/assert"
@@ -351,7 +364,8 @@ func TestDBStat(t *testing.T) {
         assert.Nil(t, err)
     }
 
-    stat := db.Stat()
+    stat, err := db.Stat()
+    assert.Nil(t, err)
     assert.NotNil(t, stat)
     assert.True(t, stat.ReclaimableSpace > 0)
 }
@@ -392,3 +406,1026 @@ func TestDBBackup(t *testing.T) {
         assert.NotNil(t, val)
     }
 }
+
+func TestDBValueCache(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-value-cache-")
+    options.DirPath = dir
+    options.ValueCacheBytes = 1024 * 1024
+
+    db, err := Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+    assert.NotNil(t, db)
+
+    value1 := utils.GetTestValue(128)
+    err = db.Put(utils.GetTestKey(1), value1)
+    assert.Nil(t, err)
+
+    // 1. First read misses, second read hits
+    val, err := db.Get(utils.GetTestKey(1))
+    assert.Nil(t, err)
+    assert.Equal(t, value1, val)
+    val, err = db.Get(utils.GetTestKey(1))
+    assert.Nil(t, err)
+    assert.Equal(t, value1, val)
+
+    stat, err := db.Stat()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(1), stat.CacheHits)
+    assert.Equal(t, uint64(1), stat.CacheMisses)
+
+    // 2. Put invalidates the old value
+    value2 := utils.GetTestValue(128)
+    err = db.Put(utils.GetTestKey(1), value2)
+    assert.Nil(t, err)
+    assert.Equal(t, 0, db.valueCache.Len())
+    val, err = db.Get(utils.GetTestKey(1))
+    assert.Nil(t, err)
+    assert.Equal(t, value2, val)
+
+    // 3. Delete invalidates the value
+    err = db.Delete(utils.GetTestKey(1))
+    assert.Nil(t, err)
+    assert.Equal(t, 0, db.valueCache.Len())
+    _, err = db.Get(utils.GetTestKey(1))
+    assert.Equal(t, ErrKeyNotFound, err)
+
+    // 4. Write batch invalidates the value
+    err = db.Put(utils.GetTestKey(2), value1)
+    assert.Nil(t, err)
+    _, err = db.Get(utils.GetTestKey(2))
+    assert.Nil(t, err)
+    assert.Equal(t, 1, db.valueCache.Len())
+    wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+    err = wb.Put(utils.GetTestKey(2), value2)
+    assert.Nil(t, err)
+    err = wb.Commit()
+    assert.Nil(t, err)
+    assert.Equal(t, 0, db.valueCache.Len())
+    val, err = db.Get(utils.GetTestKey(2))
+    assert.Nil(t, err)
+    assert.Equal(t, value2, val)
+}
+
+func TestDBBloomFilter(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-bloom-filter-")
+    _ = os.RemoveAll(dir) // WriteBatch with BPTreeIndex needs a first launch
+    options.DirPath = dir
+    options.IndexType = BPTreeIndex
+    options.BloomFilter = true
+
+    db, err := Open(options)
+    assert.Nil(t, err)
+    assert.NotNil(t, db)
+
+    // 1. Keys written through Put and WriteBatch are found
+    for i := 0; i < 2000; i++ {
+        err := db.Put(utils.GetTestKey(i), utils.GetTestValue(24))
+        assert.Nil(t, err)
+    }
+    wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+    err = wb.Put(utils.GetTestKey(5000), utils.GetTestValue(24))
+    assert.Nil(t, err)
+    err = wb.Delete(utils.GetTestKey(6000))
+    assert.Nil(t, err)
+    err = wb.Commit()
+    assert.Nil(t, err)
+
+    for i := 0; i < 2000; i++ {
+        assert.True(t, db.bloomFilter.MayContain(utils.GetTestKey(i)))
+    }
+    _, err = db.Get(utils.GetTestKey(5000))
+    assert.Nil(t, err)
+
+    // 2. Missing keys
+    _, err = db.Get([]byte("unknown key"))
+    assert.Equal(t, ErrKeyNotFound, err)
+    err = db.Delete([]byte("unknown key"))
+    assert.Nil(t, err)
+
+    // 3. The filter is persisted on close and removed once loaded again
+    err = db.Close()
+    assert.Nil(t, err)
+    _, err = os.Stat(filepath.Join(dir, data.BloomFilterFileName))
+    assert.Nil(t, err)
+
+    db, err = Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+    _, err = os.Stat(filepath.Join(dir, data.BloomFilterFileName))
+    assert.True(t, os.IsNotExist(err))
+
+    for i := 0; i < 2000; i++ {
+        val, err := db.Get(utils.GetTestKey(i))
+        assert.Nil(t, err)
+        assert.NotNil(t, val)
+    }
+    _, err = db.Get(utils.GetTestKey(5000))
+    assert.Nil(t, err)
+}
+
+func TestDBBloomFilterToggled(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-bloom-filter-")
+    options.DirPath = dir
+    defer os.RemoveAll(dir)
+
+    options.BloomFilter = true
+    db, err := Open(options)
+    assert.Nil(t, err)
+    assert.Nil(t, db.Put(utils.GetTestKey(0), utils.GetTestValue(24)))
+    assert.Nil(t, db.Close())
+
+    // Written while the filter is off, the saved one does not know the key
+    options.BloomFilter = false
+    db, err = Open(options)
+    assert.Nil(t, err)
+    assert.Nil(t, db.Put([]byte("new-key"), utils.GetTestValue(24)))
+    assert.Nil(t, db.Close())
+    _, err = os.Stat(filepath.Join(dir, data.BloomFilterFileName))
+    assert.True(t, os.IsNotExist(err))
+
+    options.BloomFilter = true
+    db, err = Open(options)
+    assert.Nil(t, err)
+    defer db.Close()
+    _, err = db.Get([]byte("new-key"))
+    assert.Nil(t, err)
+}
+
+func TestDBKeyValueSizeLimits(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-size-limits-")
+    options.DirPath = dir
+    options.DataFileSize = 4096
+    options.MaxKeySize = 128
+    options.MaxValueSize = 8192
+
+    db, err := Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+    assert.NotNil(t, db)
+
+    // 1. Configured limits
+    err = db.Put(make([]byte, 129), utils.GetTestValue(24))
+    assert.Equal(t, ErrKeyTooLarge, err)
+    err = db.Put(utils.GetTestKey(1), make([]byte, 8193))
+    assert.Equal(t, ErrValueTooLarge, err)
+
+    // 2. Records that cannot fit in one data file
+    err = db.Put(utils.GetTestKey(1), make([]byte, 4096))
+    assert.Equal(t, ErrValueTooLarge, err)
+    err = db.Put(utils.GetTestKey(1), make([]byte, 4000))
+    assert.Nil(t, err)
+
+    wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+    err = wb.Put(make([]byte, 129), nil)
+    assert.Equal(t, ErrKeyTooLarge, err)
+    err = wb.Put(utils.GetTestKey(2), make([]byte, 4096))
+    assert.Equal(t, ErrValueTooLarge, err)
+    err = wb.Commit()
+    assert.Nil(t, err)
+
+    // 3. Separated values only leave a pointer in the data file
+    err = db.Close()
+    assert.Nil(t, err)
+    options.ValueLogThreshold = 1024
+    db, err = Open(options)
+    assert.Nil(t, err)
+
+    value := utils.GetTestValue(8000)
+    err = db.Put(utils.GetTestKey(3), value)
+    assert.Nil(t, err)
+    val, err := db.Get(utils.GetTestKey(3))
+    assert.Nil(t, err)
+    assert.Equal(t, value, val)
+
+    // 4. Invalid options
+    options.MaxKeySize = -1
+    _, err = Open(options)
+    assert.Equal(t, ErrMaxKeyValueSizeInvalid, err)
+}
+
+func TestDBReadOnly(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-read-only-")
+    options.DirPath = dir
+    options.DataFileSize = 32 * 1024
+
+    db, err := Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+    for i := 0; i < 100; i++ {
+        err := db.Put(utils.GetTestKey(i), utils.GetTestValue(128))
+        assert.Nil(t, err)
+    }
+
+    // 1. Readers open next to the live writer
+    readOnlyOptions := options
+    readOnlyOptions.ReadOnly = true
+    reader, err := Open(readOnlyOptions)
+    assert.Nil(t, err)
+    otherReader, err := Open(readOnlyOptions)
+    assert.Nil(t, err)
+    err = otherReader.Close()
+    assert.Nil(t, err)
+    assert.Equal(t, 100, len(reader.ListKeys()))
+
+    // 2. Every write is rejected
+    err = reader.Put(utils.GetTestKey(1), utils.GetTestValue(8))
+    assert.Equal(t, ErrReadOnly, err)
+    err = reader.Delete(utils.GetTestKey(1))
+    assert.Equal(t, ErrReadOnly, err)
+    wb := reader.NewWriteBatch(DefaultWriteBatchOptions)
+    _ = wb.Put(utils.GetTestKey(1), utils.GetTestValue(8))
+    err = wb.Commit()
+    assert.Equal(t, ErrReadOnly, err)
+    err = reader.Merge()
+    assert.Equal(t, ErrReadOnly, err)
+
+    // 3. Refresh picks up appended records and new files
+    for i := 100; i < 400; i++ {
+        err := db.Put(utils.GetTestKey(i), utils.GetTestValue(128))
+        assert.Nil(t, err)
+    }
+    err = db.Delete(utils.GetTestKey(0))
+    assert.Nil(t, err)
+    _, err = reader.Get(utils.GetTestKey(399))
+    assert.Equal(t, ErrKeyNotFound, err)
+    err = reader.Refresh()
+    assert.Nil(t, err)
+    assert.Equal(t, 399, len(reader.ListKeys()))
+    _, err = reader.Get(utils.GetTestKey(399))
+    assert.Nil(t, err)
+
+    // 4. Closing the reader leaves nothing behind
+    entries, _ := os.ReadDir(dir)
+    err = reader.Close()
+    assert.Nil(t, err)
+    entriesAfterClose, _ := os.ReadDir(dir)
+    assert.Equal(t, len(entries), len(entriesAfterClose))
+
+    readOnlyOptions.DirPath = filepath.Join(dir, "missing")
+    _, err = Open(readOnlyOptions)
+    assert.Equal(t, ErrDataDirectoryNotFound, err)
+}
+
+// Fails everything a read-only database must not do to its directory
+type readOnlyVFS struct {
+    fio.OSFS
+}
+
+var errWriteAttempted = errors.New("write attempted")
+
+func (fs readOnlyVFS) OpenFile(name string, ioType fio.IOType) (fio.IOManager, error) {
+    if ioType != fio.ReadOnlyFileIO {
+        return nil, errWriteAttempted
+    }
+    return fs.OSFS.OpenFile(name, ioType)
+}
+
+func (readOnlyVFS) MkdirAll(string) error { return errWriteAttempted }
+func (readOnlyVFS) Rename(string, string) error { return errWriteAttempted }
+func (readOnlyVFS) Link(string, string) error { return errWriteAttempted }
+func (readOnlyVFS) Remove(string) error { return errWriteAttempted }
+func (readOnlyVFS) RemoveAll(string) error { return errWriteAttempted }
+
+func TestDBReadOnlyOpensNoFileForWriting(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-read-only-files-")
+    options.DirPath = dir
+    options.DataFileSize = 32 * 1024
+    options.ValueLogThreshold = 64
+    options.BloomFilter = true
+    options.MergeTriggerRatio = 0
+
+    db, err := Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+    for i := 0; i < 300; i++ {
+        err := db.Put(utils.GetTestKey(i), utils.GetTestValue(128))
+        assert.Nil(t, err)
+    }
+    // The merged files and their hint file are moved in by the next open
+    err = db.Merge()
+    assert.Nil(t, err)
+    err = db.Close()
+    assert.Nil(t, err)
+    db, err = Open(options)
+    assert.Nil(t, err)
+    err = db.Put(utils.GetTestKey(300), utils.GetTestValue(128))
+    assert.Nil(t, err)
+
+    readOnlyOptions := options
+    readOnlyOptions.ReadOnly = true
+    readOnlyOptions.VFS = readOnlyVFS{}
+    reader, err := Open(readOnlyOptions)
+    assert.Nil(t, err)
+    assert.Equal(t, 301, len(reader.ListKeys()))
+    _, err = os.Stat(filepath.Join(dir, data.HintFileName))
+    assert.Nil(t, err)
+    val, err := reader.Get(utils.GetTestKey(7))
+    assert.Nil(t, err)
+    assert.NotNil(t, val)
+    err = reader.Refresh()
+    assert.Nil(t, err)
+    err = reader.Close()
+    assert.Nil(t, err)
+}
+
+func TestDBChecksum(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-checksum-")
+    options.DirPath = dir
+    options.DataFileSize = 32 * 1024
+    options.ValueLogThreshold = 64
+
+    options.Checksum = ChecksumXXHash64 + 1
+    _, err := Open(options)
+    assert.Equal(t, ErrChecksumTypeInvalid, err)
+
+    // Each reopen creates files with another checksum type next to the old ones
+    for i, checksumType := range []ChecksumType{ChecksumCRC32IEEE, ChecksumCRC32C, ChecksumXXHash64} {
+        options.Checksum = checksumType
+        db, err := Open(options)
+        assert.Nil(t, err)
+        for j := i * 200; j < (i + 1) * 200; j++ {
+            err = db.Put(utils.GetTestKey(j), utils.GetTestValue(j % 128))
+            assert.Nil(t, err)
+        }
+        err = db.PutReader([]byte("streamed"), bytes.NewReader(utils.GetTestValue(1024)), 1024)
+        assert.Nil(t, err)
+        err = db.Close()
+        assert.Nil(t, err)
+    }
+
+    db, err := Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+    for j := 0; j < 600; j++ {
+        val, err := db.Get(utils.GetTestKey(j))
+        assert.Nil(t, err)
+        assert.Equal(t, len("kvdb-test-value-") + j % 128, len(val))
+    }
+    checksumTypes := make(map[ChecksumType]bool)
+    for _, valueLogFile := range db.olderValueLogs {
+        checksumTypes[valueLogFile.Header.ChecksumType] = true
+    }
+    checksumTypes[db.activeValueLog.Header.ChecksumType] = true
+    assert.Equal(t, 3, len(checksumTypes))
+
+    reader, err := db.GetReader([]byte("streamed"))
+    assert.Nil(t, err)
+    val, err := io.ReadAll(reader)
+    assert.Nil(t, err)
+    assert.Equal(t, 1024, len(val))
+    _ = reader.Close()
+}
+
+func TestDBInMemory(t *testing.T) {
+    tmpDir, _ := os.MkdirTemp("", "kvdb-go-in-memory-")
+    defer os.RemoveAll(tmpDir)
+
+    options := DefaultOptions
+    options.DirPath = filepath.Join(tmpDir, "unused")
+    options.InMemory = true
+    options.DataFileSize = 32 * 1024
+    options.ValueLogThreshold = 128
+    options.MergeTriggerRatio = 0
+    options.BloomFilter = true
+
+    options.IndexType = BPTreeIndex
+    _, err := Open(options)
+    assert.Equal(t, ErrInMemoryUnsupported, err)
+    options.IndexType = BTreeIndex
+
+    db, err := Open(options)
+    assert.Nil(t, err)
+    for i := 0; i < 1000; i++ {
+        err = db.Put(utils.GetTestKey(i), utils.GetTestValue(i % 256))
+        assert.Nil(t, err)
+    }
+    for i := 0; i < 500; i++ {
+        err = db.Put(utils.GetTestKey(i), []byte("rewritten"))
+        assert.Nil(t, err)
+    }
+    wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+    for i := 900; i < 1000; i++ {
+        err = wb.Delete(utils.GetTestKey(i))
+        assert.Nil(t, err)
+    }
+    err = wb.Commit()
+    assert.Nil(t, err)
+    err = db.PutReader([]byte("streamed"), bytes.NewReader(utils.GetTestValue(4096)), 4096)
+    assert.Nil(t, err)
+
+    // Nothing touches the directory
+    _, err = os.Stat(options.DirPath)
+    assert.True(t, os.IsNotExist(err))
+
+    check := func(db *DB) {
+        for i := 0; i < 1000; i++ {
+            val, err := db.Get(utils.GetTestKey(i))
+            switch {
+            case i < 500:
+                assert.Nil(t, err)
+                assert.Equal(t, []byte("rewritten"), val)
+            case i < 900:
+                assert.Nil(t, err)
+                assert.Equal(t, len("kvdb-test-value-") + i % 256, len(val))
+            default:
+                assert.Equal(t, ErrKeyNotFound, err)
+            }
+        }
+        reader, err := db.GetReader([]byte("streamed"))
+        assert.Nil(t, err)
+        val, err := io.ReadAll(reader)
+        assert.Nil(t, err)
+        assert.Equal(t, 4096, len(val))
+        _ = reader.Close()
+
+        iterator := db.NewIterator(DefaultIteratorOptions)
+        var keyNum int
+        for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+            _, err := iterator.Value()
+            assert.Nil(t, err)
+            keyNum++
+        }
+        iterator.Close()
+        assert.Equal(t, 901, keyNum)
+    }
+    check(db)
+
+    // The merged files replace the old ones right away
+    stat, err := db.Stat()
+    assert.Nil(t, err)
+    err = db.Merge()
+    assert.Nil(t, err)
+    mergedStat, err := db.Stat()
+    assert.Nil(t, err)
+    assert.True(t, mergedStat.DiskSize < stat.DiskSize)
+    assert.Equal(t, int64(0), mergedStat.ReclaimableSpace)
+    check(db)
+    err = db.Put(utils.GetTestKey(0), []byte("rewritten"))
+    assert.Nil(t, err)
+    err = db.Merge()
+    assert.Nil(t, err)
+    check(db)
+
+    // A backup is a regular directory
+    backupDir := filepath.Join(tmpDir, "backup")
+    err = db.Backup(backupDir)
+    assert.Nil(t, err)
+    err = db.Close()
+    assert.Nil(t, err)
+
+    options.InMemory = false
+    options.DirPath = backupDir
+    db, err = Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+    check(db)
+}
+
+// Counts the operations that reach the filesystem
+type recordingVFS struct {
+    fio.OSFS
+    mutex sync.Mutex
+    ops map[string]int
+}
+
+func (fs *recordingVFS) record(op string) {
+    fs.mutex.Lock()
+    defer fs.mutex.Unlock()
+    fs.ops[op]++
+}
+
+func (fs *recordingVFS) OpenFile(name string, ioType fio.IOType) (fio.IOManager, error) {
+    fs.record("OpenFile")
+    return fs.OSFS.OpenFile(name, ioType)
+}
+
+func (fs *recordingVFS) ReadDir(dir string) ([]os.DirEntry, error) {
+    fs.record("ReadDir")
+    return fs.OSFS.ReadDir(dir)
+}
+
+func (fs *recordingVFS) Rename(oldName string, newName string) error {
+    fs.record("Rename")
+    return fs.OSFS.Rename(oldName, newName)
+}
+
+func (fs *recordingVFS) TryLock(name string) (fio.FileLock, bool, error) {
+    fs.record("TryLock")
+    return fs.OSFS.TryLock(name)
+}
+
+func (fs *recordingVFS) DirSize(dir string) (int64, error) {
+    fs.record("DirSize")
+    return fs.OSFS.DirSize(dir)
+}
+
+func (fs *recordingVFS) AvailableSpace(dir string) (uint64, error) {
+    fs.record("AvailableSpace")
+    return fs.OSFS.AvailableSpace(dir)
+}
+
+func TestDBVFS(t *testing.T) {
+    fs := &recordingVFS{ops: make(map[string]int)}
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-vfs-")
+    options.DirPath = dir
+    options.DataFileSize = 32 * 1024
+    options.MergeTriggerRatio = 0
+    options.VFS = fs
+    defer os.RemoveAll(dir + mergeDirName)
+
+    db, err := Open(options)
+    assert.Nil(t, err)
+    for round := 0; round < 2; round++ {
+        for i := 0; i < 1000; i++ {
+            err = db.Put(utils.GetTestKey(i), utils.GetTestValue(64))
+            assert.Nil(t, err)
+        }
+    }
+    err = db.Merge()
+    assert.Nil(t, err)
+    err = db.Close()
+    assert.Nil(t, err)
+
+    // Reopening moves the merged files in
+    db, err = Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+    for i := 0; i < 1000; i++ {
+        _, err := db.Get(utils.GetTestKey(i))
+        assert.Nil(t, err)
+    }
+
+    for _, op := range []string{"OpenFile", "ReadDir", "Rename", "TryLock", "DirSize", "AvailableSpace"} {
+        assert.True(t, fs.ops[op] > 0, op)
+    }
+}
+
+func TestDBMetrics(t *testing.T) {
+    registry := metrics.NewRegistry()
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-metrics-")
+    options.DirPath = dir
+    options.DataFileSize = 32 * 1024
+    options.MergeTriggerRatio = 0
+    options.ValueCacheBytes = 1 << 20
+    options.Metrics = registry
+    defer os.RemoveAll(dir + mergeDirName)
+
+    db, err := Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+    registry.AddCollector(func(m metrics.Metrics) {
+        assert.Nil(t, db.CollectMetrics(m))
+    })
+
+    for i := 0; i < 1000; i++ {
+        err = db.Put(utils.GetTestKey(i), utils.GetTestValue(64))
+        assert.Nil(t, err)
+    }
+    for i := 0; i < 2; i++ {
+        _, err = db.Get(utils.GetTestKey(0))
+        assert.Nil(t, err)
+    }
+    err = db.Delete(utils.GetTestKey(1))
+    assert.Nil(t, err)
+    err = db.Sync()
+    assert.Nil(t, err)
+
+    // Of the files the merge writes only sealing the active one counts
+    counter := func(name string) int {
+        var buf bytes.Buffer
+        err := registry.WriteText(&buf)
+        assert.Nil(t, err)
+        match := regexp.MustCompile("\n" + name + " ([0-9]+)\n").FindStringSubmatch(buf.String())
+        assert.NotNil(t, match)
+        value, _ := strconv.Atoi(match[1])
+        return value
+    }
+    rotations, fsyncs := counter(metrics.FileRotations), counter(metrics.Fsyncs)
+    err = db.Merge()
+    assert.Nil(t, err)
+    assert.Equal(t, rotations + 1, counter(metrics.FileRotations))
+    assert.Equal(t, fsyncs + 1, counter(metrics.Fsyncs))
+
+    var buf bytes.Buffer
+    err = registry.WriteText(&buf)
+    assert.Nil(t, err)
+    text := buf.String()
+    for _, line := range []string {
+        "kvdb_keys 999",
+        "kvdb_cache_hits_total 1",
+        "kvdb_cache_misses_total 1",
+        "kvdb_put_duration_seconds_count 1000",
+        "kvdb_get_duration_seconds_count 2",
+        "kvdb_delete_duration_seconds_count 1",
+        "kvdb_merge_duration_seconds_count 1",
+    } {
+        assert.Contains(t, text, line + "\n")
+    }
+    for _, name := range []string{metrics.BytesWritten, metrics.Fsyncs, metrics.FileRotations, metrics.MergeReclaimedBytes, metrics.DiskBytes} {
+        assert.Regexp(t, "\n" + name + " [1-9]", text)
+    }
+}
+
+type recordingListener struct {
+    NopEventListener
+    rotations []FileRotatedInfo
+    merges []MergeInfo
+    corruptions []CorruptionInfo
+    truncations []RecoveryTruncatedInfo
+    stalls []WriteStallInfo
+    backups []BackupInfo
+}
+
+func (l *recordingListener) OnFileRotated(info FileRotatedInfo) {
+    l.rotations = append(l.rotations, info)
+}
+
+func (l *recordingListener) OnMergeCompleted(info MergeInfo) {
+    l.merges = append(l.merges, info)
+}
+
+func (l *recordingListener) OnCorruptionDetected(info CorruptionInfo) {
+    l.corruptions = append(l.corruptions, info)
+}
+
+func (l *recordingListener) OnRecoveryTruncated(info RecoveryTruncatedInfo) {
+    l.truncations = append(l.truncations, info)
+}
+
+func (l *recordingListener) OnBackupCompleted(info BackupInfo) {
+    l.backups = append(l.backups, info)
+}
+
+func (l *recordingListener) OnWriteStall(info WriteStallInfo) {
+    l.stalls = append(l.stalls, info)
+}
+
+func TestDBEventListener(t *testing.T) {
+    listener := &recordingListener{}
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-listener-")
+    options.DirPath = dir
+    options.DataFileSize = 32 * 1024
+    options.MergeTriggerRatio = 0
+    options.EventListener = listener
+    defer os.RemoveAll(dir)
+    defer os.RemoveAll(dir + mergeDirName)
+
+    db, err := Open(options)
+    assert.Nil(t, err)
+    for i := 0; i < 1000; i++ {
+        err = db.Put(utils.GetTestKey(i), utils.GetTestValue(64))
+        assert.Nil(t, err)
+    }
+    assert.True(t, len(listener.rotations) > 0)
+    assert.Equal(t, listener.rotations[0].SealedFileId + 1, listener.rotations[0].ActiveFileId)
+
+    err = db.Merge()
+    assert.Nil(t, err)
+    assert.Equal(t, 1, len(listener.merges))
+    assert.Nil(t, listener.merges[0].Err)
+    assert.True(t, listener.merges[0].FileNum > 0)
+
+    backupDir, _ := os.MkdirTemp("", "kvdb-go-listener-backup-")
+    defer os.RemoveAll(backupDir)
+    err = db.Backup(backupDir)
+    assert.Nil(t, err)
+    assert.Equal(t, 1, len(listener.backups))
+    assert.True(t, listener.backups[0].FileNum > 0)
+
+    // Merge left the active file empty
+    for i := 0; i < 10; i++ {
+        err = db.Put(utils.GetTestKey(i), utils.GetTestValue(64))
+        assert.Nil(t, err)
+    }
+    activeFileName := data.GetDataFileName(dir, db.activeFile.FileId)
+    err = db.Close()
+    assert.Nil(t, err)
+
+    // A torn record at the end of the active file
+    file, err := os.OpenFile(activeFileName, os.O_APPEND | os.O_WRONLY, 0644)
+    assert.Nil(t, err)
+    _, err = file.Write([]byte{1, 2, 3})
+    assert.Nil(t, err)
+    info, _ := file.Stat()
+    assert.Nil(t, file.Close())
+
+    db, err = Open(options)
+    assert.Nil(t, err)
+    assert.Equal(t, 1, len(listener.truncations))
+    assert.Equal(t, info.Size() - 3, listener.truncations[0].Offset)
+    assert.Equal(t, int64(3), listener.truncations[0].DroppedBytes)
+    err = db.Close()
+    assert.Nil(t, err)
+
+    // A flipped bit in the last record of the old active file
+    buf, err := os.ReadFile(activeFileName)
+    assert.Nil(t, err)
+    buf[len(buf) - 5] ^= 1
+    assert.Nil(t, os.WriteFile(activeFileName, buf, 0644))
+
+    _, err = Open(options)
+    assert.Equal(t, data.ErrInvalidCRC, err)
+    assert.Equal(t, 1, len(listener.corruptions))
+}
+
+// Cancelled once Err has been asked enough times, to stop an operation halfway
+type countdownContext struct {
+    context.Context
+    checks int
+}
+
+func (ctx *countdownContext) Err() error {
+    if ctx.checks <= 0 {
+        return context.Canceled
+    }
+    ctx.checks--
+    return nil
+}
+
+func TestDBContext(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-context-")
+    options.DirPath = dir
+    options.DataFileSize = 32 * 1024
+    options.MergeTriggerRatio = 0
+    defer os.RemoveAll(dir)
+    defer os.RemoveAll(dir + mergeDirName)
+
+    db, err := Open(options)
+    assert.Nil(t, err)
+    defer db.Close()
+    for i := 0; i < 1000; i++ {
+        err = db.Put(utils.GetTestKey(i), utils.GetTestValue(64))
+        assert.Nil(t, err)
+    }
+
+    cancelled, cancel := context.WithCancel(context.Background())
+    cancel()
+    err = db.PutCtx(cancelled, utils.GetTestKey(1000), utils.GetTestValue(64))
+    assert.Equal(t, context.Canceled, err)
+    _, err = db.GetCtx(cancelled, utils.GetTestKey(1000))
+    assert.Equal(t, context.Canceled, err)
+    _, err = db.ListKeysCtx(cancelled)
+    assert.Equal(t, context.Canceled, err)
+
+    var folded int
+    err = db.FoldCtx(&countdownContext{Context: context.Background(), checks: 10}, func(key []byte, value []byte) bool {
+        folded++
+        return true
+    })
+    assert.Equal(t, context.Canceled, err)
+    assert.Equal(t, 10, folded)
+
+    iterator := db.NewIteratorCtx(&countdownContext{Context: context.Background(), checks: 5}, DefaultIteratorOptions)
+    var iterated int
+    for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+        iterated++
+    }
+    assert.Equal(t, context.Canceled, iterator.Err())
+    assert.Equal(t, 5, iterated)
+    iterator.Close()
+
+    // The partly merged files are removed and the database is left as it was
+    err = db.MergeCtx(&countdownContext{Context: context.Background(), checks: 100})
+    assert.Equal(t, context.Canceled, err)
+    _, err = os.Stat(dir + mergeDirName)
+    assert.True(t, os.IsNotExist(err))
+    value, err := db.Get(utils.GetTestKey(999))
+    assert.Nil(t, err)
+    assert.NotNil(t, value)
+
+    backupDir, _ := os.MkdirTemp("", "kvdb-go-context-backup-")
+    defer os.RemoveAll(backupDir)
+    err = db.BackupCtx(&countdownContext{Context: context.Background(), checks: 2}, backupDir)
+    assert.Equal(t, context.Canceled, err)
+    entries, err := os.ReadDir(backupDir)
+    assert.Nil(t, err)
+    assert.Equal(t, 0, len(entries))
+
+    err = db.MergeCtx(context.Background())
+    assert.Nil(t, err)
+    err = db.BackupCtx(context.Background(), backupDir)
+    assert.Nil(t, err)
+}
+
+func TestDBWriteStall(t *testing.T) {
+    listener := &recordingListener{}
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-write-stall-")
+    options.DirPath = dir
+    options.MergeTriggerRatio = 0
+    options.EventListener = listener
+    options.WriteStallDelay = time.Second
+    options.SlowdownReclaimableBytes = 10 * 1024
+    options.StopReclaimableBytes = 20 * 1024
+    options.RateLimiter, _ = NewRateLimiter(1 << 30, 1 << 20)
+    defer os.RemoveAll(dir)
+    defer os.RemoveAll(dir + mergeDirName)
+
+    db, err := Open(options)
+    assert.Nil(t, err)
+    defer db.Close()
+
+    for i := 0; db.reclaimableSpace < options.SlowdownReclaimableBytes; i++ {
+        err = db.Put(utils.GetTestKey(0), utils.GetTestValue(1024))
+        assert.Nil(t, err)
+    }
+    assert.Equal(t, 0, len(listener.stalls))
+
+    // Slowed down for longer than the caller waits
+    ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+    defer cancel()
+    err = db.PutCtx(ctx, utils.GetTestKey(0), utils.GetTestValue(1024))
+    assert.Equal(t, context.DeadlineExceeded, err)
+    assert.Equal(t, 1, len(listener.stalls))
+    assert.Equal(t, WriteStallReclaimableSpace, listener.stalls[0].Reason)
+    assert.Equal(t, time.Second, listener.stalls[0].Delay)
+    assert.False(t, listener.stalls[0].Rejected)
+
+    db.options.StopReclaimableBytes = options.SlowdownReclaimableBytes
+    err = db.Put(utils.GetTestKey(0), utils.GetTestValue(1024))
+    assert.Equal(t, ErrWriteStalled, err)
+    assert.True(t, listener.stalls[1].Rejected)
+
+    // Batches and streamed values are stalled as well
+    wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+    err = wb.Put(utils.GetTestKey(1), utils.GetTestValue(1024))
+    assert.Nil(t, err)
+    err = wb.Commit()
+    assert.Equal(t, ErrWriteStalled, err)
+    err = db.PutReader(utils.GetTestKey(2), bytes.NewReader(make([]byte, 1024)), 1024)
+    assert.Equal(t, ErrWriteStalled, err)
+    assert.Equal(t, 4, len(listener.stalls))
+
+    // Deletes and merges still go through, and the merged space lifts the stall without a reopen
+    err = db.Delete(utils.GetTestKey(0))
+    assert.Nil(t, err)
+    err = db.Merge()
+    assert.Nil(t, err)
+    assert.Equal(t, int64(0), db.reclaimableSpace)
+    err = db.Put(utils.GetTestKey(0), utils.GetTestValue(1024))
+    assert.Nil(t, err)
+    err = db.Put(utils.GetTestKey(0), utils.GetTestValue(1024))
+    assert.Nil(t, err)
+    assert.Equal(t, 4, len(listener.stalls))
+
+    // A slowed down Put keeps waiting and fails once the stop threshold is reached meanwhile
+    db.options.SlowdownReclaimableBytes = 1
+    db.options.StopReclaimableBytes = options.StopReclaimableBytes
+    db.options.WriteStallDelay = 20 * time.Millisecond
+    done := make(chan error)
+    go func() {
+        done <- db.Put(utils.GetTestKey(0), utils.GetTestValue(1024))
+    }()
+    time.Sleep(100 * time.Millisecond)
+    db.mutex.Lock()
+    db.options.StopReclaimableBytes = 1
+    db.mutex.Unlock()
+    assert.Equal(t, ErrWriteStalled, <-done)
+    assert.Equal(t, 6, len(listener.stalls))
+    assert.True(t, listener.stalls[5].Rejected)
+
+    // A Put waiting in a stall fails once the database is closed meanwhile
+    db.options.StopReclaimableBytes = options.StopReclaimableBytes
+    db.options.WriteStallDelay = 200 * time.Millisecond
+    go func() {
+        done <- db.Put(utils.GetTestKey(0), utils.GetTestValue(1024))
+    }()
+    time.Sleep(50 * time.Millisecond)
+    err = db.Close()
+    assert.Nil(t, err)
+    assert.Equal(t, ErrDatabaseClosed, <-done)
+}
+
+// Writes what still fits in the budget, then fails with ENOSPC
+type fullDiskVFS struct {
+    fio.OSFS
+    budget *int64
+}
+
+func (fs fullDiskVFS) OpenFile(name string, ioType fio.IOType) (fio.IOManager, error) {
+    ioManager, err := fs.OSFS.OpenFile(name, ioType)
+    if err != nil {
+        return nil, err
+    }
+    return &fullDiskIOManager{IOManager: ioManager, budget: fs.budget}, nil
+}
+
+type fullDiskIOManager struct {
+    fio.IOManager
+    budget *int64
+}
+
+func (m *fullDiskIOManager) Write(b []byte) (int, error) {
+    if int64(len(b)) <= *m.budget {
+        *m.budget -= int64(len(b))
+        return m.IOManager.Write(b)
+    }
+    n, err := m.IOManager.Write(b[:*m.budget])
+    *m.budget = 0
+    if err != nil {
+        return n, err
+    }
+    return n, &os.PathError{Op: "write", Path: "full", Err: syscall.ENOSPC}
+}
+
+func TestDBDiskFull(t *testing.T) {
+    budget := int64(1 << 20)
+    listener := &recordingListener{}
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-disk-full-")
+    options.DirPath = dir
+    options.VFS = fullDiskVFS{budget: &budget}
+    options.EventListener = listener
+    defer os.RemoveAll(dir)
+
+    db, err := Open(options)
+    assert.Nil(t, err)
+    for i := 0; i < 10; i++ {
+        err = db.Put(utils.GetTestKey(i), utils.GetTestValue(1024))
+        assert.Nil(t, err)
+    }
+
+    budget = 100
+    err = db.Put(utils.GetTestKey(10), utils.GetTestValue(1024))
+    assert.Equal(t, ErrDiskFull, err)
+
+    // The partial record is gone and the active file stays in use
+    size, err := db.activeFile.IOManager.Size()
+    assert.Nil(t, err)
+    assert.Equal(t, db.activeFile.WriteOffset, size)
+    activeFileId := db.activeFile.FileId
+    _, err = db.Get(utils.GetTestKey(5))
+    assert.Nil(t, err)
+
+    budget = 1 << 20
+    err = db.Put(utils.GetTestKey(10), utils.GetTestValue(1024))
+    assert.Nil(t, err)
+    assert.Equal(t, activeFileId, db.activeFile.FileId)
+    err = db.Close()
+    assert.Nil(t, err)
+
+    db, err = Open(options)
+    assert.Nil(t, err)
+    defer db.Close()
+    assert.Equal(t, 0, len(listener.truncations))
+    assert.Equal(t, 11, len(db.ListKeys()))
+}
+
+func TestDBDiskQuota(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-disk-quota-")
+    options.DirPath = dir
+    options.MaxDiskBytes = 64 * 1024
+    defer os.RemoveAll(dir)
+
+    options.MaxDiskBytes = -1
+    _, err := Open(options)
+    assert.Equal(t, ErrDiskQuotaInvalid, err)
+    options.MaxDiskBytes = 64 * 1024
+
+    db, err := Open(options)
+    assert.Nil(t, err)
+    var i int
+    for ; i < 1000 && err == nil; i++ {
+        err = db.Put(utils.GetTestKey(i), utils.GetTestValue(1024))
+    }
+    assert.Equal(t, ErrDiskFull, err)
+    diskSize, err := db.diskSize()
+    assert.Nil(t, err)
+    assert.True(t, diskSize <= options.MaxDiskBytes)
+
+    // Reads and deletes still work, a batch with puts is rejected as a whole
+    _, err = db.Get(utils.GetTestKey(0))
+    assert.Nil(t, err)
+    wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+    assert.Nil(t, wb.Delete(utils.GetTestKey(1)))
+    assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.GetTestValue(1024)))
+    assert.Equal(t, ErrDiskFull, wb.Commit())
+    err = db.Delete(utils.GetTestKey(0))
+    assert.Nil(t, err)
+    err = db.Close()
+    assert.Nil(t, err)
+
+    // No file system has this much free
+    options.MaxDiskBytes = 0
+    options.MinFreeDiskBytes = 1 << 62
+    db, err = Open(options)
+    assert.Nil(t, err)
+    defer db.Close()
+    err = db.Put(utils.GetTestKey(0), utils.GetTestValue(1024))
+    assert.Equal(t, ErrDiskFull, err)
+    err = db.Delete(utils.GetTestKey(1))
+    assert.Nil(t, err)
+}
@@ -13,7 +13,42 @@ var (
     ErrExceedMaxBatchSize = errors.New("exceed max batch size")
     ErrMergeInProgress = errors.New("merge in progress")
     ErrDatabaseIsInUse = errors.New("database is in use")
+    ErrDatabaseClosed = errors.New("database is closed")
     ErrMergeTriggerRatioInvalid = errors.New("merge trigger ratio is invalid")
     ErrMergeTriggerRatioNotReached = errors.New("merge trigger ratio not reached")
     ErrDiskSpaceNotEnoughForMerge = errors.New("disk space not enough for merge")
+    ErrValueCacheBytesInvalid = errors.New("value cache bytes is invalid")
+    ErrBloomFalsePositiveRateInvalid = errors.New("bloom filter false positive rate is invalid")
+    ErrChecksumTypeInvalid = errors.New("checksum type is invalid")
+    ErrValueLogThresholdInvalid = errors.New("value log threshold is invalid")
+    ErrDiscardRatioInvalid = errors.New("discard ratio is invalid")
+    ErrKeyTooLarge = errors.New("key is too large")
+    ErrValueTooLarge = errors.New("value is too large")
+    ErrLogRecordTooLarge = errors.New("log record does not fit in a data file")
+    ErrMaxKeyValueSizeInvalid = errors.New("max key or value size is invalid")
+    ErrWatchOptionsInvalid = errors.New("watch buffer or history size is invalid")
+    ErrWatchSeqNotReached = errors.New("watch sequence number is not reached yet")
+    ErrReadOnly = errors.New("database is read only")
+    ErrDataDirectoryNotFound = errors.New("data directory does not exist")
+    ErrDataFilesRewritten = errors.New("data files were rewritten by a merge, reopen the database")
+    ErrBackupDirNotEmpty = errors.New("backup directory is not empty")
+    ErrRefreshUnsupported = errors.New("refresh is not supported with the B+ tree index")
+    ErrReplicaDiverged = errors.New("replica has diverged from the leader")
+    ErrReplicaIndexTypeUnsupported = errors.New("replica does not support the B+ tree index")
+    ErrReplicaPromoted = errors.New("replica has been promoted")
+    ErrShardNumInvalid = errors.New("shard number is invalid")
+    ErrShardNumMismatch = errors.New("shard number does not match the existing shards")
+    ErrShardedBatchIncomplete = errors.New("sharded batch is committed on some shards only, it is completed before the next write or on the next open")
+    ErrWriteBatchUnsupported = errors.New("write batch is not supported by a B+ tree index without its sequence number file")
+    ErrExportFormatUnsupported = errors.New("export format is not supported")
+    ErrImportDataCorrupted = errors.New("import data is corrupted")
+    ErrStagingDirNotEmpty = errors.New("bulk load staging directory is not empty")
+    ErrBulkLoaderFinished = errors.New("bulk loader is already finished")
+    ErrBulkLoadNotFinished = errors.New("bulk load is not finished")
+    ErrInMemoryUnsupported = errors.New("not supported by an in-memory database")
+    ErrRateLimitInvalid = errors.New("rate limit must be positive and burst must not be negative")
+    ErrWriteStalled = errors.New("write stalled by too much reclaimable space or disk usage")
+    ErrWriteStallOptionsInvalid = errors.New("write stall options are invalid")
+    ErrDiskFull = errors.New("disk is full or the disk quota is used up")
+    ErrDiskQuotaInvalid = errors.New("disk quota or free space reserve is invalid")
 )
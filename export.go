@@ -0,0 +1,382 @@
+package kvdb_go
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/csv"
+    "encoding/json"
+    "io"
+    "math"
+    "unicode/utf8"
+)
+
+type ExportFormat = byte
+
+const (
+    // One JSON object per line, keys and values that are no valid UTF-8 are base64 encoded
+    ExportJSONLines ExportFormat = iota + 1
+    // key,value,encoding rows, the encoding column is base64 when key and value are base64 encoded
+    ExportCSV
+    // Magic header followed by keySize key valueSize value records with varint sizes
+    ExportBinary
+)
+
+const importBatchSize = 1000
+
+var (
+    exportBinaryMagic = []byte("KVDBEXP1")
+    exportCSVHeader = []string{"key", "value", "encoding"}
+)
+
+func ParseExportFormat(name string) (ExportFormat, error) {
+    switch name {
+    case "jsonl", "json":
+        return ExportJSONLines, nil
+    case "csv":
+        return ExportCSV, nil
+    case "binary", "bin":
+        return ExportBinary, nil
+    default:
+        return 0, ErrExportFormatUnsupported
+    }
+}
+
+type exportRecord struct {
+    Key *string `json:"key,omitempty"`
+    KeyBase64 *string `json:"key_base64,omitempty"`
+    Value *string `json:"value,omitempty"`
+    ValueBase64 *string `json:"value_base64,omitempty"`
+}
+
+// Writes every live pair whose key has one of the prefixes, or every pair without prefixes.
+// Returns the number of pairs written.
+func (db *DB) Export(w io.Writer, format ExportFormat, prefixes ...[]byte) (int, error) {
+    bufWriter := bufio.NewWriter(w)
+    var csvWriter *csv.Writer
+    switch format {
+    case ExportJSONLines:
+    case ExportCSV:
+        csvWriter = csv.NewWriter(bufWriter)
+        if err := csvWriter.Write(exportCSVHeader); err != nil {
+            return 0, err
+        }
+    case ExportBinary:
+        if _, err := bufWriter.Write(exportBinaryMagic); err != nil {
+            return 0, err
+        }
+    default:
+        return 0, ErrExportFormatUnsupported
+    }
+
+    var count int
+    iterator := db.NewIterator(DefaultIteratorOptions)
+    defer iterator.Close()
+    for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+        key := iterator.Key()
+        if !hasAnyPrefix(key, prefixes) {
+            continue
+        }
+
+        value, err := iterator.Value()
+        if err == ErrKeyNotFound {
+            continue
+        }
+        if err != nil {
+            return count, err
+        }
+
+        switch format {
+        case ExportJSONLines:
+            err = writeJSONLine(bufWriter, key, value)
+        case ExportCSV:
+            err = writeCSVRow(csvWriter, key, value)
+        case ExportBinary:
+            err = writeBinaryRecord(bufWriter, key, value)
+        }
+        if err != nil {
+            return count, err
+        }
+        count++
+    }
+
+    if csvWriter != nil {
+        csvWriter.Flush()
+        if err := csvWriter.Error(); err != nil {
+            return count, err
+        }
+    }
+    return count, bufWriter.Flush()
+}
+
+// Reads pairs written by Export and puts those whose key has one of the prefixes, or every pair without prefixes.
+// Pairs are committed in batches, a failure leaves the batches before it in place.
+// Returns the number of pairs imported.
+func (db *DB) Import(r io.Reader, format ExportFormat, prefixes ...[]byte) (int, error) {
+    if !db.canUseWriteBatch() {
+        return 0, ErrWriteBatchUnsupported
+    }
+    next, err := newImportReader(r, format, db.options)
+    if err != nil {
+        return 0, err
+    }
+
+    // A key repeated within a batch is written once and counted once
+    batchOptions := WriteBatchOptions{MaxBatchSize: importBatchSize, SyncWrites: false}
+    wb := db.NewWriteBatch(batchOptions)
+    var count int
+    for {
+        key, value, err := next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return count, err
+        }
+        if !hasAnyPrefix(key, prefixes) {
+            continue
+        }
+
+        if err := wb.Put(key, value); err != nil {
+            return count, err
+        }
+
+        if len(wb.pendingWrites) == importBatchSize {
+            pending := len(wb.pendingWrites)
+            if err := wb.Commit(); err != nil {
+                return count, err
+            }
+            count += pending
+            wb = db.NewWriteBatch(batchOptions)
+        }
+    }
+
+    pending := len(wb.pendingWrites)
+    if err := wb.Commit(); err != nil {
+        return count, err
+    }
+    count += pending
+
+    return count, db.Sync()
+}
+
+// Returns a function yielding the pairs of an export one by one, and io.EOF after the last.
+// Binary sizes are checked against the limits of the options before anything is read.
+func newImportReader(r io.Reader, format ExportFormat, options Options) (func() ([]byte, []byte, error), error) {
+    bufReader := bufio.NewReader(r)
+
+    switch format {
+    case ExportJSONLines:
+        decoder := json.NewDecoder(bufReader)
+        return func() ([]byte, []byte, error) {
+            return readJSONLine(decoder)
+        }, nil
+    case ExportCSV:
+        csvReader := csv.NewReader(bufReader)
+        csvReader.FieldsPerRecord = len(exportCSVHeader)
+        if _, err := csvReader.Read(); err != nil {
+            if err == io.EOF {
+                return func() ([]byte, []byte, error) {
+                    return nil, nil, io.EOF
+                }, nil
+            }
+            return nil, ErrImportDataCorrupted
+        }
+        return func() ([]byte, []byte, error) {
+            return readCSVRow(csvReader)
+        }, nil
+    case ExportBinary:
+        magic := make([]byte, len(exportBinaryMagic))
+        if _, err := io.ReadFull(bufReader, magic); err != nil || !bytes.Equal(magic, exportBinaryMagic) {
+            return nil, ErrImportDataCorrupted
+        }
+        maxKeySize, maxValueSize := importFieldLimits(options)
+        return func() ([]byte, []byte, error) {
+            return readBinaryRecord(bufReader, maxKeySize, maxValueSize)
+        }, nil
+    default:
+        return nil, ErrExportFormatUnsupported
+    }
+}
+
+func hasAnyPrefix(key []byte, prefixes [][]byte) bool {
+    if len(prefixes) == 0 {
+        return true
+    }
+    for _, prefix := range prefixes {
+        if bytes.HasPrefix(key, prefix) {
+            return true
+        }
+    }
+    return false
+}
+
+func writeJSONLine(w io.Writer, key []byte, value []byte) error {
+    record := &exportRecord{}
+    record.Key, record.KeyBase64 = encodeExportField(key)
+    record.Value, record.ValueBase64 = encodeExportField(value)
+
+    line, err := json.Marshal(record)
+    if err != nil {
+        return err
+    }
+    if _, err := w.Write(line); err != nil {
+        return err
+    }
+    _, err = w.Write([]byte{'\n'})
+    return err
+}
+
+func readJSONLine(decoder *json.Decoder) ([]byte, []byte, error) {
+    record := &exportRecord{}
+    if err := decoder.Decode(record); err != nil {
+        if err == io.EOF {
+            return nil, nil, err
+        }
+        return nil, nil, ErrImportDataCorrupted
+    }
+
+    key, err := decodeExportField(record.Key, record.KeyBase64)
+    if err != nil || len(key) == 0 {
+        return nil, nil, ErrImportDataCorrupted
+    }
+    value, err := decodeExportField(record.Value, record.ValueBase64)
+    if err != nil {
+        return nil, nil, ErrImportDataCorrupted
+    }
+    return key, value, nil
+}
+
+func encodeExportField(field []byte) (*string, *string) {
+    if utf8.Valid(field) {
+        text := string(field)
+        return &text, nil
+    }
+    encoded := base64.StdEncoding.EncodeToString(field)
+    return nil, &encoded
+}
+
+func decodeExportField(text *string, encoded *string) ([]byte, error) {
+    if encoded != nil {
+        return base64.StdEncoding.DecodeString(*encoded)
+    }
+    if text != nil {
+        return []byte(*text), nil
+    }
+    return []byte{}, nil
+}
+
+func writeCSVRow(w *csv.Writer, key []byte, value []byte) error {
+    // The csv reader drops carriage returns before newlines, so those fields go as base64 too
+    if utf8.Valid(key) && utf8.Valid(value) && !bytes.ContainsRune(key, '\r') && !bytes.ContainsRune(value, '\r') {
+        return w.Write([]string{string(key), string(value), ""})
+    }
+    return w.Write([]string {
+        base64.StdEncoding.EncodeToString(key),
+        base64.StdEncoding.EncodeToString(value),
+        "base64",
+    })
+}
+
+func readCSVRow(r *csv.Reader) ([]byte, []byte, error) {
+    row, err := r.Read()
+    if err != nil {
+        if err == io.EOF {
+            return nil, nil, err
+        }
+        return nil, nil, ErrImportDataCorrupted
+    }
+
+    switch row[2] {
+    case "":
+        return []byte(row[0]), []byte(row[1]), nil
+    case "base64":
+        key, err := base64.StdEncoding.DecodeString(row[0])
+        if err != nil {
+            return nil, nil, ErrImportDataCorrupted
+        }
+        value, err := base64.StdEncoding.DecodeString(row[1])
+        if err != nil {
+            return nil, nil, ErrImportDataCorrupted
+        }
+        return key, value, nil
+    default:
+        return nil, nil, ErrImportDataCorrupted
+    }
+}
+
+func writeBinaryRecord(w io.Writer, key []byte, value []byte) error {
+    header := make([]byte, binary.MaxVarintLen64 * 2)
+    index := binary.PutUvarint(header, uint64(len(key)))
+    if _, err := w.Write(header[:index]); err != nil {
+        return err
+    }
+    if _, err := w.Write(key); err != nil {
+        return err
+    }
+
+    index = binary.PutUvarint(header, uint64(len(value)))
+    if _, err := w.Write(header[:index]); err != nil {
+        return err
+    }
+    _, err := w.Write(value)
+    return err
+}
+
+// The largest sizes validateKeyValue may accept, a pair up to them is read and rejected by the writer
+func importFieldLimits(options Options) (uint64, uint64) {
+    maxKeySize := uint64(options.DataFileSize)
+    if options.MaxKeySize > 0 {
+        maxKeySize = uint64(options.MaxKeySize)
+    }
+
+    // Separated values are bounded by the value log only
+    maxValueSize := uint64(options.DataFileSize)
+    if options.ValueLogThreshold > 0 {
+        maxValueSize = math.MaxUint32
+    }
+    if options.MaxValueSize > 0 {
+        maxValueSize = uint64(options.MaxValueSize)
+    }
+    return maxKeySize, maxValueSize
+}
+
+func readBinaryRecord(r *bufio.Reader, maxKeySize uint64, maxValueSize uint64) ([]byte, []byte, error) {
+    keySize, err := binary.ReadUvarint(r)
+    if err != nil {
+        if err == io.EOF {
+            return nil, nil, err
+        }
+        return nil, nil, ErrImportDataCorrupted
+    }
+    if keySize > maxKeySize {
+        return nil, nil, ErrKeyTooLarge
+    }
+    key, err := readBinaryField(r, keySize)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    valueSize, err := binary.ReadUvarint(r)
+    if err != nil {
+        return nil, nil, ErrImportDataCorrupted
+    }
+    if valueSize > maxValueSize {
+        return nil, nil, ErrValueTooLarge
+    }
+    value, err := readBinaryField(r, valueSize)
+    if err != nil {
+        return nil, nil, err
+    }
+    return key, value, nil
+}
+
+// The buffer grows with the bytes read, a size past the end of a short input allocates no more than the input
+func readBinaryField(r io.Reader, size uint64) ([]byte, error) {
+    field, err := io.ReadAll(io.LimitReader(r, int64(size)))
+    if err != nil || uint64(len(field)) != size {
+        return nil, ErrImportDataCorrupted
+    }
+    return field, nil
+}
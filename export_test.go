@@ -0,0 +1,170 @@
+package kvdb_go
+
+import (
+    "bytes"
+    "encoding/binary"
+    "kvdb-go/data"
+    "kvdb-go/utils"
+    "os"
+    "path/filepath"
+    "runtime"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestDBExportImport(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-export-")
+    options.DirPath = dir
+    db, err := Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+
+    for i := 0; i < 1500; i++ {
+        err := db.Put(utils.GetTestKey(i), utils.GetTestValue(16))
+        assert.Nil(t, err)
+    }
+    binaryKey := []byte{0xff, 0x00, 0xfe}
+    err = db.Put(binaryKey, []byte("line\r\nbreak"))
+    assert.Nil(t, err)
+    err = db.Put([]byte("text"), []byte{0x80, 0x81})
+    assert.Nil(t, err)
+    err = db.Put([]byte("empty"), []byte{})
+    assert.Nil(t, err)
+    err = db.Delete(utils.GetTestKey(0))
+    assert.Nil(t, err)
+
+    _, err = ParseExportFormat("xml")
+    assert.Equal(t, ErrExportFormatUnsupported, err)
+
+    for _, format := range []ExportFormat{ExportJSONLines, ExportCSV, ExportBinary} {
+        buf := new(bytes.Buffer)
+        count, err := db.Export(buf, format)
+        assert.Nil(t, err)
+        assert.Equal(t, 1502, count)
+
+        options2 := DefaultOptions
+        dir2, _ := os.MkdirTemp("", "kvdb-go-import-")
+        options2.DirPath = dir2
+        db2, err := Open(options2)
+        assert.Nil(t, err)
+
+        count, err = db2.Import(bytes.NewReader(buf.Bytes()), format)
+        assert.Nil(t, err)
+        assert.Equal(t, 1502, count)
+        assert.Equal(t, 1502, len(db2.ListKeys()))
+
+        for _, key := range [][]byte{utils.GetTestKey(1499), binaryKey, []byte("text"), []byte("empty")} {
+            expected, _ := db.Get(key)
+            value, err := db2.Get(key)
+            assert.Nil(t, err)
+            assert.Equal(t, expected, value)
+        }
+        _, err = db2.Get(utils.GetTestKey(0))
+        assert.Equal(t, ErrKeyNotFound, err)
+        destroyDB(db2)
+    }
+
+    // Prefix filters on both sides
+    buf := new(bytes.Buffer)
+    count, err := db.Export(buf, ExportJSONLines, []byte("te"), []byte("em"))
+    assert.Nil(t, err)
+    assert.Equal(t, 2, count)
+
+    options2 := DefaultOptions
+    dir2, _ := os.MkdirTemp("", "kvdb-go-import-")
+    options2.DirPath = dir2
+    db2, err := Open(options2)
+    defer destroyDB(db2)
+    assert.Nil(t, err)
+    count, err = db2.Import(bytes.NewReader(buf.Bytes()), ExportJSONLines, []byte("text"))
+    assert.Nil(t, err)
+    assert.Equal(t, 1, count)
+
+    _, err = db2.Import(bytes.NewReader([]byte("not a dump")), ExportBinary)
+    assert.Equal(t, ErrImportDataCorrupted, err)
+
+    // A key repeated within a batch counts once
+    lines := "{\"key\":\"dup\",\"value\":\"1\"}\n{\"key\":\"dup\",\"value\":\"2\"}\n{\"key\":\"other\",\"value\":\"3\"}\n"
+    count, err = db2.Import(bytes.NewReader([]byte(lines)), ExportJSONLines)
+    assert.Nil(t, err)
+    assert.Equal(t, 2, count)
+    value, err := db2.Get([]byte("dup"))
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("2"), value)
+}
+
+func TestDBImportBPTreeWithoutSeqNum(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-import-bptree-")
+    options.DirPath = dir
+    options.IndexType = BPTreeIndex
+    db, err := Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+    err = db.Put(utils.GetTestKey(1), utils.GetTestValue(16))
+    assert.Nil(t, err)
+    err = db.Close()
+    assert.Nil(t, err)
+
+    // As if the database was not closed cleanly
+    err = os.Remove(filepath.Join(dir, data.SeqNumFileName))
+    assert.Nil(t, err)
+    db, err = Open(options)
+    defer db.Close()
+    assert.Nil(t, err)
+    _, err = db.Import(bytes.NewReader(nil), ExportBinary)
+    assert.Equal(t, ErrWriteBatchUnsupported, err)
+}
+
+func TestDBImportOversizedField(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-import-oversized-")
+    options.DirPath = dir
+    db, err := Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+
+    header := make([]byte, binary.MaxVarintLen64)
+    record := func(fields ...interface{}) []byte {
+        dump := append([]byte{}, exportBinaryMagic...)
+        for _, field := range fields {
+            switch f := field.(type) {
+            case uint64:
+                dump = append(dump, header[:binary.PutUvarint(header, f)]...)
+            case string:
+                dump = append(dump, f...)
+            }
+        }
+        return dump
+    }
+
+    // Sizes past the limits fail before anything is allocated for them
+    _, err = db.Import(bytes.NewReader(record(uint64(1 << 31), "k")), ExportBinary)
+    assert.Equal(t, ErrKeyTooLarge, err)
+    _, err = db.Import(bytes.NewReader(record(uint64(1), "k", uint64(1 << 31), "v")), ExportBinary)
+    assert.Equal(t, ErrValueTooLarge, err)
+
+    stagingDir := dir + "-staging"
+    defer os.RemoveAll(stagingDir)
+    loader, err := NewBulkLoader(stagingDir, options)
+    assert.Nil(t, err)
+    _, err = loader.Import(bytes.NewReader(record(uint64(1 << 31), "k")), ExportBinary)
+    assert.Equal(t, ErrKeyTooLarge, err)
+    err = loader.Abort()
+    assert.Nil(t, err)
+
+    // Values for the value log may be that large, a short input is read without allocating the size
+    db.options.ValueLogThreshold = 1024
+    var before, after runtime.MemStats
+    runtime.ReadMemStats(&before)
+    _, err = db.Import(bytes.NewReader(record(uint64(1), "k", uint64(1 << 31), "v")), ExportBinary)
+    assert.Equal(t, ErrImportDataCorrupted, err)
+    runtime.ReadMemStats(&after)
+    assert.Less(t, after.TotalAlloc - before.TotalAlloc, uint64(1 << 20))
+
+    count, err := db.Import(bytes.NewReader(record(uint64(1), "k", uint64(1), "v")), ExportBinary)
+    assert.Nil(t, err)
+    assert.Equal(t, 1, count)
+}
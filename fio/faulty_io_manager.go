@@ -0,0 +1,543 @@
+package fio
+
+import (
+    "errors"
+    "io"
+    "math/rand"
+    "os"
+    "path/filepath"
+    "sync"
+)
+
+var (
+    ErrInjectedFault = errors.New("injected io fault")
+    ErrCrashed = errors.New("file is gone with a simulated crash")
+)
+
+type Fault = byte
+
+const (
+    NoFault Fault = iota
+    FaultWriteError // Nothing is written
+    FaultShortWrite // A random part of the buffer is written
+    FaultCorruptWrite // The write succeeds with one bit flipped
+    FaultSyncError // The data stays unsynced
+)
+
+type FaultOp = byte
+
+const (
+    FaultOpWrite FaultOp = iota
+    FaultOpSync
+)
+
+// Picks the fault of each write and sync, it is called with the seeded rand of the injector
+type FaultSchedule func(fileName string, op FaultOp, rand *rand.Rand) Fault
+
+// Faults every write and sync with the given probability, picking one of the faults that apply to it
+func RandomFaults(rate float64, faults ...Fault) FaultSchedule {
+    var writeFaults, syncFaults []Fault
+    for _, fault := range faults {
+        if fault == FaultSyncError {
+            syncFaults = append(syncFaults, fault)
+        } else if fault != NoFault {
+            writeFaults = append(writeFaults, fault)
+        }
+    }
+
+    return func(fileName string, op FaultOp, rand *rand.Rand) Fault {
+        candidates := writeFaults
+        if op == FaultOpSync {
+            candidates = syncFaults
+        }
+        if len(candidates) == 0 || rand.Float64() >= rate {
+            return NoFault
+        }
+        return candidates[rand.Intn(len(candidates))]
+    }
+}
+
+// Faults the n-th write or sync counted from 0 across all files
+func FaultAt(n int, fault Fault) FaultSchedule {
+    var ops int
+    return func(fileName string, op FaultOp, rand *rand.Rand) Fault {
+        ops++
+        if ops - 1 == n {
+            return fault
+        }
+        return NoFault
+    }
+}
+
+// A VFS that simulates the disk of one machine. Writes stay in memory until they are synced, so Crash can drop them
+// like a power loss would. Closing a file hands its writes to the underlying IOManager, a closed file
+// counts as durable. Creations, renames and removals are applied right away but undone by Crash
+// until the directories they touch are synced.
+type FaultInjector struct {
+    VFS // Keeps the files, OSFS unless set before use
+    mutex sync.Mutex
+    schedule FaultSchedule
+    rand *rand.Rand
+    files map[*FaultyIOManager]struct{}
+    dirOps []*dirOp
+    crashed bool
+}
+
+// A namespace change that is lost in a crash until each of its directories is synced.
+// Like on journaling filesystems a rename is durable once the new name's directory is.
+type dirOp struct {
+    dirs map[string]struct{}
+    undo func() error
+}
+
+// The content of a file or a directory tree before it was removed or replaced
+type fileSnapshot struct {
+    name string
+    isDir bool
+    content []byte
+    children []*fileSnapshot
+}
+
+func NewFaultInjector(schedule FaultSchedule, seed int64) *FaultInjector {
+    return &FaultInjector {
+        VFS: OSFS{},
+        schedule: schedule,
+        rand: rand.New(rand.NewSource(seed)),
+        files: make(map[*FaultyIOManager]struct{}),
+    }
+}
+
+// Wraps the IOManagers of the underlying VFS
+func (fi *FaultInjector) OpenFile(fileName string, ioType IOType) (IOManager, error) {
+    if fi.isCrashed() {
+        return nil, ErrCrashed
+    }
+
+    _, statErr := fi.VFS.Stat(fileName)
+    ioManager, err := fi.VFS.OpenFile(fileName, ioType)
+    if err != nil {
+        return nil, err
+    }
+    if os.IsNotExist(statErr) {
+        fi.recordDirOp(func() error {
+            return fi.VFS.Remove(fileName)
+        }, fileName)
+    }
+    return fi.Wrap(fileName, ioManager), nil
+}
+
+func (fi *FaultInjector) MkdirAll(dir string) error {
+    if fi.isCrashed() {
+        return ErrCrashed
+    }
+
+    // Only the topmost directory that is created has to be undone
+    created := ""
+    for parent := filepath.Clean(dir); ; parent = filepath.Dir(parent) {
+        if _, err := fi.VFS.Stat(parent); err == nil || !os.IsNotExist(err) {
+            break
+        }
+        created = parent
+        if filepath.Dir(parent) == parent {
+            break
+        }
+    }
+    if err := fi.VFS.MkdirAll(dir); err != nil {
+        return err
+    }
+    if created != "" {
+        fi.recordDirOp(func() error {
+            return fi.VFS.RemoveAll(created)
+        }, created)
+    }
+    return nil
+}
+
+func (fi *FaultInjector) Rename(oldName string, newName string) error {
+    if fi.isCrashed() {
+        return ErrCrashed
+    }
+
+    replaced, err := fi.snapshot(newName)
+    if err != nil {
+        return err
+    }
+    if err := fi.VFS.Rename(oldName, newName); err != nil {
+        return err
+    }
+    fi.recordDirOp(func() error {
+        // The old directory may be gone for good, then so is the file
+        if err := fi.VFS.Rename(newName, oldName); os.IsNotExist(err) {
+            err = fi.VFS.Remove(newName)
+            if err != nil {
+                return err
+            }
+        } else if err != nil {
+            return err
+        }
+        return fi.restore(replaced)
+    }, newName)
+    return nil
+}
+
+func (fi *FaultInjector) Link(oldName string, newName string) error {
+    if fi.isCrashed() {
+        return ErrCrashed
+    }
+
+    if err := fi.VFS.Link(oldName, newName); err != nil {
+        return err
+    }
+    fi.recordDirOp(func() error {
+        return fi.VFS.Remove(newName)
+    }, newName)
+    return nil
+}
+
+func (fi *FaultInjector) Remove(name string) error {
+    return fi.remove(name, fi.VFS.Remove)
+}
+
+func (fi *FaultInjector) RemoveAll(name string) error {
+    return fi.remove(name, fi.VFS.RemoveAll)
+}
+
+func (fi *FaultInjector) remove(name string, remove func(string) error) error {
+    if fi.isCrashed() {
+        return ErrCrashed
+    }
+
+    removed, err := fi.snapshot(name)
+    if err != nil {
+        return err
+    }
+    if err := remove(name); err != nil {
+        return err
+    }
+    if removed != nil {
+        fi.recordDirOp(func() error {
+            return fi.restore(removed)
+        }, name)
+    }
+    return nil
+}
+
+// Makes the namespace changes in the directory durable
+func (fi *FaultInjector) SyncDir(dir string) error {
+    if fi.isCrashed() {
+        return ErrCrashed
+    }
+    if err := fi.VFS.SyncDir(dir); err != nil {
+        return err
+    }
+
+    fi.mutex.Lock()
+    defer fi.mutex.Unlock()
+    dir = filepath.Clean(dir)
+    pending := fi.dirOps[:0]
+    for _, op := range fi.dirOps {
+        delete(op.dirs, dir)
+        if len(op.dirs) > 0 {
+            pending = append(pending, op)
+        }
+    }
+    fi.dirOps = pending
+    return nil
+}
+
+func (fi *FaultInjector) isCrashed() bool {
+    fi.mutex.Lock()
+    defer fi.mutex.Unlock()
+    return fi.crashed
+}
+
+func (fi *FaultInjector) recordDirOp(undo func() error, names ...string) {
+    op := &dirOp{dirs: make(map[string]struct{}), undo: undo}
+    for _, name := range names {
+        op.dirs[filepath.Dir(filepath.Clean(name))] = struct{}{}
+    }
+
+    fi.mutex.Lock()
+    defer fi.mutex.Unlock()
+    fi.dirOps = append(fi.dirOps, op)
+}
+
+// Returns nil when nothing is at the name. Only what reached the underlying VFS is kept.
+func (fi *FaultInjector) snapshot(name string) (*fileSnapshot, error) {
+    info, err := fi.VFS.Stat(name)
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    snapshot := &fileSnapshot{name: name, isDir: info.IsDir()}
+    if snapshot.isDir {
+        entries, err := fi.VFS.ReadDir(name)
+        if err != nil {
+            return nil, err
+        }
+        for _, entry := range entries {
+            child, err := fi.snapshot(filepath.Join(name, entry.Name()))
+            if err != nil {
+                return nil, err
+            }
+            snapshot.children = append(snapshot.children, child)
+        }
+        return snapshot, nil
+    }
+
+    file, err := fi.VFS.OpenFile(name, StandardFileIO)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+    size, err := file.Size()
+    if err != nil {
+        return nil, err
+    }
+    snapshot.content = make([]byte, size)
+    if _, err := file.Read(snapshot.content, 0); err != nil && err != io.EOF {
+        return nil, err
+    }
+    return snapshot, nil
+}
+
+func (fi *FaultInjector) restore(snapshot *fileSnapshot) error {
+    if snapshot == nil {
+        return nil
+    }
+    if snapshot.isDir {
+        if err := fi.VFS.MkdirAll(snapshot.name); err != nil {
+            return err
+        }
+        for _, child := range snapshot.children {
+            if err := fi.restore(child); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+
+    if err := fi.VFS.RemoveAll(snapshot.name); err != nil {
+        return err
+    }
+    file, err := fi.VFS.OpenFile(snapshot.name, StandardFileIO)
+    if err != nil {
+        return err
+    }
+    if _, err := file.Write(snapshot.content); err != nil {
+        _ = file.Close()
+        return err
+    }
+    if err := file.Sync(); err != nil {
+        _ = file.Close()
+        return err
+    }
+    return file.Close()
+}
+
+func (fi *FaultInjector) Wrap(fileName string, ioManager IOManager) *FaultyIOManager {
+    fi.mutex.Lock()
+    defer fi.mutex.Unlock()
+
+    file := &FaultyIOManager {
+        injector: fi,
+        fileName: fileName,
+        inner: ioManager,
+    }
+    fi.files[file] = struct{}{}
+    return file
+}
+
+func (fi *FaultInjector) SetSchedule(schedule FaultSchedule) {
+    fi.mutex.Lock()
+    defer fi.mutex.Unlock()
+    fi.schedule = schedule
+}
+
+// Every open file keeps a random prefix of its unsynced writes, a torn write, and fails from now on.
+// The underlying IOManagers are closed. Of the namespace changes in directories that were not synced
+// a random prefix is kept and the rest is undone.
+func (fi *FaultInjector) Crash() error {
+    fi.mutex.Lock()
+    defer fi.mutex.Unlock()
+
+    fi.crashed = true
+    var firstErr error
+    for file := range fi.files {
+        kept := fi.rand.Intn(len(file.unsynced) + 1)
+        if err := file.closeInner(file.unsynced[:kept]); err != nil && firstErr == nil {
+            firstErr = err
+        }
+    }
+    fi.files = make(map[*FaultyIOManager]struct{})
+
+    kept := fi.rand.Intn(len(fi.dirOps) + 1)
+    for i := len(fi.dirOps) - 1; i >= kept; i-- {
+        // A name a later change removed again was restored before, or never came back
+        if err := fi.dirOps[i].undo(); err != nil && !os.IsNotExist(err) && firstErr == nil {
+            firstErr = err
+        }
+    }
+    fi.dirOps = nil
+    return firstErr
+}
+
+// The caller holds fi.mutex
+func (fi *FaultInjector) nextFault(fileName string, op FaultOp) Fault {
+    if fi.schedule == nil {
+        return NoFault
+    }
+    return fi.schedule(fileName, op, fi.rand)
+}
+
+type FaultyIOManager struct {
+    injector *FaultInjector
+    fileName string
+    inner IOManager
+    unsynced []byte
+    closed bool
+}
+
+func (f *FaultyIOManager) Read(b []byte, offset int64) (int, error) {
+    f.injector.mutex.Lock()
+    defer f.injector.mutex.Unlock()
+    if f.closed {
+        return 0, ErrCrashed
+    }
+
+    innerSize, err := f.inner.Size()
+    if err != nil {
+        return 0, err
+    }
+
+    var n int
+    if offset < innerSize {
+        length := int64(len(b))
+        if length > innerSize - offset {
+            length = innerSize - offset
+        }
+        n, err = f.inner.Read(b[:length], offset)
+        if err != nil && err != io.EOF {
+            return n, err
+        }
+    }
+    if unsyncedOffset := offset + int64(n) - innerSize; n < len(b) && unsyncedOffset >= 0 && unsyncedOffset < int64(len(f.unsynced)) {
+        n += copy(b[n:], f.unsynced[unsyncedOffset:])
+    }
+    if n < len(b) {
+        return n, io.EOF
+    }
+    return n, nil
+}
+
+func (f *FaultyIOManager) Write(b []byte) (int, error) {
+    f.injector.mutex.Lock()
+    defer f.injector.mutex.Unlock()
+    if f.closed {
+        return 0, ErrCrashed
+    }
+
+    switch f.injector.nextFault(f.fileName, FaultOpWrite) {
+    case FaultWriteError:
+        return 0, ErrInjectedFault
+    case FaultShortWrite:
+        n := 0
+        if len(b) > 0 {
+            n = f.injector.rand.Intn(len(b))
+        }
+        f.unsynced = append(f.unsynced, b[:n]...)
+        return n, ErrInjectedFault
+    case FaultCorruptWrite:
+        start := len(f.unsynced)
+        f.unsynced = append(f.unsynced, b...)
+        if len(b) > 0 {
+            f.unsynced[start + f.injector.rand.Intn(len(b))] ^= 1 << uint(f.injector.rand.Intn(8))
+        }
+        return len(b), nil
+    default:
+        f.unsynced = append(f.unsynced, b...)
+        return len(b), nil
+    }
+}
+
+func (f *FaultyIOManager) Sync() error {
+    f.injector.mutex.Lock()
+    defer f.injector.mutex.Unlock()
+    if f.closed {
+        return ErrCrashed
+    }
+
+    if f.injector.nextFault(f.fileName, FaultOpSync) == FaultSyncError {
+        return ErrInjectedFault
+    }
+    if len(f.unsynced) > 0 {
+        if _, err := f.inner.Write(f.unsynced); err != nil {
+            return err
+        }
+        f.unsynced = nil
+    }
+    return f.inner.Sync()
+}
+
+func (f *FaultyIOManager) Close() error {
+    f.injector.mutex.Lock()
+    defer f.injector.mutex.Unlock()
+    if f.closed {
+        return ErrCrashed
+    }
+
+    delete(f.injector.files, f)
+    return f.closeInner(f.unsynced)
+}
+
+func (f *FaultyIOManager) Size() (int64, error) {
+    f.injector.mutex.Lock()
+    defer f.injector.mutex.Unlock()
+    if f.closed {
+        return 0, ErrCrashed
+    }
+
+    size, err := f.inner.Size()
+    if err != nil {
+        return 0, err
+    }
+    return size + int64(len(f.unsynced)), nil
+}
+
+// Unsynced bytes are dropped from the buffer, synced ones from the inner file right away
+func (f *FaultyIOManager) Truncate(size int64) error {
+    f.injector.mutex.Lock()
+    defer f.injector.mutex.Unlock()
+    if f.closed {
+        return ErrCrashed
+    }
+
+    innerSize, err := f.inner.Size()
+    if err != nil {
+        return err
+    }
+    if size >= innerSize {
+        if size - innerSize < int64(len(f.unsynced)) {
+            f.unsynced = f.unsynced[:size - innerSize]
+        }
+        return nil
+    }
+    f.unsynced = nil
+    return f.inner.Truncate(size)
+}
+
+// The caller holds the injector mutex
+func (f *FaultyIOManager) closeInner(kept []byte) error {
+    f.closed = true
+    f.unsynced = nil
+    if len(kept) > 0 {
+        if _, err := f.inner.Write(kept); err != nil {
+            _ = f.inner.Close()
+            return err
+        }
+    }
+    return f.inner.Close()
+}
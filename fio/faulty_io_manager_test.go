@@ -0,0 +1,129 @@
+package fio
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestFaultyIOManager(t *testing.T) {
+    dir, _ := os.MkdirTemp("", "kvdb-go-faulty-io-")
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "test_faulty_io_manager")
+
+    injector := NewFaultInjector(nil, 1)
+    ioManager, err := injector.OpenFile(path, StandardFileIO)
+    assert.Nil(t, err)
+
+    _, err = ioManager.Write([]byte("synced-"))
+    assert.Nil(t, err)
+    err = ioManager.Sync()
+    assert.Nil(t, err)
+    _, err = ioManager.Write([]byte("unsynced"))
+    assert.Nil(t, err)
+
+    // Unsynced writes are read back, but only synced ones are in the file
+    b := make([]byte, 15)
+    n, err := ioManager.Read(b, 0)
+    assert.Nil(t, err)
+    assert.Equal(t, 15, n)
+    assert.Equal(t, []byte("synced-unsynced"), b)
+    size, err := ioManager.Size()
+    assert.Nil(t, err)
+    assert.Equal(t, int64(15), size)
+    info, _ := os.Stat(path)
+    assert.Equal(t, int64(7), info.Size())
+
+    injector.SetSchedule(FaultAt(0, FaultWriteError))
+    n, err = ioManager.Write([]byte("failed"))
+    assert.Equal(t, ErrInjectedFault, err)
+    assert.Equal(t, 0, n)
+    injector.SetSchedule(FaultAt(0, FaultSyncError))
+    err = ioManager.Sync()
+    assert.Equal(t, ErrInjectedFault, err)
+
+    // A crash keeps a prefix of the unsynced writes
+    err = injector.Crash()
+    assert.Nil(t, err)
+    info, _ = os.Stat(path)
+    assert.True(t, info.Size() >= 7 && info.Size() <= 15)
+    _, err = ioManager.Write([]byte("after crash"))
+    assert.Equal(t, ErrCrashed, err)
+    _, err = injector.OpenFile(path, StandardFileIO)
+    assert.Equal(t, ErrCrashed, err)
+}
+
+func TestFaultyIOManagerShortWrite(t *testing.T) {
+    dir, _ := os.MkdirTemp("", "kvdb-go-faulty-io-")
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "test_faulty_io_manager")
+
+    injector := NewFaultInjector(FaultAt(0, FaultShortWrite), 1)
+    ioManager, err := injector.OpenFile(path, StandardFileIO)
+    assert.Nil(t, err)
+
+    n, err := ioManager.Write([]byte("short write"))
+    assert.Equal(t, ErrInjectedFault, err)
+    assert.True(t, n < 11)
+    err = ioManager.Close()
+    assert.Nil(t, err)
+
+    // Closed files keep what was written
+    info, _ := os.Stat(path)
+    assert.Equal(t, int64(n), info.Size())
+}
+
+func TestFaultInjectorDirSync(t *testing.T) {
+    dir, _ := os.MkdirTemp("", "kvdb-go-faulty-io-")
+    defer os.RemoveAll(dir)
+    synced := filepath.Join(dir, "synced")
+    removed := filepath.Join(dir, "removed")
+    renamed := filepath.Join(dir, "renamed")
+    created := filepath.Join(dir, "created")
+
+    injector := NewFaultInjector(nil, 1)
+    for _, name := range []string{synced, removed} {
+        ioManager, err := injector.OpenFile(name, StandardFileIO)
+        assert.Nil(t, err)
+        _, err = ioManager.Write([]byte(name))
+        assert.Nil(t, err)
+        err = ioManager.Close()
+        assert.Nil(t, err)
+    }
+    err := injector.SyncDir(dir)
+    assert.Nil(t, err)
+
+    err = injector.Remove(removed)
+    assert.Nil(t, err)
+    err = injector.Rename(synced, renamed)
+    assert.Nil(t, err)
+    ioManager, err := injector.OpenFile(created, StandardFileIO)
+    assert.Nil(t, err)
+    err = ioManager.Close()
+    assert.Nil(t, err)
+    _, err = os.Stat(renamed)
+    assert.Nil(t, err)
+
+    // The directory was not synced again, a power loss keeps a prefix of the changes.
+    // With no open files the prefix is the first number drawn.
+    injector.rand.Seed(0)
+    kept := injector.rand.Intn(4)
+    injector.rand.Seed(0)
+    err = injector.Crash()
+    assert.Nil(t, err)
+
+    _, err = os.Stat(removed)
+    assert.Equal(t, kept < 1, err == nil)
+    _, err = os.Stat(synced)
+    assert.Equal(t, kept < 2, err == nil)
+    _, err = os.Stat(created)
+    assert.Equal(t, kept >= 3, err == nil)
+    if kept < 1 {
+        content, _ := os.ReadFile(removed)
+        assert.Equal(t, []byte(removed), content)
+    }
+    _, err = injector.OpenFile(created, StandardFileIO)
+    assert.Equal(t, ErrCrashed, err)
+}
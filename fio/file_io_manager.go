@@ -14,6 +14,15 @@ func NewFileIOManager(fileName string) (*FileIOManager, error) {
     return &FileIOManager{fd}, nil
 }
 
+// Neither creates the file nor needs write permission on it
+func NewReadOnlyFileIOManager(fileName string) (*FileIOManager, error) {
+    fd, err := os.OpenFile(fileName, os.O_RDONLY, 0)
+    if err != nil {
+        return nil, err
+    }
+    return &FileIOManager{fd}, nil
+}
+
 func (fio *FileIOManager) Read(b []byte, offset int64) (int, error) {
     return fio.fd.ReadAt(b, offset)
 }
@@ -30,6 +39,11 @@ func (fio *FileIOManager) Close() error {
     return fio.fd.Close()
 }
 
+// Writes still append, they continue at the new end
+func (fio *FileIOManager) Truncate(size int64) error {
+    return fio.fd.Truncate(size)
+}
+
 func (fio *FileIOManager) Size() (int64, error) {
     stat, err := fio.fd.Stat()
     if err != nil {
@@ -90,3 +90,60 @@ func TestFileIOSync(t *testing.T) {
 
     destroyFile(path)
 }
+
+func TestFileIOTruncate(t *testing.T) {
+    path := filepath.Join("/tmp", "test_file_io_manager")
+    destroyFile(path)
+
+    fio, err := NewFileIOManager(path)
+    assert.Nil(t, err)
+
+    _, err = fio.Write([]byte("hello world"))
+    assert.Nil(t, err)
+    err = fio.Truncate(5)
+    assert.Nil(t, err)
+
+    // Writes continue at the new end
+    _, err = fio.Write([]byte("!"))
+    assert.Nil(t, err)
+    size, err := fio.Size()
+    assert.Nil(t, err)
+    assert.Equal(t, int64(6), size)
+    b := make([]byte, 6)
+    _, err = fio.Read(b, 0)
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("hello!"), b)
+
+    destroyFile(path)
+}
+
+func TestReadOnlyFileIO(t *testing.T) {
+    path := filepath.Join("/tmp", "test_file_io_manager")
+    destroyFile(path)
+
+    // A missing file is not created
+    _, err := NewReadOnlyFileIOManager(path)
+    assert.True(t, os.IsNotExist(err))
+    _, err = os.Stat(path)
+    assert.True(t, os.IsNotExist(err))
+
+    fio, err := NewFileIOManager(path)
+    assert.Nil(t, err)
+    _, err = fio.Write([]byte("hello"))
+    assert.Nil(t, err)
+    err = fio.Close()
+    assert.Nil(t, err)
+
+    readOnlyFio, err := NewReadOnlyFileIOManager(path)
+    assert.Nil(t, err)
+    b := make([]byte, 5)
+    _, err = readOnlyFio.Read(b, 0)
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("hello"), b)
+    _, err = readOnlyFio.Write([]byte("!"))
+    assert.NotNil(t, err)
+    err = readOnlyFio.Close()
+    assert.Nil(t, err)
+
+    destroyFile(path)
+}
@@ -0,0 +1,80 @@
+package fio
+
+import (
+    "io"
+    "sync"
+    "time"
+)
+
+// Keeps the content of a file in memory, nothing reaches the disk
+type InMemoryIO struct {
+    mutex sync.RWMutex
+    buf []byte
+    modTime time.Time
+}
+
+func NewInMemoryIO() *InMemoryIO {
+    return &InMemoryIO{modTime: time.Now()}
+}
+
+func (mio *InMemoryIO) Read(b []byte, offset int64) (int, error) {
+    mio.mutex.RLock()
+    defer mio.mutex.RUnlock()
+
+    if offset >= int64(len(mio.buf)) {
+        return 0, io.EOF
+    }
+    n := copy(b, mio.buf[offset:])
+    if n < len(b) {
+        return n, io.EOF
+    }
+    return n, nil
+}
+
+func (mio *InMemoryIO) Write(b []byte) (int, error) {
+    mio.mutex.Lock()
+    defer mio.mutex.Unlock()
+
+    mio.buf = append(mio.buf, b...)
+    mio.modTime = time.Now()
+    return len(b), nil
+}
+
+func (mio *InMemoryIO) Sync() error {
+    return nil
+}
+
+// Releases the content, the file is gone once closed
+func (mio *InMemoryIO) Close() error {
+    mio.mutex.Lock()
+    defer mio.mutex.Unlock()
+
+    mio.buf = nil
+    return nil
+}
+
+func (mio *InMemoryIO) Size() (int64, error) {
+    mio.mutex.RLock()
+    defer mio.mutex.RUnlock()
+
+    return int64(len(mio.buf)), nil
+}
+
+func (mio *InMemoryIO) Truncate(size int64) error {
+    mio.mutex.Lock()
+    defer mio.mutex.Unlock()
+
+    if size < int64(len(mio.buf)) {
+        mio.buf = mio.buf[:size]
+        mio.modTime = time.Now()
+    }
+    return nil
+}
+
+// The time of the last write, backups compare it like the modification time of a file
+func (mio *InMemoryIO) ModTime() time.Time {
+    mio.mutex.RLock()
+    defer mio.mutex.RUnlock()
+
+    return mio.modTime
+}
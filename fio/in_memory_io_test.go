@@ -0,0 +1,46 @@
+package fio
+
+import (
+    "io"
+    "testing"
+    "github.com/stretchr/testify/assert"
+)
+
+func TestInMemoryIO(t *testing.T) {
+    mio := NewInMemoryIO()
+
+    n, err := mio.Write([]byte("hello "))
+    assert.Nil(t, err)
+    assert.Equal(t, 6, n)
+    _, err = mio.Write([]byte("world"))
+    assert.Nil(t, err)
+
+    size, err := mio.Size()
+    assert.Nil(t, err)
+    assert.Equal(t, int64(11), size)
+
+    b := make([]byte, 5)
+    n, err = mio.Read(b, 6)
+    assert.Nil(t, err)
+    assert.Equal(t, 5, n)
+    assert.Equal(t, []byte("world"), b)
+
+    n, err = mio.Read(b, 8)
+    assert.Equal(t, io.EOF, err)
+    assert.Equal(t, 3, n)
+
+    _, err = mio.Read(b, 11)
+    assert.Equal(t, io.EOF, err)
+
+    err = mio.Truncate(5)
+    assert.Nil(t, err)
+    size, err = mio.Size()
+    assert.Nil(t, err)
+    assert.Equal(t, int64(5), size)
+
+    err = mio.Close()
+    assert.Nil(t, err)
+    size, err = mio.Size()
+    assert.Nil(t, err)
+    assert.Equal(t, int64(0), size)
+}
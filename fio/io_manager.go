@@ -6,6 +6,8 @@ type IOType = byte
 const (
     StandardFileIO IOType = iota
     MemoryMapIO
+    // Opens an existing file for reading only, writes fail
+    ReadOnlyFileIO
 )
 
 type IOManager interface {
@@ -14,6 +16,8 @@ type IOManager interface {
     Sync() error
     Close() error
     Size() (int64, error)
+    // Drops the content from size on
+    Truncate(size int64) error
 }
 
 func NewIOManager(fileName string, ioType IOType) (IOManager, error) {
@@ -22,6 +26,8 @@ func NewIOManager(fileName string, ioType IOType) (IOManager, error) {
         return NewFileIOManager(fileName)
     case MemoryMapIO:
         return NewMMapIOManager(fileName)
+    case ReadOnlyFileIO:
+        return NewReadOnlyFileIOManager(fileName)
     default:
         panic("Unknown IO type")
     }
@@ -34,6 +34,10 @@ func (mmap *MMap) Sync() error {
     panic("not implemented")
 }
 
+func (mmap *MMap) Truncate(size int64) error {
+    panic("not implemented")
+}
+
 func (mmap *MMap) Close() error {
     return mmap.readerAt.Close()
 }
@@ -0,0 +1,126 @@
+package fio
+
+import (
+    "os"
+    "kvdb-go/utils"
+    "path/filepath"
+
+    "github.com/gofrs/flock"
+)
+
+// The filesystem the engine keeps its files in. Missing files are reported with errors os.IsNotExist recognizes.
+type VFS interface {
+    // Opens the IOManager of a file, creating it when it is missing
+    OpenFile(name string, ioType IOType) (IOManager, error)
+    Stat(name string) (os.FileInfo, error)
+    ReadDir(dir string) ([]os.DirEntry, error)
+    MkdirAll(dir string) error
+    Rename(oldName string, newName string) error
+    Link(oldName string, newName string) error
+    Remove(name string) error
+    RemoveAll(name string) error
+    // Takes an exclusive lock on the file, held is false when someone else has it
+    TryLock(name string) (lock FileLock, held bool, err error)
+    // Makes the creations, renames and removals of entries in the directory durable
+    SyncDir(dir string) error
+    DirSize(dir string) (int64, error)
+    AvailableSpace(dir string) (uint64, error)
+}
+
+type FileLock interface {
+    Unlock() error
+}
+
+// The operating system's filesystem
+type OSFS struct{}
+
+func (OSFS) OpenFile(name string, ioType IOType) (IOManager, error) {
+    return NewIOManager(name, ioType)
+}
+
+func (OSFS) Stat(name string) (os.FileInfo, error) {
+    return os.Stat(name)
+}
+
+func (OSFS) ReadDir(dir string) ([]os.DirEntry, error) {
+    return os.ReadDir(dir)
+}
+
+func (OSFS) MkdirAll(dir string) error {
+    return os.MkdirAll(dir, 0755)
+}
+
+func (OSFS) Rename(oldName string, newName string) error {
+    return os.Rename(oldName, newName)
+}
+
+func (OSFS) Link(oldName string, newName string) error {
+    return os.Link(oldName, newName)
+}
+
+func (OSFS) Remove(name string) error {
+    return os.Remove(name)
+}
+
+func (OSFS) RemoveAll(name string) error {
+    return os.RemoveAll(name)
+}
+
+func (OSFS) TryLock(name string) (FileLock, bool, error) {
+    fileLock := flock.New(name)
+    held, err := fileLock.TryLock()
+    if err != nil || !held {
+        return nil, held, err
+    }
+    return fileLock, true, nil
+}
+
+func (OSFS) SyncDir(dir string) error {
+    fd, err := os.Open(dir)
+    if err != nil {
+        return err
+    }
+    if err := fd.Sync(); err != nil {
+        _ = fd.Close()
+        return err
+    }
+    return fd.Close()
+}
+
+func (OSFS) DirSize(dir string) (int64, error) {
+    return utils.DirSize(dir)
+}
+
+func (OSFS) AvailableSpace(dir string) (uint64, error) {
+    return utils.AvailableDiskSpace(dir)
+}
+
+// A nil VFS is the operating system's
+func OrOSFS(fs VFS) VFS {
+    if fs == nil {
+        return OSFS{}
+    }
+    return fs
+}
+
+// Creates the directory and syncs its parent, so the directory outlives a power loss
+func MkdirAllDurable(fs VFS, dir string) error {
+    if err := fs.MkdirAll(dir); err != nil {
+        return err
+    }
+    return fs.SyncDir(filepath.Dir(dir))
+}
+
+func RemoveDurable(fs VFS, name string) error {
+    if err := fs.Remove(name); err != nil {
+        return err
+    }
+    return fs.SyncDir(filepath.Dir(name))
+}
+
+func RemoveAllDurable(fs VFS, name string) error {
+    if err := fs.RemoveAll(name); err != nil {
+        return err
+    }
+    return fs.SyncDir(filepath.Dir(name))
+}
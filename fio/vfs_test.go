@@ -0,0 +1,51 @@
+package fio
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+    "github.com/stretchr/testify/assert"
+)
+
+func TestOSFS(t *testing.T) {
+    dir, _ := os.MkdirTemp("", "kvdb-go-vfs-")
+    defer os.RemoveAll(dir)
+    fs := OrOSFS(nil)
+
+    err := fs.MkdirAll(filepath.Join(dir, "sub"))
+    assert.Nil(t, err)
+    ioManager, err := fs.OpenFile(filepath.Join(dir, "sub", "file"), StandardFileIO)
+    assert.Nil(t, err)
+    _, err = ioManager.Write([]byte("hello world"))
+    assert.Nil(t, err)
+    err = ioManager.Close()
+    assert.Nil(t, err)
+
+    err = fs.Rename(filepath.Join(dir, "sub", "file"), filepath.Join(dir, "file"))
+    assert.Nil(t, err)
+    err = fs.SyncDir(dir)
+    assert.Nil(t, err)
+    _, err = fs.Stat(filepath.Join(dir, "sub", "file"))
+    assert.True(t, os.IsNotExist(err))
+    size, err := fs.DirSize(dir)
+    assert.Nil(t, err)
+    assert.Equal(t, int64(11), size)
+    available, err := fs.AvailableSpace(dir)
+    assert.Nil(t, err)
+    assert.True(t, available > 0)
+
+    // The lock is exclusive until it is released
+    lock, held, err := fs.TryLock(filepath.Join(dir, "lock"))
+    assert.Nil(t, err)
+    assert.True(t, held)
+    _, held, err = fs.TryLock(filepath.Join(dir, "lock"))
+    assert.Nil(t, err)
+    assert.False(t, held)
+    err = lock.Unlock()
+    assert.Nil(t, err)
+    lock, held, err = fs.TryLock(filepath.Join(dir, "lock"))
+    assert.Nil(t, err)
+    assert.True(t, held)
+    err = lock.Unlock()
+    assert.Nil(t, err)
+}
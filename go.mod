@@ -3,22 +3,23 @@ module kvdb-go
 go 1.17
 
 require (
+	github.com/cespare/xxhash/v2 v2.3.0
+	github.com/gofrs/flock v0.8.1
 	github.com/google/btree v1.1.2
 	github.com/plar/go-adaptive-radix-tree v1.0.5
 	github.com/sirupsen/logrus v1.9.3
 	github.com/stretchr/testify v1.8.2
+	github.com/tidwall/redcon v1.6.2
 	go.etcd.io/bbolt v1.3.9
+	golang.org/x/exp v0.0.0-20240604190554-fc45aab8b7f8
 	golang.org/x/text v0.14.0
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/gofrs/flock v0.8.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/tidwall/btree v1.1.0 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
-	github.com/tidwall/redcon v1.6.2 // indirect
-	golang.org/x/exp v0.0.0-20240604190554-fc45aab8b7f8 // indirect
 	golang.org/x/sys v0.15.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -1,15 +1,19 @@
 package main
 
 import (
+    "context"
     "encoding/json"
+    "errors"
     "fmt"
     kvdb "kvdb-go"
+    "kvdb-go/metrics"
     "log"
     "net/http"
     "os"
 )
 
 var db *kvdb.DB
+var registry = metrics.NewRegistry()
 
 func init() {
     var err error
@@ -18,10 +22,17 @@ func init() {
     dir, _ := os.MkdirTemp("", "kvdb-go-server-")
     log.Printf("db dir: %s", dir)
     options.DirPath = dir
+    options.Metrics = registry
     db, err = kvdb.Open(options)
     if err != nil {
         panic(fmt.Sprintf("failed to open db: %v", err))
     }
+
+    registry.AddCollector(func(m metrics.Metrics) {
+        if err := db.CollectMetrics(m); err != nil {
+            log.Printf("failed to collect metrics: %v", err)
+        }
+    })
 }
 
 func handlePut(writer http.ResponseWriter, request *http.Request) {
@@ -36,9 +47,17 @@ func handlePut(writer http.ResponseWriter, request *http.Request) {
         return
     }
 
+    // Reject the whole request before writing anything
     for key, value := range data {
-        if err := db.Put([]byte(key), []byte(value)); err != nil {
-            http.Error(writer, err.Error(), http.StatusInternalServerError)
+        if err := db.ValidateKeyValue([]byte(key), []byte(value)); err != nil {
+            writeError(writer, err)
+            return
+        }
+    }
+
+    for key, value := range data {
+        if err := db.PutCtx(request.Context(), []byte(key), []byte(value)); err != nil {
+            writeError(writer, err)
             log.Printf("failed to put key-value: %v", err)
             return
         }
@@ -52,9 +71,9 @@ func handleGet(writer http.ResponseWriter, request *http.Request) {
     }
 
     key := request.URL.Query().Get("key")
-    value, err := db.Get([]byte(key))
-    if err != nil && err != kvdb.ErrKeyNotFound {
-        http.Error(writer, err.Error(), http.StatusInternalServerError)
+    value, err := db.GetCtx(request.Context(), []byte(key))
+    if err != nil && !errors.Is(err, kvdb.ErrKeyNotFound) {
+        writeError(writer, err)
         log.Printf("failed to get value: %v", err)
         return
     }
@@ -70,8 +89,8 @@ func handleDelete(writer http.ResponseWriter, request *http.Request) {
     }
 
     key := request.URL.Query().Get("key")
-    if err := db.Delete([]byte(key)); err != nil && err != kvdb.ErrKeyNotFound {
-        http.Error(writer, err.Error(), http.StatusInternalServerError)
+    if err := db.Delete([]byte(key)); err != nil && !errors.Is(err, kvdb.ErrKeyNotFound) {
+        writeError(writer, err)
         log.Printf("failed to delete key: %v", err)
         return
     }
@@ -86,7 +105,12 @@ func handleListKeys(writer http.ResponseWriter, request *http.Request) {
         return
     }
 
-    keys := db.ListKeys()
+    keys, err := db.ListKeysCtx(request.Context())
+    if err != nil {
+        writeError(writer, err)
+        log.Printf("failed to list keys: %v", err)
+        return
+    }
     var result []string
     for _, key := range keys {
         result = append(result, string(key))
@@ -102,17 +126,58 @@ func handleStat(writer http.ResponseWriter, request *http.Request) {
         return
     }
 
-    stats := db.Stat()
+    stats, err := db.Stat()
+    if err != nil {
+        writeError(writer, err)
+        log.Printf("failed to get stat: %v", err)
+        return
+    }
     writer.Header().Set("Content-Type", "application/json")
     _ = json.NewEncoder(writer).Encode(stats)
 }
 
+// Set by nginx for a client that went away before the response, nobody reads it
+const statusClientClosedRequest = 499
+
+// A stalled write may go through once a merge reclaimed the space
+const writeStallRetryAfter = "1"
+
+func writeError(writer http.ResponseWriter, err error) {
+    if errors.Is(err, kvdb.ErrWriteStalled) {
+        writer.Header().Set("Retry-After", writeStallRetryAfter)
+    }
+    http.Error(writer, err.Error(), statusCodeOf(err))
+}
+
+// Errors may come wrapped
+func statusCodeOf(err error) int {
+    switch {
+    case errors.Is(err, kvdb.ErrKeyTooLarge), errors.Is(err, kvdb.ErrValueTooLarge):
+        return http.StatusRequestEntityTooLarge
+    case errors.Is(err, kvdb.ErrKeyIsEmpty):
+        return http.StatusBadRequest
+    case errors.Is(err, kvdb.ErrReadOnly):
+        return http.StatusForbidden
+    case errors.Is(err, kvdb.ErrWriteStalled):
+        return http.StatusServiceUnavailable
+    case errors.Is(err, kvdb.ErrDiskFull):
+        return http.StatusInsufficientStorage
+    case errors.Is(err, context.DeadlineExceeded):
+        return http.StatusGatewayTimeout
+    case errors.Is(err, context.Canceled):
+        return statusClientClosedRequest
+    default:
+        return http.StatusInternalServerError
+    }
+}
+
 func main() {
     http.HandleFunc("/kvdb/put", handlePut)
     http.HandleFunc("/kvdb/get", handleGet)
     http.HandleFunc("/kvdb/delete", handleDelete)
     http.HandleFunc("/kvdb/list", handleListKeys)
     http.HandleFunc("/kvdb/stat", handleStat)
+    http.Handle("/metrics", registry)
 
     _ = http.ListenAndServe("localhost:8080", nil)
 }
@@ -1,13 +1,15 @@
 package index
 
 import (
+    "errors"
     "kvdb-go/data"
     "path/filepath"
+    "time"
 
     bbolt "go.etcd.io/bbolt"
 )
 
-const bptreeIndexFileName = "bptree-index"
+const BPTreeIndexFileName = "bptree-index"
 var indexBucketName = []byte("kvdb-index")
 
 type BPlusTree struct {
@@ -17,7 +19,7 @@ type BPlusTree struct {
 func NewBPlusTree(dirPath string, syncWrites bool) *BPlusTree {
     opts := bbolt.DefaultOptions
     opts.NoSync = !syncWrites
-    bptree, err := bbolt.Open(filepath.Join(dirPath, bptreeIndexFileName), 0644, nil)
+    bptree, err := bbolt.Open(filepath.Join(dirPath, BPTreeIndexFileName), 0644, nil)
     if err != nil {
         panic(err)
     }
@@ -32,6 +34,23 @@ func NewBPlusTree(dirPath string, syncWrites bool) *BPlusTree {
     return &BPlusTree{tree: bptree}
 }
 
+var ErrIndexFileInUse = errors.New("index file is in use")
+
+// The writer holds the bbolt file lock, so this only works on a closed database or a backup
+func NewReadOnlyBPlusTree(dirPath string) (*BPlusTree, error) {
+    opts := *bbolt.DefaultOptions
+    opts.ReadOnly = true
+    opts.Timeout = 100 * time.Millisecond
+    bptree, err := bbolt.Open(filepath.Join(dirPath, BPTreeIndexFileName), 0644, &opts)
+    if err == bbolt.ErrTimeout {
+        return nil, ErrIndexFileInUse
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &BPlusTree{tree: bptree}, nil
+}
+
 func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
     var oldVal []byte
     if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
@@ -49,6 +68,27 @@ func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos
     return data.DecodeLogRecordPos(oldVal)
 }
 
+// Puts all keys in one transaction
+func (bpt *BPlusTree) PutBatch(keys [][]byte, positions []*data.LogRecordPos) []*data.LogRecordPos {
+    oldPositions := make([]*data.LogRecordPos, len(keys))
+    if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
+        bucket := tx.Bucket(indexBucketName)
+        for i, key := range keys {
+            if oldVal := bucket.Get(key); len(oldVal) > 0 {
+                oldPositions[i] = data.DecodeLogRecordPos(oldVal)
+            }
+            if err := bucket.Put(key, data.EncodeLogRecordPos(positions[i])); err != nil {
+                return err
+            }
+        }
+        return nil
+    }); err != nil {
+        panic("failed to put keys into bptree")
+    }
+
+    return oldPositions
+}
+
 func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
     var pos *data.LogRecordPos
     if err := bpt.tree.View(func(tx *bbolt.Tx) error {
@@ -80,3 +80,23 @@ func TestBPlusTreeDelete(t *testing.T) {
     assert.False(t, ok4)
     assert.Nil(t, res4)
 }
+
+func TestBPlusTreePutBatch(t *testing.T) {
+    path := filepath.Join(os.TempDir(), "bptree-put-batch")
+    _ = os.MkdirAll(path, os.ModePerm)
+    defer func() {
+        _ = os.RemoveAll(path)
+    }()
+
+    tree := NewBPlusTree(path, false)
+    tree.Put([]byte("key-1"), &data.LogRecordPos{FileId: 1, Offset: 1})
+
+    keys := [][]byte{[]byte("key-1"), []byte("key-2"), []byte("key-2")}
+    positions := []*data.LogRecordPos{{FileId: 2, Offset: 2}, {FileId: 3, Offset: 3}, {FileId: 4, Offset: 4}}
+    oldPositions := PutBatch(tree, keys, positions)
+    assert.Equal(t, uint32(1), oldPositions[0].FileId)
+    assert.Nil(t, oldPositions[1])
+    assert.Equal(t, uint32(3), oldPositions[2].FileId)
+    assert.Equal(t, uint32(4), tree.Get([]byte("key-2")).FileId)
+    assert.Equal(t, 2, tree.Size())
+}
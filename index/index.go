@@ -16,6 +16,24 @@ type Indexer interface {
     Close() error
 }
 
+// Implemented by indexes that apply many puts at once faster than one by one
+type BatchPutter interface {
+    PutBatch(keys [][]byte, positions []*data.LogRecordPos) []*data.LogRecordPos
+}
+
+// Puts every key in order and returns the old positions, nil for new keys
+func PutBatch(indexer Indexer, keys [][]byte, positions []*data.LogRecordPos) []*data.LogRecordPos {
+    if batchPutter, ok := indexer.(BatchPutter); ok {
+        return batchPutter.PutBatch(keys, positions)
+    }
+
+    oldPositions := make([]*data.LogRecordPos, len(keys))
+    for i, key := range keys {
+        oldPositions[i] = indexer.Put(key, positions[i])
+    }
+    return oldPositions
+}
+
 type IndexType = int8
 
 const (
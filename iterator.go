@@ -2,6 +2,7 @@ package kvdb_go
 
 import (
     "bytes"
+    "context"
     "kvdb-go/index"
 )
 
@@ -9,14 +10,22 @@ type Iterator struct {
     indexIterator index.Iterator
     db *DB
     options IteratorOptions
+    ctx context.Context
 }
 
 func (db *DB) NewIterator(options IteratorOptions) *Iterator {
+    return db.NewIteratorCtx(context.Background(), options)
+}
+
+// The iterator turns invalid once ctx is done, Err tells it apart from the end of the keys.
+// It still has to be closed.
+func (db *DB) NewIteratorCtx(ctx context.Context, options IteratorOptions) *Iterator {
     indexIterator := db.index.Iterator(options.Reverse)
     iterator := &Iterator{
         indexIterator: indexIterator,
         db: db,
         options: options,
+        ctx: ctx,
     }
     iterator.skipToNext()
     return iterator
@@ -38,7 +47,15 @@ func (itr *Iterator) Next() {
 }
 
 func (itr *Iterator) Valid() bool {
-    return itr.indexIterator.Valid()
+    return itr.ctx.Err() == nil && itr.indexIterator.Valid()
+}
+
+// Why the iteration stopped early, nil if it did not
+func (itr *Iterator) Err() error {
+    if itr.indexIterator.Valid() {
+        return itr.ctx.Err()
+    }
+    return nil
 }
 
 func (itr *Iterator) Key() []byte {
@@ -62,7 +79,7 @@ func (itr *Iterator) skipToNext() {
         return
     }
 
-    for ; itr.indexIterator.Valid(); itr.indexIterator.Next() {
+    for ; itr.Valid(); itr.indexIterator.Next() {
         key := itr.indexIterator.Key()
         if len(key) >= prefixLen && bytes.Equal(itr.options.Prefix, key[:prefixLen]) {
             break
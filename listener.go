@@ -0,0 +1,78 @@
+package kvdb_go
+
+import "time"
+
+// Receives lifecycle events of the database. Callbacks run synchronously, some of them with the
+// database locked, so they must return quickly and must not call back into the database.
+// Embed NopEventListener to implement only some of them.
+type EventListener interface {
+    OnFileRotated(info FileRotatedInfo)
+    OnMergeStarted(info MergeInfo)
+    OnMergeCompleted(info MergeInfo)
+    // A record failed its checksum while the index was loaded, Open fails with Err
+    OnCorruptionDetected(info CorruptionInfo)
+    // A torn record at the end of a data file was dropped while the index was loaded
+    OnRecoveryTruncated(info RecoveryTruncatedInfo)
+    OnBackupCompleted(info BackupInfo)
+    // A Put was slowed down or rejected, see the write stall options
+    OnWriteStall(info WriteStallInfo)
+}
+
+type FileRotatedInfo struct {
+    SealedFileId uint32
+    ActiveFileId uint32
+}
+
+type MergeInfo struct {
+    FileNum int // Data files being merged
+    ReclaimableSpace int64 // Bytes of stale records in them when the merge started
+    Duration time.Duration // Only set on completion
+    Err error // Only set on completion
+}
+
+type CorruptionInfo struct {
+    FileId uint32
+    Offset int64
+    Err error
+}
+
+type RecoveryTruncatedInfo struct {
+    FileId uint32
+    Offset int64 // Where the dropped bytes start
+    DroppedBytes int64
+}
+
+type BackupInfo struct {
+    Dir string
+    Base string // Empty for a full backup
+    FileNum int
+    Duration time.Duration
+}
+
+// Reasons of a write stall
+const (
+    WriteStallReclaimableSpace = "reclaimable space"
+    WriteStallDiskUsage = "disk usage"
+)
+
+type WriteStallInfo struct {
+    Reason string
+    Delay time.Duration
+    Rejected bool // The write failed instead of waiting
+}
+
+type NopEventListener struct{}
+
+func (NopEventListener) OnFileRotated(info FileRotatedInfo) {}
+
+func (NopEventListener) OnMergeStarted(info MergeInfo) {}
+
+func (NopEventListener) OnMergeCompleted(info MergeInfo) {}
+
+func (NopEventListener) OnCorruptionDetected(info CorruptionInfo) {}
+
+func (NopEventListener) OnRecoveryTruncated(info RecoveryTruncatedInfo) {}
+
+func (NopEventListener) OnBackupCompleted(info BackupInfo) {}
+
+func (NopEventListener) OnWriteStall(info WriteStallInfo) {}
@@ -0,0 +1,85 @@
+package logger
+
+import "fmt"
+
+// A structured logger, keyvals alternate between string keys and values like slog takes them.
+// Implementations must be safe for concurrent use.
+type Logger interface {
+    Debug(msg string, keyvals ...interface{})
+    Info(msg string, keyvals ...interface{})
+    Warn(msg string, keyvals ...interface{})
+    Error(msg string, keyvals ...interface{})
+}
+
+// Drops every message
+type Nop struct{}
+
+func (Nop) Debug(msg string, keyvals ...interface{}) {}
+
+func (Nop) Info(msg string, keyvals ...interface{}) {}
+
+func (Nop) Warn(msg string, keyvals ...interface{}) {}
+
+func (Nop) Error(msg string, keyvals ...interface{}) {}
+
+// A nil Logger drops every message
+func OrNop(l Logger) Logger {
+    if l == nil {
+        return Nop{}
+    }
+    return l
+}
+
+// A key or a value of the user. It is logged as its length only, unless the Logger is wrapped by ShowPayloads.
+type Payload struct {
+    b []byte
+}
+
+func NewPayload(b []byte) Payload {
+    return Payload{b: b}
+}
+
+func (p Payload) String() string {
+    return fmt.Sprintf("<redacted %d bytes>", len(p.b))
+}
+
+// Used by JSON and slog handlers instead of the bytes
+func (p Payload) MarshalText() ([]byte, error) {
+    return []byte(p.String()), nil
+}
+
+type showPayloads struct {
+    logger Logger
+}
+
+// Logs keys and values in full, for debugging only
+func ShowPayloads(l Logger) Logger {
+    return showPayloads{logger: OrNop(l)}
+}
+
+func (s showPayloads) Debug(msg string, keyvals ...interface{}) {
+    s.logger.Debug(msg, revealPayloads(keyvals)...)
+}
+
+func (s showPayloads) Info(msg string, keyvals ...interface{}) {
+    s.logger.Info(msg, revealPayloads(keyvals)...)
+}
+
+func (s showPayloads) Warn(msg string, keyvals ...interface{}) {
+    s.logger.Warn(msg, revealPayloads(keyvals)...)
+}
+
+func (s showPayloads) Error(msg string, keyvals ...interface{}) {
+    s.logger.Error(msg, revealPayloads(keyvals)...)
+}
+
+func revealPayloads(keyvals []interface{}) []interface{} {
+    revealed := make([]interface{}, len(keyvals))
+    for i, v := range keyvals {
+        if p, ok := v.(Payload); ok {
+            v = fmt.Sprintf("%q", p.b)
+        }
+        revealed[i] = v
+    }
+    return revealed
+}
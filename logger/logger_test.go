@@ -0,0 +1,30 @@
+package logger
+
+import (
+    "bytes"
+    "testing"
+
+    "github.com/sirupsen/logrus"
+    "github.com/stretchr/testify/assert"
+)
+
+func TestLogrusRedactsPayloads(t *testing.T) {
+    var buf bytes.Buffer
+    l := logrus.New()
+    l.SetOutput(&buf)
+    l.SetFormatter(&logrus.JSONFormatter{})
+
+    NewLogrus(l).Warn("torn record", "key", NewPayload([]byte("secret-key")), "offset", 16)
+    assert.Contains(t, buf.String(), "redacted 10 bytes")
+    assert.Contains(t, buf.String(), `"offset":16`)
+    assert.NotContains(t, buf.String(), "secret")
+
+    buf.Reset()
+    ShowPayloads(NewLogrus(l)).Warn("torn record", "key", NewPayload([]byte("secret-key")))
+    assert.Contains(t, buf.String(), "secret-key")
+
+    // Below the level nothing is written
+    buf.Reset()
+    NewLogrus(l).Debug("record", "value", NewPayload([]byte("v")))
+    assert.Equal(t, 0, buf.Len())
+}
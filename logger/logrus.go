@@ -0,0 +1,45 @@
+package logger
+
+import (
+    "fmt"
+
+    "github.com/sirupsen/logrus"
+)
+
+type logrusLogger struct {
+    logger logrus.FieldLogger
+}
+
+// Logs through logrus, keyvals become fields
+func NewLogrus(l logrus.FieldLogger) Logger {
+    return logrusLogger{logger: l}
+}
+
+func (l logrusLogger) Debug(msg string, keyvals ...interface{}) {
+    l.logger.WithFields(logrusFields(keyvals)).Debug(msg)
+}
+
+func (l logrusLogger) Info(msg string, keyvals ...interface{}) {
+    l.logger.WithFields(logrusFields(keyvals)).Info(msg)
+}
+
+func (l logrusLogger) Warn(msg string, keyvals ...interface{}) {
+    l.logger.WithFields(logrusFields(keyvals)).Warn(msg)
+}
+
+func (l logrusLogger) Error(msg string, keyvals ...interface{}) {
+    l.logger.WithFields(logrusFields(keyvals)).Error(msg)
+}
+
+// A value without a key is kept under "!BADKEY", like slog does
+func logrusFields(keyvals []interface{}) logrus.Fields {
+    fields := make(logrus.Fields, len(keyvals) / 2)
+    for i := 0; i < len(keyvals); i += 2 {
+        if i + 1 == len(keyvals) {
+            fields["!BADKEY"] = keyvals[i]
+            break
+        }
+        fields[fmt.Sprint(keyvals[i])] = keyvals[i + 1]
+    }
+    return fields
+}
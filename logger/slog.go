@@ -0,0 +1,30 @@
+//go:build go1.21
+
+package logger
+
+import "log/slog"
+
+type slogLogger struct {
+    logger *slog.Logger
+}
+
+// Logs through slog, keyvals are passed on as they are
+func NewSlog(l *slog.Logger) Logger {
+    return slogLogger{logger: l}
+}
+
+func (l slogLogger) Debug(msg string, keyvals ...interface{}) {
+    l.logger.Debug(msg, keyvals...)
+}
+
+func (l slogLogger) Info(msg string, keyvals ...interface{}) {
+    l.logger.Info(msg, keyvals...)
+}
+
+func (l slogLogger) Warn(msg string, keyvals ...interface{}) {
+    l.logger.Warn(msg, keyvals...)
+}
+
+func (l slogLogger) Error(msg string, keyvals ...interface{}) {
+    l.logger.Error(msg, keyvals...)
+}
@@ -0,0 +1,22 @@
+//go:build go1.21
+
+package logger
+
+import (
+    "bytes"
+    "log/slog"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestSlogRedactsPayloads(t *testing.T) {
+    var buf bytes.Buffer
+    NewSlog(slog.New(slog.NewJSONHandler(&buf, nil))).Error("corrupted record", "value", NewPayload([]byte("secret-value")))
+    assert.Contains(t, buf.String(), "redacted 12 bytes")
+    assert.NotContains(t, buf.String(), "secret")
+
+    buf.Reset()
+    NewSlog(slog.New(slog.NewTextHandler(&buf, nil))).Error("corrupted record", "value", NewPayload([]byte("secret-value")))
+    assert.Contains(t, buf.String(), `value="<redacted 12 bytes>"`)
+}
@@ -1,14 +1,17 @@
 package kvdb_go
 
 import (
+    "context"
     "io"
     "kvdb-go/data"
-    "kvdb-go/utils"
+    "kvdb-go/fio"
+    "kvdb-go/metrics"
     "os"
     "path"
     "path/filepath"
     "sort"
     "strconv"
+    "time"
 )
 
 const (
@@ -17,18 +20,30 @@ const (
 )
 
 func (db *DB) Merge() error {
+    return db.MergeCtx(context.Background())
+}
+
+// Stops with ctx.Err() between records, the partly merged files are removed and the data files are left as they were
+func (db *DB) MergeCtx(ctx context.Context) error {
     if db.activeFile == nil {
         return nil
     }
+    if err := ctx.Err(); err != nil {
+        return err
+    }
 
     db.mutex.Lock()
+    if db.options.ReadOnly {
+        db.mutex.Unlock()
+        return ErrReadOnly
+    }
     if db.isMerging {
         db.mutex.Unlock()
         return ErrMergeInProgress
     }
 
     // Check if the amount of data can be merged is greater than the merge trigger ratio
-    totalSize, err := utils.DirSize(db.options.DirPath)
+    totalSize, err := db.diskSize()
     if err != nil {
         db.mutex.Unlock()
         return err
@@ -40,14 +55,16 @@ func (db *DB) Merge() error {
 
     // Check if the available disk space is enough for merge
     // When merging, there are old data (totalSize) and merged data (totalSize - reclaimableSpace)
-    availableDiskSize, err := utils.AvailableDiskSpace()
-    if err != nil {
-        db.mutex.Unlock()
-        return err
-    }
-    if uint64(totalSize-db.reclaimableSpace) >= availableDiskSize {
-        db.mutex.Unlock()
-        return ErrDiskSpaceNotEnoughForMerge
+    if !db.options.InMemory {
+        availableDiskSize, err := db.options.VFS.AvailableSpace(db.options.DirPath)
+        if err != nil {
+            db.mutex.Unlock()
+            return err
+        }
+        if uint64(totalSize-db.reclaimableSpace) >= availableDiskSize {
+            db.mutex.Unlock()
+            return ErrDiskSpaceNotEnoughForMerge
+        }
     }
 
     db.isMerging = true
@@ -55,55 +72,142 @@ func (db *DB) Merge() error {
         db.isMerging = false
     }()
 
-    if err := db.activeFile.Sync(); err != nil {
+    if err := db.rotateActiveFile(); err != nil {
         db.mutex.Unlock()
         return err
     }
-
-    db.olderFiles[db.activeFile.FileId] = db.activeFile
-    if err := db.setActiveDataFile(); err != nil {
-        db.mutex.Unlock()
-        return nil
+    // In memory the merged files replace the old ones right away, they take the ids before the active file.
+    // They never outnumber the files they are merged from.
+    if db.options.InMemory {
+        db.activeFile.FileId += uint32(len(db.olderFiles))
     }
+    reclaimableSpace := db.reclaimableSpace
 
     nonMergeFileId := db.activeFile.FileId
 
+    // Merged files reuse the old file ids, cached positions will not be valid afterwards
+    if db.valueCache != nil {
+        db.valueCache.Purge()
+    }
+
     var mergeFiles []*data.DataFile
     for _, file := range db.olderFiles {
         mergeFiles = append(mergeFiles, file)
     }
     db.mutex.Unlock()
 
+    info := MergeInfo{FileNum: len(mergeFiles), ReclaimableSpace: reclaimableSpace}
+    db.options.EventListener.OnMergeStarted(info)
+    start := time.Now()
+    err = db.mergeFiles(ctx, mergeFiles, nonMergeFileId, reclaimableSpace)
+    info.Duration, info.Err = time.Since(start), err
+    if err == nil {
+        db.options.Metrics.ObserveHistogram(metrics.MergeDuration, info.Duration.Seconds())
+        db.options.Metrics.AddCounter(metrics.MergeReclaimedBytes, float64(reclaimableSpace))
+        db.options.Logger.Info("Merge completed", "files", info.FileNum, "reclaimableBytes", reclaimableSpace, "duration", info.Duration)
+    } else {
+        db.options.Logger.Error("Merge failed", "files", info.FileNum, "err", err)
+    }
+    db.options.EventListener.OnMergeCompleted(info)
+    return err
+}
+
+// Writes the valid records of the files into the merge directory, or in memory swaps them in
+func (db *DB) mergeFiles(ctx context.Context, mergeFiles []*data.DataFile, nonMergeFileId uint32, reclaimableSpace int64) (err error) {
     sort.Slice(mergeFiles, func(i, j int) bool {
         return mergeFiles[i].FileId < mergeFiles[j].FileId
     })
 
+    mergeOptions := db.options
+    mergeOptions.DirPath = db.getMergePath()
+    mergeOptions.SyncWrites = false // Batch write
+    mergeOptions.BloomFilter = false
+    mergeOptions.ValueCacheBytes = 0
+    mergeOptions.ValueLogThreshold = 0 // Records are copied as they are, pointers included
+    mergeOptions.EventListener = NopEventListener{} // Its rotations are part of the merge
+    mergeOptions.Metrics = metrics.Nop{}
+    mergeOptions.MaxDiskBytes = 0 // The space was checked before the merge started
+    mergeOptions.MinFreeDiskBytes = 0
+
+    if db.options.InMemory {
+        return db.mergeInMemory(ctx, mergeFiles, mergeOptions, nonMergeFileId, reclaimableSpace)
+    }
+
+    // Left behind by a merge that failed
     mergePath := db.getMergePath()
-    if _, err := os.Stat(mergePath); os.IsNotExist(err) {
-        if err := os.RemoveAll(mergePath); err != nil {
-            return err
-        }
+    if err := db.options.VFS.RemoveAll(mergePath); err != nil {
+        return err
     }
 
-    if err := os.Mkdir(mergePath, os.ModePerm); err != nil {
+    if err := fio.MkdirAllDurable(db.options.VFS, mergePath); err != nil {
         return err
     }
+    // Runs after the merge files are closed
+    defer func() {
+        if err != nil {
+            _ = fio.RemoveAllDurable(db.options.VFS, mergePath)
+        }
+    }()
 
-    mergeOptions := db.options
-    mergeOptions.DirPath = mergePath
-    mergeOptions.SyncWrites = false // Batch write
     mergeDB, err := Open(mergeOptions)
     if err != nil {
         return err
     }
+    defer mergeDB.Close()
+
+    hintFile, err := data.OpenHintFile(db.options.VFS, mergePath)
+    if err != nil {
+        return err
+    }
+    defer hintFile.Close()
+
+    err = db.copyValidRecords(ctx, mergeFiles, mergeDB, func(key []byte, pos *data.LogRecordPos) error {
+        hintOffset := hintFile.WriteOffset
+        if err := hintFile.WriteHintRecord(key, pos); err != nil {
+            return err
+        }
+        return db.options.RateLimiter.WaitN(ctx, int(hintFile.WriteOffset - hintOffset))
+    })
+    if err != nil {
+        return err
+    }
+
+    if err := hintFile.Sync(); err != nil {
+        return err
+    }
+
+    if err := mergeDB.Sync(); err != nil {
+        return err
+    }
 
-    hintFile, err := data.OpenHintFile(mergePath)
+    mergeFinishedFile, err := data.OpenMergeFinishedFile(db.options.VFS, mergePath)
     if err != nil {
         return err
     }
+    defer mergeFinishedFile.Close()
+    mergeFinishedRecord := &data.LogRecord{
+        Key:   []byte(mergeFinishedKey),
+        Value: []byte(strconv.Itoa(int(nonMergeFileId))),
+    }
+    encodedRecord, _ := data.EncodeLogRecord(mergeFinishedRecord)
+    if err := mergeFinishedFile.Write(encodedRecord); err != nil {
+        return err
+    }
+    if err := mergeFinishedFile.Sync(); err != nil {
+        return err
+    }
+
+    // The merged files replace the old ones on the next open, writes stalled on the space need not wait for it
+    db.mutex.Lock()
+    db.reclaimableSpace -= reclaimableSpace
+    db.mutex.Unlock()
+    return nil
+}
 
+// Appends the records the index still points to into mergeDB and hands each new position to fn
+func (db *DB) copyValidRecords(ctx context.Context, mergeFiles []*data.DataFile, mergeDB *DB, fn func(key []byte, pos *data.LogRecordPos) error) error {
     for _, dataFile := range mergeFiles {
-        var offset int64 = 0
+        var offset int64 = data.FileHeaderSize
         for {
             logRecord, size, err := dataFile.ReadLogRecord(offset)
             if err != nil {
@@ -112,18 +216,33 @@ func (db *DB) Merge() error {
                 }
                 return err
             }
+            // A torn record at the end of a file
+            if logRecord == nil {
+                break
+            }
 
             realKey, _ := parseLogRecordKeyWithSeq(logRecord.Key)
             logRecordPos := db.index.Get(realKey)
             // Check if it is a valid data
-            if logRecordPos != nil && logRecordPos.FileId == dataFile.FileId && logRecordPos.Offset == offset {
+            valid := logRecordPos != nil && logRecordPos.FileId == dataFile.FileId && logRecordPos.Offset == offset
+
+            // A valid record is written again after it is read
+            ioBytes := size
+            if valid {
+                ioBytes += size
+            }
+            if err := db.options.RateLimiter.WaitN(ctx, int(ioBytes)); err != nil {
+                return err
+            }
+
+            if valid {
                 logRecord.Key = logRecordKeyWithSeq(realKey, nonTransactionSeqNum)
                 mergeLogRecordPos, err := mergeDB.appendLogRecord(logRecord)
                 if err != nil {
                     return err
                 }
 
-                if err := hintFile.WriteHintRecord(realKey, mergeLogRecordPos); err != nil {
+                if err := fn(realKey, mergeLogRecordPos); err != nil {
                     return err
                 }
             }
@@ -131,31 +250,67 @@ func (db *DB) Merge() error {
             offset += size
         }
     }
+    return nil
+}
 
-    if err := hintFile.Sync(); err != nil {
+// Swaps the merged files in as soon as they are written, there is no reopen to wait for.
+// Values of iterators created before the merge may no longer be found.
+func (db *DB) mergeInMemory(ctx context.Context, mergeFiles []*data.DataFile, mergeOptions Options, nonMergeFileId uint32, reclaimableSpace int64) error {
+    mergeDB, err := Open(mergeOptions)
+    if err != nil {
         return err
     }
+    defer mergeDB.Close()
 
-    if err := mergeDB.Sync(); err != nil {
+    var keys [][]byte
+    var positions []*data.LogRecordPos
+    err = db.copyValidRecords(ctx, mergeFiles, mergeDB, func(key []byte, pos *data.LogRecordPos) error {
+        keys = append(keys, key)
+        positions = append(positions, pos)
+        return nil
+    })
+    if err != nil {
         return err
     }
 
-    mergeFinishedFile, err := data.OpenMergeFinishedFile(mergePath)
-    if err != nil {
-        return err
+    var mergedFiles []*data.DataFile
+    for _, file := range mergeDB.olderFiles {
+        mergedFiles = append(mergedFiles, file)
     }
-    mergeFinishedRecord := &data.LogRecord{
-        Key:   []byte(mergeFinishedKey),
-        Value: []byte(strconv.Itoa(int(nonMergeFileId))),
+    if mergeDB.activeFile != nil {
+        mergedFiles = append(mergedFiles, mergeDB.activeFile)
     }
-    encodedRecord, _ := data.EncodeLogRecord(mergeFinishedRecord)
-    if err := mergeFinishedFile.Write(encodedRecord); err != nil {
-        return err
+    // The merged files now belong to db
+    mergeDB.activeFile, mergeDB.olderFiles = nil, nil
+
+    firstMergedFileId := nonMergeFileId - uint32(len(mergeFiles))
+    for _, file := range mergedFiles {
+        file.FileId += firstMergedFileId
     }
-    if err := mergeFinishedFile.Sync(); err != nil {
-        return err
+
+    db.mutex.Lock()
+    defer db.mutex.Unlock()
+
+    for _, file := range mergeFiles {
+        delete(db.olderFiles, file.FileId)
+        _ = file.Close()
+    }
+    for _, file := range mergedFiles {
+        db.olderFiles[file.FileId] = file
     }
 
+    // Keys written since they were copied point to newer files
+    for i, key := range keys {
+        if pos := db.index.Get(key); pos != nil && pos.FileId < firstMergedFileId {
+            positions[i].FileId += firstMergedFileId
+            db.index.Put(key, positions[i])
+        }
+    }
+
+    db.reclaimableSpace -= reclaimableSpace
+    if db.valueCache != nil {
+        db.valueCache.Purge()
+    }
     return nil
 }
 
@@ -170,14 +325,11 @@ func (db *DB) getMergePath() string {
 func (db *DB) loadMergeFiles() error {
     mergePath := db.getMergePath()
 
-    if _, err := os.Stat(mergePath); os.IsNotExist(err) {
+    if _, err := db.options.VFS.Stat(mergePath); os.IsNotExist(err) {
         return nil
     }
-    defer func() {
-        _ = os.RemoveAll(mergePath)
-    }()
 
-    dirEntries, err := os.ReadDir(mergePath)
+    dirEntries, err := db.options.VFS.ReadDir(mergePath)
     if err != nil {
         return err
     }
@@ -194,11 +346,17 @@ func (db *DB) loadMergeFiles() error {
         if entry.Name() == fileLockName {
             continue
         }
+        if entry.Name() == data.BloomFilterFileName {
+            continue
+        }
+        if entry.Name() == data.WatchEpochFileName {
+            continue
+        }
         mergeFileNames = append(mergeFileNames, entry.Name())
     }
 
     if !mergeFinished {
-        return nil
+        return fio.RemoveAllDurable(db.options.VFS, mergePath)
     }
 
     nonMergeFileId, err := db.getNonMergeFileId(mergePath)
@@ -206,11 +364,23 @@ func (db *DB) loadMergeFiles() error {
         return err
     }
 
+    // The merge directory stays until every file is moved, so a crash in between makes the next Open run this again.
+    // Merged files that already moved in have ids up to the last one in the hint file, which moves after them,
+    // so only files above it are removed and the others are replaced by the renames.
     var fileId uint32
+    if _, err := db.options.VFS.Stat(filepath.Join(mergePath, data.HintFileName)); os.IsNotExist(err) {
+        fileId = nonMergeFileId
+    } else {
+        lastMergedFileId, err := db.getLastHintedFileId(mergePath)
+        if err != nil {
+            return err
+        }
+        fileId = uint32(lastMergedFileId + 1)
+    }
     for ; fileId < nonMergeFileId; fileId++ {
         fileName := data.GetDataFileName(db.options.DirPath, fileId)
-        if _, err := os.Stat(fileName); err == nil {
-            if err := os.Remove(fileName); err != nil {
+        if _, err := db.options.VFS.Stat(fileName); err == nil {
+            if err := db.options.VFS.Remove(fileName); err != nil {
                 return err
             }
         }
@@ -221,21 +391,56 @@ func (db *DB) loadMergeFiles() error {
         srcPath := filepath.Join(mergePath, fileName)
         dstPath := filepath.Join(db.options.DirPath, fileName)
 
-        if err := os.Rename(srcPath, dstPath); err != nil {
+        // The removals and the moves of the data files are durable before the hint file moves
+        if fileName == data.HintFileName {
+            if err := db.options.VFS.SyncDir(db.options.DirPath); err != nil {
+                return err
+            }
+        }
+        if err := db.options.VFS.Rename(srcPath, dstPath); err != nil {
             return err
         }
     }
+    if err := db.options.VFS.SyncDir(db.options.DirPath); err != nil {
+        return err
+    }
 
-    return nil
+    return fio.RemoveAllDurable(db.options.VFS, mergePath)
+}
+
+// Returns -1 when the hint file has no records
+func (db *DB) getLastHintedFileId(dirPath string) (int64, error) {
+    hintFile, err := data.OpenHintFile(db.options.VFS, dirPath)
+    if err != nil {
+        return 0, err
+    }
+    defer hintFile.Close()
+
+    var lastFileId int64 = -1
+    var offset int64 = data.FileHeaderSize
+    for {
+        logRecord, size, err := hintFile.ReadLogRecord(offset)
+        if err == io.EOF || (err == nil && logRecord == nil) {
+            return lastFileId, nil
+        }
+        if err != nil {
+            return 0, err
+        }
+
+        if pos := data.DecodeLogRecordPos(logRecord.Value); int64(pos.FileId) > lastFileId {
+            lastFileId = int64(pos.FileId)
+        }
+        offset += size
+    }
 }
 
 func (db *DB) getNonMergeFileId(dirPath string) (uint32, error) {
-    mergeFinishedFile, err := data.OpenMergeFinishedFile(dirPath)
+    mergeFinishedFile, err := db.openMetaFile(dirPath, data.MergeFinishedFileName, data.OpenMergeFinishedFile)
     if err != nil {
         return 0, err
     }
 
-    record, _, err := mergeFinishedFile.ReadLogRecord(0)
+    record, _, err := mergeFinishedFile.ReadLogRecord(data.FileHeaderSize)
     if err != nil {
         return 0, err
     }
@@ -250,16 +455,16 @@ func (db *DB) getNonMergeFileId(dirPath string) (uint32, error) {
 
 func (db *DB) loadIndexFromHintFile() error {
     hintFileName := filepath.Join(db.options.DirPath, data.HintFileName)
-    if _, err := os.Stat(hintFileName); os.IsNotExist(err) {
+    if _, err := db.options.VFS.Stat(hintFileName); os.IsNotExist(err) {
         return nil
     }
 
-    hintFile, err := data.OpenHintFile(db.options.DirPath)
+    hintFile, err := db.openMetaFile(db.options.DirPath, data.HintFileName, data.OpenHintFile)
     if err != nil {
         return err
     }
 
-    var offset int64 = 0
+    var offset int64 = data.FileHeaderSize
     for {
         logRecord, size, err := hintFile.ReadLogRecord(offset)
         if err != nil {
@@ -0,0 +1,67 @@
+package metrics
+
+// Receives the measurements of the engine. Implementations must be safe for concurrent use.
+type Metrics interface {
+    AddCounter(name string, delta float64)
+    ObserveHistogram(name string, value float64)
+    SetGauge(name string, value float64)
+}
+
+const (
+    PutDuration = "kvdb_put_duration_seconds"
+    GetDuration = "kvdb_get_duration_seconds"
+    DeleteDuration = "kvdb_delete_duration_seconds"
+    BytesWritten = "kvdb_bytes_written_total"
+    Fsyncs = "kvdb_fsyncs_total"
+    FsyncDuration = "kvdb_fsync_duration_seconds"
+    FileRotations = "kvdb_file_rotations_total"
+    MergeDuration = "kvdb_merge_duration_seconds"
+    MergeReclaimedBytes = "kvdb_merge_reclaimed_bytes_total"
+    CacheHits = "kvdb_cache_hits_total"
+    CacheMisses = "kvdb_cache_misses_total"
+    WriteStalls = "kvdb_write_stalls_total"
+
+    // Gauges, set when the database is collected
+    Keys = "kvdb_keys"
+    DataFiles = "kvdb_data_files"
+    ValueLogFiles = "kvdb_value_log_files"
+    DiskBytes = "kvdb_disk_bytes"
+    ReclaimableBytes = "kvdb_reclaimable_bytes"
+)
+
+var help = map[string]string {
+    PutDuration: "Latency of Put.",
+    GetDuration: "Latency of Get.",
+    DeleteDuration: "Latency of Delete.",
+    BytesWritten: "Bytes appended to data and value log files.",
+    Fsyncs: "Syncs of data and value log files.",
+    FsyncDuration: "Latency of syncing a data or value log file.",
+    FileRotations: "Active data files sealed for a new one.",
+    MergeDuration: "Duration of successful merges.",
+    MergeReclaimedBytes: "Bytes of stale records dropped by merges.",
+    CacheHits: "Values found in the value cache.",
+    CacheMisses: "Values read from disk with the value cache enabled.",
+    WriteStalls: "Puts slowed down or rejected by a write stall.",
+    Keys: "Keys in the index.",
+    DataFiles: "Data files, the active one included.",
+    ValueLogFiles: "Value log files, the active one included.",
+    DiskBytes: "Bytes of all files of the database.",
+    ReclaimableBytes: "Bytes of stale records a merge would drop.",
+}
+
+// Drops every measurement
+type Nop struct{}
+
+func (Nop) AddCounter(name string, delta float64) {}
+
+func (Nop) ObserveHistogram(name string, value float64) {}
+
+func (Nop) SetGauge(name string, value float64) {}
+
+// A nil Metrics drops every measurement
+func OrNop(m Metrics) Metrics {
+    if m == nil {
+        return Nop{}
+    }
+    return m
+}
@@ -0,0 +1,150 @@
+package metrics
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "math"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync"
+)
+
+// Upper bounds in seconds, from fast in-memory operations to slow merges
+var DefaultBuckets = []float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 60}
+
+type histogram struct {
+    counts []uint64 // Per bucket, not cumulative
+    sum float64
+    count uint64
+}
+
+// Keeps the measurements in memory and serves them in the Prometheus text format
+type Registry struct {
+    mutex sync.Mutex
+    buckets []float64
+    counters map[string]float64
+    gauges map[string]float64
+    histograms map[string]*histogram
+    collectors []func(Metrics)
+}
+
+func NewRegistry() *Registry {
+    return &Registry {
+        buckets: DefaultBuckets,
+        counters: make(map[string]float64),
+        gauges: make(map[string]float64),
+        histograms: make(map[string]*histogram),
+    }
+}
+
+func (r *Registry) AddCounter(name string, delta float64) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.counters[name] += delta
+}
+
+func (r *Registry) ObserveHistogram(name string, value float64) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    h, ok := r.histograms[name]
+    if !ok {
+        h = &histogram{counts: make([]uint64, len(r.buckets))}
+        r.histograms[name] = h
+    }
+    if i := sort.SearchFloat64s(r.buckets, value); i < len(r.buckets) {
+        h.counts[i]++
+    }
+    h.sum += value
+    h.count++
+}
+
+func (r *Registry) SetGauge(name string, value float64) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.gauges[name] = value
+}
+
+// Runs fn before every scrape, it sets the gauges that are read rather than measured
+func (r *Registry) AddCollector(fn func(Metrics)) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.collectors = append(r.collectors, fn)
+}
+
+func (r *Registry) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+    writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    _ = r.WriteText(writer)
+}
+
+// Writes every metric in the Prometheus text exposition format
+func (r *Registry) WriteText(w io.Writer) error {
+    r.mutex.Lock()
+    collectors := r.collectors
+    r.mutex.Unlock()
+    for _, collect := range collectors {
+        collect(r)
+    }
+
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    bw := bufio.NewWriter(w)
+    for _, name := range sortedNames(r.counters) {
+        writeHeader(bw, name, "counter")
+        fmt.Fprintf(bw, "%s %s\n", name, formatFloat(r.counters[name]))
+    }
+    for _, name := range sortedNames(r.gauges) {
+        writeHeader(bw, name, "gauge")
+        fmt.Fprintf(bw, "%s %s\n", name, formatFloat(r.gauges[name]))
+    }
+
+    var histogramNames []string
+    for name := range r.histograms {
+        histogramNames = append(histogramNames, name)
+    }
+    sort.Strings(histogramNames)
+    for _, name := range histogramNames {
+        h := r.histograms[name]
+        writeHeader(bw, name, "histogram")
+        var cumulative uint64
+        for i, bound := range r.buckets {
+            cumulative += h.counts[i]
+            fmt.Fprintf(bw, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), cumulative)
+        }
+        fmt.Fprintf(bw, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+        fmt.Fprintf(bw, "%s_sum %s\n", name, formatFloat(h.sum))
+        fmt.Fprintf(bw, "%s_count %d\n", name, h.count)
+    }
+    return bw.Flush()
+}
+
+func writeHeader(w io.Writer, name string, metricType string) {
+    if text, ok := help[name]; ok {
+        fmt.Fprintf(w, "# HELP %s %s\n", name, text)
+    }
+    fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+func sortedNames(values map[string]float64) []string {
+    var names []string
+    for name := range values {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+func formatFloat(v float64) string {
+    switch {
+    case math.IsInf(v, 1):
+        return "+Inf"
+    case math.IsInf(v, -1):
+        return "-Inf"
+    case math.IsNaN(v):
+        return "NaN"
+    }
+    return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,43 @@
+package metrics
+
+import (
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+    registry := NewRegistry()
+    registry.AddCounter(BytesWritten, 100)
+    registry.AddCounter(BytesWritten, 20)
+    registry.ObserveHistogram(PutDuration, 0.00002)
+    registry.ObserveHistogram(PutDuration, 0.5)
+    registry.ObserveHistogram(PutDuration, 100)
+    registry.AddCollector(func(m Metrics) {
+        m.SetGauge(Keys, 3)
+    })
+
+    recorder := httptest.NewRecorder()
+    registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+    body := recorder.Body.String()
+    assert.True(t, strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain"))
+
+    for _, line := range []string {
+        "# TYPE kvdb_bytes_written_total counter",
+        "kvdb_bytes_written_total 120",
+        "# TYPE kvdb_keys gauge",
+        "kvdb_keys 3",
+        "# HELP kvdb_put_duration_seconds Latency of Put.",
+        "# TYPE kvdb_put_duration_seconds histogram",
+        `kvdb_put_duration_seconds_bucket{le="1e-05"} 0`,
+        `kvdb_put_duration_seconds_bucket{le="5e-05"} 1`,
+        `kvdb_put_duration_seconds_bucket{le="0.5"} 2`,
+        `kvdb_put_duration_seconds_bucket{le="60"} 2`,
+        `kvdb_put_duration_seconds_bucket{le="+Inf"} 3`,
+        "kvdb_put_duration_seconds_count 3",
+    } {
+        assert.Contains(t, body, line + "\n")
+    }
+}
@@ -1,6 +1,13 @@
 package kvdb_go
 
-import "os"
+import (
+    "kvdb-go/data"
+    "kvdb-go/fio"
+    "kvdb-go/logger"
+    "kvdb-go/metrics"
+    "os"
+    "time"
+)
 
 type Options struct {
     DirPath string
@@ -10,6 +17,29 @@ type Options struct {
     IndexType IndexType
     MMapAtStart bool
     MergeTriggerRatio float32
+    ValueCacheBytes int64 // 0 disables the value cache
+    BloomFilter bool
+    BloomFalsePositiveRate float64
+    ValueLogThreshold int // Values longer than this go to value log files, 0 disables it
+    MaxKeySize int // 0 means only the data file size limits it
+    MaxValueSize int // 0 means only the data file size limits it
+    WatchBufferSize int // Events buffered per watcher before it misses some, 0 is the default
+    WatchHistorySize int // Recent events kept for Watch with fromSeq, 0 keeps none
+    ReadOnly bool // Takes no lock and rejects writes, several processes can read one database
+    Checksum ChecksumType // Used for new files, existing files keep the one in their header
+    VFS fio.VFS // The filesystem of every file, nil is the operating system's
+    InMemory bool // Keeps every file in memory and persists nothing, DirPath may be empty
+    Metrics metrics.Metrics // Receives latencies and counters, nil drops them
+    EventListener EventListener // Notified of rotations, merges, recovery and backups, nil ignores them
+    Logger logger.Logger // Keys and values are redacted unless wrapped by logger.ShowPayloads, nil drops the messages
+    RateLimiter *RateLimiter // Paces the I/O of merges, their hint files and backups, nil leaves it unlimited
+    WriteStallDelay time.Duration // How long a slowed down Put waits
+    SlowdownReclaimableBytes int64 // Puts are slowed down once this much space is reclaimable, 0 disables it
+    StopReclaimableBytes int64 // Puts fail with ErrWriteStalled once this much space is reclaimable, 0 disables it
+    SlowdownDiskBytes int64 // Puts are slowed down once the files take this many bytes, 0 disables it
+    StopDiskBytes int64 // Puts fail with ErrWriteStalled once the files take this many bytes, 0 disables it
+    MaxDiskBytes int64 // Puts fail with ErrDiskFull when the files would take more, 0 disables the quota
+    MinFreeDiskBytes int64 // Puts fail with ErrDiskFull when the file system of DirPath would have less free, 0 disables it
 }
 
 type IteratorOptions struct {
@@ -22,6 +52,14 @@ type WriteBatchOptions struct {
     SyncWrites bool
 }
 
+type ChecksumType = data.ChecksumType
+
+const (
+    ChecksumCRC32IEEE = data.ChecksumCRC32IEEE
+    ChecksumCRC32C = data.ChecksumCRC32C
+    ChecksumXXHash64 = data.ChecksumXXHash64
+)
+
 type IndexType = int8
 
 const (
@@ -38,6 +76,29 @@ var DefaultOptions = Options {
     IndexType: BTreeIndex,
     MMapAtStart: true,
     MergeTriggerRatio: 0.5,
+    ValueCacheBytes: 0,
+    BloomFilter: false,
+    BloomFalsePositiveRate: 0.01,
+    ValueLogThreshold: 0,
+    MaxKeySize: 1 << 16,
+    MaxValueSize: 0,
+    WatchBufferSize: 1024,
+    WatchHistorySize: 0,
+    ReadOnly: false,
+    Checksum: ChecksumCRC32IEEE,
+    VFS: fio.OSFS{},
+    InMemory: false,
+    Metrics: nil,
+    EventListener: nil,
+    Logger: nil,
+    RateLimiter: nil,
+    WriteStallDelay: time.Millisecond,
+    SlowdownReclaimableBytes: 0,
+    StopReclaimableBytes: 0,
+    SlowdownDiskBytes: 0,
+    StopDiskBytes: 0,
+    MaxDiskBytes: 0,
+    MinFreeDiskBytes: 0,
 }
 
 var DefaultIteratorOptions = IteratorOptions {
@@ -0,0 +1,133 @@
+package raft
+
+import (
+    "encoding/binary"
+    "errors"
+)
+
+type OpType = byte
+
+const (
+    OpPut OpType = iota + 1
+    OpDelete
+)
+
+type Op struct {
+    Type OpType
+    Key []byte
+    Value []byte
+}
+
+// A group of operations applied atomically through a kvdb WriteBatch
+type Batch struct {
+    ops []Op
+}
+
+func NewBatch() *Batch {
+    return &Batch{}
+}
+
+func (b *Batch) Put(key []byte, value []byte) {
+    b.ops = append(b.ops, Op{Type: OpPut, Key: key, Value: value})
+}
+
+func (b *Batch) Delete(key []byte) {
+    b.ops = append(b.ops, Op{Type: OpDelete, Key: key})
+}
+
+var errCommandCorrupted = errors.New("raft command is corrupted")
+
+// count | type keySize key valueSize value ...
+func encodeOps(ops []Op) []byte {
+    size := binary.MaxVarintLen64
+    for _, op := range ops {
+        size += 1 + binary.MaxVarintLen64 * 2 + len(op.Key) + len(op.Value)
+    }
+
+    buf := make([]byte, size)
+    index := binary.PutUvarint(buf, uint64(len(ops)))
+    for _, op := range ops {
+        buf[index] = op.Type
+        index++
+        index += binary.PutUvarint(buf[index:], uint64(len(op.Key)))
+        index += copy(buf[index:], op.Key)
+        index += binary.PutUvarint(buf[index:], uint64(len(op.Value)))
+        index += copy(buf[index:], op.Value)
+    }
+
+    return buf[:index]
+}
+
+func decodeOps(buf []byte) ([]Op, error) {
+    count, index := binary.Uvarint(buf)
+    if index <= 0 {
+        return nil, errCommandCorrupted
+    }
+
+    var ops []Op
+    for i := uint64(0); i < count; i++ {
+        if index >= len(buf) {
+            return nil, errCommandCorrupted
+        }
+        op := Op{Type: buf[index]}
+        index++
+
+        var err error
+        if op.Key, index, err = decodeBytes(buf, index); err != nil {
+            return nil, err
+        }
+        if op.Value, index, err = decodeBytes(buf, index); err != nil {
+            return nil, err
+        }
+        ops = append(ops, op)
+    }
+
+    return ops, nil
+}
+
+func encodeStrings(values []string) []byte {
+    size := binary.MaxVarintLen64
+    for _, value := range values {
+        size += binary.MaxVarintLen64 + len(value)
+    }
+
+    buf := make([]byte, size)
+    index := binary.PutUvarint(buf, uint64(len(values)))
+    for _, value := range values {
+        index += binary.PutUvarint(buf[index:], uint64(len(value)))
+        index += copy(buf[index:], value)
+    }
+
+    return buf[:index]
+}
+
+func decodeStrings(buf []byte) ([]string, error) {
+    count, index := binary.Uvarint(buf)
+    if index <= 0 {
+        return nil, errCommandCorrupted
+    }
+
+    var values []string
+    for i := uint64(0); i < count; i++ {
+        var value []byte
+        var err error
+        if value, index, err = decodeBytes(buf, index); err != nil {
+            return nil, err
+        }
+        values = append(values, string(value))
+    }
+
+    return values, nil
+}
+
+func decodeBytes(buf []byte, index int) ([]byte, int, error) {
+    size, n := binary.Uvarint(buf[index:])
+    if n <= 0 || uint64(len(buf) - index - n) < size {
+        return nil, 0, errCommandCorrupted
+    }
+    index += n
+
+    value := make([]byte, size)
+    copy(value, buf[index:])
+    return value, index + int(size), nil
+}
@@ -0,0 +1,1187 @@
+package raft
+
+import (
+    "errors"
+    kvdb "kvdb-go"
+    "kvdb-go/fio"
+    "kvdb-go/logger"
+    "kvdb-go/utils"
+    "math/rand"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+type State = byte
+
+const (
+    Follower State = iota + 1
+    Candidate
+    Leader
+)
+
+var (
+    ErrNotLeader = errors.New("raft node is not the leader")
+    ErrLeadershipLost = errors.New("raft leadership lost before the entry was committed")
+    ErrTimeout = errors.New("raft operation timed out")
+    ErrClosed = errors.New("raft node is closed")
+    ErrConfigChangeInProgress = errors.New("raft configuration change in progress")
+    ErrConfigInvalid = errors.New("raft config is invalid")
+)
+
+const (
+    dataDirName = "data"
+    raftDirName = "raft"
+    snapshotDirName = "snapshot"
+)
+
+type Config struct {
+    ID string
+    Peers []string // Initial members including ID, empty for a node that is added later with AddServer
+    DirPath string
+    Transport Transport
+    ElectionTimeout time.Duration // Randomized between ElectionTimeout and twice of it
+    HeartbeatInterval time.Duration
+    CommitTimeout time.Duration // How long proposals and reads wait
+    SnapshotThreshold uint64 // Applied entries kept in the log before a snapshot is taken, 0 disables snapshots
+    MaxEntriesPerMessage int
+    DBOptions kvdb.Options // Options of the state machine, DirPath is ignored
+    StorageVFS fio.VFS // The filesystem of the log, term and vote, nil is the operating system's
+    Logger logger.Logger // Also handed to the storage, nil drops the messages
+}
+
+var DefaultConfig = Config {
+    ElectionTimeout: 150 * time.Millisecond,
+    HeartbeatInterval: 30 * time.Millisecond,
+    CommitTimeout: 2 * time.Second,
+    SnapshotThreshold: 1024,
+    MaxEntriesPerMessage: 256,
+    DBOptions: kvdb.DefaultOptions,
+    StorageVFS: nil,
+    Logger: nil,
+}
+
+type waiter struct {
+    term uint64
+    ch chan error
+}
+
+// A member of a cluster replicating Put, Delete and batch commands into a local kvdb DB
+type Node struct {
+    mutex *sync.Mutex
+    config Config
+    db *kvdb.DB
+    storage *storage
+    state State
+    currentTerm uint64
+    votedFor string
+    leaderId string
+    log []*Entry // log[0] stands for the last entry covered by the snapshot
+    snapshotMembers []string
+    members []string
+    commitIndex uint64
+    lastApplied uint64
+    nextIndex map[string]uint64
+    matchIndex map[string]uint64
+    electionDeadline time.Time
+    lastBroadcast time.Time
+    waiters map[uint64]*waiter
+    appliedCh chan struct{} // Closed and replaced whenever entries are applied
+    closed bool
+    shutdown chan struct{}
+    done chan struct{}
+}
+
+// Implemented by transports that deliver RPCs to nodes of the same process
+type nodeBinder interface {
+    bind(node *Node)
+    unbind(node *Node)
+}
+
+func (t *inmemTransport) bind(node *Node) {
+    t.network.register(t.id, node)
+}
+
+func (t *inmemTransport) unbind(node *Node) {
+    t.network.unregister(t.id, node)
+}
+
+// Opens the node and starts taking part in elections.
+// Entries after the last snapshot are applied again on restart, that is safe because every command
+// sets absolute values.
+func NewNode(config Config) (*Node, error) {
+    if config.ID == "" || config.DirPath == "" || config.Transport == nil || config.ElectionTimeout <= 0 ||
+        config.HeartbeatInterval <= 0 || config.CommitTimeout <= 0 || config.MaxEntriesPerMessage <= 0 {
+        return nil, ErrConfigInvalid
+    }
+
+    config.Logger = logger.OrNop(config.Logger)
+
+    // The term, the vote and the entries must be on disk before a node replies
+    storageOptions := kvdb.DefaultOptions
+    storageOptions.DirPath = filepath.Join(config.DirPath, raftDirName)
+    storageOptions.SyncWrites = true
+    storageOptions.VFS = config.StorageVFS
+    storageOptions.Logger = config.Logger
+    storage, err := openStorage(storageOptions)
+    if err != nil {
+        return nil, err
+    }
+
+    node := &Node {
+        mutex: new(sync.Mutex),
+        config: config,
+        storage: storage,
+        state: Follower,
+        nextIndex: make(map[string]uint64),
+        matchIndex: make(map[string]uint64),
+        waiters: make(map[uint64]*waiter),
+        appliedCh: make(chan struct{}),
+        shutdown: make(chan struct{}),
+        done: make(chan struct{}),
+    }
+
+    if err := node.load(); err != nil {
+        _ = storage.close()
+        return nil, err
+    }
+
+    dbOptions := config.DBOptions
+    dbOptions.DirPath = filepath.Join(config.DirPath, dataDirName)
+    if node.db, err = kvdb.Open(dbOptions); err != nil {
+        _ = storage.close()
+        return nil, err
+    }
+
+    node.resetElectionDeadline()
+    if binder, ok := config.Transport.(nodeBinder); ok {
+        binder.bind(node)
+    }
+    go node.run()
+
+    return node, nil
+}
+
+func (n *Node) load() error {
+    var err error
+    if n.currentTerm, n.votedFor, err = n.storage.loadState(); err != nil {
+        return err
+    }
+
+    meta, err := n.storage.loadSnapshotMeta()
+    if err != nil {
+        return err
+    }
+    n.log = []*Entry{{}}
+    if meta != nil {
+        n.log[0] = &Entry{Index: meta.Index, Term: meta.Term}
+        n.snapshotMembers = meta.Members
+    }
+
+    entries, err := n.storage.loadEntries()
+    if err != nil {
+        return err
+    }
+    for _, entry := range entries {
+        if entry.Index > n.log[0].Index {
+            n.log = append(n.log, entry)
+        }
+    }
+
+    n.commitIndex = n.log[0].Index
+    n.lastApplied = n.log[0].Index
+    n.members = n.membersUpTo(n.lastIndex())
+    return nil
+}
+
+// Stale reads can go to the DB directly, it is replaced when the node installs a snapshot
+func (n *Node) DB() *kvdb.DB {
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+
+    return n.db
+}
+
+func (n *Node) State() State {
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+
+    return n.state
+}
+
+func (n *Node) Leader() string {
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+
+    return n.leaderId
+}
+
+func (n *Node) Members() []string {
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+
+    return append([]string(nil), n.members...)
+}
+
+func (n *Node) Put(key []byte, value []byte) error {
+    return n.propose(EntryCommand, encodeOps([]Op{{Type: OpPut, Key: key, Value: value}}))
+}
+
+func (n *Node) Delete(key []byte) error {
+    return n.propose(EntryCommand, encodeOps([]Op{{Type: OpDelete, Key: key}}))
+}
+
+func (n *Node) Apply(batch *Batch) error {
+    return n.propose(EntryCommand, encodeOps(batch.ops))
+}
+
+// Linearizable read: the leader confirms it still is the leader and waits until
+// everything committed before the read is applied
+func (n *Node) Get(key []byte) ([]byte, error) {
+    readIndex, err := n.readIndex()
+    if err != nil {
+        return nil, err
+    }
+    if err := n.waitApplied(readIndex); err != nil {
+        return nil, err
+    }
+
+    // The DB is swapped when a snapshot is installed
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+
+    if n.closed {
+        return nil, ErrClosed
+    }
+    return n.db.Get(key)
+}
+
+// Members are changed one at a time, the new configuration is used as soon as it is in the log
+func (n *Node) AddServer(id string) error {
+    return n.changeMembers(func(members []string) []string {
+        for _, member := range members {
+            if member == id {
+                return members
+            }
+        }
+        return append(members, id)
+    })
+}
+
+func (n *Node) RemoveServer(id string) error {
+    return n.changeMembers(func(members []string) []string {
+        var remaining []string
+        for _, member := range members {
+            if member != id {
+                remaining = append(remaining, member)
+            }
+        }
+        return remaining
+    })
+}
+
+func (n *Node) Close() error {
+    n.mutex.Lock()
+    if n.closed {
+        n.mutex.Unlock()
+        return nil
+    }
+    n.closed = true
+    close(n.shutdown)
+    n.mutex.Unlock()
+
+    <-n.done
+    if binder, ok := n.config.Transport.(nodeBinder); ok {
+        binder.unbind(n)
+    }
+
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+
+    if err := n.db.Close(); err != nil {
+        return err
+    }
+    return n.storage.close()
+}
+
+func (n *Node) run() {
+    defer close(n.done)
+
+    ticker := time.NewTicker(n.config.HeartbeatInterval / 2)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-n.shutdown:
+            return
+        case <-ticker.C:
+            n.tick()
+        }
+    }
+}
+
+func (n *Node) tick() {
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+
+    if n.closed {
+        return
+    }
+
+    now := time.Now()
+    if n.state == Leader {
+        if now.Sub(n.lastBroadcast) >= n.config.HeartbeatInterval {
+            n.broadcast()
+        }
+    } else if now.After(n.electionDeadline) && n.isMember(n.config.ID) {
+        n.startElection()
+    }
+}
+
+func (n *Node) resetElectionDeadline() {
+    timeout := n.config.ElectionTimeout + time.Duration(rand.Int63n(int64(n.config.ElectionTimeout)))
+    n.electionDeadline = time.Now().Add(timeout)
+}
+
+func (n *Node) lastIndex() uint64 {
+    return n.log[len(n.log) - 1].Index
+}
+
+func (n *Node) lastTerm() uint64 {
+    return n.log[len(n.log) - 1].Term
+}
+
+func (n *Node) entry(index uint64) *Entry {
+    if index < n.log[0].Index || index > n.lastIndex() {
+        return nil
+    }
+    return n.log[index - n.log[0].Index]
+}
+
+func (n *Node) termAt(index uint64) uint64 {
+    if entry := n.entry(index); entry != nil {
+        return entry.Term
+    }
+    return 0
+}
+
+func (n *Node) isMember(id string) bool {
+    for _, member := range n.members {
+        if member == id {
+            return true
+        }
+    }
+    return false
+}
+
+func (n *Node) isQuorum(count int) bool {
+    return count * 2 > len(n.members)
+}
+
+func (n *Node) membersUpTo(index uint64) []string {
+    if index > n.lastIndex() {
+        index = n.lastIndex()
+    }
+    for ; index > n.log[0].Index; index-- {
+        entry := n.entry(index)
+        if entry.Type != EntryConfiguration {
+            continue
+        }
+        if members, err := decodeStrings(entry.Data); err == nil {
+            return members
+        }
+    }
+
+    if n.log[0].Index > 0 {
+        return n.snapshotMembers
+    }
+    return n.config.Peers
+}
+
+// Nothing may act on a term or vote that is not persisted, they are left as they were when saving fails
+func (n *Node) persistState(term uint64, votedFor string) error {
+    if err := n.storage.saveState(term, votedFor); err != nil {
+        return err
+    }
+    n.currentTerm = term
+    n.votedFor = votedFor
+    return nil
+}
+
+// Steps down even if the newer term can not be persisted, the caller must not reply on its behalf then
+func (n *Node) becomeFollower(term uint64) error {
+    n.state = Follower
+    if term > n.currentTerm {
+        return n.persistState(term, "")
+    }
+    return nil
+}
+
+// For replies to the RPCs this node sent, there is nobody to return the error to
+func (n *Node) stepDown(term uint64) {
+    if err := n.becomeFollower(term); err != nil {
+        n.config.Logger.Error("Failed to persist the raft term", "term", term, "err", err)
+    }
+}
+
+func (n *Node) startElection() {
+    n.resetElectionDeadline()
+    if err := n.persistState(n.currentTerm + 1, n.config.ID); err != nil {
+        n.config.Logger.Error("Failed to persist the raft vote", "term", n.currentTerm + 1, "err", err)
+        return
+    }
+    n.state = Candidate
+    n.leaderId = ""
+
+    term := n.currentTerm
+    args := &RequestVoteArgs {
+        Term: term,
+        CandidateId: n.config.ID,
+        LastLogIndex: n.lastIndex(),
+        LastLogTerm: n.lastTerm(),
+    }
+
+    votes := 1
+    if n.isQuorum(votes) {
+        n.becomeLeader()
+        return
+    }
+
+    for _, member := range n.members {
+        if member == n.config.ID {
+            continue
+        }
+
+        go func(peer string) {
+            reply, err := n.config.Transport.RequestVote(peer, args)
+
+            n.mutex.Lock()
+            defer n.mutex.Unlock()
+
+            if err != nil || n.closed {
+                return
+            }
+            if reply.Term > n.currentTerm {
+                n.stepDown(reply.Term)
+                return
+            }
+            if n.state != Candidate || n.currentTerm != term || !reply.VoteGranted {
+                return
+            }
+
+            votes++
+            if n.isQuorum(votes) {
+                n.becomeLeader()
+            }
+        }(member)
+    }
+}
+
+func (n *Node) becomeLeader() {
+    n.state = Leader
+    n.leaderId = n.config.ID
+    n.nextIndex = make(map[string]uint64)
+    n.matchIndex = make(map[string]uint64)
+    for _, member := range n.members {
+        n.nextIndex[member] = n.lastIndex() + 1
+    }
+
+    if _, err := n.appendLocal(EntryNoop, nil); err != nil {
+        n.config.Logger.Error("Failed to append raft entry", "err", err)
+        n.stepDown(n.currentTerm)
+        return
+    }
+    n.advanceCommit()
+    n.broadcast()
+}
+
+// The caller holds n.mutex
+func (n *Node) appendLocal(entryType EntryType, data []byte) (*Entry, error) {
+    entry := &Entry {
+        Index: n.lastIndex() + 1,
+        Term: n.currentTerm,
+        Type: entryType,
+        Data: data,
+    }
+    if err := n.storage.appendEntries([]*Entry{entry}); err != nil {
+        return nil, err
+    }
+    n.log = append(n.log, entry)
+
+    if entryType == EntryConfiguration {
+        n.members = n.membersUpTo(entry.Index)
+        for _, member := range n.members {
+            if _, ok := n.nextIndex[member]; !ok {
+                n.nextIndex[member] = entry.Index
+            }
+        }
+    }
+
+    return entry, nil
+}
+
+func (n *Node) propose(entryType EntryType, data []byte) error {
+    n.mutex.Lock()
+    if err := n.checkLeader(); err != nil {
+        n.mutex.Unlock()
+        return err
+    }
+
+    index, w, err := n.startEntry(entryType, data)
+    n.mutex.Unlock()
+    if err != nil {
+        return err
+    }
+
+    return n.waitCommitted(index, w)
+}
+
+func (n *Node) changeMembers(change func(members []string) []string) error {
+    n.mutex.Lock()
+    if err := n.checkLeader(); err != nil {
+        n.mutex.Unlock()
+        return err
+    }
+
+    for index := n.commitIndex + 1; index <= n.lastIndex(); index++ {
+        if n.entry(index).Type == EntryConfiguration {
+            n.mutex.Unlock()
+            return ErrConfigChangeInProgress
+        }
+    }
+
+    members := change(append([]string(nil), n.members...))
+    index, w, err := n.startEntry(EntryConfiguration, encodeStrings(members))
+    n.mutex.Unlock()
+    if err != nil {
+        return err
+    }
+
+    return n.waitCommitted(index, w)
+}
+
+func (n *Node) checkLeader() error {
+    if n.closed {
+        return ErrClosed
+    }
+    if n.state != Leader {
+        return ErrNotLeader
+    }
+    return nil
+}
+
+// The caller holds n.mutex
+func (n *Node) startEntry(entryType EntryType, data []byte) (uint64, *waiter, error) {
+    entry, err := n.appendLocal(entryType, data)
+    if err != nil {
+        return 0, nil, err
+    }
+
+    w := &waiter{term: entry.Term, ch: make(chan error, 1)}
+    n.waiters[entry.Index] = w
+    n.advanceCommit()
+    n.broadcast()
+
+    return entry.Index, w, nil
+}
+
+func (n *Node) waitCommitted(index uint64, w *waiter) error {
+    timer := time.NewTimer(n.config.CommitTimeout)
+    defer timer.Stop()
+
+    select {
+    case err := <-w.ch:
+        return err
+    case <-timer.C:
+        n.mutex.Lock()
+        if n.waiters[index] == w {
+            delete(n.waiters, index)
+        }
+        n.mutex.Unlock()
+        return ErrTimeout
+    case <-n.shutdown:
+        return ErrClosed
+    }
+}
+
+func (n *Node) readIndex() (uint64, error) {
+    deadline := time.Now().Add(n.config.CommitTimeout)
+
+    // Until an entry of its own term is committed the leader does not know the commit index
+    n.mutex.Lock()
+    for {
+        if err := n.checkLeader(); err != nil {
+            n.mutex.Unlock()
+            return 0, err
+        }
+        if n.termAt(n.commitIndex) == n.currentTerm {
+            break
+        }
+
+        appliedCh := n.appliedCh
+        n.mutex.Unlock()
+        if err := n.waitFor(appliedCh, deadline); err != nil {
+            return 0, err
+        }
+        n.mutex.Lock()
+    }
+
+    readIndex, term := n.commitIndex, n.currentTerm
+    var peers []string
+    acks := 0
+    for _, member := range n.members {
+        if member == n.config.ID {
+            acks++
+        } else {
+            peers = append(peers, member)
+        }
+    }
+    if n.isQuorum(acks) {
+        n.mutex.Unlock()
+        return readIndex, nil
+    }
+    n.mutex.Unlock()
+
+    results := make(chan bool, len(peers))
+    for _, peer := range peers {
+        go func(peer string) {
+            results <- n.replicate(peer, term)
+        }(peer)
+    }
+
+    for range peers {
+        if <-results {
+            acks++
+        }
+
+        n.mutex.Lock()
+        quorum := n.isQuorum(acks)
+        n.mutex.Unlock()
+        if quorum {
+            return readIndex, nil
+        }
+    }
+    return 0, ErrNotLeader
+}
+
+func (n *Node) waitApplied(index uint64) error {
+    deadline := time.Now().Add(n.config.CommitTimeout)
+    for {
+        n.mutex.Lock()
+        if n.closed {
+            n.mutex.Unlock()
+            return ErrClosed
+        }
+        if n.lastApplied >= index {
+            n.mutex.Unlock()
+            return nil
+        }
+        appliedCh := n.appliedCh
+        n.mutex.Unlock()
+
+        if err := n.waitFor(appliedCh, deadline); err != nil {
+            return err
+        }
+    }
+}
+
+func (n *Node) waitFor(ch chan struct{}, deadline time.Time) error {
+    timer := time.NewTimer(time.Until(deadline))
+    defer timer.Stop()
+
+    select {
+    case <-ch:
+        return nil
+    case <-timer.C:
+        return ErrTimeout
+    case <-n.shutdown:
+        return ErrClosed
+    }
+}
+
+// The caller holds n.mutex
+func (n *Node) broadcast() {
+    n.lastBroadcast = time.Now()
+    for _, member := range n.members {
+        if member != n.config.ID {
+            go n.replicate(member, n.currentTerm)
+        }
+    }
+}
+
+// Sends the entries the peer is missing, or the snapshot when they are compacted away.
+// Returns whether the peer acknowledged the leadership in the given term.
+func (n *Node) replicate(peer string, term uint64) bool {
+    n.mutex.Lock()
+    if n.closed || n.state != Leader || n.currentTerm != term {
+        n.mutex.Unlock()
+        return false
+    }
+
+    nextIndex := n.nextIndex[peer]
+    if nextIndex == 0 {
+        nextIndex = n.lastIndex() + 1
+    }
+    if nextIndex <= n.log[0].Index {
+        return n.sendSnapshot(peer, term)
+    }
+
+    prevIndex := nextIndex - 1
+    var entries []*Entry
+    for index := nextIndex; index <= n.lastIndex() && len(entries) < n.config.MaxEntriesPerMessage; index++ {
+        entries = append(entries, n.entry(index))
+    }
+    args := &AppendEntriesArgs {
+        Term: term,
+        LeaderId: n.config.ID,
+        PrevLogIndex: prevIndex,
+        PrevLogTerm: n.termAt(prevIndex),
+        Entries: entries,
+        LeaderCommit: n.commitIndex,
+    }
+    n.mutex.Unlock()
+
+    reply, err := n.config.Transport.AppendEntries(peer, args)
+
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+
+    if err != nil || n.closed {
+        return false
+    }
+    if reply.Term > n.currentTerm {
+        n.stepDown(reply.Term)
+        return false
+    }
+    if n.state != Leader || n.currentTerm != term {
+        return false
+    }
+
+    if reply.Success {
+        if matchIndex := prevIndex + uint64(len(entries)); matchIndex > n.matchIndex[peer] {
+            n.matchIndex[peer] = matchIndex
+        }
+        n.nextIndex[peer] = n.matchIndex[peer] + 1
+        n.advanceCommit()
+    } else {
+        n.nextIndex[peer] = reply.ConflictIndex
+        if n.nextIndex[peer] <= n.matchIndex[peer] {
+            n.nextIndex[peer] = n.matchIndex[peer] + 1
+        }
+    }
+
+    if n.nextIndex[peer] <= n.lastIndex() && n.isMember(peer) {
+        go n.replicate(peer, term)
+    }
+    return true
+}
+
+// The caller holds n.mutex, it is released
+func (n *Node) sendSnapshot(peer string, term uint64) bool {
+    files, err := readSnapshotFiles(filepath.Join(n.config.DirPath, snapshotDirName))
+    if err != nil {
+        n.mutex.Unlock()
+        n.config.Logger.Error("Failed to read raft snapshot", "err", err)
+        return false
+    }
+
+    args := &InstallSnapshotArgs {
+        Term: term,
+        LeaderId: n.config.ID,
+        Meta: snapshotMeta{Index: n.log[0].Index, Term: n.log[0].Term, Members: n.snapshotMembers},
+        Files: files,
+    }
+    n.mutex.Unlock()
+
+    reply, err := n.config.Transport.InstallSnapshot(peer, args)
+
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+
+    if err != nil || n.closed {
+        return false
+    }
+    if reply.Term > n.currentTerm {
+        n.stepDown(reply.Term)
+        return false
+    }
+    if n.state != Leader || n.currentTerm != term {
+        return false
+    }
+
+    if args.Meta.Index > n.matchIndex[peer] {
+        n.matchIndex[peer] = args.Meta.Index
+    }
+    n.nextIndex[peer] = n.matchIndex[peer] + 1
+    if n.nextIndex[peer] <= n.lastIndex() {
+        go n.replicate(peer, term)
+    }
+    return true
+}
+
+// The caller holds n.mutex
+func (n *Node) advanceCommit() {
+    for index := n.lastIndex(); index > n.commitIndex && n.termAt(index) == n.currentTerm; index-- {
+        count := 0
+        for _, member := range n.members {
+            if member == n.config.ID || n.matchIndex[member] >= index {
+                count++
+            }
+        }
+
+        if n.isQuorum(count) {
+            n.commitIndex = index
+            n.applyCommitted()
+            return
+        }
+    }
+}
+
+// The caller holds n.mutex
+func (n *Node) applyCommitted() {
+    if n.lastApplied >= n.commitIndex {
+        return
+    }
+
+    for n.lastApplied < n.commitIndex {
+        n.lastApplied++
+        entry := n.entry(n.lastApplied)
+
+        var err error
+        if entry.Type == EntryCommand {
+            err = n.applyCommand(entry.Data)
+        }
+
+        if w, ok := n.waiters[entry.Index]; ok {
+            if w.term != entry.Term {
+                err = ErrLeadershipLost
+            }
+            w.ch <- err
+            delete(n.waiters, entry.Index)
+        }
+    }
+
+    close(n.appliedCh)
+    n.appliedCh = make(chan struct{})
+
+    // A leader that removed itself hands over once the change is committed
+    if n.state == Leader && !n.isMember(n.config.ID) {
+        n.stepDown(n.currentTerm)
+    }
+
+    if n.config.SnapshotThreshold > 0 && n.lastApplied - n.log[0].Index >= n.config.SnapshotThreshold {
+        if err := n.takeSnapshot(); err != nil {
+            n.config.Logger.Error("Failed to take raft snapshot", "err", err)
+        }
+    }
+}
+
+// Errors are returned to the proposer, every node runs into the same ones
+func (n *Node) applyCommand(data []byte) error {
+    ops, err := decodeOps(data)
+    if err != nil {
+        return err
+    }
+
+    if len(ops) == 1 {
+        if ops[0].Type == OpDelete {
+            return n.db.Delete(ops[0].Key)
+        }
+        return n.db.Put(ops[0].Key, ops[0].Value)
+    }
+
+    wb := n.db.NewWriteBatch(kvdb.DefaultWriteBatchOptions)
+    for _, op := range ops {
+        if op.Type == OpDelete {
+            err = wb.Delete(op.Key)
+        } else {
+            err = wb.Put(op.Key, op.Value)
+        }
+        if err != nil {
+            return err
+        }
+    }
+    return wb.Commit()
+}
+
+// Backs the state machine up into the snapshot directory and drops the applied entries
+func (n *Node) takeSnapshot() error {
+    snapshotDir := filepath.Join(n.config.DirPath, snapshotDirName)
+    tmpDir := snapshotDir + ".tmp"
+    if err := os.RemoveAll(tmpDir); err != nil {
+        return err
+    }
+    if err := n.db.Backup(tmpDir); err != nil {
+        return err
+    }
+    if err := os.RemoveAll(snapshotDir); err != nil {
+        return err
+    }
+    if err := os.Rename(tmpDir, snapshotDir); err != nil {
+        return err
+    }
+
+    meta := &snapshotMeta {
+        Index: n.lastApplied,
+        Term: n.termAt(n.lastApplied),
+        Members: n.membersUpTo(n.lastApplied),
+    }
+    return n.compact(meta)
+}
+
+// The caller holds n.mutex
+func (n *Node) compact(meta *snapshotMeta) error {
+    if err := n.storage.saveSnapshotMeta(meta); err != nil {
+        return err
+    }
+
+    firstIndex, lastIndex := n.log[0].Index + 1, n.lastIndex()
+    remaining := []*Entry{{Index: meta.Index, Term: meta.Term}}
+    if meta.Index < lastIndex && n.termAt(meta.Index) == meta.Term {
+        remaining = append(remaining, n.log[meta.Index - n.log[0].Index + 1:]...)
+        lastIndex = meta.Index
+    }
+
+    n.log = remaining
+    n.snapshotMembers = meta.Members
+    return n.storage.deleteEntries(firstIndex, lastIndex)
+}
+
+func (n *Node) handleRequestVote(args *RequestVoteArgs) (*RequestVoteReply, error) {
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+
+    if n.closed {
+        return nil, ErrClosed
+    }
+
+    if args.Term > n.currentTerm {
+        if err := n.becomeFollower(args.Term); err != nil {
+            return nil, err
+        }
+    }
+    reply := &RequestVoteReply{Term: n.currentTerm}
+    if args.Term < n.currentTerm {
+        return reply, nil
+    }
+
+    upToDate := args.LastLogTerm > n.lastTerm() ||
+        (args.LastLogTerm == n.lastTerm() && args.LastLogIndex >= n.lastIndex())
+    if (n.votedFor == "" || n.votedFor == args.CandidateId) && upToDate {
+        // The vote is refused when it can not be persisted, a restart must not forget it
+        if err := n.persistState(n.currentTerm, args.CandidateId); err != nil {
+            return nil, err
+        }
+        n.resetElectionDeadline()
+        reply.VoteGranted = true
+    }
+
+    return reply, nil
+}
+
+func (n *Node) handleAppendEntries(args *AppendEntriesArgs) (*AppendEntriesReply, error) {
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+
+    if n.closed {
+        return nil, ErrClosed
+    }
+
+    reply := &AppendEntriesReply{Term: n.currentTerm}
+    if args.Term < n.currentTerm {
+        return reply, nil
+    }
+    if args.Term > n.currentTerm || n.state != Follower {
+        if err := n.becomeFollower(args.Term); err != nil {
+            return nil, err
+        }
+    }
+    n.leaderId = args.LeaderId
+    n.resetElectionDeadline()
+    reply.Term = n.currentTerm
+
+    if args.PrevLogIndex > n.lastIndex() {
+        reply.ConflictIndex = n.lastIndex() + 1
+        return reply, nil
+    }
+
+    entries := args.Entries
+    if args.PrevLogIndex < n.log[0].Index {
+        // The beginning is covered by the snapshot already
+        skip := n.log[0].Index - args.PrevLogIndex
+        if skip >= uint64(len(entries)) {
+            entries = nil
+        } else {
+            entries = entries[skip:]
+        }
+    } else if conflictTerm := n.termAt(args.PrevLogIndex); conflictTerm != args.PrevLogTerm {
+        // Skip the whole conflicting term at once
+        index := args.PrevLogIndex
+        for index > n.log[0].Index + 1 && n.termAt(index - 1) == conflictTerm {
+            index--
+        }
+        reply.ConflictIndex = index
+        return reply, nil
+    }
+
+    for i, entry := range entries {
+        if entry.Index <= n.lastIndex() && n.termAt(entry.Index) == entry.Term {
+            continue
+        }
+
+        if entry.Index <= n.lastIndex() {
+            if err := n.truncate(entry.Index); err != nil {
+                return nil, err
+            }
+        }
+        if err := n.storage.appendEntries(entries[i:]); err != nil {
+            return nil, err
+        }
+        n.log = append(n.log, entries[i:]...)
+        break
+    }
+    n.members = n.membersUpTo(n.lastIndex())
+
+    reply.Success = true
+    if lastNewIndex := args.PrevLogIndex + uint64(len(args.Entries)); args.LeaderCommit > n.commitIndex {
+        commitIndex := args.LeaderCommit
+        if lastNewIndex < commitIndex {
+            commitIndex = lastNewIndex
+        }
+        if commitIndex > n.commitIndex {
+            n.commitIndex = commitIndex
+            n.applyCommitted()
+        }
+    }
+
+    return reply, nil
+}
+
+// Drops the conflicting entries from index on, they were never committed
+func (n *Node) truncate(index uint64) error {
+    if err := n.storage.deleteEntries(index, n.lastIndex()); err != nil {
+        return err
+    }
+
+    for i := index; i <= n.lastIndex(); i++ {
+        if w, ok := n.waiters[i]; ok {
+            w.ch <- ErrLeadershipLost
+            delete(n.waiters, i)
+        }
+    }
+    n.log = n.log[:index - n.log[0].Index]
+    return nil
+}
+
+func (n *Node) handleInstallSnapshot(args *InstallSnapshotArgs) (*InstallSnapshotReply, error) {
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+
+    if n.closed {
+        return nil, ErrClosed
+    }
+
+    reply := &InstallSnapshotReply{Term: n.currentTerm}
+    if args.Term < n.currentTerm {
+        return reply, nil
+    }
+    if args.Term > n.currentTerm || n.state != Follower {
+        if err := n.becomeFollower(args.Term); err != nil {
+            return nil, err
+        }
+    }
+    n.leaderId = args.LeaderId
+    n.resetElectionDeadline()
+    reply.Term = n.currentTerm
+
+    if args.Meta.Index <= n.commitIndex {
+        return reply, nil
+    }
+
+    if err := n.restoreSnapshot(args.Files); err != nil {
+        return nil, err
+    }
+
+    for index, w := range n.waiters {
+        if index <= args.Meta.Index {
+            w.ch <- ErrLeadershipLost
+            delete(n.waiters, index)
+        }
+    }
+    meta := args.Meta
+    if err := n.compact(&meta); err != nil {
+        return nil, err
+    }
+
+    n.commitIndex = meta.Index
+    n.lastApplied = meta.Index
+    n.members = n.membersUpTo(n.lastIndex())
+    close(n.appliedCh)
+    n.appliedCh = make(chan struct{})
+
+    return reply, nil
+}
+
+// Replaces the state machine with the snapshot files
+func (n *Node) restoreSnapshot(files map[string][]byte) error {
+    snapshotDir := filepath.Join(n.config.DirPath, snapshotDirName)
+    tmpDir := snapshotDir + ".tmp"
+    if err := os.RemoveAll(tmpDir); err != nil {
+        return err
+    }
+    for name, content := range files {
+        fileName := filepath.Join(tmpDir, name)
+        if err := os.MkdirAll(filepath.Dir(fileName), os.ModePerm); err != nil {
+            return err
+        }
+        if err := os.WriteFile(fileName, content, 0644); err != nil {
+            return err
+        }
+    }
+    if err := os.RemoveAll(snapshotDir); err != nil {
+        return err
+    }
+    if err := os.Rename(tmpDir, snapshotDir); err != nil {
+        return err
+    }
+
+    if err := n.db.Close(); err != nil {
+        return err
+    }
+    dbOptions := n.config.DBOptions
+    dbOptions.DirPath = filepath.Join(n.config.DirPath, dataDirName)
+    if err := os.RemoveAll(dbOptions.DirPath); err != nil {
+        return err
+    }
+    if err := utils.CopyDir(snapshotDir, dbOptions.DirPath, nil); err != nil {
+        return err
+    }
+
+    db, err := kvdb.Open(dbOptions)
+    if err != nil {
+        return err
+    }
+    n.db = db
+    return nil
+}
+
+func readSnapshotFiles(dir string) (map[string][]byte, error) {
+    files := make(map[string][]byte)
+    err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+        if err != nil || info.IsDir() {
+            return err
+        }
+
+        name, err := filepath.Rel(dir, path)
+        if err != nil {
+            return err
+        }
+        content, err := os.ReadFile(path)
+        if err != nil {
+            return err
+        }
+        files[name] = content
+        return nil
+    })
+    return files, err
+}
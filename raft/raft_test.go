@@ -0,0 +1,263 @@
+package raft
+
+import (
+    "fmt"
+    "kvdb-go/fio"
+    "kvdb-go/utils"
+    "os"
+    "testing"
+    "time"
+
+    "github.com/sirupsen/logrus"
+    "github.com/stretchr/testify/assert"
+)
+
+func init() {
+    logrus.SetOutput(os.Stdout)
+    logrus.SetLevel(logrus.DebugLevel)
+}
+
+type testCluster struct {
+    network *InmemNetwork
+    nodes map[string]*Node
+    dir string
+}
+
+func newTestConfig(network *InmemNetwork, dir string, id string, peers []string) Config {
+    config := DefaultConfig
+    config.ID = id
+    config.Peers = peers
+    config.DirPath = fmt.Sprintf("%s/%s", dir, id)
+    config.Transport = network.Transport(id)
+    config.ElectionTimeout = 50 * time.Millisecond
+    config.HeartbeatInterval = 10 * time.Millisecond
+    config.CommitTimeout = 500 * time.Millisecond
+    config.SnapshotThreshold = 20
+    return config
+}
+
+func newTestCluster(t *testing.T, ids ...string) *testCluster {
+    dir, _ := os.MkdirTemp("", "kvdb-go-raft-")
+    cluster := &testCluster {
+        network: NewInmemNetwork(),
+        nodes: make(map[string]*Node),
+        dir: dir,
+    }
+
+    for _, id := range ids {
+        node, err := NewNode(newTestConfig(cluster.network, dir, id, ids))
+        assert.Nil(t, err)
+        cluster.nodes[id] = node
+    }
+    return cluster
+}
+
+func (c *testCluster) destroy() {
+    for _, node := range c.nodes {
+        _ = node.Close()
+    }
+    _ = os.RemoveAll(c.dir)
+}
+
+// Waits until one of the given nodes leads
+func (c *testCluster) waitLeader(t *testing.T, ids ...string) *Node {
+    deadline := time.Now().Add(3 * time.Second)
+    for time.Now().Before(deadline) {
+        for _, id := range ids {
+            if node := c.nodes[id]; node.State() == Leader {
+                return node
+            }
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    t.Fatal("no leader elected")
+    return nil
+}
+
+func waitValue(t *testing.T, node *Node, key []byte, value []byte) {
+    deadline := time.Now().Add(3 * time.Second)
+    for time.Now().Before(deadline) {
+        if val, err := node.DB().Get(key); err == nil && string(val) == string(value) {
+            return
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    t.Fatalf("%s never saw %s", node.config.ID, key)
+}
+
+func TestRaftReplication(t *testing.T) {
+    cluster := newTestCluster(t, "n1", "n2", "n3")
+    defer cluster.destroy()
+
+    leader := cluster.waitLeader(t, "n1", "n2", "n3")
+    for i := 0; i < 50; i++ {
+        err := leader.Put(utils.GetTestKey(i), []byte(fmt.Sprintf("value-%d", i)))
+        assert.Nil(t, err)
+    }
+    err := leader.Delete(utils.GetTestKey(0))
+    assert.Nil(t, err)
+
+    batch := NewBatch()
+    batch.Put([]byte("batch-1"), []byte("1"))
+    batch.Put([]byte("batch-2"), []byte("2"))
+    batch.Delete(utils.GetTestKey(1))
+    err = leader.Apply(batch)
+    assert.Nil(t, err)
+
+    val, err := leader.Get(utils.GetTestKey(49))
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("value-49"), val)
+    _, err = leader.Get(utils.GetTestKey(1))
+    assert.NotNil(t, err)
+
+    for _, node := range cluster.nodes {
+        waitValue(t, node, []byte("batch-2"), []byte("2"))
+        _, err := node.DB().Get(utils.GetTestKey(0))
+        assert.NotNil(t, err)
+
+        if node != leader {
+            err := node.Put([]byte("key"), []byte("value"))
+            assert.Equal(t, ErrNotLeader, err)
+            _, err = node.Get([]byte("batch-1"))
+            assert.Equal(t, ErrNotLeader, err)
+        }
+    }
+}
+
+func TestRaftFailover(t *testing.T) {
+    cluster := newTestCluster(t, "n1", "n2", "n3")
+    defer cluster.destroy()
+
+    oldLeader := cluster.waitLeader(t, "n1", "n2", "n3")
+    err := oldLeader.Put([]byte("before"), []byte("1"))
+    assert.Nil(t, err)
+
+    // Cut the leader off, the rest elect a new one
+    cluster.network.Disconnect(oldLeader.config.ID)
+    var others []string
+    for id := range cluster.nodes {
+        if id != oldLeader.config.ID {
+            others = append(others, id)
+        }
+    }
+    newLeader := cluster.waitLeader(t, others...)
+
+    // The old leader can neither commit nor serve linearizable reads
+    err = oldLeader.Put([]byte("lost"), []byte("1"))
+    assert.NotNil(t, err)
+    _, err = oldLeader.Get([]byte("before"))
+    assert.NotNil(t, err)
+
+    // Enough entries for a snapshot, the old leader has to install it
+    for i := 0; i < 50; i++ {
+        err := newLeader.Put(utils.GetTestKey(i), []byte("after"))
+        assert.Nil(t, err)
+    }
+    val, err := newLeader.Get([]byte("before"))
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("1"), val)
+
+    cluster.network.Connect(oldLeader.config.ID)
+    waitValue(t, oldLeader, utils.GetTestKey(49), []byte("after"))
+    _, err = oldLeader.DB().Get([]byte("lost"))
+    assert.NotNil(t, err)
+}
+
+func TestRaftMembershipChange(t *testing.T) {
+    cluster := newTestCluster(t, "n1", "n2", "n3")
+    defer cluster.destroy()
+
+    leader := cluster.waitLeader(t, "n1", "n2", "n3")
+    for i := 0; i < 30; i++ {
+        err := leader.Put(utils.GetTestKey(i), []byte("value"))
+        assert.Nil(t, err)
+    }
+
+    // A new node starts empty and catches up once it is added
+    node, err := NewNode(newTestConfig(cluster.network, cluster.dir, "n4", nil))
+    assert.Nil(t, err)
+    cluster.nodes["n4"] = node
+    err = leader.AddServer("n4")
+    assert.Nil(t, err)
+    waitValue(t, node, utils.GetTestKey(29), []byte("value"))
+    assert.Equal(t, 4, len(node.Members()))
+
+    // Removing the leader makes the others elect a new one
+    err = leader.RemoveServer(leader.config.ID)
+    assert.Nil(t, err)
+    var others []string
+    for id := range cluster.nodes {
+        if id != leader.config.ID {
+            others = append(others, id)
+        }
+    }
+    newLeader := cluster.waitLeader(t, others...)
+    assert.Equal(t, 3, len(newLeader.Members()))
+
+    err = newLeader.Put([]byte("after-remove"), []byte("1"))
+    assert.Nil(t, err)
+    val, err := newLeader.Get([]byte("after-remove"))
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("1"), val)
+}
+
+func TestRaftRestart(t *testing.T) {
+    cluster := newTestCluster(t, "n1")
+    defer cluster.destroy()
+
+    node := cluster.waitLeader(t, "n1")
+    for i := 0; i < 30; i++ {
+        err := node.Put(utils.GetTestKey(i), []byte(fmt.Sprintf("value-%d", i)))
+        assert.Nil(t, err)
+    }
+    err := node.Close()
+    assert.Nil(t, err)
+
+    node, err = NewNode(newTestConfig(cluster.network, cluster.dir, "n1", []string{"n1"}))
+    assert.Nil(t, err)
+    cluster.nodes["n1"] = node
+    node = cluster.waitLeader(t, "n1")
+
+    val, err := node.Get(utils.GetTestKey(29))
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("value-29"), val)
+}
+
+func TestRaftVoteSurvivesCrash(t *testing.T) {
+    dir, _ := os.MkdirTemp("", "kvdb-go-raft-crash-")
+    defer os.RemoveAll(dir)
+    network := NewInmemNetwork()
+
+    newConfig := func(id string, vfs fio.VFS) Config {
+        config := newTestConfig(network, dir, id, []string{"n1", "n2", "n3"})
+        config.ElectionTimeout = time.Hour
+        config.StorageVFS = vfs
+        return config
+    }
+
+    for seed := int64(1); seed <= 8; seed++ {
+        id := fmt.Sprintf("n%d", seed)
+        node, err := NewNode(newConfig(id, nil))
+        assert.Nil(t, err)
+        assert.Nil(t, node.Close())
+
+        injector := fio.NewFaultInjector(nil, seed)
+        node, err = NewNode(newConfig(id, injector))
+        assert.Nil(t, err)
+        reply, err := node.handleRequestVote(&RequestVoteArgs{Term: 5, CandidateId: "n2"})
+        assert.Nil(t, err)
+        assert.True(t, reply.VoteGranted)
+
+        // The node crashes right after it replied
+        _ = injector.Crash()
+        _ = node.Close()
+
+        node, err = NewNode(newConfig(id, nil))
+        assert.Nil(t, err)
+        reply, err = node.handleRequestVote(&RequestVoteArgs{Term: 5, CandidateId: "n3"})
+        assert.Nil(t, err)
+        assert.False(t, reply.VoteGranted)
+        assert.Equal(t, uint64(5), reply.Term)
+        assert.Nil(t, node.Close())
+    }
+}
@@ -0,0 +1,173 @@
+package raft
+
+import (
+    "encoding/binary"
+    "errors"
+    kvdb "kvdb-go"
+)
+
+type EntryType = byte
+
+const (
+    EntryCommand EntryType = iota + 1
+    EntryConfiguration
+    // Appended by every new leader so that entries of earlier terms get committed
+    EntryNoop
+)
+
+type Entry struct {
+    Index uint64
+    Term uint64
+    Type EntryType
+    Data []byte
+}
+
+type snapshotMeta struct {
+    Index uint64
+    Term uint64
+    Members []string
+}
+
+var (
+    logKeyPrefix = []byte("log/")
+    stateKey = []byte("state")
+    snapshotKey = []byte("snapshot")
+
+    errStorageCorrupted = errors.New("raft storage is corrupted")
+)
+
+// Persists the log, the current term and vote, and the snapshot metadata in a kvdb DB of its own
+type storage struct {
+    db *kvdb.DB
+}
+
+func openStorage(options kvdb.Options) (*storage, error) {
+    db, err := kvdb.Open(options)
+    if err != nil {
+        return nil, err
+    }
+    return &storage{db: db}, nil
+}
+
+func (s *storage) close() error {
+    return s.db.Close()
+}
+
+func logKey(index uint64) []byte {
+    key := make([]byte, len(logKeyPrefix) + 8)
+    copy(key, logKeyPrefix)
+    binary.BigEndian.PutUint64(key[len(logKeyPrefix):], index)
+    return key
+}
+
+// term | votedFor
+func (s *storage) saveState(term uint64, votedFor string) error {
+    buf := make([]byte, 8 + len(votedFor))
+    binary.BigEndian.PutUint64(buf, term)
+    copy(buf[8:], votedFor)
+    return s.db.Put(stateKey, buf)
+}
+
+func (s *storage) loadState() (uint64, string, error) {
+    buf, err := s.db.Get(stateKey)
+    if err == kvdb.ErrKeyNotFound {
+        return 0, "", nil
+    }
+    if err != nil {
+        return 0, "", err
+    }
+    if len(buf) < 8 {
+        return 0, "", errStorageCorrupted
+    }
+    return binary.BigEndian.Uint64(buf), string(buf[8:]), nil
+}
+
+func (s *storage) appendEntries(entries []*Entry) error {
+    wb := s.db.NewWriteBatch(kvdb.DefaultWriteBatchOptions)
+    for _, entry := range entries {
+        buf := make([]byte, 8 + 1 + len(entry.Data))
+        binary.BigEndian.PutUint64(buf, entry.Term)
+        buf[8] = entry.Type
+        copy(buf[9:], entry.Data)
+        if err := wb.Put(logKey(entry.Index), buf); err != nil {
+            return err
+        }
+    }
+    return wb.Commit()
+}
+
+// Deletes the entries in [from, to]
+func (s *storage) deleteEntries(from uint64, to uint64) error {
+    const maxDeletesPerBatch = 1000
+
+    for from <= to {
+        wb := s.db.NewWriteBatch(kvdb.DefaultWriteBatchOptions)
+        for i := 0; i < maxDeletesPerBatch && from <= to; i++ {
+            if err := wb.Delete(logKey(from)); err != nil {
+                return err
+            }
+            from++
+        }
+        if err := wb.Commit(); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (s *storage) loadEntries() ([]*Entry, error) {
+    iterator := s.db.NewIterator(kvdb.IteratorOptions{Prefix: logKeyPrefix})
+    defer iterator.Close()
+
+    var entries []*Entry
+    for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+        buf, err := iterator.Value()
+        if err != nil {
+            return nil, err
+        }
+        if len(buf) < 9 || len(iterator.Key()) != len(logKeyPrefix) + 8 {
+            return nil, errStorageCorrupted
+        }
+
+        entries = append(entries, &Entry {
+            Index: binary.BigEndian.Uint64(iterator.Key()[len(logKeyPrefix):]),
+            Term: binary.BigEndian.Uint64(buf),
+            Type: buf[8],
+            Data: buf[9:],
+        })
+    }
+    return entries, nil
+}
+
+// index | term | members
+func (s *storage) saveSnapshotMeta(meta *snapshotMeta) error {
+    members := encodeStrings(meta.Members)
+    buf := make([]byte, 16 + len(members))
+    binary.BigEndian.PutUint64(buf, meta.Index)
+    binary.BigEndian.PutUint64(buf[8:], meta.Term)
+    copy(buf[16:], members)
+    return s.db.Put(snapshotKey, buf)
+}
+
+func (s *storage) loadSnapshotMeta() (*snapshotMeta, error) {
+    buf, err := s.db.Get(snapshotKey)
+    if err == kvdb.ErrKeyNotFound {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if len(buf) < 16 {
+        return nil, errStorageCorrupted
+    }
+
+    members, err := decodeStrings(buf[16:])
+    if err != nil {
+        return nil, err
+    }
+    return &snapshotMeta {
+        Index: binary.BigEndian.Uint64(buf),
+        Term: binary.BigEndian.Uint64(buf[8:]),
+        Members: members,
+    }, nil
+}
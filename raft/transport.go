@@ -0,0 +1,142 @@
+package raft
+
+import (
+    "errors"
+    "sync"
+)
+
+var ErrUnreachable = errors.New("raft node is unreachable")
+
+type RequestVoteArgs struct {
+    Term uint64
+    CandidateId string
+    LastLogIndex uint64
+    LastLogTerm uint64
+}
+
+type RequestVoteReply struct {
+    Term uint64
+    VoteGranted bool
+}
+
+type AppendEntriesArgs struct {
+    Term uint64
+    LeaderId string
+    PrevLogIndex uint64
+    PrevLogTerm uint64
+    Entries []*Entry
+    LeaderCommit uint64
+}
+
+type AppendEntriesReply struct {
+    Term uint64
+    Success bool
+    ConflictIndex uint64 // Where the leader continues after a failure
+}
+
+type InstallSnapshotArgs struct {
+    Term uint64
+    LeaderId string
+    Meta snapshotMeta
+    Files map[string][]byte // Backup of the state machine, relative path to content
+}
+
+type InstallSnapshotReply struct {
+    Term uint64
+}
+
+// Carries the RPCs between the nodes of a cluster
+type Transport interface {
+    RequestVote(target string, args *RequestVoteArgs) (*RequestVoteReply, error)
+    AppendEntries(target string, args *AppendEntriesArgs) (*AppendEntriesReply, error)
+    InstallSnapshot(target string, args *InstallSnapshotArgs) (*InstallSnapshotReply, error)
+}
+
+// Connects nodes of one process, nodes can be cut off to simulate partitions
+type InmemNetwork struct {
+    mutex *sync.RWMutex
+    nodes map[string]*Node
+    disconnected map[string]bool
+}
+
+func NewInmemNetwork() *InmemNetwork {
+    return &InmemNetwork {
+        mutex: new(sync.RWMutex),
+        nodes: make(map[string]*Node),
+        disconnected: make(map[string]bool),
+    }
+}
+
+func (network *InmemNetwork) Transport(id string) Transport {
+    return &inmemTransport{network: network, id: id}
+}
+
+func (network *InmemNetwork) register(id string, node *Node) {
+    network.mutex.Lock()
+    defer network.mutex.Unlock()
+
+    network.nodes[id] = node
+}
+
+func (network *InmemNetwork) unregister(id string, node *Node) {
+    network.mutex.Lock()
+    defer network.mutex.Unlock()
+
+    if network.nodes[id] == node {
+        delete(network.nodes, id)
+    }
+}
+
+func (network *InmemNetwork) Disconnect(id string) {
+    network.mutex.Lock()
+    defer network.mutex.Unlock()
+
+    network.disconnected[id] = true
+}
+
+func (network *InmemNetwork) Connect(id string) {
+    network.mutex.Lock()
+    defer network.mutex.Unlock()
+
+    delete(network.disconnected, id)
+}
+
+func (network *InmemNetwork) target(from string, to string) (*Node, error) {
+    network.mutex.RLock()
+    defer network.mutex.RUnlock()
+
+    node, ok := network.nodes[to]
+    if !ok || network.disconnected[from] || network.disconnected[to] {
+        return nil, ErrUnreachable
+    }
+    return node, nil
+}
+
+type inmemTransport struct {
+    network *InmemNetwork
+    id string
+}
+
+func (t *inmemTransport) RequestVote(target string, args *RequestVoteArgs) (*RequestVoteReply, error) {
+    node, err := t.network.target(t.id, target)
+    if err != nil {
+        return nil, err
+    }
+    return node.handleRequestVote(args)
+}
+
+func (t *inmemTransport) AppendEntries(target string, args *AppendEntriesArgs) (*AppendEntriesReply, error) {
+    node, err := t.network.target(t.id, target)
+    if err != nil {
+        return nil, err
+    }
+    return node.handleAppendEntries(args)
+}
+
+func (t *inmemTransport) InstallSnapshot(target string, args *InstallSnapshotArgs) (*InstallSnapshotReply, error) {
+    node, err := t.network.target(t.id, target)
+    if err != nil {
+        return nil, err
+    }
+    return node.handleInstallSnapshot(args)
+}
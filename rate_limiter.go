@@ -0,0 +1,93 @@
+package kvdb_go
+
+import (
+    "context"
+    "io"
+    "sync"
+    "time"
+)
+
+// A token bucket of bytes. One limiter can be shared by several databases to bound their background I/O together.
+type RateLimiter struct {
+    mutex sync.Mutex
+    bytesPerSecond float64
+    burst float64
+    tokens float64
+    last time.Time
+}
+
+// The bucket starts full, burst is the most bytes taken at once without waiting
+func NewRateLimiter(bytesPerSecond int64, burst int64) (*RateLimiter, error) {
+    if bytesPerSecond <= 0 || burst < 0 {
+        return nil, ErrRateLimitInvalid
+    }
+    return &RateLimiter {
+        bytesPerSecond: float64(bytesPerSecond),
+        burst: float64(burst),
+        tokens: float64(burst),
+        last: time.Now(),
+    }, nil
+}
+
+// Takes n bytes and waits until the bucket has refilled them. More than the burst goes into debt
+// that later callers wait for. A nil limiter never waits.
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+    if l == nil {
+        return ctx.Err()
+    }
+
+    l.mutex.Lock()
+    now := time.Now()
+    l.tokens += now.Sub(l.last).Seconds() * l.bytesPerSecond
+    if l.tokens > l.burst {
+        l.tokens = l.burst
+    }
+    l.last = now
+    l.tokens -= float64(n)
+    var delay time.Duration
+    if l.tokens < 0 {
+        delay = time.Duration(-l.tokens / l.bytesPerSecond * float64(time.Second))
+    }
+    l.mutex.Unlock()
+
+    if err := sleepCtx(ctx, delay); err != nil {
+        // The bytes were not used
+        l.mutex.Lock()
+        l.tokens += float64(n)
+        l.mutex.Unlock()
+        return err
+    }
+    return nil
+}
+
+func sleepCtx(ctx context.Context, delay time.Duration) error {
+    if delay <= 0 {
+        return ctx.Err()
+    }
+    timer := time.NewTimer(delay)
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// Paces the bytes read through it, each read is charged what it returned
+type rateLimitedReader struct {
+    ctx context.Context
+    limiter *RateLimiter
+    reader io.Reader
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+    if err := r.ctx.Err(); err != nil {
+        return 0, err
+    }
+    n, err := r.reader.Read(p)
+    if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil && err == nil {
+        err = waitErr
+    }
+    return n, err
+}
@@ -0,0 +1,55 @@
+package kvdb_go
+
+import (
+    "bytes"
+    "context"
+    "io"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+    _, err := NewRateLimiter(0, 10 * 1024)
+    assert.Equal(t, ErrRateLimitInvalid, err)
+    _, err = NewRateLimiter(100 * 1024, -1)
+    assert.Equal(t, ErrRateLimitInvalid, err)
+
+    limiter, err := NewRateLimiter(100 * 1024, 10 * 1024)
+    assert.Nil(t, err)
+
+    // The burst is free, the debt after it is waited for
+    start := time.Now()
+    err = limiter.WaitN(context.Background(), 10 * 1024)
+    assert.Nil(t, err)
+    assert.True(t, time.Since(start) < 50 * time.Millisecond)
+    err = limiter.WaitN(context.Background(), 10 * 1024)
+    assert.Nil(t, err)
+    assert.True(t, time.Since(start) >= 90 * time.Millisecond)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+    defer cancel()
+    err = limiter.WaitN(ctx, 100 * 1024)
+    assert.Equal(t, context.DeadlineExceeded, err)
+
+    var nilLimiter *RateLimiter
+    err = nilLimiter.WaitN(context.Background(), 1 << 30)
+    assert.Nil(t, err)
+}
+
+func TestRateLimitedReader(t *testing.T) {
+    limiter, err := NewRateLimiter(1024, 1024)
+    assert.Nil(t, err)
+
+    // A short read is charged what it returned, not the size of the buffer
+    reader := &rateLimitedReader{ctx: context.Background(), limiter: limiter, reader: bytes.NewReader(make([]byte, 100))}
+    start := time.Now()
+    n, err := reader.Read(make([]byte, 1 << 20))
+    assert.Nil(t, err)
+    assert.Equal(t, 100, n)
+    n, err = reader.Read(make([]byte, 1 << 20))
+    assert.Equal(t, io.EOF, err)
+    assert.Equal(t, 0, n)
+    assert.True(t, time.Since(start) < 50 * time.Millisecond)
+}
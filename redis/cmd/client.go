@@ -1,6 +1,7 @@
 package main
 
 import (
+    "context"
     "fmt"
     kvdb "kvdb-go"
     kvdb_redis "kvdb-go/redis"
@@ -28,6 +29,9 @@ var supportCommands = map[string]cmdHandler{
 type BitcaskClient struct {
     server *BitcaskServer
     db *kvdb_redis.RedisDataStructure
+    // Cancelled when the connection closes
+    ctx context.Context
+    cancel context.CancelFunc
 }
 
 func execClientCommand(conn redcon.Conn, cmd redcon.Command) {
@@ -45,6 +49,13 @@ func execClientCommand(conn redcon.Conn, cmd redcon.Command) {
     case "ping":
         conn.WriteString("PONG")
     default:
+        if len(cmd.Args) > 1 {
+            if err := client.db.CheckSize(cmd.Args[1], cmd.Args[2:]...); err != nil {
+                conn.WriteError("ERR " + err.Error())
+                return
+            }
+        }
+
         res, err := cmdFunc(client, cmd.Args[1:])
         if err != nil {
             if err == kvdb.ErrKeyNotFound {
@@ -64,7 +75,7 @@ func set(bitcaskClient *BitcaskClient, args [][]byte) (interface{}, error) {
     }
 
     key, value := args[0], args[1]
-    if err := bitcaskClient.db.Set(key, 0, value); err != nil {
+    if err := bitcaskClient.db.SetCtx(bitcaskClient.ctx, key, 0, value); err != nil {
         return nil, err
     }
 
@@ -77,7 +88,7 @@ func get(bitcaskClient *BitcaskClient, args [][]byte) (interface{}, error) {
     }
 
     key := args[0]
-    value, err := bitcaskClient.db.Get(key)
+    value, err := bitcaskClient.db.GetCtx(bitcaskClient.ctx, key)
     if err != nil {
         return nil, err
     }
@@ -1,6 +1,7 @@
 package main
 
 import (
+    "context"
     kvdb "kvdb-go"
     kvdb_redis "kvdb-go/redis"
     "log"
@@ -45,12 +46,16 @@ func (bitcaskServer *BitcaskServer) accept(conn redcon.Conn) bool {
     
     client.server = bitcaskServer
     client.db = bitcaskServer.dbs[0]
+    client.ctx, client.cancel = context.WithCancel(context.Background())
     conn.SetContext(client)
 
     return true
 }
 
 func (bitcaskServer *BitcaskServer) close(conn redcon.Conn, err error) {
+    if client, ok := conn.Context().(*BitcaskClient); ok {
+        client.cancel()
+    }
     for _, db := range bitcaskServer.dbs {
         _ = db.Close()
     }
@@ -18,3 +18,17 @@ func (rds *RedisDataStructure) Type(key []byte) (redisDataType, error) {
 
     return redisDataType(encodedValue[0]), nil
 }
+
+// Lets front ends reject oversized arguments before any of them is written
+func (rds *RedisDataStructure) CheckSize(key []byte, values ...[]byte) error {
+    if len(values) == 0 {
+        return rds.db.ValidateKeyValue(key, nil)
+    }
+
+    for _, value := range values {
+        if err := rds.db.ValidateKeyValue(key, value); err != nil {
+            return err
+        }
+    }
+    return nil
+}
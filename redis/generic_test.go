@@ -50,3 +50,24 @@ func TestRedisDataStructureType(t *testing.T) {
     assert.Nil(t, err)
     assert.Equal(t, String, typ)
 }
+
+func TestRedisDataStructureCheckSize(t *testing.T) {
+    options := kvdb.DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-redis-check-size-")
+    options.DirPath = dir
+    options.MaxKeySize = 32
+    options.MaxValueSize = 64
+
+    rds, err := NewRedisDataStructure(options)
+    assert.Nil(t, err)
+
+    err = rds.CheckSize(utils.GetTestKey(1))
+    assert.Nil(t, err)
+    err = rds.CheckSize(utils.GetTestKey(1), []byte("field"), utils.GetTestValue(24))
+    assert.Nil(t, err)
+
+    err = rds.CheckSize(make([]byte, 33))
+    assert.Equal(t, kvdb.ErrKeyTooLarge, err)
+    err = rds.CheckSize(utils.GetTestKey(1), []byte("field"), make([]byte, 65))
+    assert.Equal(t, kvdb.ErrValueTooLarge, err)
+}
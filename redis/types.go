@@ -1,6 +1,7 @@
 package redis
 
 import (
+    "context"
     "encoding/binary"
     "errors"
     kvdb "kvdb-go"
@@ -40,6 +41,10 @@ func (rds *RedisDataStructure) Close() error {
 }
 
 func (rds *RedisDataStructure) Set(key []byte, ttl time.Duration, value []byte) error {
+    return rds.SetCtx(context.Background(), key, ttl, value)
+}
+
+func (rds *RedisDataStructure) SetCtx(ctx context.Context, key []byte, ttl time.Duration, value []byte) error {
     if value == nil {
         return nil
     }
@@ -57,11 +62,15 @@ func (rds *RedisDataStructure) Set(key []byte, ttl time.Duration, value []byte)
     copy(encodedeValue, buffer[:idx])
     copy(encodedeValue[idx:], value)
 
-    return rds.db.Put(key, encodedeValue)
+    return rds.db.PutCtx(ctx, key, encodedeValue)
 }
 
 func (rds *RedisDataStructure) Get(key []byte) ([]byte, error) {
-    value, err := rds.db.Get(key)
+    return rds.GetCtx(context.Background(), key)
+}
+
+func (rds *RedisDataStructure) GetCtx(ctx context.Context, key []byte) ([]byte, error) {
+    value, err := rds.db.GetCtx(ctx, key)
     if err != nil {
         return nil, err
     }
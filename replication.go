@@ -0,0 +1,557 @@
+package kvdb_go
+
+import (
+    "crypto/rand"
+    "encoding/binary"
+    "hash/crc32"
+    "io"
+    "kvdb-go/data"
+    "kvdb-go/fio"
+    "path/filepath"
+    "sort"
+    "sync"
+    "time"
+)
+
+const replicationChunkSize = 1 << 20
+
+type ReplicatedFile struct {
+    FileId uint32
+    Size int64
+    ValueLog bool
+}
+
+// The files of a leader at one point in time.
+// The epoch changes whenever the source is recreated, files may have been rewritten by a merge in between.
+type ReplicationSnapshot struct {
+    Epoch uint64
+    Files []ReplicatedFile
+}
+
+// Moves data files from a leader to its replicas
+type ReplicationTransport interface {
+    ListFiles() (*ReplicationSnapshot, error)
+    ReadFile(file ReplicatedFile, offset int64, length int64) ([]byte, error)
+    Checksum(file ReplicatedFile, length int64) (uint32, error)
+    Close() error
+}
+
+// Serves the files of a leader, it is the in-process transport as well
+type ReplicationSource struct {
+    db *DB
+    epoch uint64
+}
+
+func NewReplicationSource(db *DB) *ReplicationSource {
+    var buf [8]byte
+    _, _ = rand.Read(buf[:])
+
+    return &ReplicationSource {
+        db: db,
+        epoch: binary.LittleEndian.Uint64(buf[:]) | 1,
+    }
+}
+
+func (s *ReplicationSource) ListFiles() (*ReplicationSnapshot, error) {
+    db := s.db
+    db.mutex.RLock()
+    defer db.mutex.RUnlock()
+
+    snapshot := &ReplicationSnapshot{Epoch: s.epoch}
+    for fileId, valueLogFile := range db.olderValueLogs {
+        size, err := valueLogFile.IOManager.Size()
+        if err != nil {
+            return nil, err
+        }
+        snapshot.Files = append(snapshot.Files, ReplicatedFile{FileId: fileId, Size: size, ValueLog: true})
+    }
+    if db.activeValueLog != nil {
+        snapshot.Files = append(snapshot.Files, ReplicatedFile {
+            FileId: db.activeValueLog.FileId,
+            Size: db.activeValueLog.WriteOffset,
+            ValueLog: true,
+        })
+    }
+
+    for fileId, dataFile := range db.olderFiles {
+        size, err := dataFile.IOManager.Size()
+        if err != nil {
+            return nil, err
+        }
+        snapshot.Files = append(snapshot.Files, ReplicatedFile{FileId: fileId, Size: size})
+    }
+    // Only complete records are listed, the active file may be in the middle of a write
+    if db.activeFile != nil {
+        snapshot.Files = append(snapshot.Files, ReplicatedFile {
+            FileId: db.activeFile.FileId,
+            Size: db.activeFile.WriteOffset,
+        })
+    }
+
+    // Value logs come first, they have to be in place before the records pointing into them
+    sort.Slice(snapshot.Files, func(i, j int) bool {
+        if snapshot.Files[i].ValueLog != snapshot.Files[j].ValueLog {
+            return snapshot.Files[i].ValueLog
+        }
+        return snapshot.Files[i].FileId < snapshot.Files[j].FileId
+    })
+
+    return snapshot, nil
+}
+
+func (s *ReplicationSource) ReadFile(file ReplicatedFile, offset int64, length int64) ([]byte, error) {
+    db := s.db
+    db.mutex.RLock()
+    defer db.mutex.RUnlock()
+
+    dataFile := db.replicatedFile(file)
+    if dataFile == nil {
+        return nil, ErrDataFileNotFound
+    }
+
+    buf := make([]byte, length)
+    n, err := dataFile.IOManager.Read(buf, offset)
+    if err != nil && !(err == io.EOF && n > 0) {
+        return nil, err
+    }
+    return buf[:n], nil
+}
+
+func (s *ReplicationSource) Checksum(file ReplicatedFile, length int64) (uint32, error) {
+    db := s.db
+    db.mutex.RLock()
+    defer db.mutex.RUnlock()
+
+    dataFile := db.replicatedFile(file)
+    if dataFile == nil {
+        return 0, ErrDataFileNotFound
+    }
+    return fileChecksum(dataFile, length)
+}
+
+func (s *ReplicationSource) Close() error {
+    return nil
+}
+
+func (db *DB) replicatedFile(file ReplicatedFile) *data.DataFile {
+    if file.ValueLog {
+        return db.getValueLogFile(file.FileId)
+    }
+    return db.getDataFile(file.FileId)
+}
+
+func fileChecksum(dataFile *data.DataFile, length int64) (uint32, error) {
+    var crc uint32
+    buf := make([]byte, streamChunkSize)
+    for offset := int64(0); offset < length; {
+        chunk := buf
+        if length - offset < int64(len(chunk)) {
+            chunk = chunk[:length - offset]
+        }
+
+        n, err := dataFile.IOManager.Read(chunk, offset)
+        if n < len(chunk) {
+            if err == nil || err == io.EOF {
+                err = io.ErrUnexpectedEOF
+            }
+            return 0, err
+        }
+
+        crc = crc32.Update(crc, crc32.IEEETable, chunk)
+        offset += int64(n)
+    }
+    return crc, nil
+}
+
+// A read-only database that tails the files of a leader.
+// Sealed files are copied whole, the active file is copied from where the last sync stopped,
+// and the new records are applied the same way as when the database is opened.
+type Replica struct {
+    db *DB
+    transport ReplicationTransport
+    epoch uint64
+    promoted bool
+    syncMutex *sync.Mutex
+    stop chan struct{}
+    done chan struct{}
+}
+
+func OpenReplica(options Options, transport ReplicationTransport) (*Replica, error) {
+    // The B+ tree index is persisted on its own and is not rebuilt from the records
+    if options.IndexType == BPTreeIndex {
+        return nil, ErrReplicaIndexTypeUnsupported
+    }
+    if options.InMemory {
+        return nil, ErrInMemoryUnsupported
+    }
+
+    // A read-only database takes no lock, but the replica writes its files and needs one
+    options.VFS = fio.OrOSFS(options.VFS)
+    if err := fio.MkdirAllDurable(options.VFS, options.DirPath); err != nil {
+        return nil, err
+    }
+    fileLock, held, err := options.VFS.TryLock(filepath.Join(options.DirPath, fileLockName))
+    if err != nil {
+        return nil, err
+    }
+    if !held {
+        return nil, ErrDatabaseIsInUse
+    }
+
+    options.ReadOnly = true
+    db, err := open(options, fileLock)
+    if err != nil {
+        _ = fileLock.Unlock()
+        return nil, err
+    }
+    if db.loader == nil {
+        db.loader = db.newRecordLoader()
+    }
+
+    return &Replica {
+        db: db,
+        transport: transport,
+        syncMutex: new(sync.Mutex),
+    }, nil
+}
+
+func (r *Replica) DB() *DB {
+    return r.db
+}
+
+// Catches up with the leader once.
+// ErrReplicaDiverged means the local files are no prefix of the leader's any more, the replica has to be rebuilt.
+func (r *Replica) Sync() error {
+    r.syncMutex.Lock()
+    defer r.syncMutex.Unlock()
+
+    if r.promoted {
+        return ErrReplicaPromoted
+    }
+
+    snapshot, err := r.transport.ListFiles()
+    if err != nil {
+        return err
+    }
+
+    if snapshot.Epoch != r.epoch {
+        if err := r.verify(snapshot); err != nil {
+            return err
+        }
+        r.epoch = snapshot.Epoch
+    }
+
+    for _, file := range snapshot.Files {
+        if err := r.pull(file); err != nil {
+            return err
+        }
+    }
+
+    return r.removeValueLogs(snapshot)
+}
+
+// Syncs every interval in the background until the replica is closed or promoted
+func (r *Replica) Start(interval time.Duration) {
+    r.stop = make(chan struct{})
+    r.done = make(chan struct{})
+
+    go func(stop chan struct{}, done chan struct{}) {
+        defer close(done)
+
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-stop:
+                return
+            case <-ticker.C:
+                if err := r.Sync(); err != nil {
+                    r.db.options.Logger.Error("Replica sync failed", "err", err)
+                    if err == ErrReplicaDiverged || err == ErrReplicaPromoted {
+                        return
+                    }
+                }
+            }
+        }
+    }(r.stop, r.done)
+}
+
+// Stops following the leader and makes the database writable.
+// Records of transactions that were not complete yet are dropped.
+func (r *Replica) Promote() error {
+    r.stopSync()
+
+    r.syncMutex.Lock()
+    defer r.syncMutex.Unlock()
+
+    db := r.db
+    db.mutex.Lock()
+    defer db.mutex.Unlock()
+
+    if db.activeFile != nil {
+        size, err := db.activeFile.IOManager.Size()
+        if err != nil {
+            return err
+        }
+        db.activeFile.WriteOffset = size
+    }
+
+    // New values go to a value log of their own, the last replicated one may be a streamed value
+    if db.activeValueLog != nil {
+        db.olderValueLogs[db.activeValueLog.FileId] = db.activeValueLog
+        db.activeValueLog = nil
+    }
+
+    if db.loader.seqNum > db.seqNum {
+        db.seqNum = db.loader.seqNum
+    }
+    db.options.ReadOnly = false
+    r.promoted = true
+
+    return nil
+}
+
+func (r *Replica) Close() error {
+    r.stopSync()
+
+    if err := r.transport.Close(); err != nil {
+        return err
+    }
+    return r.db.Close()
+}
+
+func (r *Replica) stopSync() {
+    if r.stop == nil {
+        return
+    }
+    close(r.stop)
+    <-r.done
+    r.stop = nil
+}
+
+// The local files have to be prefixes of the leader's files with the same content
+func (r *Replica) verify(snapshot *ReplicationSnapshot) error {
+    remoteFiles := make(map[ReplicatedFile]ReplicatedFile)
+    var maxRemoteDataFileId uint32
+    for _, file := range snapshot.Files {
+        remoteFiles[ReplicatedFile{FileId: file.FileId, ValueLog: file.ValueLog}] = file
+        if !file.ValueLog && file.FileId > maxRemoteDataFileId {
+            maxRemoteDataFileId = file.FileId
+        }
+    }
+
+    db := r.db
+    db.mutex.RLock()
+    defer db.mutex.RUnlock()
+
+    localFiles := make(map[ReplicatedFile]*data.DataFile)
+    for fileId, dataFile := range db.olderFiles {
+        localFiles[ReplicatedFile{FileId: fileId}] = dataFile
+    }
+    if db.activeFile != nil {
+        localFiles[ReplicatedFile{FileId: db.activeFile.FileId}] = db.activeFile
+    }
+    for fileId, valueLogFile := range db.olderValueLogs {
+        localFiles[ReplicatedFile{FileId: fileId, ValueLog: true}] = valueLogFile
+    }
+    if db.activeValueLog != nil {
+        localFiles[ReplicatedFile{FileId: db.activeValueLog.FileId, ValueLog: true}] = db.activeValueLog
+    }
+
+    for key, localFile := range localFiles {
+        size, err := localFile.IOManager.Size()
+        if err != nil {
+            return err
+        }
+
+        remoteFile, ok := remoteFiles[key]
+        if !ok {
+            // Value logs go away with ValueLogGC, data files only with a merge
+            if key.ValueLog {
+                continue
+            }
+            return ErrReplicaDiverged
+        }
+        if remoteFile.Size < size {
+            return ErrReplicaDiverged
+        }
+        if size == 0 {
+            continue
+        }
+
+        localChecksum, err := fileChecksum(localFile, size)
+        if err != nil {
+            return err
+        }
+        remoteChecksum, err := r.transport.Checksum(remoteFile, size)
+        if err != nil {
+            return err
+        }
+        if localChecksum != remoteChecksum {
+            return ErrReplicaDiverged
+        }
+    }
+
+    // A data file in the middle that the replica never saw can not be applied in order any more
+    for key := range remoteFiles {
+        if _, ok := localFiles[key]; !ok && !key.ValueLog && db.activeFile != nil && key.FileId < db.activeFile.FileId {
+            return ErrReplicaDiverged
+        }
+    }
+
+    return nil
+}
+
+// Copies the missing tail of a file and applies the records in it
+func (r *Replica) pull(file ReplicatedFile) error {
+    localFile, err := r.openLocalFile(file)
+    if err != nil {
+        return err
+    }
+
+    size, err := localFile.IOManager.Size()
+    if err != nil {
+        return err
+    }
+    if file.Size < size {
+        return ErrReplicaDiverged
+    }
+
+    // Bytes are appended without the lock, readers never look past the applied records
+    copied := size < file.Size
+    for size < file.Size {
+        length := file.Size - size
+        if length > replicationChunkSize {
+            length = replicationChunkSize
+        }
+
+        buf, err := r.transport.ReadFile(file, size, length)
+        if err != nil {
+            return err
+        }
+        if len(buf) == 0 {
+            return io.ErrUnexpectedEOF
+        }
+        if _, err := localFile.IOManager.Write(buf); err != nil {
+            return err
+        }
+        size += int64(len(buf))
+    }
+    if copied {
+        if err := localFile.Sync(); err != nil {
+            return err
+        }
+    }
+
+    db := r.db
+    db.mutex.Lock()
+    defer db.mutex.Unlock()
+
+    if file.ValueLog {
+        localFile.WriteOffset = size
+        return nil
+    }
+    if localFile.WriteOffset == size {
+        return nil
+    }
+
+    offset, err := db.loader.loadFile(localFile, localFile.WriteOffset)
+    if err != nil {
+        return err
+    }
+    localFile.WriteOffset = offset
+
+    return nil
+}
+
+func (r *Replica) openLocalFile(file ReplicatedFile) (*data.DataFile, error) {
+    db := r.db
+    db.mutex.Lock()
+    defer db.mutex.Unlock()
+
+    if localFile := db.replicatedFile(file); localFile != nil {
+        return localFile, nil
+    }
+
+    // The copy has to keep the header of the leader, its records use the checksum type in it
+    header, err := r.readFileHeader(file)
+    if err != nil {
+        return nil, err
+    }
+
+    if file.ValueLog {
+        valueLogFile, err := db.withLogger(data.OpenValueLogFileWithHeader(db.options.VFS, db.options.DirPath, file.FileId, header))
+        if err != nil {
+            return nil, err
+        }
+        db.olderValueLogs[file.FileId] = valueLogFile
+        if file.FileId >= db.nextValueLogFileId {
+            db.nextValueLogFileId = file.FileId + 1
+        }
+        return valueLogFile, nil
+    }
+
+    if db.activeFile != nil && file.FileId < db.activeFile.FileId {
+        return nil, ErrReplicaDiverged
+    }
+
+    dataFile, err := db.withLogger(data.OpenDataFileWithHeader(db.options.VFS, db.options.DirPath, file.FileId, fio.StandardFileIO, header))
+    if err != nil {
+        return nil, err
+    }
+    if db.activeFile != nil {
+        db.olderFiles[db.activeFile.FileId] = db.activeFile
+    }
+    db.activeFile = dataFile
+
+    return dataFile, nil
+}
+
+func (r *Replica) readFileHeader(file ReplicatedFile) (data.FileHeader, error) {
+    buf, err := r.transport.ReadFile(file, 0, data.FileHeaderSize)
+    if err != nil {
+        return data.FileHeader{}, err
+    }
+    return data.DecodeFileHeader(buf)
+}
+
+// Drops the value logs the leader has collected
+func (r *Replica) removeValueLogs(snapshot *ReplicationSnapshot) error {
+    remoteFileIds := make(map[uint32]struct{})
+    for _, file := range snapshot.Files {
+        if file.ValueLog {
+            remoteFileIds[file.FileId] = struct{}{}
+        }
+    }
+
+    db := r.db
+    db.mutex.Lock()
+    defer db.mutex.Unlock()
+
+    for fileId, valueLogFile := range db.olderValueLogs {
+        if _, ok := remoteFileIds[fileId]; ok {
+            continue
+        }
+        if err := valueLogFile.Close(); err != nil {
+            return err
+        }
+        delete(db.olderValueLogs, fileId)
+        if err := db.removeValueLogFile(fileId); err != nil {
+            return err
+        }
+    }
+
+    if db.activeValueLog != nil {
+        if _, ok := remoteFileIds[db.activeValueLog.FileId]; !ok {
+            if err := db.activeValueLog.Close(); err != nil {
+                return err
+            }
+            if err := db.removeValueLogFile(db.activeValueLog.FileId); err != nil {
+                return err
+            }
+            db.activeValueLog = nil
+        }
+    }
+
+    return nil
+}
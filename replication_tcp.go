@@ -0,0 +1,111 @@
+package kvdb_go
+
+import (
+    "net"
+    "net/rpc"
+)
+
+const replicationServiceName = "Replication"
+
+type ReadFileArgs struct {
+    File ReplicatedFile
+    Offset int64
+    Length int64
+}
+
+type ChecksumArgs struct {
+    File ReplicatedFile
+    Length int64
+}
+
+type replicationService struct {
+    source *ReplicationSource
+}
+
+func (s *replicationService) ListFiles(_ struct{}, reply *ReplicationSnapshot) error {
+    snapshot, err := s.source.ListFiles()
+    if err != nil {
+        return err
+    }
+    *reply = *snapshot
+    return nil
+}
+
+func (s *replicationService) ReadFile(args *ReadFileArgs, reply *[]byte) error {
+    buf, err := s.source.ReadFile(args.File, args.Offset, args.Length)
+    if err != nil {
+        return err
+    }
+    *reply = buf
+    return nil
+}
+
+func (s *replicationService) Checksum(args *ChecksumArgs, reply *uint32) error {
+    crc, err := s.source.Checksum(args.File, args.Length)
+    if err != nil {
+        return err
+    }
+    *reply = crc
+    return nil
+}
+
+// Serves the files of db to replicas until the listener is closed
+func ServeReplication(listener net.Listener, db *DB) error {
+    server := rpc.NewServer()
+    if err := server.RegisterName(replicationServiceName, &replicationService{source: NewReplicationSource(db)}); err != nil {
+        return err
+    }
+
+    server.Accept(listener)
+    return nil
+}
+
+type tcpReplicationTransport struct {
+    client *rpc.Client
+}
+
+func DialReplication(addr string) (ReplicationTransport, error) {
+    client, err := rpc.Dial("tcp", addr)
+    if err != nil {
+        return nil, err
+    }
+    return &tcpReplicationTransport{client: client}, nil
+}
+
+func (t *tcpReplicationTransport) ListFiles() (*ReplicationSnapshot, error) {
+    snapshot := new(ReplicationSnapshot)
+    if err := t.client.Call(replicationServiceName + ".ListFiles", struct{}{}, snapshot); err != nil {
+        return nil, replicationError(err)
+    }
+    return snapshot, nil
+}
+
+func (t *tcpReplicationTransport) ReadFile(file ReplicatedFile, offset int64, length int64) ([]byte, error) {
+    var buf []byte
+    args := &ReadFileArgs{File: file, Offset: offset, Length: length}
+    if err := t.client.Call(replicationServiceName + ".ReadFile", args, &buf); err != nil {
+        return nil, replicationError(err)
+    }
+    return buf, nil
+}
+
+func (t *tcpReplicationTransport) Checksum(file ReplicatedFile, length int64) (uint32, error) {
+    var crc uint32
+    args := &ChecksumArgs{File: file, Length: length}
+    if err := t.client.Call(replicationServiceName + ".Checksum", args, &crc); err != nil {
+        return 0, replicationError(err)
+    }
+    return crc, nil
+}
+
+func (t *tcpReplicationTransport) Close() error {
+    return t.client.Close()
+}
+
+// Errors come back from the server as plain strings
+func replicationError(err error) error {
+    if serverErr, ok := err.(rpc.ServerError); ok && string(serverErr) == ErrDataFileNotFound.Error() {
+        return ErrDataFileNotFound
+    }
+    return err
+}
@@ -0,0 +1,202 @@
+package kvdb_go
+
+import (
+    "kvdb-go/data"
+    "kvdb-go/utils"
+    "net"
+    "os"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func openTestReplica(t *testing.T, transport ReplicationTransport) *Replica {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-replica-")
+    options.DirPath = dir
+    options.ValueLogThreshold = 64
+
+    replica, err := OpenReplica(options, transport)
+    assert.Nil(t, err)
+    assert.NotNil(t, replica)
+    return replica
+}
+
+func destroyReplica(replica *Replica) {
+    _ = replica.Close()
+    _ = os.RemoveAll(replica.DB().options.DirPath)
+}
+
+func TestReplicaSync(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-replication-")
+    options.DirPath = dir
+    options.DataFileSize = 64 * 1024
+    options.ValueLogThreshold = 64
+    leader, err := Open(options)
+    defer destroyDB(leader)
+    assert.Nil(t, err)
+
+    replica := openTestReplica(t, NewReplicationSource(leader))
+    defer destroyReplica(replica)
+
+    // 1. Several data files and value logs
+    for i := 0; i < 500; i++ {
+        err := leader.Put(utils.GetTestKey(i), utils.GetTestValue(256))
+        assert.Nil(t, err)
+    }
+    for i := 0; i < 100; i++ {
+        err := leader.Delete(utils.GetTestKey(i))
+        assert.Nil(t, err)
+    }
+    err = replica.Sync()
+    assert.Nil(t, err)
+    assert.Equal(t, 400, len(replica.DB().ListKeys()))
+    val, err := replica.DB().Get(utils.GetTestKey(200))
+    assert.Nil(t, err)
+    expected, _ := leader.Get(utils.GetTestKey(200))
+    assert.Equal(t, expected, val)
+
+    // 2. Writes are rejected
+    err = replica.DB().Put(utils.GetTestKey(1), utils.GetTestValue(8))
+    assert.Equal(t, ErrReadOnly, err)
+
+    // 3. Tail of the active file
+    err = leader.Put([]byte("tail"), []byte("value"))
+    assert.Nil(t, err)
+    err = replica.Sync()
+    assert.Nil(t, err)
+    val, err = replica.DB().Get([]byte("tail"))
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("value"), val)
+
+    // 4. A batch only shows up once its finished record is synced
+    wb := leader.NewWriteBatch(DefaultWriteBatchOptions)
+    _ = wb.Put([]byte("batch-1"), []byte("value"))
+    _ = wb.Put([]byte("batch-2"), []byte("value"))
+    err = wb.Commit()
+    assert.Nil(t, err)
+    err = replica.Sync()
+    assert.Nil(t, err)
+    val, err = replica.DB().Get([]byte("batch-2"))
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("value"), val)
+}
+
+func TestReplicaPendingTransaction(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-replication-tx-")
+    options.DirPath = dir
+    leader, err := Open(options)
+    defer destroyDB(leader)
+    assert.Nil(t, err)
+
+    replica := openTestReplica(t, NewReplicationSource(leader))
+    defer destroyReplica(replica)
+
+    // Copy the leader's records up to the middle of a batch
+    wb := leader.NewWriteBatch(DefaultWriteBatchOptions)
+    _ = wb.Put([]byte("a"), []byte("1"))
+    _ = wb.Put([]byte("b"), []byte("2"))
+    err = wb.Commit()
+    assert.Nil(t, err)
+
+    snapshot, err := NewReplicationSource(leader).ListFiles()
+    assert.Nil(t, err)
+    file := snapshot.Files[0]
+    recordSize := int64(leader.index.Get([]byte("a")).Size)
+    file.Size = data.FileHeaderSize + recordSize
+    err = replica.pull(file)
+    assert.Nil(t, err)
+    _, err = replica.DB().Get([]byte("a"))
+    assert.Equal(t, ErrKeyNotFound, err)
+
+    err = replica.Sync()
+    assert.Nil(t, err)
+    val, err := replica.DB().Get([]byte("a"))
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("1"), val)
+}
+
+func TestReplicaTCPFailover(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-replication-tcp-")
+    options.DirPath = dir
+    options.ValueLogThreshold = 64
+    leader, err := Open(options)
+    defer destroyDB(leader)
+    assert.Nil(t, err)
+
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    assert.Nil(t, err)
+    go func() {
+        _ = ServeReplication(listener, leader)
+    }()
+
+    transport, err := DialReplication(listener.Addr().String())
+    assert.Nil(t, err)
+    replica := openTestReplica(t, transport)
+    defer destroyReplica(replica)
+
+    for i := 0; i < 100; i++ {
+        err := leader.Put(utils.GetTestKey(i), utils.GetTestValue(128))
+        assert.Nil(t, err)
+    }
+    err = replica.Sync()
+    assert.Nil(t, err)
+
+    // The leader goes away, the replica takes over
+    _ = listener.Close()
+    err = replica.Promote()
+    assert.Nil(t, err)
+    err = replica.Sync()
+    assert.Equal(t, ErrReplicaPromoted, err)
+
+    db := replica.DB()
+    assert.Equal(t, 100, len(db.ListKeys()))
+    err = db.Put(utils.GetTestKey(100), utils.GetTestValue(128))
+    assert.Nil(t, err)
+    wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+    _ = wb.Put([]byte("after-promote"), []byte("value"))
+    err = wb.Commit()
+    assert.Nil(t, err)
+    val, err := db.Get([]byte("after-promote"))
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("value"), val)
+    val, err = db.Get(utils.GetTestKey(50))
+    assert.Nil(t, err)
+    expected, _ := leader.Get(utils.GetTestKey(50))
+    assert.Equal(t, expected, val)
+}
+
+func TestReplicaDiverged(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-replication-diverged-")
+    options.DirPath = dir
+    leader, err := Open(options)
+    defer destroyDB(leader)
+    assert.Nil(t, err)
+
+    err = leader.Put([]byte("a"), []byte("1"))
+    assert.Nil(t, err)
+    replica := openTestReplica(t, NewReplicationSource(leader))
+    defer destroyReplica(replica)
+    err = replica.Sync()
+    assert.Nil(t, err)
+
+    // Another leader with different contents at the same offsets
+    otherOptions := DefaultOptions
+    otherDir, _ := os.MkdirTemp("", "kvdb-go-replication-other-")
+    otherOptions.DirPath = otherDir
+    other, err := Open(otherOptions)
+    defer destroyDB(other)
+    assert.Nil(t, err)
+    err = other.Put([]byte("b"), []byte("2"))
+    assert.Nil(t, err)
+    err = other.Put([]byte("c"), []byte("3"))
+    assert.Nil(t, err)
+
+    replica.transport = NewReplicationSource(other)
+    err = replica.Sync()
+    assert.Equal(t, ErrReplicaDiverged, err)
+}
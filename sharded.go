@@ -0,0 +1,551 @@
+package kvdb_go
+
+import (
+    "bytes"
+    "container/heap"
+    "encoding/binary"
+    "fmt"
+    "hash/fnv"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "sync"
+    "sync/atomic"
+)
+
+const (
+    coordinatorDirName = "coordinator"
+    shardNumKey = "shard-num"
+    batchIntentKeyPrefix = "intent/"
+    shardCommitAttempts = 3
+)
+
+// Spreads keys over several DB instances by hash, so writes to different shards do not contend for one lock.
+// Each key lives in exactly one shard.
+type ShardedDB struct {
+    shards []*DB
+    // Holds the intents of batches spanning several shards until every shard has committed them
+    coordinator *DB
+    intentSeq uint64
+    // A batch spanning shards holds the gates of its shards until its intent is removed, the other writes share them.
+    // No write is acknowledged that redoing the intent on the next open could overwrite.
+    gates []*sync.RWMutex
+    // Batches some shard failed to commit, they are completed before anything else is written
+    pendingMutex *sync.Mutex
+    pendingBatches []*pendingBatch
+}
+
+type pendingBatch struct {
+    intentKey []byte
+    writes []*shardedWrite // Of the shards that did not commit yet
+}
+
+func OpenSharded(options Options, shardNum int) (*ShardedDB, error) {
+    if shardNum <= 0 {
+        return nil, ErrShardNumInvalid
+    }
+    if err := checkOptions(options); err != nil {
+        return nil, err
+    }
+
+    coordinatorOptions := options
+    coordinatorOptions.DirPath = filepath.Join(options.DirPath, coordinatorDirName)
+    coordinatorOptions.SyncWrites = true
+    coordinator, err := Open(coordinatorOptions)
+    if err != nil {
+        return nil, err
+    }
+
+    sdb := &ShardedDB{coordinator: coordinator, pendingMutex: new(sync.Mutex)}
+    if err := sdb.checkShardNum(shardNum); err != nil {
+        _ = sdb.Close()
+        return nil, err
+    }
+
+    for i := 0; i < shardNum; i++ {
+        shardOptions := options
+        shardOptions.DirPath = filepath.Join(options.DirPath, fmt.Sprintf("shard-%03d", i))
+        shard, err := Open(shardOptions)
+        if err != nil {
+            _ = sdb.Close()
+            return nil, err
+        }
+        sdb.shards = append(sdb.shards, shard)
+        sdb.gates = append(sdb.gates, new(sync.RWMutex))
+    }
+
+    if err := sdb.redoBatchIntents(); err != nil {
+        _ = sdb.Close()
+        return nil, err
+    }
+
+    return sdb, nil
+}
+
+// Keys are routed by hash, so the number of shards can not change once data is written
+func (sdb *ShardedDB) checkShardNum(shardNum int) error {
+    value, err := sdb.coordinator.Get([]byte(shardNumKey))
+    if err == ErrKeyNotFound {
+        return sdb.coordinator.Put([]byte(shardNumKey), []byte(strconv.Itoa(shardNum)))
+    }
+    if err != nil {
+        return err
+    }
+    if string(value) != strconv.Itoa(shardNum) {
+        return ErrShardNumMismatch
+    }
+    return nil
+}
+
+func (sdb *ShardedDB) shardIndex(key []byte) int {
+    hash := fnv.New32a()
+    _, _ = hash.Write(key)
+    return int(hash.Sum32() % uint32(len(sdb.shards)))
+}
+
+func (sdb *ShardedDB) shard(key []byte) *DB {
+    return sdb.shards[sdb.shardIndex(key)]
+}
+
+func (sdb *ShardedDB) Put(key []byte, value []byte) error {
+    if len(key) == 0 {
+        return ErrKeyIsEmpty
+    }
+
+    shardIndex := sdb.shardIndex(key)
+    sdb.gates[shardIndex].RLock()
+    defer sdb.gates[shardIndex].RUnlock()
+
+    if err := sdb.completePendingBatches(); err != nil {
+        return err
+    }
+    return sdb.shards[shardIndex].Put(key, value)
+}
+
+func (sdb *ShardedDB) Get(key []byte) ([]byte, error) {
+    if len(key) == 0 {
+        return nil, ErrKeyIsEmpty
+    }
+    return sdb.shard(key).Get(key)
+}
+
+func (sdb *ShardedDB) Delete(key []byte) error {
+    if len(key) == 0 {
+        return ErrKeyIsEmpty
+    }
+
+    shardIndex := sdb.shardIndex(key)
+    sdb.gates[shardIndex].RLock()
+    defer sdb.gates[shardIndex].RUnlock()
+
+    if err := sdb.completePendingBatches(); err != nil {
+        return err
+    }
+    return sdb.shards[shardIndex].Delete(key)
+}
+
+func (sdb *ShardedDB) Sync() error {
+    for _, shard := range sdb.shards {
+        if err := shard.Sync(); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (sdb *ShardedDB) Close() error {
+    var firstErr error
+    for _, shard := range sdb.shards {
+        if err := shard.Close(); err != nil && firstErr == nil {
+            firstErr = err
+        }
+    }
+    if err := sdb.coordinator.Close(); err != nil && firstErr == nil {
+        firstErr = err
+    }
+    return firstErr
+}
+
+// Applies the batches that were interrupted after their intent was written
+func (sdb *ShardedDB) redoBatchIntents() error {
+    var intentKeys [][]byte
+    iterator := sdb.coordinator.NewIterator(IteratorOptions{Prefix: []byte(batchIntentKeyPrefix)})
+    for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+        intentKeys = append(intentKeys, iterator.Key())
+    }
+    iterator.Close()
+
+    // Keys sort by sequence number, so later batches are redone last and new ones follow the last
+    for _, intentKey := range intentKeys {
+        sdb.intentSeq = binary.BigEndian.Uint64(intentKey[len(batchIntentKeyPrefix):])
+        intent, err := sdb.coordinator.Get(intentKey)
+        if err != nil {
+            return err
+        }
+        writes, err := decodeBatchIntent(intent)
+        if err != nil {
+            return err
+        }
+
+        if err := sdb.completeBatch(&pendingBatch{intentKey: intentKey, writes: writes}); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Rolls the batch forward on the shards that do not have it yet, then removes its intent
+func (sdb *ShardedDB) completeBatch(batch *pendingBatch) error {
+    var err error
+    for attempt := 0; attempt < shardCommitAttempts && len(batch.writes) > 0; attempt++ {
+        batch.writes, err = sdb.commitShards(batch.writes, WriteBatchOptions{MaxBatchSize: uint(len(batch.writes)), SyncWrites: true})
+    }
+    if len(batch.writes) > 0 {
+        return err
+    }
+    return sdb.coordinator.Delete(batch.intentKey)
+}
+
+// Until then a later write could be overwritten when the intent is redone on the next open
+func (sdb *ShardedDB) completePendingBatches() error {
+    sdb.pendingMutex.Lock()
+    defer sdb.pendingMutex.Unlock()
+
+    for len(sdb.pendingBatches) > 0 {
+        if err := sdb.completeBatch(sdb.pendingBatches[0]); err != nil {
+            sdb.coordinator.options.Logger.Error("Failed to complete a sharded batch", "err", err)
+            return ErrShardedBatchIncomplete
+        }
+        sdb.pendingBatches = sdb.pendingBatches[1:]
+    }
+    return nil
+}
+
+type shardedWrite struct {
+    key []byte
+    value []byte
+    deleted bool
+}
+
+type ShardedWriteBatch struct {
+    options WriteBatchOptions
+    mutex *sync.Mutex
+    sdb *ShardedDB
+    pendingWrites map[string]*shardedWrite
+}
+
+func (sdb *ShardedDB) NewWriteBatch(options WriteBatchOptions) *ShardedWriteBatch {
+    return &ShardedWriteBatch {
+        options: options,
+        mutex: new(sync.Mutex),
+        sdb: sdb,
+        pendingWrites: make(map[string]*shardedWrite),
+    }
+}
+
+func (wb *ShardedWriteBatch) Put(key []byte, value []byte) error {
+    if err := wb.sdb.shard(key).ValidateKeyValue(key, value); err != nil {
+        return err
+    }
+
+    wb.mutex.Lock()
+    defer wb.mutex.Unlock()
+
+    wb.pendingWrites[string(key)] = &shardedWrite{key: key, value: value}
+    return nil
+}
+
+func (wb *ShardedWriteBatch) Delete(key []byte) error {
+    if len(key) == 0 {
+        return ErrKeyIsEmpty
+    }
+
+    wb.mutex.Lock()
+    defer wb.mutex.Unlock()
+
+    wb.pendingWrites[string(key)] = &shardedWrite{key: key, deleted: true}
+    return nil
+}
+
+// A batch within one shard is a plain WriteBatch. A batch spanning shards writes its intent to the
+// coordinator first and removes it once every shard has committed, an intent left behind by a crash
+// is redone on the next open. Readers may see some shards committed before others.
+// When a shard keeps failing ErrShardedBatchIncomplete is returned, the batch is still completed
+// by the next write or open and nothing else is written before.
+func (wb *ShardedWriteBatch) Commit() error {
+    wb.mutex.Lock()
+    defer wb.mutex.Unlock()
+
+    if len(wb.pendingWrites) == 0 {
+        return nil
+    }
+    if uint(len(wb.pendingWrites)) > wb.options.MaxBatchSize {
+        return ErrExceedMaxBatchSize
+    }
+
+    writes := make([]*shardedWrite, 0, len(wb.pendingWrites))
+    shardSet := make(map[int]struct{})
+    for _, write := range wb.pendingWrites {
+        writes = append(writes, write)
+        shardSet[wb.sdb.shardIndex(write.key)] = struct{}{}
+    }
+    var shardIndexes []int
+    for shardIndex := range shardSet {
+        shardIndexes = append(shardIndexes, shardIndex)
+    }
+
+    if len(shardIndexes) == 1 {
+        gate := wb.sdb.gates[shardIndexes[0]]
+        gate.RLock()
+        defer gate.RUnlock()
+
+        if err := wb.sdb.completePendingBatches(); err != nil {
+            return err
+        }
+        if _, err := wb.sdb.commitShards(writes, wb.options); err != nil {
+            return err
+        }
+        wb.pendingWrites = make(map[string]*shardedWrite)
+        return nil
+    }
+
+    // In shard order, so batches sharing shards do not deadlock. The sequence number is taken under the gates,
+    // intents of batches sharing a shard are redone in the order they were committed.
+    sort.Ints(shardIndexes)
+    for _, shardIndex := range shardIndexes {
+        wb.sdb.gates[shardIndex].Lock()
+        defer wb.sdb.gates[shardIndex].Unlock()
+    }
+    if err := wb.sdb.completePendingBatches(); err != nil {
+        return err
+    }
+
+    intentKey := make([]byte, len(batchIntentKeyPrefix) + 8)
+    copy(intentKey, batchIntentKeyPrefix)
+    binary.BigEndian.PutUint64(intentKey[len(batchIntentKeyPrefix):], atomic.AddUint64(&wb.sdb.intentSeq, 1))
+    if err := wb.sdb.coordinator.Put(intentKey, encodeBatchIntent(writes)); err != nil {
+        return err
+    }
+
+    // The intent is durable from here on, the batch is rolled forward whatever fails
+    wb.pendingWrites = make(map[string]*shardedWrite)
+    batch := &pendingBatch{intentKey: intentKey, writes: writes}
+    if err := wb.sdb.completeBatch(batch); err != nil {
+        wb.sdb.coordinator.options.Logger.Error("Failed to commit a sharded batch", "err", err)
+        wb.sdb.pendingMutex.Lock()
+        wb.sdb.pendingBatches = append(wb.sdb.pendingBatches, batch)
+        wb.sdb.pendingMutex.Unlock()
+        return ErrShardedBatchIncomplete
+    }
+    return nil
+}
+
+// Commits the writes shard by shard in shard order, the writes of the shards that failed are returned
+func (sdb *ShardedDB) commitShards(writes []*shardedWrite, options WriteBatchOptions) ([]*shardedWrite, error) {
+    shardWrites := make(map[int][]*shardedWrite)
+    var shardIndexes []int
+    for _, write := range writes {
+        shardIndex := sdb.shardIndex(write.key)
+        if _, ok := shardWrites[shardIndex]; !ok {
+            shardIndexes = append(shardIndexes, shardIndex)
+        }
+        shardWrites[shardIndex] = append(shardWrites[shardIndex], write)
+    }
+    sort.Ints(shardIndexes)
+
+    var failed []*shardedWrite
+    var firstErr error
+    for _, shardIndex := range shardIndexes {
+        if err := sdb.commitShard(shardIndex, shardWrites[shardIndex], options); err != nil {
+            failed = append(failed, shardWrites[shardIndex]...)
+            if firstErr == nil {
+                firstErr = err
+            }
+        }
+    }
+    return failed, firstErr
+}
+
+func (sdb *ShardedDB) commitShard(shardIndex int, writes []*shardedWrite, options WriteBatchOptions) error {
+    batch := sdb.shards[shardIndex].NewWriteBatch(options)
+    for _, write := range writes {
+        var err error
+        if write.deleted {
+            err = batch.Delete(write.key)
+        } else {
+            err = batch.Put(write.key, write.value)
+        }
+        if err != nil {
+            return err
+        }
+    }
+    return batch.Commit()
+}
+
+// count | deleted keySize key valueSize value ...
+func encodeBatchIntent(writes []*shardedWrite) []byte {
+    size := binary.MaxVarintLen64
+    for _, write := range writes {
+        size += 1 + binary.MaxVarintLen64 * 2 + len(write.key) + len(write.value)
+    }
+
+    buf := make([]byte, size)
+    index := binary.PutUvarint(buf, uint64(len(writes)))
+    for _, write := range writes {
+        if write.deleted {
+            buf[index] = 1
+        }
+        index++
+        index += binary.PutUvarint(buf[index:], uint64(len(write.key)))
+        index += copy(buf[index:], write.key)
+        index += binary.PutUvarint(buf[index:], uint64(len(write.value)))
+        index += copy(buf[index:], write.value)
+    }
+
+    return buf[:index]
+}
+
+func decodeBatchIntent(buf []byte) ([]*shardedWrite, error) {
+    count, index := binary.Uvarint(buf)
+    if index <= 0 {
+        return nil, ErrDataDirectoryCorrupted
+    }
+
+    readBytes := func() ([]byte, bool) {
+        size, n := binary.Uvarint(buf[index:])
+        if n <= 0 || uint64(len(buf) - index - n) < size {
+            return nil, false
+        }
+        index += n
+        value := buf[index : index + int(size)]
+        index += int(size)
+        return value, true
+    }
+
+    var writes []*shardedWrite
+    for i := uint64(0); i < count; i++ {
+        if index >= len(buf) {
+            return nil, ErrDataDirectoryCorrupted
+        }
+        write := &shardedWrite{deleted: buf[index] == 1}
+        index++
+
+        var ok bool
+        if write.key, ok = readBytes(); !ok {
+            return nil, ErrDataDirectoryCorrupted
+        }
+        if write.value, ok = readBytes(); !ok {
+            return nil, ErrDataDirectoryCorrupted
+        }
+        writes = append(writes, write)
+    }
+
+    return writes, nil
+}
+
+// Merges the ordered iterators of all shards
+type ShardedIterator struct {
+    iterators []*Iterator
+    heap *iteratorHeap
+}
+
+func (sdb *ShardedDB) NewIterator(options IteratorOptions) *ShardedIterator {
+    iterators := make([]*Iterator, len(sdb.shards))
+    for i, shard := range sdb.shards {
+        iterators[i] = shard.NewIterator(options)
+    }
+
+    itr := &ShardedIterator {
+        iterators: iterators,
+        heap: &iteratorHeap{reverse: options.Reverse},
+    }
+    itr.rebuild()
+    return itr
+}
+
+func (itr *ShardedIterator) rebuild() {
+    itr.heap.iterators = itr.heap.iterators[:0]
+    for _, iterator := range itr.iterators {
+        if iterator.Valid() {
+            itr.heap.iterators = append(itr.heap.iterators, iterator)
+        }
+    }
+    heap.Init(itr.heap)
+}
+
+func (itr *ShardedIterator) Rewind() {
+    for _, iterator := range itr.iterators {
+        iterator.Rewind()
+    }
+    itr.rebuild()
+}
+
+func (itr *ShardedIterator) Seek(key []byte) {
+    for _, iterator := range itr.iterators {
+        iterator.Seek(key)
+    }
+    itr.rebuild()
+}
+
+func (itr *ShardedIterator) Next() {
+    if !itr.Valid() {
+        return
+    }
+
+    top := itr.heap.iterators[0]
+    top.Next()
+    if top.Valid() {
+        heap.Fix(itr.heap, 0)
+    } else {
+        heap.Pop(itr.heap)
+    }
+}
+
+func (itr *ShardedIterator) Valid() bool {
+    return len(itr.heap.iterators) > 0
+}
+
+func (itr *ShardedIterator) Key() []byte {
+    return itr.heap.iterators[0].Key()
+}
+
+func (itr *ShardedIterator) Value() ([]byte, error) {
+    return itr.heap.iterators[0].Value()
+}
+
+func (itr *ShardedIterator) Close() {
+    for _, iterator := range itr.iterators {
+        iterator.Close()
+    }
+}
+
+type iteratorHeap struct {
+    iterators []*Iterator
+    reverse bool
+}
+
+func (h *iteratorHeap) Len() int {
+    return len(h.iterators)
+}
+
+func (h *iteratorHeap) Less(i, j int) bool {
+    if h.reverse {
+        return bytes.Compare(h.iterators[i].Key(), h.iterators[j].Key()) > 0
+    }
+    return bytes.Compare(h.iterators[i].Key(), h.iterators[j].Key()) < 0
+}
+
+func (h *iteratorHeap) Swap(i, j int) {
+    h.iterators[i], h.iterators[j] = h.iterators[j], h.iterators[i]
+}
+
+func (h *iteratorHeap) Push(x interface{}) {
+    h.iterators = append(h.iterators, x.(*Iterator))
+}
+
+func (h *iteratorHeap) Pop() interface{} {
+    last := h.iterators[len(h.iterators) - 1]
+    h.iterators = h.iterators[:len(h.iterators) - 1]
+    return last
+}
@@ -0,0 +1,299 @@
+package kvdb_go
+
+import (
+    "bytes"
+    "fmt"
+    "kvdb-go/fio"
+    "kvdb-go/utils"
+    "math/rand"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestShardedDB(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-sharded-")
+    options.DirPath = dir
+    defer os.RemoveAll(dir)
+
+    _, err := OpenSharded(options, 0)
+    assert.Equal(t, ErrShardNumInvalid, err)
+
+    sdb, err := OpenSharded(options, 4)
+    assert.Nil(t, err)
+
+    // 1. Put, get and delete
+    for i := 0; i < 100; i++ {
+        err := sdb.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+        assert.Nil(t, err)
+    }
+    for _, shard := range sdb.shards {
+        assert.True(t, len(shard.ListKeys()) > 0)
+    }
+    val, err := sdb.Get(utils.GetTestKey(42))
+    assert.Nil(t, err)
+    assert.Equal(t, utils.GetTestKey(42), val)
+    err = sdb.Delete(utils.GetTestKey(42))
+    assert.Nil(t, err)
+    _, err = sdb.Get(utils.GetTestKey(42))
+    assert.Equal(t, ErrKeyNotFound, err)
+
+    // 2. Merged iterator returns the keys of all shards in order
+    var keys [][]byte
+    iterator := sdb.NewIterator(DefaultIteratorOptions)
+    for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+        value, err := iterator.Value()
+        assert.Nil(t, err)
+        assert.Equal(t, iterator.Key(), value)
+        keys = append(keys, iterator.Key())
+    }
+    iterator.Close()
+    assert.Equal(t, 99, len(keys))
+    for i := 1; i < len(keys); i++ {
+        assert.True(t, bytes.Compare(keys[i - 1], keys[i]) < 0)
+    }
+
+    iterator = sdb.NewIterator(IteratorOptions{Reverse: true})
+    iterator.Seek(keys[50])
+    assert.Equal(t, keys[50], iterator.Key())
+    iterator.Next()
+    assert.Equal(t, keys[49], iterator.Key())
+    iterator.Close()
+
+    // 3. Batches spanning shards
+    wb := sdb.NewWriteBatch(DefaultWriteBatchOptions)
+    for i := 0; i < 10; i++ {
+        err := wb.Put(utils.GetTestKey(1000 + i), []byte("batch"))
+        assert.Nil(t, err)
+    }
+    err = wb.Delete(utils.GetTestKey(0))
+    assert.Nil(t, err)
+    err = wb.Commit()
+    assert.Nil(t, err)
+    val, err = sdb.Get(utils.GetTestKey(1009))
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("batch"), val)
+    _, err = sdb.Get(utils.GetTestKey(0))
+    assert.Equal(t, ErrKeyNotFound, err)
+
+    // 4. An intent left behind by a crash is redone on open
+    intent := encodeBatchIntent([]*shardedWrite {
+        {key: []byte("redo-1"), value: []byte("1")},
+        {key: []byte("redo-2"), value: []byte("2")},
+        {key: utils.GetTestKey(1), deleted: true},
+    })
+    err = sdb.coordinator.Put([]byte(batchIntentKeyPrefix + "00000000"), intent)
+    assert.Nil(t, err)
+    err = sdb.Close()
+    assert.Nil(t, err)
+
+    _, err = OpenSharded(options, 8)
+    assert.Equal(t, ErrShardNumMismatch, err)
+
+    sdb, err = OpenSharded(options, 4)
+    assert.Nil(t, err)
+    val, err = sdb.Get([]byte("redo-2"))
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("2"), val)
+    _, err = sdb.Get(utils.GetTestKey(1))
+    assert.Equal(t, ErrKeyNotFound, err)
+    _, err = sdb.coordinator.Get([]byte(batchIntentKeyPrefix + "00000000"))
+    assert.Equal(t, ErrKeyNotFound, err)
+    err = sdb.Close()
+    assert.Nil(t, err)
+}
+
+func TestShardedWriteBatchShardFailure(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-sharded-failure-")
+    options.DirPath = dir
+    defer os.RemoveAll(dir)
+
+    // Writes to the second shard fail while failures is above 0
+    var failures int
+    injector := fio.NewFaultInjector(func(fileName string, op fio.FaultOp, rand *rand.Rand) fio.Fault {
+        if op == fio.FaultOpWrite && failures > 0 && strings.Contains(fileName, "shard-001") {
+            failures--
+            return fio.FaultWriteError
+        }
+        return fio.NoFault
+    }, 1)
+    options.VFS = injector
+
+    sdb, err := OpenSharded(options, 2)
+    assert.Nil(t, err)
+
+    newBatch := func(round int) (*ShardedWriteBatch, [][]byte) {
+        wb := sdb.NewWriteBatch(DefaultWriteBatchOptions)
+        var keys [][]byte
+        for i := 0; i < 10; i++ {
+            key := []byte(fmt.Sprintf("round-%d-key-%d", round, i))
+            err := wb.Put(key, []byte("batch"))
+            assert.Nil(t, err)
+            keys = append(keys, key)
+        }
+        return wb, keys
+    }
+    assertVisible := func(keys [][]byte) {
+        for _, key := range keys {
+            val, err := sdb.Get(key)
+            assert.Nil(t, err)
+            assert.Equal(t, []byte("batch"), val)
+        }
+    }
+
+    // 1. A failure that goes away is retried right away
+    wb, keys := newBatch(1)
+    failures = 1
+    err = wb.Commit()
+    assert.Nil(t, err)
+    assertVisible(keys)
+
+    // 2. A shard that keeps failing leaves the batch pending, the next write completes it first
+    wb, keys = newBatch(2)
+    failures = 1000
+    err = wb.Commit()
+    assert.Equal(t, ErrShardedBatchIncomplete, err)
+    var firstShardKey []byte
+    for _, key := range keys {
+        if sdb.shardIndex(key) == 0 {
+            firstShardKey = key
+        }
+    }
+    assert.NotNil(t, firstShardKey)
+    _, err = sdb.Get(firstShardKey)
+    assert.Nil(t, err)
+    err = sdb.Put(firstShardKey, []byte("later"))
+    assert.Equal(t, ErrShardedBatchIncomplete, err)
+
+    failures = 0
+    err = sdb.Put(firstShardKey, []byte("later"))
+    assert.Nil(t, err)
+    for _, key := range keys {
+        if !bytes.Equal(key, firstShardKey) {
+            assertVisible([][]byte{key})
+        }
+    }
+
+    // 3. Nothing written after the batch is overwritten when its intent is redone on open
+    wb, keys = newBatch(3)
+    failures = 1000
+    err = wb.Commit()
+    assert.Equal(t, ErrShardedBatchIncomplete, err)
+    failures = 0
+    err = sdb.Close()
+    assert.Nil(t, err)
+
+    sdb, err = OpenSharded(options, 2)
+    assert.Nil(t, err)
+    assertVisible(keys)
+    // New intents sort after the redone ones
+    assert.Equal(t, uint64(3), sdb.intentSeq)
+    val, err := sdb.Get(firstShardKey)
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("later"), val)
+    iterator := sdb.coordinator.NewIterator(IteratorOptions{Prefix: []byte(batchIntentKeyPrefix)})
+    iterator.Rewind()
+    assert.False(t, iterator.Valid())
+    iterator.Close()
+    err = sdb.Close()
+    assert.Nil(t, err)
+}
+
+// Holds the writes to the coordinator's files from the holdFrom-th on until release is closed
+type holdingVFS struct {
+    fio.OSFS
+    coordinatorDir string
+    mutex sync.Mutex
+    writes int
+    holdFrom int
+    release chan struct{}
+}
+
+type holdingIOManager struct {
+    fio.IOManager
+    fs *holdingVFS
+}
+
+func (fs *holdingVFS) OpenFile(name string, ioType fio.IOType) (fio.IOManager, error) {
+    ioManager, err := fs.OSFS.OpenFile(name, ioType)
+    if err != nil || filepath.Dir(name) != fs.coordinatorDir {
+        return ioManager, err
+    }
+    return &holdingIOManager{IOManager: ioManager, fs: fs}, nil
+}
+
+func (f *holdingIOManager) Write(b []byte) (int, error) {
+    f.fs.mutex.Lock()
+    f.fs.writes++
+    held := f.fs.holdFrom > 0 && f.fs.writes >= f.fs.holdFrom
+    f.fs.mutex.Unlock()
+    if held {
+        <-f.fs.release
+    }
+    return f.IOManager.Write(b)
+}
+
+func TestShardedWriteBatchHoldsShards(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-sharded-gate-")
+    options.DirPath = dir
+    defer os.RemoveAll(dir)
+    fs := &holdingVFS{coordinatorDir: filepath.Join(dir, coordinatorDirName), release: make(chan struct{})}
+    options.VFS = fs
+
+    sdb, err := OpenSharded(options, 2)
+    assert.Nil(t, err)
+    defer sdb.Close()
+
+    wb := sdb.NewWriteBatch(DefaultWriteBatchOptions)
+    for i := 0; i < 10; i++ {
+        err := wb.Put(utils.GetTestKey(i), []byte("batch"))
+        assert.Nil(t, err)
+    }
+
+    // The batch writes its intent and commits the shards, then waits to remove the intent
+    fs.mutex.Lock()
+    fs.holdFrom = fs.writes + 2
+    fs.mutex.Unlock()
+    committed := make(chan error)
+    go func() {
+        committed <- wb.Commit()
+    }()
+    var shardsCommitted bool
+    for i := 0; i < 100 && !shardsCommitted; i++ {
+        time.Sleep(10 * time.Millisecond)
+        val, err := sdb.Get(utils.GetTestKey(0))
+        shardsCommitted = err == nil && bytes.Equal(val, []byte("batch"))
+    }
+    assert.True(t, shardsCommitted)
+
+    // A crash now would redo the intent over the write
+    put := make(chan error)
+    go func() {
+        put <- sdb.Put(utils.GetTestKey(0), []byte("later"))
+    }()
+    var putDone bool
+    select {
+    case err = <-put:
+        putDone = true
+        t.Error("a write to a shard of the batch was acknowledged before its intent was removed")
+    case <-time.After(100 * time.Millisecond):
+    }
+
+    close(fs.release)
+    assert.Nil(t, <-committed)
+    if !putDone {
+        err = <-put
+    }
+    assert.Nil(t, err)
+    val, err := sdb.Get(utils.GetTestKey(0))
+    assert.Nil(t, err)
+    assert.Equal(t, []byte("later"), val)
+}
@@ -0,0 +1,184 @@
+package kvdb_go
+
+import (
+    "context"
+    "encoding/binary"
+    "hash/crc32"
+    "io"
+    "kvdb-go/data"
+    "kvdb-go/metrics"
+    "math"
+)
+
+const streamChunkSize = 64 * 1024
+
+// Streams size bytes from reader into a value log file of its own, the value is never held in memory as a whole.
+// Other writers are only blocked while the pointer record is appended.
+func (db *DB) PutReader(key []byte, reader io.Reader, size int64) error {
+    if err := db.ValidateKeyValue(key, nil); err != nil {
+        return err
+    }
+    if size < 0 || uint64(size) > math.MaxUint32 || (db.options.MaxValueSize > 0 && size > int64(db.options.MaxValueSize)) {
+        return ErrValueTooLarge
+    }
+
+    db.mutex.Lock()
+    if db.options.ReadOnly {
+        db.mutex.Unlock()
+        return ErrReadOnly
+    }
+    if err := db.waitWriteStall(context.Background()); err != nil {
+        db.mutex.Unlock()
+        return err
+    }
+    if err := db.checkDiskSpace(data.MaxLogRecordSize(len(key), int(size))); err != nil {
+        db.mutex.Unlock()
+        return err
+    }
+    if db.activeFile == nil {
+        if err := db.setActiveDataFile(); err != nil {
+            db.mutex.Unlock()
+            return err
+        }
+    }
+    fileId := db.allocateValueLogFileId()
+    db.mutex.Unlock()
+
+    valueLogFile, recordSize, err := db.writeStreamedValue(fileId, key, reader, size)
+    if err != nil {
+        _ = db.removeValueLogFile(fileId)
+        return err
+    }
+
+    db.mutex.Lock()
+    defer db.mutex.Unlock()
+
+    db.olderValueLogs[fileId] = valueLogFile
+    db.addDiskUsage(valueLogFile.WriteOffset)
+    pos, err := db.appendLogRecord(&data.LogRecord {
+        Key: logRecordKeyWithSeq(key, nonTransactionSeqNum),
+        Value: data.EncodeLogRecordPos(&data.LogRecordPos{FileId: fileId, Offset: data.FileHeaderSize, Size: uint32(recordSize)}),
+        Type: data.LogRecordValuePointer,
+    })
+    if err != nil {
+        return err
+    }
+
+    db.bloomAdd(key)
+    if oldPos := db.index.Put(key, pos); oldPos != nil {
+        db.reclaimableSpace += int64(oldPos.Size)
+        db.invalidateCache(oldPos)
+    }
+    // Streamed values are too large to be handed to watchers
+    db.watchHub.publish(EventPut, key, nil)
+
+    return nil
+}
+
+func (db *DB) writeStreamedValue(fileId uint32, key []byte, reader io.Reader, size int64) (*data.DataFile, int64, error) {
+    valueLogFile, err := db.createValueLogFile(fileId)
+    if err != nil {
+        return nil, 0, err
+    }
+
+    checksumType := valueLogFile.Header.ChecksumType
+    header := data.EncodeStreamedLogRecordHeader(logRecordKeyWithSeq(key, nonTransactionSeqNum), size, checksumType)
+    if err := valueLogFile.Write(header); err != nil {
+        _ = valueLogFile.Close()
+        return nil, 0, diskFullOr(err)
+    }
+
+    checksum := data.NewChecksum(checksumType)
+    buf := make([]byte, streamChunkSize)
+    remaining := size
+    for remaining > 0 {
+        chunk := buf
+        if remaining < int64(len(chunk)) {
+            chunk = chunk[:remaining]
+        }
+
+        if _, err := io.ReadFull(reader, chunk); err != nil {
+            _ = valueLogFile.Close()
+            if err == io.EOF {
+                err = io.ErrUnexpectedEOF
+            }
+            return nil, 0, err
+        }
+
+        _, _ = checksum.Write(chunk)
+        if err := valueLogFile.Write(chunk); err != nil {
+            _ = valueLogFile.Close()
+            return nil, 0, diskFullOr(err)
+        }
+        remaining -= int64(len(chunk))
+    }
+
+    trailer := make([]byte, crc32.Size)
+    binary.LittleEndian.PutUint32(trailer, checksum.Sum32())
+    if err := valueLogFile.Write(trailer); err != nil {
+        _ = valueLogFile.Close()
+        return nil, 0, diskFullOr(err)
+    }
+
+    // The value has to be durable before the pointer record is written
+    if err := db.syncFile(valueLogFile); err != nil {
+        _ = valueLogFile.Close()
+        return nil, 0, err
+    }
+    db.options.Metrics.AddCounter(metrics.BytesWritten, float64(valueLogFile.WriteOffset - data.FileHeaderSize))
+
+    return valueLogFile, valueLogFile.WriteOffset - data.FileHeaderSize, nil
+}
+
+// The crc of the value is checked incrementally, the last Read returns data.ErrInvalidCRC on a mismatch.
+// Files removed by ValueLogGC while the reader is open make it fail.
+func (db *DB) GetReader(key []byte) (io.ReadCloser, error) {
+    if len(key) == 0 {
+        return nil, ErrKeyIsEmpty
+    }
+
+    db.mutex.RLock()
+    defer db.mutex.RUnlock()
+
+    if !db.bloomMayContain(key) {
+        return nil, ErrKeyNotFound
+    }
+
+    logRecordPos := db.index.Get(key)
+    if logRecordPos == nil {
+        return nil, ErrKeyNotFound
+    }
+
+    dataFile := db.getDataFile(logRecordPos.FileId)
+    if dataFile == nil {
+        return nil, ErrDataFileNotFound
+    }
+
+    recordType, reader, _, err := dataFile.ReadLogRecordValue(logRecordPos.Offset)
+    if err != nil {
+        return nil, err
+    }
+
+    switch recordType {
+    case data.LogRecordDeleted:
+        return nil, ErrKeyNotFound
+    case data.LogRecordValuePointer:
+        pointer, err := io.ReadAll(reader)
+        if err != nil {
+            return nil, err
+        }
+
+        valuePos := data.DecodeLogRecordPos(pointer)
+        valueLogFile := db.getValueLogFile(valuePos.FileId)
+        if valueLogFile == nil {
+            return nil, ErrDataFileNotFound
+        }
+
+        _, reader, _, err = valueLogFile.ReadLogRecordValue(valuePos.Offset)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    return io.NopCloser(reader), nil
+}
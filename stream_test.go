@@ -0,0 +1,104 @@
+package kvdb_go
+
+import (
+    "bytes"
+    "io"
+    "kvdb-go/data"
+    "kvdb-go/utils"
+    "os"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestDBPutReaderGetReader(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-stream-")
+    options.DirPath = dir
+    options.DataFileSize = 64 * 1024
+    options.MergeTriggerRatio = 0
+
+    db, err := Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+    assert.NotNil(t, db)
+
+    // 1. A value much larger than a data file
+    value := bytes.Repeat(utils.GetTestValue(1000), 1024)
+    err = db.PutReader(utils.GetTestKey(1), bytes.NewReader(value), int64(len(value)))
+    assert.Nil(t, err)
+
+    reader, err := db.GetReader(utils.GetTestKey(1))
+    assert.Nil(t, err)
+    streamed, err := io.ReadAll(reader)
+    assert.Nil(t, err)
+    assert.Nil(t, reader.Close())
+    assert.Equal(t, value, streamed)
+
+    val, err := db.Get(utils.GetTestKey(1))
+    assert.Nil(t, err)
+    assert.Equal(t, value, val)
+
+    // 2. Values written by Put can be streamed as well
+    smallValue := utils.GetTestValue(128)
+    err = db.Put(utils.GetTestKey(2), smallValue)
+    assert.Nil(t, err)
+    reader, err = db.GetReader(utils.GetTestKey(2))
+    assert.Nil(t, err)
+    streamed, err = io.ReadAll(reader)
+    assert.Nil(t, err)
+    assert.Equal(t, smallValue, streamed)
+
+    _, err = db.GetReader([]byte("unknown key"))
+    assert.Equal(t, ErrKeyNotFound, err)
+
+    // 3. A short reader leaves nothing behind
+    valueLogFiles := len(db.olderValueLogs)
+    err = db.PutReader(utils.GetTestKey(3), bytes.NewReader(value[:100]), 1000)
+    assert.Equal(t, io.ErrUnexpectedEOF, err)
+    assert.Equal(t, valueLogFiles, len(db.olderValueLogs))
+    _, err = db.Get(utils.GetTestKey(3))
+    assert.Equal(t, ErrKeyNotFound, err)
+
+    // 4. Merge and restart
+    err = db.Put(utils.GetTestKey(2), utils.GetTestValue(128))
+    assert.Nil(t, err)
+    err = db.Merge()
+    assert.Nil(t, err)
+    err = db.Close()
+    assert.Nil(t, err)
+
+    db, err = Open(options)
+    assert.Nil(t, err)
+    reader, err = db.GetReader(utils.GetTestKey(1))
+    assert.Nil(t, err)
+    streamed, err = io.ReadAll(reader)
+    assert.Nil(t, err)
+    assert.Equal(t, value, streamed)
+}
+
+func TestDBGetReaderCorrupted(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-stream-corrupted-")
+    options.DirPath = dir
+
+    db, err := Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+
+    value := bytes.Repeat([]byte("a"), 1000)
+    err = db.PutReader(utils.GetTestKey(1), bytes.NewReader(value), int64(len(value)))
+    assert.Nil(t, err)
+
+    // Flip one byte of the value on disk
+    file, err := os.OpenFile(data.GetValueLogFileName(dir, 0), os.O_RDWR, 0644)
+    assert.Nil(t, err)
+    _, err = file.WriteAt([]byte("b"), 500)
+    assert.Nil(t, err)
+    assert.Nil(t, file.Close())
+
+    reader, err := db.GetReader(utils.GetTestKey(1))
+    assert.Nil(t, err)
+    _, err = io.ReadAll(reader)
+    assert.Equal(t, data.ErrInvalidCRC, err)
+}
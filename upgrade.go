@@ -0,0 +1,274 @@
+package kvdb_go
+
+import (
+    "bufio"
+    "io"
+    "kvdb-go/data"
+    "kvdb-go/fio"
+    "kvdb-go/index"
+    "os"
+    "path/filepath"
+    "strings"
+
+    "github.com/gofrs/flock"
+)
+
+const upgradeFileSuffix = ".upgrade"
+
+// Rewrites a closed database directory written before files had a format header.
+// Files that already have one are left alone, so an interrupted upgrade can simply run again.
+// Value log offsets move behind the header, so data files are rewritten record by record,
+// the hint file is dropped and a B+ tree index is rebuilt.
+func Upgrade(options Options) error {
+    if _, err := os.Stat(options.DirPath); os.IsNotExist(err) {
+        return ErrDataDirectoryNotFound
+    }
+
+    fileLock := flock.New(filepath.Join(options.DirPath, fileLockName))
+    hold, err := fileLock.TryLock()
+    if err != nil {
+        return err
+    }
+    if !hold {
+        return ErrDatabaseIsInUse
+    }
+
+    err = upgradeDirectory(options)
+    if unlockErr := fileLock.Unlock(); err == nil {
+        err = unlockErr
+    }
+    if err != nil {
+        return err
+    }
+
+    if options.IndexType == BPTreeIndex {
+        if err := rebuildBPlusTree(options); err != nil {
+            return err
+        }
+    }
+
+    // Loading every file once checks the result
+    db, err := Open(options)
+    if err != nil {
+        return err
+    }
+    return db.Close()
+}
+
+func upgradeDirectory(options Options) error {
+    // A finished merge is moved in first, like Open would
+    db := &DB{options: options}
+    mergePath := db.getMergePath()
+    if _, err := os.Stat(mergePath); err == nil {
+        if err := upgradeFiles(mergePath); err != nil {
+            return err
+        }
+        if err := db.loadMergeFiles(); err != nil {
+            return err
+        }
+    }
+
+    if err := upgradeFiles(options.DirPath); err != nil {
+        return err
+    }
+
+    // Without the hint file the merged files are replayed like all others
+    hintFileName := filepath.Join(options.DirPath, data.HintFileName)
+    if _, err := os.Stat(hintFileName); os.IsNotExist(err) {
+        if err := os.Remove(filepath.Join(options.DirPath, data.MergeFinishedFileName)); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+    }
+    return nil
+}
+
+func upgradeFiles(dir string) error {
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return err
+    }
+
+    for _, entry := range entries {
+        name := entry.Name()
+        fileName := filepath.Join(dir, name)
+        if entry.IsDir() || strings.HasSuffix(name, upgradeFileSuffix) {
+            continue
+        }
+
+        var upgrade func(string) error
+        switch {
+        case strings.HasSuffix(name, data.DataFileNameSuffix):
+            upgrade = upgradeDataFile
+        case strings.HasSuffix(name, data.ValueLogFileNameSuffix),
+            name == data.SeqNumFileName,
+            name == data.MergeFinishedFileName:
+            upgrade = prependFileHeader
+        case name == data.HintFileName, name == data.BloomFilterFileName:
+            // Both are rebuilt, the hint positions are stale anyway
+            upgrade = os.Remove
+        default:
+            continue
+        }
+
+        legacy, err := isLegacyFile(fileName)
+        if err != nil {
+            return err
+        }
+        if !legacy {
+            continue
+        }
+        if err := upgrade(fileName); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+func isLegacyFile(fileName string) (bool, error) {
+    file, err := os.Open(fileName)
+    if err != nil {
+        return false, err
+    }
+    defer file.Close()
+
+    buf := make([]byte, data.FileHeaderSize)
+    n, err := io.ReadFull(file, buf)
+    if n == 0 {
+        return false, nil
+    }
+    if err != nil && err != io.ErrUnexpectedEOF {
+        return false, err
+    }
+
+    _, err = data.DecodeFileHeader(buf[:n])
+    if err == data.ErrFileHeaderMissing {
+        return true, nil
+    }
+    return false, err
+}
+
+// Value logs, seq-num and merge-finished only move behind the header
+func prependFileHeader(fileName string) error {
+    src, err := os.Open(fileName)
+    if err != nil {
+        return err
+    }
+    defer src.Close()
+
+    return writeUpgradedFile(fileName, func(w io.Writer) error {
+        _, err := io.Copy(w, src)
+        return err
+    })
+}
+
+// Pointer records follow their value log, which moved behind the header
+func upgradeDataFile(fileName string) error {
+    legacyFile, err := data.OpenLegacyFile(fileName, 0)
+    if err != nil {
+        return err
+    }
+    defer legacyFile.Close()
+
+    return writeUpgradedFile(fileName, func(w io.Writer) error {
+        var offset int64 = 0
+        for {
+            logRecord, size, err := legacyFile.ReadLogRecord(offset)
+            if err == io.EOF || (err == nil && logRecord == nil) {
+                // Not a single record, this is no data file of an older version
+                if offset == 0 {
+                    return ErrDataDirectoryCorrupted
+                }
+                return nil
+            }
+            if err != nil {
+                return err
+            }
+
+            switch logRecord.Type {
+            case data.LogRecordStreamed:
+                return ErrDataDirectoryCorrupted
+            case data.LogRecordValuePointer:
+                valuePos := data.DecodeLogRecordPos(logRecord.Value)
+                valuePos.Offset += data.FileHeaderSize
+                logRecord.Value = data.EncodeLogRecordPos(valuePos)
+            }
+
+            encodedRecord, _ := data.EncodeLogRecord(logRecord)
+            if _, err := w.Write(encodedRecord); err != nil {
+                return err
+            }
+            offset += size
+        }
+    })
+}
+
+// Writes the header and the body to a temporary file that replaces fileName once synced
+func writeUpgradedFile(fileName string, writeBody func(io.Writer) error) error {
+    tmpFileName := fileName + upgradeFileSuffix
+    tmpFile, err := os.OpenFile(tmpFileName, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, fio.DataFilePerm)
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmpFileName)
+    defer tmpFile.Close()
+
+    bufWriter := bufio.NewWriter(tmpFile)
+    if _, err := bufWriter.Write(data.EncodeFileHeader(data.DefaultFileHeader)); err != nil {
+        return err
+    }
+    if err := writeBody(bufWriter); err != nil {
+        return err
+    }
+    if err := bufWriter.Flush(); err != nil {
+        return err
+    }
+    if err := tmpFile.Sync(); err != nil {
+        return err
+    }
+
+    if err := os.Rename(tmpFileName, fileName); err != nil {
+        return err
+    }
+    return fio.OSFS{}.SyncDir(filepath.Dir(fileName))
+}
+
+// Loads the upgraded files into a B-tree and writes its positions into a new B+ tree file
+func rebuildBPlusTree(options Options) error {
+    // The replay recomputes the sequence number and Close writes it again
+    for _, name := range []string{index.BPTreeIndexFileName, data.SeqNumFileName} {
+        if err := os.Remove(filepath.Join(options.DirPath, name)); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+    }
+
+    btreeOptions := options
+    btreeOptions.IndexType = BTreeIndex
+    btreeOptions.BloomFilter = false
+    db, err := Open(btreeOptions)
+    if err != nil {
+        return err
+    }
+
+    bptree := index.NewBPlusTree(options.DirPath, false)
+    var keys [][]byte
+    var positions []*data.LogRecordPos
+    iterator := db.index.Iterator(false)
+    for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+        keys = append(keys, iterator.Key())
+        positions = append(positions, iterator.Value())
+        if len(keys) == ingestBatchSize {
+            index.PutBatch(bptree, keys, positions)
+            keys, positions = keys[:0], positions[:0]
+        }
+    }
+    index.PutBatch(bptree, keys, positions)
+    iterator.Close()
+
+    if err := bptree.Close(); err != nil {
+        _ = db.Close()
+        return err
+    }
+    // Closing writes the seq-num file the B+ tree index needs
+    return db.Close()
+}
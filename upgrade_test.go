@@ -0,0 +1,70 @@
+package kvdb_go
+
+import (
+    "kvdb-go/data"
+    "kvdb-go/utils"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+// Writes the records the way versions without file headers did
+func writeLegacyFile(t *testing.T, fileName string, records ...*data.LogRecord) {
+    var buf []byte
+    for _, record := range records {
+        encodedRecord, _ := data.EncodeLogRecord(record)
+        buf = append(buf, encodedRecord...)
+    }
+    err := os.WriteFile(fileName, buf, 0644)
+    assert.Nil(t, err)
+}
+
+func TestUpgrade(t *testing.T) {
+    dir, _ := os.MkdirTemp("", "kvdb-go-upgrade-")
+    defer os.RemoveAll(dir)
+
+    largeValue := utils.GetTestValue(256)
+    valueRecord := &data.LogRecord{Key: logRecordKeyWithSeq([]byte("large"), nonTransactionSeqNum), Value: largeValue}
+    _, valueRecordSize := data.EncodeLogRecord(valueRecord)
+    writeLegacyFile(t, data.GetValueLogFileName(dir, 0), valueRecord)
+    writeLegacyFile(t, data.GetDataFileName(dir, 0),
+        &data.LogRecord{Key: logRecordKeyWithSeq([]byte("a"), nonTransactionSeqNum), Value: []byte("1")},
+        &data.LogRecord{Key: logRecordKeyWithSeq([]byte("b"), nonTransactionSeqNum), Value: []byte("2")},
+        &data.LogRecord{Key: logRecordKeyWithSeq([]byte("a"), nonTransactionSeqNum), Type: data.LogRecordDeleted},
+        &data.LogRecord {
+            Key: logRecordKeyWithSeq([]byte("large"), nonTransactionSeqNum),
+            Value: data.EncodeLogRecordPos(&data.LogRecordPos{FileId: 0, Offset: 0, Size: uint32(valueRecordSize)}),
+            Type: data.LogRecordValuePointer,
+        },
+    )
+    writeLegacyFile(t, filepath.Join(dir, data.BloomFilterFileName), &data.LogRecord{Key: []byte(bloomFilterKey), Value: []byte("stale")})
+
+    options := DefaultOptions
+    options.DirPath = dir
+    _, err := Open(options)
+    assert.Equal(t, data.ErrFileHeaderMissing, err)
+
+    for _, indexType := range []IndexType{BTreeIndex, BPTreeIndex} {
+        options.IndexType = indexType
+        // A second run finds nothing left to rewrite
+        for i := 0; i < 2; i++ {
+            err = Upgrade(options)
+            assert.Nil(t, err)
+        }
+
+        db, err := Open(options)
+        assert.Nil(t, err)
+        _, err = db.Get([]byte("a"))
+        assert.Equal(t, ErrKeyNotFound, err)
+        val, err := db.Get([]byte("b"))
+        assert.Nil(t, err)
+        assert.Equal(t, []byte("2"), val)
+        val, err = db.Get([]byte("large"))
+        assert.Nil(t, err)
+        assert.Equal(t, largeValue, val)
+        err = db.Close()
+        assert.Nil(t, err)
+    }
+}
@@ -24,14 +24,10 @@ func DirSize(dirPath string) (int64, error) {
     return size, err
 }
 
-func AvailableDiskSpace() (uint64, error) {
-    wd, err := syscall.Getwd()
-    if err != nil {
-        return 0, err
-    }
-
+// Free bytes of the file system dir is on, for an unprivileged user
+func AvailableDiskSpace(dir string) (uint64, error) {
     var stat syscall.Statfs_t
-    if err = syscall.Statfs(wd, &stat); err != nil {
+    if err := syscall.Statfs(dir, &stat); err != nil {
         return 0, err
     }
 
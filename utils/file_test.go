@@ -16,7 +16,12 @@ func TestDirSize(t *testing.T) {
 }
 
 func TestAvailableDiskSpace(t *testing.T) {
-    space, err := AvailableDiskSpace()
+    dir, _ := os.Getwd()
+
+    space, err := AvailableDiskSpace(dir)
     assert.Nil(t, err)
     assert.True(t, space > 0)
+
+    _, err = AvailableDiskSpace(dir + "-not-exist")
+    assert.NotNil(t, err)
 }
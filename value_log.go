@@ -0,0 +1,266 @@
+package kvdb_go
+
+import (
+    "io"
+    "kvdb-go/data"
+    "kvdb-go/metrics"
+    "sort"
+)
+
+type valueLogEntry struct {
+    key []byte
+    offset int64
+}
+
+func (db *DB) loadValueLogFiles() error {
+    fileIds, err := listFileIds(db.options.VFS, db.options.DirPath, data.ValueLogFileNameSuffix)
+    if err != nil {
+        return err
+    }
+
+    for i, fileId := range fileIds {
+        valueLogFile, err := db.openValueLogFile(fileId)
+        if err != nil {
+            return err
+        }
+
+        size, err := valueLogFile.IOManager.Size()
+        if err != nil {
+            return err
+        }
+        valueLogFile.WriteOffset = size
+
+        if i == len(fileIds) - 1 {
+            db.activeValueLog = valueLogFile
+        } else {
+            db.olderValueLogs[fileId] = valueLogFile
+        }
+        db.nextValueLogFileId = fileId + 1
+    }
+
+    return nil
+}
+
+func (db *DB) shouldSeparateValue(logRecord *data.LogRecord) bool {
+    return db.options.ValueLogThreshold > 0 &&
+        logRecord.Type == data.LogRecordNormal &&
+        len(logRecord.Value) > db.options.ValueLogThreshold
+}
+
+// Writes the value to the value log and returns the pointer record that goes to the data file
+func (db *DB) separateValue(logRecord *data.LogRecord) (*data.LogRecord, error) {
+    valuePos, err := db.appendValueLog(logRecord)
+    if err != nil {
+        return nil, err
+    }
+
+    return &data.LogRecord {
+        Key: logRecord.Key,
+        Value: data.EncodeLogRecordPos(valuePos),
+        Type: data.LogRecordValuePointer,
+    }, nil
+}
+
+func (db *DB) appendValueLog(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
+    if db.activeValueLog == nil {
+        if err := db.setActiveValueLog(); err != nil {
+            return nil, err
+        }
+    }
+
+    encodedRecord, size := db.activeValueLog.EncodeLogRecord(logRecord)
+    // A value larger than a whole file gets a file of its own
+    if db.activeValueLog.WriteOffset > data.FileHeaderSize && db.activeValueLog.WriteOffset + size > db.options.DataFileSize {
+        if err := db.syncFile(db.activeValueLog); err != nil {
+            return nil, err
+        }
+
+        db.olderValueLogs[db.activeValueLog.FileId] = db.activeValueLog
+
+        if err := db.setActiveValueLog(); err != nil {
+            return nil, err
+        }
+        encodedRecord, _ = db.activeValueLog.EncodeLogRecord(logRecord)
+    }
+
+    writeOffset := db.activeValueLog.WriteOffset
+    if err := db.activeValueLog.Write(encodedRecord); err != nil {
+        // Value logs are read record by record as well
+        if db.activeValueLog.WriteOffset > writeOffset {
+            if truncErr := db.activeValueLog.Truncate(writeOffset); truncErr != nil {
+                db.options.Logger.Error("Failed to truncate the active value log after a failed write", "err", truncErr)
+            }
+        }
+        return nil, diskFullOr(err)
+    }
+    db.addDiskUsage(size)
+    db.options.Metrics.AddCounter(metrics.BytesWritten, float64(size))
+
+    return &data.LogRecordPos {
+        FileId: db.activeValueLog.FileId,
+        Offset: writeOffset,
+        Size: uint32(size),
+    }, nil
+}
+
+func (db *DB) setActiveValueLog() error {
+    valueLogFile, err := db.createValueLogFile(db.allocateValueLogFileId())
+    if err != nil {
+        return err
+    }
+
+    db.activeValueLog = valueLogFile
+    return nil
+}
+
+// Streamed values take file ids from the same sequence as the active value log
+func (db *DB) allocateValueLogFileId() uint32 {
+    fileId := db.nextValueLogFileId
+    db.nextValueLogFileId++
+    return fileId
+}
+
+func (db *DB) getValueLogFile(fileId uint32) *data.DataFile {
+    if db.activeValueLog != nil && db.activeValueLog.FileId == fileId {
+        return db.activeValueLog
+    }
+    return db.olderValueLogs[fileId]
+}
+
+func (db *DB) readValueLog(pointer []byte) ([]byte, error) {
+    valuePos := data.DecodeLogRecordPos(pointer)
+    valueLogFile := db.getValueLogFile(valuePos.FileId)
+    if valueLogFile == nil {
+        return nil, ErrDataFileNotFound
+    }
+
+    logRecord, _, err := valueLogFile.ReadLogRecord(valuePos.Offset)
+    if err != nil {
+        return nil, err
+    }
+    return logRecord.Value, nil
+}
+
+// The value log must reach the disk before the data file records pointing into it
+func (db *DB) syncValueLog() error {
+    if db.activeValueLog == nil {
+        return nil
+    }
+    return db.syncFile(db.activeValueLog)
+}
+
+// Rewrites the live values of every sealed value log file whose garbage ratio is at least
+// discardRatio into the active value log, then removes the old file.
+// Writers are blocked while a file is being rewritten.
+func (db *DB) ValueLogGC(discardRatio float32) error {
+    if discardRatio <= 0 || discardRatio > 1 {
+        return ErrDiscardRatioInvalid
+    }
+
+    db.mutex.Lock()
+    defer db.mutex.Unlock()
+
+    if db.options.ReadOnly {
+        return ErrReadOnly
+    }
+
+    var fileIds []uint32
+    for fileId := range db.olderValueLogs {
+        fileIds = append(fileIds, fileId)
+    }
+    sort.Slice(fileIds, func(i, j int) bool {
+        return fileIds[i] < fileIds[j]
+    })
+
+    for _, fileId := range fileIds {
+        if err := db.rewriteValueLog(db.olderValueLogs[fileId], discardRatio); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+func (db *DB) rewriteValueLog(valueLogFile *data.DataFile, discardRatio float32) error {
+    var liveEntries []*valueLogEntry
+    var liveSize int64
+    var offset int64 = data.FileHeaderSize
+    for {
+        logRecord, size, err := valueLogFile.ReadLogRecord(offset)
+        if err != nil {
+            if err == io.EOF {
+                break
+            }
+            return err
+        }
+
+        realKey, _ := parseLogRecordKeyWithSeq(logRecord.Key)
+        if db.isLiveValue(realKey, valueLogFile.FileId, offset) {
+            liveEntries = append(liveEntries, &valueLogEntry{key: realKey, offset: offset})
+            liveSize += size
+        }
+
+        offset += size
+    }
+
+    if totalSize := offset - data.FileHeaderSize; totalSize > 0 && float32(totalSize - liveSize) / float32(totalSize) < discardRatio {
+        return nil
+    }
+
+    for _, entry := range liveEntries {
+        logRecord, _, err := valueLogFile.ReadLogRecord(entry.offset)
+        if err != nil {
+            return err
+        }
+
+        pointerRecord, err := db.separateValue(&data.LogRecord {
+            Key: logRecordKeyWithSeq(entry.key, nonTransactionSeqNum),
+            Value: logRecord.Value,
+            Type: data.LogRecordNormal,
+        })
+        if err != nil {
+            return err
+        }
+
+        pos, err := db.appendLogRecord(pointerRecord)
+        if err != nil {
+            return err
+        }
+
+        if oldPos := db.index.Put(entry.key, pos); oldPos != nil {
+            db.reclaimableSpace += int64(oldPos.Size)
+            db.invalidateCache(oldPos)
+        }
+    }
+
+    if err := db.syncFiles(); err != nil {
+        return err
+    }
+
+    if err := valueLogFile.Close(); err != nil {
+        return err
+    }
+    delete(db.olderValueLogs, valueLogFile.FileId)
+
+    return db.removeValueLogFile(valueLogFile.FileId)
+}
+
+func (db *DB) isLiveValue(key []byte, fileId uint32, offset int64) bool {
+    logRecordPos := db.index.Get(key)
+    if logRecordPos == nil {
+        return false
+    }
+
+    dataFile := db.getDataFile(logRecordPos.FileId)
+    if dataFile == nil {
+        return false
+    }
+
+    logRecord, _, err := dataFile.ReadLogRecord(logRecordPos.Offset)
+    if err != nil || logRecord.Type != data.LogRecordValuePointer {
+        return false
+    }
+
+    valuePos := data.DecodeLogRecordPos(logRecord.Value)
+    return valuePos.FileId == fileId && valuePos.Offset == offset
+}
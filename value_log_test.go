@@ -0,0 +1,162 @@
+package kvdb_go
+
+import (
+    "kvdb-go/utils"
+    "os"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestDBValueLogPutGet(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-value-log-")
+    options.DirPath = dir
+    options.ValueLogThreshold = 64
+
+    db, err := Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+    assert.NotNil(t, db)
+
+    // 1. Small values stay in the data file, large ones go to the value log
+    smallValue := utils.GetTestValue(16)
+    largeValue := utils.GetTestValue(4096)
+    err = db.Put(utils.GetTestKey(1), smallValue)
+    assert.Nil(t, err)
+    err = db.Put(utils.GetTestKey(2), largeValue)
+    assert.Nil(t, err)
+    assert.NotNil(t, db.activeValueLog)
+    assert.True(t, db.activeFile.WriteOffset < 4096)
+
+    val, err := db.Get(utils.GetTestKey(1))
+    assert.Nil(t, err)
+    assert.Equal(t, smallValue, val)
+    val, err = db.Get(utils.GetTestKey(2))
+    assert.Nil(t, err)
+    assert.Equal(t, largeValue, val)
+
+    // 2. Write batch
+    batchValue := utils.GetTestValue(1024)
+    wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+    err = wb.Put(utils.GetTestKey(3), batchValue)
+    assert.Nil(t, err)
+    err = wb.Commit()
+    assert.Nil(t, err)
+    val, err = db.Get(utils.GetTestKey(3))
+    assert.Nil(t, err)
+    assert.Equal(t, batchValue, val)
+
+    // 3. Restart database
+    err = db.Close()
+    assert.Nil(t, err)
+
+    db, err = Open(options)
+    assert.Nil(t, err)
+    val, err = db.Get(utils.GetTestKey(2))
+    assert.Nil(t, err)
+    assert.Equal(t, largeValue, val)
+    val, err = db.Get(utils.GetTestKey(3))
+    assert.Nil(t, err)
+    assert.Equal(t, batchValue, val)
+
+    var folded int
+    err = db.Fold(func(key []byte, value []byte) bool {
+        folded++
+        return true
+    })
+    assert.Nil(t, err)
+    assert.Equal(t, 3, folded)
+}
+
+func TestDBValueLogMerge(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-value-log-merge-")
+    options.DirPath = dir
+    options.ValueLogThreshold = 64
+    options.MergeTriggerRatio = 0
+
+    db, err := Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+
+    values := make(map[int][]byte)
+    for i := 0; i < 100; i++ {
+        values[i] = utils.GetTestValue(1024)
+        err := db.Put(utils.GetTestKey(i), values[i])
+        assert.Nil(t, err)
+    }
+    for i := 0; i < 50; i++ {
+        err := db.Delete(utils.GetTestKey(i))
+        assert.Nil(t, err)
+    }
+
+    err = db.Merge()
+    assert.Nil(t, err)
+    err = db.Close()
+    assert.Nil(t, err)
+
+    db, err = Open(options)
+    assert.Nil(t, err)
+    assert.Equal(t, 50, len(db.ListKeys()))
+    for i := 50; i < 100; i++ {
+        val, err := db.Get(utils.GetTestKey(i))
+        assert.Nil(t, err)
+        assert.Equal(t, values[i], val)
+    }
+}
+
+func TestDBValueLogGC(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-value-log-gc-")
+    options.DirPath = dir
+    options.ValueLogThreshold = 64
+    options.DataFileSize = 64 * 1024
+
+    db, err := Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+
+    err = db.ValueLogGC(0)
+    assert.Equal(t, ErrDiscardRatioInvalid, err)
+
+    values := make(map[int][]byte)
+    for i := 0; i < 200; i++ {
+        values[i] = utils.GetTestValue(1024)
+        err := db.Put(utils.GetTestKey(i), values[i])
+        assert.Nil(t, err)
+    }
+    assert.True(t, len(db.olderValueLogs) > 0)
+    sealedFiles := len(db.olderValueLogs)
+
+    // Overwrite most of the keys so the sealed value logs become mostly garbage
+    for i := 0; i < 180; i++ {
+        values[i] = utils.GetTestValue(1024)
+        err := db.Put(utils.GetTestKey(i), values[i])
+        assert.Nil(t, err)
+    }
+
+    err = db.ValueLogGC(0.5)
+    assert.Nil(t, err)
+    for fileId := range db.olderValueLogs {
+        assert.True(t, fileId >= uint32(sealedFiles))
+    }
+
+    for i := 0; i < 200; i++ {
+        val, err := db.Get(utils.GetTestKey(i))
+        assert.Nil(t, err)
+        assert.Equal(t, values[i], val)
+    }
+
+    // Restart database
+    err = db.Close()
+    assert.Nil(t, err)
+
+    db, err = Open(options)
+    assert.Nil(t, err)
+    for i := 0; i < 200; i++ {
+        val, err := db.Get(utils.GetTestKey(i))
+        assert.Nil(t, err)
+        assert.Equal(t, values[i], val)
+    }
+}
@@ -0,0 +1,271 @@
+package kvdb_go
+
+import (
+    "bytes"
+    "sync"
+)
+
+type EventOp = byte
+
+const (
+    EventPut EventOp = iota + 1
+    EventDelete
+    // Events from SeqNum on were dropped, the consumer has to resync from the database
+    EventMissed
+)
+
+type Event struct {
+    Key []byte
+    Value []byte // nil for deletes and for values written by PutReader
+    Op EventOp
+    SeqNum uint64 // The events of one write batch share it
+}
+
+type Watcher struct {
+    prefix []byte
+    events chan *Event
+    hub *watchHub
+    queue []*Event // Waits for the consumer, the front is being delivered
+    missedFrom uint64 // 0 when nothing was dropped
+    wakeup chan struct{}
+    stop chan struct{}
+    done chan struct{}
+    closed bool
+}
+
+// Sequence numbers grow in commit order. The high 32 bits are the epoch of the open, which every writable open
+// of the directory increments durably, so the numbers of an earlier open are smaller.
+type watchHub struct {
+    mutex *sync.Mutex
+    watchers map[*Watcher]struct{}
+    bufferSize int
+    history []*Event
+    historySize int
+    seqNum uint64
+    firstSeqNum uint64
+}
+
+func newWatchHub(bufferSize int, historySize int, epoch uint32) *watchHub {
+    seqNum := uint64(epoch) << 32
+    return &watchHub {
+        mutex: new(sync.Mutex),
+        watchers: make(map[*Watcher]struct{}),
+        bufferSize: bufferSize,
+        historySize: historySize,
+        seqNum: seqNum,
+        firstSeqNum: seqNum + 1,
+    }
+}
+
+// Subscribes to committed mutations of keys with the given prefix.
+// With fromSeq > 0 the kept history from fromSeq on is replayed first, an EventMissed event
+// tells that the history does not reach back that far, or that fromSeq is from an earlier open.
+// A fromSeq past the next sequence number returns ErrWatchSeqNotReached.
+// A consumer that falls behind by more than WatchBufferSize events gets an EventMissed event
+// instead of the dropped ones.
+func (db *DB) Watch(prefix []byte, fromSeq uint64) (*Watcher, error) {
+    return db.watchHub.watch(prefix, fromSeq)
+}
+
+func (w *Watcher) Events() <-chan *Event {
+    return w.events
+}
+
+// Closes the channel, the events still waiting are dropped
+func (w *Watcher) Close() {
+    w.hub.mutex.Lock()
+    w.hub.remove(w)
+    w.hub.mutex.Unlock()
+
+    <-w.done
+}
+
+func (hub *watchHub) watch(prefix []byte, fromSeq uint64) (*Watcher, error) {
+    hub.mutex.Lock()
+    defer hub.mutex.Unlock()
+
+    if fromSeq > hub.seqNum + 1 {
+        return nil, ErrWatchSeqNotReached
+    }
+
+    watcher := &Watcher {
+        prefix: prefix,
+        events: make(chan *Event),
+        hub: hub,
+        wakeup: make(chan struct{}, 1),
+        stop: make(chan struct{}),
+        done: make(chan struct{}),
+    }
+
+    if fromSeq > 0 && fromSeq <= hub.seqNum {
+        if fromSeq < hub.firstSeqNum || len(hub.history) == 0 || hub.history[0].SeqNum > fromSeq {
+            watcher.missedFrom = fromSeq
+        }
+        for _, event := range hub.history {
+            if event.SeqNum >= fromSeq {
+                watcher.send(event)
+            }
+        }
+    }
+
+    hub.watchers[watcher] = struct{}{}
+    go watcher.deliver()
+    return watcher, nil
+}
+
+// The caller holds db.mutex, so events are published in commit order
+func (hub *watchHub) publish(op EventOp, key []byte, value []byte) {
+    hub.publishAll([]*Event{{Key: key, Value: value, Op: op}})
+}
+
+// The events are committed together and get one sequence number
+func (hub *watchHub) publishAll(events []*Event) {
+    hub.mutex.Lock()
+    defer hub.mutex.Unlock()
+
+    hub.seqNum++
+    if len(hub.watchers) == 0 && hub.historySize == 0 {
+        return
+    }
+
+    for _, e := range events {
+        event := &Event {
+            Key: copyBytes(e.Key),
+            Value: copyBytes(e.Value),
+            Op: e.Op,
+            SeqNum: hub.seqNum,
+        }
+
+        if hub.historySize > 0 {
+            hub.history = append(hub.history, event)
+        }
+        for watcher := range hub.watchers {
+            watcher.send(event)
+        }
+    }
+
+    // A batch leaves the history whole, a replay never starts in its middle
+    for len(hub.history) > hub.historySize {
+        evicted := hub.history[0].SeqNum
+        for len(hub.history) > 0 && hub.history[0].SeqNum == evicted {
+            hub.history = hub.history[1:]
+        }
+    }
+}
+
+// For changes too many to publish one by one, every watcher and every replay of the history misses them
+func (hub *watchHub) publishMissed() {
+    hub.mutex.Lock()
+    defer hub.mutex.Unlock()
+
+    hub.seqNum++
+    hub.history = nil
+    for watcher := range hub.watchers {
+        if watcher.missedFrom == 0 {
+            watcher.missedFrom = hub.seqNum
+        }
+        select {
+        case watcher.wakeup <- struct{}{}:
+        default:
+        }
+    }
+}
+
+func (hub *watchHub) close() {
+    hub.mutex.Lock()
+    watchers := make([]*Watcher, 0, len(hub.watchers))
+    for watcher := range hub.watchers {
+        hub.remove(watcher)
+        watchers = append(watchers, watcher)
+    }
+    hub.mutex.Unlock()
+
+    for _, watcher := range watchers {
+        <-watcher.done
+    }
+}
+
+// The caller holds hub.mutex
+func (hub *watchHub) remove(watcher *Watcher) {
+    if watcher.closed {
+        return
+    }
+    watcher.closed = true
+    delete(hub.watchers, watcher)
+    close(watcher.stop)
+}
+
+// Never blocks, the caller holds hub.mutex
+func (w *Watcher) send(event *Event) {
+    if !bytes.HasPrefix(event.Key, w.prefix) {
+        return
+    }
+
+    // The marker goes before anything that came after the gap
+    if w.missedFrom > 0 {
+        if len(w.queue) >= w.hub.bufferSize {
+            return
+        }
+        w.queue = append(w.queue, &Event{Op: EventMissed, SeqNum: w.missedFrom})
+        w.missedFrom = 0
+    }
+
+    if len(w.queue) >= w.hub.bufferSize {
+        w.missedFrom = event.SeqNum
+        return
+    }
+    w.queue = append(w.queue, event)
+
+    select {
+    case w.wakeup <- struct{}{}:
+    default:
+    }
+}
+
+// Hands the queued events to the consumer one at a time, a pending marker as soon as the queue is drained
+func (w *Watcher) deliver() {
+    defer close(w.done)
+    defer close(w.events)
+
+    for {
+        w.hub.mutex.Lock()
+        if len(w.queue) == 0 && w.missedFrom > 0 {
+            w.queue = append(w.queue, &Event{Op: EventMissed, SeqNum: w.missedFrom})
+            w.missedFrom = 0
+        }
+        var event *Event
+        if len(w.queue) > 0 {
+            event = w.queue[0]
+        }
+        w.hub.mutex.Unlock()
+
+        if event == nil {
+            select {
+            case <-w.wakeup:
+                continue
+            case <-w.stop:
+                return
+            }
+        }
+
+        select {
+        case w.events <- event:
+        case <-w.stop:
+            return
+        }
+
+        w.hub.mutex.Lock()
+        w.queue[0] = nil
+        w.queue = w.queue[1:]
+        w.hub.mutex.Unlock()
+    }
+}
+
+func copyBytes(b []byte) []byte {
+    if b == nil {
+        return nil
+    }
+    copied := make([]byte, len(b))
+    copy(copied, b)
+    return copied
+}
@@ -0,0 +1,206 @@
+package kvdb_go
+
+import (
+    "kvdb-go/data"
+    "kvdb-go/utils"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestDBWatch(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-watch-")
+    options.DirPath = dir
+
+    db, err := Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+
+    watcher, err := db.Watch([]byte("user-"), 0)
+    assert.Nil(t, err)
+
+    // 1. Put, Delete and keys without the prefix
+    err = db.Put([]byte("user-1"), []byte("alice"))
+    assert.Nil(t, err)
+    err = db.Put([]byte("order-1"), []byte("book"))
+    assert.Nil(t, err)
+    err = db.Delete([]byte("user-1"))
+    assert.Nil(t, err)
+
+    event := <-watcher.Events()
+    assert.Equal(t, EventPut, event.Op)
+    assert.Equal(t, []byte("user-1"), event.Key)
+    assert.Equal(t, []byte("alice"), event.Value)
+    firstSeq := event.SeqNum
+
+    event = <-watcher.Events()
+    assert.Equal(t, EventDelete, event.Op)
+    assert.Equal(t, []byte("user-1"), event.Key)
+    assert.Equal(t, firstSeq + 2, event.SeqNum)
+
+    // 2. Write batch events only show up after commit, in key order with one sequence number
+    wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+    for _, key := range []string{"user-4", "user-2", "user-3"} {
+        err = wb.Put([]byte(key), []byte("bob"))
+        assert.Nil(t, err)
+    }
+    err = wb.Delete([]byte("user-1"))
+    assert.Nil(t, err)
+    select {
+    case <-watcher.Events():
+        t.Fatal("event before commit")
+    case <-time.After(10 * time.Millisecond):
+    }
+    err = wb.Commit()
+    assert.Nil(t, err)
+
+    for i, key := range []string{"user-2", "user-3", "user-4"} {
+        event = <-watcher.Events()
+        assert.Equal(t, EventPut, event.Op)
+        assert.Equal(t, []byte(key), event.Key)
+        assert.Equal(t, firstSeq + 3, event.SeqNum, i)
+    }
+
+    // 3. Closing the watcher closes the channel
+    watcher.Close()
+    _, ok := <-watcher.Events()
+    assert.False(t, ok)
+    watcher.Close()
+}
+
+func TestDBWatchSlowConsumer(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-watch-slow-")
+    options.DirPath = dir
+    options.WatchBufferSize = 4
+
+    db, err := Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+
+    watcher, err := db.Watch(nil, 0)
+    assert.Nil(t, err)
+    for i := 0; i < 10; i++ {
+        err := db.Put(utils.GetTestKey(i), utils.GetTestValue(8))
+        assert.Nil(t, err)
+    }
+
+    var firstSeq uint64
+    for i := 0; i < 4; i++ {
+        event := <-watcher.Events()
+        assert.Equal(t, EventPut, event.Op)
+        if i == 0 {
+            firstSeq = event.SeqNum
+        }
+        assert.Equal(t, firstSeq + uint64(i), event.SeqNum)
+    }
+
+    // Once drained, the marker tells where the gap starts without waiting for another write
+    event := <-watcher.Events()
+    assert.Equal(t, EventMissed, event.Op)
+    assert.Equal(t, firstSeq + 4, event.SeqNum)
+
+    err = db.Put(utils.GetTestKey(10), utils.GetTestValue(8))
+    assert.Nil(t, err)
+    event = <-watcher.Events()
+    assert.Equal(t, firstSeq + 10, event.SeqNum)
+}
+
+func TestDBWatchFromSeq(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-watch-history-")
+    options.DirPath = dir
+    options.WatchHistorySize = 5
+
+    db, err := Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+
+    watcher, err := db.Watch(nil, 0)
+    assert.Nil(t, err)
+    var seqs []uint64
+    for i := 0; i < 10; i++ {
+        err := db.Put(utils.GetTestKey(i), utils.GetTestValue(8))
+        assert.Nil(t, err)
+        seqs = append(seqs, (<-watcher.Events()).SeqNum)
+    }
+    watcher.Close()
+
+    // 1. Within the history
+    watcher, err = db.Watch(nil, seqs[7])
+    assert.Nil(t, err)
+    for i := 7; i < 10; i++ {
+        event := <-watcher.Events()
+        assert.Equal(t, seqs[i], event.SeqNum)
+        assert.Equal(t, utils.GetTestKey(i), event.Key)
+    }
+    watcher.Close()
+
+    // 2. Older than the history
+    watcher, err = db.Watch(nil, seqs[1])
+    assert.Nil(t, err)
+    event := <-watcher.Events()
+    assert.Equal(t, EventMissed, event.Op)
+    assert.Equal(t, seqs[1], event.SeqNum)
+    event = <-watcher.Events()
+    assert.Equal(t, seqs[5], event.SeqNum)
+    watcher.Close()
+
+    // 3. Not reached yet
+    _, err = db.Watch(nil, seqs[9] + 2)
+    assert.Equal(t, ErrWatchSeqNotReached, err)
+
+    // 4. From an earlier open, each open starts a new epoch
+    err = db.Close()
+    assert.Nil(t, err)
+    db, err = Open(options)
+    assert.Nil(t, err)
+    err = db.Put(utils.GetTestKey(10), utils.GetTestValue(8))
+    assert.Nil(t, err)
+    watcher, err = db.Watch(nil, seqs[9])
+    assert.Nil(t, err)
+    event = <-watcher.Events()
+    assert.Equal(t, EventMissed, event.Op)
+    event = <-watcher.Events()
+    assert.Equal(t, utils.GetTestKey(10), event.Key)
+    assert.Equal(t, seqs[9] >> 32 + 1, event.SeqNum >> 32)
+    watcher.Close()
+    err = db.Close()
+    assert.Nil(t, err)
+
+    // 5. A torn epoch record is cut off and the epoch still grows
+    epochFile, err := os.OpenFile(filepath.Join(dir, data.WatchEpochFileName), os.O_APPEND|os.O_WRONLY, 0644)
+    assert.Nil(t, err)
+    _, err = epochFile.Write([]byte{1, 2, 3})
+    assert.Nil(t, err)
+    err = epochFile.Close()
+    assert.Nil(t, err)
+    db, err = Open(options)
+    assert.Nil(t, err)
+    err = db.Close()
+    assert.Nil(t, err)
+    db, err = Open(options)
+    assert.Nil(t, err)
+    defer db.Close()
+    assert.Equal(t, seqs[9] >> 32 + 3, db.watchHub.seqNum >> 32)
+}
+
+func TestDBWatchBufferSizeDefault(t *testing.T) {
+    options := DefaultOptions
+    dir, _ := os.MkdirTemp("", "kvdb-go-watch-default-")
+    options.DirPath = dir
+    options.WatchBufferSize = 0
+
+    db, err := Open(options)
+    defer destroyDB(db)
+    assert.Nil(t, err)
+    assert.Equal(t, DefaultOptions.WatchBufferSize, db.watchHub.bufferSize)
+
+    options.WatchBufferSize = -1
+    _, err = Open(options)
+    assert.Equal(t, ErrWatchOptionsInvalid, err)
+}